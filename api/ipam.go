@@ -36,6 +36,22 @@ func (client *Client) AllocateIP(ID string, checkAlive bool) (*net.IPNet, error)
 	return client.ipamOp(ID, "POST", ipamValues(checkAlive))
 }
 
+// returns an IP for the ID given, allocating a fresh one if necessary;
+// if an address is reserved for name, that is the one returned
+func (client *Client) AllocateIPForName(ID string, name string, checkAlive bool) (*net.IPNet, error) {
+	values := ipamValues(checkAlive)
+	values.Set("name", name)
+	return client.ipamOp(ID, "POST", values)
+}
+
+// returns an IP for the ID given from the named pool, allocating a
+// fresh one if necessary
+func (client *Client) AllocateIPInPool(ID string, pool string, checkAlive bool) (*net.IPNet, error) {
+	values := ipamValues(checkAlive)
+	values.Set("pool", pool)
+	return client.ipamOp(ID, "POST", values)
+}
+
 func (client *Client) AllocateIPInSubnet(ID string, subnet *net.IPNet, checkAlive bool) (*net.IPNet, error) {
 	ip, err := client.httpVerb("POST", fmt.Sprintf("/ip/%s/%s", ID, subnet), ipamValues(checkAlive))
 	if err != nil {
@@ -77,6 +93,17 @@ func (client *Client) DefaultSubnet() (*net.IPNet, error) {
 	return ipnet, err
 }
 
+// returns the subnet addresses are allocated within by default in the
+// named pool
+func (client *Client) PoolSubnet(pool string) (*net.IPNet, error) {
+	cidr, err := client.httpVerb("GET", "/ipinfo/defaultsubnet?pool="+url.QueryEscape(pool), nil)
+	if err != nil {
+		return nil, err
+	}
+	_, ipnet, err := net.ParseCIDR(cidr)
+	return ipnet, err
+}
+
 func parseIP(body string) (*net.IPNet, error) {
 	ip, ipnet, err := net.ParseCIDR(string(body))
 	if err != nil {
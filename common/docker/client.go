@@ -23,6 +23,12 @@ type ContainerObserver interface {
 	ContainerDestroyed(ident string)
 }
 
+// A ContainerObserver may also be a HealthObserver, to hear when the
+// result of a container's health check changes
+type HealthObserver interface {
+	ContainerHealthChanged(ident string, healthy bool)
+}
+
 type Client struct {
 	*docker.Client
 }
@@ -106,6 +112,9 @@ func (c *Client) AddObserver(ob ContainerObserver) error {
 				c.errorf("Unable to add listener to Docker API: %s - retrying in %ds", err, retryInterval/time.Second)
 			} else {
 				start := time.Now()
+				if hob, ok := ob.(HealthObserver); ok {
+					c.reportHealth(hob)
+				}
 				for event := range events {
 					switch event.Status {
 					case "start":
@@ -117,6 +126,10 @@ func (c *Client) AddObserver(ob ContainerObserver) error {
 					case "destroy":
 						pending.finish(event.ID)
 						ob.ContainerDestroyed(event.ID)
+					case "health_status: healthy", "health_status: unhealthy":
+						if hob, ok := ob.(HealthObserver); ok {
+							hob.ContainerHealthChanged(event.ID, event.Status == "health_status: healthy")
+						}
 					}
 				}
 				if time.Since(start) > retryInterval {
@@ -134,6 +147,27 @@ func (c *Client) AddObserver(ob ContainerObserver) error {
 	return nil
 }
 
+// reportHealth tells hob the current result of the health checks of
+// running containers, which may have changed while we were not
+// listening for events
+func (c *Client) reportHealth(hob HealthObserver) {
+	ids, err := c.RunningContainerIDs()
+	if err != nil {
+		c.errorf("Unable to list containers to check their health: %s", err)
+		return
+	}
+	for _, id := range ids {
+		container, err := c.InspectContainer(id)
+		if err != nil {
+			continue
+		}
+		switch container.State.Health.Status {
+		case "healthy", "unhealthy":
+			hob.ContainerHealthChanged(id, container.State.Health.Status == "healthy")
+		}
+	}
+}
+
 // Docker sends a 'start' event before it has attempted to start the
 // container.  Delay notifying the observer until the container has a
 // pid, or we are told to stop when a 'die' event arrives.
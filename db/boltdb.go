@@ -110,6 +110,20 @@ func (d *BoltDB) Save(ident string, data interface{}) error {
 	})
 }
 
+// Idents returns the idents under which data has been saved
+func (d *BoltDB) Idents() ([]string, error) {
+	var idents []string
+	err := d.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(topBucket).ForEach(func(k, v []byte) error {
+			if !bytes.Equal(k, versionIdent) {
+				idents = append(idents, string(k))
+			}
+			return nil
+		})
+	})
+	return idents, err
+}
+
 func (d *BoltDB) Close() error {
 	return d.db.Close()
 }
@@ -34,27 +34,34 @@ func (g *allocate) Try(alloc *Allocator) bool {
 		return true
 	}
 
-	if !alloc.universe.Range().Overlaps(g.r.Range()) {
+	if g.r.Upper != alloc.universe.Upper || !alloc.universe.Range().Overlaps(g.r.Range()) {
 		g.resultChan <- allocateResult{err: fmt.Errorf("range %s out of bounds: %s", g.r, alloc.universe)}
 		return true
 	}
 
 	alloc.establishRing()
+	alloc.holdReservedAddresses()
 
 	if ok, addr := alloc.space.Allocate(g.r.HostRange()); ok {
+		cidr := address.MakeCIDR(g.r, addr)
 		// If caller hasn't supplied a unique ID, file it under the IP address
 		// which lets the caller then release the address using DELETE /ip/address
 		if g.ident == api.NoContainerID {
-			g.ident = addr.String()
+			g.ident = cidr.IP().String()
 		}
-		alloc.debugln("Allocated", addr, "for", g.ident, "in", g.r)
-		alloc.addOwned(g.ident, address.MakeCIDR(g.r, addr), g.isContainer)
+		alloc.debugln("Allocated", cidr, "for", g.ident, "in", g.r)
+		alloc.addOwned(g.ident, cidr, g.isContainer)
+		alloc.auditAddress(AuditAllocate, g.ident, cidr, "")
 		g.resultChan <- allocateResult{addr, nil}
 		return true
 	}
 
 	// out of space
-	donors := alloc.ring.ChoosePeersToAskForSpace(g.r.Addr, g.r.Range().End)
+	if !alloc.belowMaxOwned() {
+		alloc.debugln("Quota prevents asking for more space in", g.r)
+		return false
+	}
+	donors := alloc.ring.ChoosePeersToAskForSpace(g.r.Addr, g.r.Range().End, alloc.canDonate, alloc.rand)
 	for _, donor := range donors {
 		if err := alloc.sendSpaceRequest(donor, g.r.Range()); err != nil {
 			alloc.debugln("Problem asking peer", donor, "for space:", err)
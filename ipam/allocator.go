@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"encoding/gob"
 	"fmt"
+	"math/rand"
 	"sort"
+	"sync"
 	"time"
 
 	"github.com/weaveworks/mesh"
@@ -55,8 +57,11 @@ type Allocator struct {
 	actionChan        chan<- func()
 	stopChan          chan<- struct{}
 	ourName           mesh.PeerName
+	name              string                   // distinguishes us from other allocators on this peer
 	seed              []mesh.PeerName          // optional user supplied ring seed
-	universe          address.CIDR             // superset of all ranges
+	universe          address.CIDR             // superset of all ranges; grows when the range is expanded
+	universeLock      sync.RWMutex             // held to change universe, or read it outside the actor
+	configUniverse    address.CIDR             // the universe we were started with
 	ring              *ring.Ring               // information on ranges owned by all peers
 	space             space.Space              // more detail on ranges owned by us
 	owned             map[string]ownedData     // who owns what addresses, indexed by container-ID
@@ -69,12 +74,19 @@ type Allocator struct {
 	gossip            mesh.Gossip              // our link to the outside world for sending messages
 	paxos             paxos.Participant
 	awaitingConsensus bool
-	ticker            *time.Ticker
+	ticker            *time.Ticker // nil if noTicker
+	noTicker          bool
 	shuttingDown      bool // to avoid doing any requests while trying to shut down
 	isKnownPeer       func(mesh.PeerName) bool
 	quorum            func() uint
 	now               func() time.Time
+	rand              *rand.Rand // for choosing whom to ask for space
 	tracker           tracker.LocalRangeTracker
+	quotas            Quotas
+	reservations      reservations               // addresses reserved for particular containers
+	held              map[address.Address]string // reserved addresses we are keeping free, by pattern
+	leases            map[string]time.Time       // when each ident's allocation was last known to be in use
+	auditLog          *AuditLog                  // optional record of changes in who has which addresses
 }
 
 // PreClaims are IP addresses discovered before we could initialize IPAM
@@ -96,6 +108,12 @@ type Config struct {
 	Db          db.DB
 	IsKnownPeer func(name mesh.PeerName) bool
 	Tracker     tracker.LocalRangeTracker
+	Name        string // optional, to tell apart the data and logs of several allocators on one peer
+	Quotas      Quotas
+	AuditLog    *AuditLog
+	Now         func() time.Time // optional clock, e.g. for simulations; defaults to time.Now
+	Rand        *rand.Rand       // optional source of random choices, e.g. for simulations; seeded from the clock by default
+	NoTicker    bool             // if true, periodic retries only happen on calls to Tick
 }
 
 // NewAllocator creates and initialises a new Allocator
@@ -120,6 +138,7 @@ func NewAllocator(config Config) *Allocator {
 
 	alloc = &Allocator{
 		ourName:     config.OurName,
+		name:        config.Name,
 		seed:        config.Seed,
 		universe:    config.Universe,
 		ring:        ring.New(config.Universe.Range().Start, config.Universe.Range().End, config.OurName, onUpdate),
@@ -132,6 +151,20 @@ func NewAllocator(config Config) *Allocator {
 		dead:        make(map[string]time.Time),
 		now:         time.Now,
 		tracker:     config.Tracker,
+		quotas:      config.Quotas,
+		held:        make(map[address.Address]string),
+		leases:      make(map[string]time.Time),
+	}
+	alloc.ring.Upper = config.Universe.Upper
+	alloc.configUniverse = config.Universe
+	alloc.auditLog = config.AuditLog
+	alloc.noTicker = config.NoTicker
+	if config.Now != nil {
+		alloc.now = config.Now
+	}
+	alloc.rand = config.Rand
+	if alloc.rand == nil {
+		alloc.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
 	}
 
 	alloc.pendingClaims = make([]operation, len(config.PreClaims))
@@ -158,6 +191,7 @@ func ParseCIDRSubnet(cidrStr string) (cidr address.CIDR, err error) {
 
 // Start runs the allocator goroutine
 func (alloc *Allocator) Start() {
+	alloc.loadReservations()
 	loadedPersistedData := alloc.loadPersistedData()
 	switch {
 	case loadedPersistedData && len(alloc.seed) != 0:
@@ -179,7 +213,9 @@ func (alloc *Allocator) Start() {
 	stopChan := make(chan struct{})
 	alloc.actionChan = actionChan
 	alloc.stopChan = stopChan
-	alloc.ticker = time.NewTicker(tickInterval)
+	if !alloc.noTicker {
+		alloc.ticker = time.NewTicker(tickInterval)
+	}
 	go alloc.actorLoop(actionChan, stopChan)
 }
 
@@ -294,6 +330,13 @@ func (e *errorCancelled) Error() string {
 
 // Actor client API
 
+// Universe returns the range of addresses this allocator manages
+func (alloc *Allocator) Universe() address.CIDR {
+	alloc.universeLock.RLock()
+	defer alloc.universeLock.RUnlock()
+	return alloc.universe
+}
+
 // Prime (Sync) - wait for consensus
 func (alloc *Allocator) Prime() {
 	resultChan := make(chan struct{})
@@ -322,6 +365,9 @@ func (alloc *Allocator) Allocate(ident string, r address.CIDR, isContainer bool,
 func (alloc *Allocator) Lookup(ident string, r address.Range) ([]address.CIDR, error) {
 	resultChan := make(chan []address.CIDR)
 	alloc.actionChan <- func() {
+		if _, found := alloc.owned[ident]; found {
+			alloc.renewLease(ident)
+		}
 		resultChan <- alloc.ownedInRange(ident, r)
 	}
 	return <-resultChan, nil
@@ -360,7 +406,7 @@ func (alloc *Allocator) ContainerDestroyed(ident string) {
 	alloc.actionChan <- func() {
 		if alloc.hasOwnedByContainer(ident) {
 			alloc.debugln("Container", ident, "destroyed; removing addresses")
-			alloc.delete(ident)
+			alloc.delete(ident, "container destroyed")
 			delete(alloc.dead, ident)
 		}
 	}
@@ -370,7 +416,7 @@ func (alloc *Allocator) removeDeadContainers() {
 	cutoff := alloc.now().Add(-containerDiedTimeout)
 	for ident, timeOfDeath := range alloc.dead {
 		if timeOfDeath.Before(cutoff) {
-			if err := alloc.delete(ident); err == nil {
+			if err := alloc.delete(ident, "container died"); err == nil {
 				alloc.debugln("Removed addresses for container", ident)
 			}
 			delete(alloc.dead, ident)
@@ -398,18 +444,19 @@ func (alloc *Allocator) PruneOwned(ids []string) {
 func (alloc *Allocator) Delete(ident string) error {
 	errChan := make(chan error)
 	alloc.actionChan <- func() {
-		errChan <- alloc.delete(ident)
+		errChan <- alloc.delete(ident, "released")
 	}
 	return <-errChan
 }
 
-func (alloc *Allocator) delete(ident string) error {
+func (alloc *Allocator) delete(ident, reason string) error {
 	cidrs := alloc.removeAllOwned(ident)
 	if len(cidrs) == 0 {
 		return fmt.Errorf("Delete: no addresses for %s", ident)
 	}
 	for _, cidr := range cidrs {
 		alloc.space.Free(cidr.Addr)
+		alloc.auditAddress(AuditFree, ident, cidr, reason)
 	}
 	return nil
 }
@@ -418,9 +465,10 @@ func (alloc *Allocator) delete(ident string) error {
 func (alloc *Allocator) Free(ident string, addrToFree address.Address) error {
 	errChan := make(chan error)
 	alloc.actionChan <- func() {
-		if alloc.removeOwned(ident, addrToFree) {
+		if cidr, found := alloc.removeOwned(ident, alloc.universe.Upper, addrToFree); found {
 			alloc.debugln("Freed", addrToFree, "for", ident)
 			alloc.space.Free(addrToFree)
+			alloc.auditAddress(AuditFree, ident, cidr, "released")
 			errChan <- nil
 			return
 		}
@@ -467,7 +515,7 @@ func (alloc *Allocator) Shutdown() {
 		alloc.cancelOps(&alloc.pendingAllocates)
 		alloc.cancelOps(&alloc.pendingPrimes)
 		heir := alloc.pickPeerForTransfer()
-		alloc.ring.Transfer(alloc.ourName, heir)
+		alloc.auditRanges(AuditTransfer, alloc.ring.Transfer(alloc.ourName, heir), heir, "shutdown")
 		alloc.space.Clear()
 		if heir != mesh.UnknownPeerName {
 			alloc.persistRing()
@@ -499,6 +547,7 @@ func (alloc *Allocator) AdminTakeoverRanges(peerNameOrNickname string) address.C
 		}
 
 		newRanges := alloc.ring.Transfer(peername, alloc.ourName)
+		alloc.auditRanges(AuditTransfer, newRanges, alloc.ourName, "taken over from "+alloc.annotatePeernames([]mesh.PeerName{peername})[0])
 
 		if len(newRanges) == 0 {
 			resultChan <- address.Count(0)
@@ -516,6 +565,17 @@ func (alloc *Allocator) AdminTakeoverRanges(peerNameOrNickname string) address.C
 	return <-resultChan
 }
 
+// Tick (Sync) - retry whatever is waiting on other peers, as is done
+// periodically unless Config.NoTicker was set
+func (alloc *Allocator) Tick() {
+	doneChan := make(chan struct{})
+	alloc.actionChan <- func() {
+		alloc.tick()
+		close(doneChan)
+	}
+	<-doneChan
+}
+
 // Lookup a PeerName by nickname or stringified PeerName.  We can't
 // call into the router for this because we are interested in peers
 // that have gone away but are still in the ring, which is why we
@@ -617,14 +677,16 @@ type gossipState struct {
 	Now       int64
 	Nicknames map[mesh.PeerName]string
 
-	Paxos paxos.GossipState
-	Ring  *ring.Ring
+	Paxos        paxos.GossipState
+	Ring         *ring.Ring
+	Reservations reservations
 }
 
 func (alloc *Allocator) encode() []byte {
 	data := gossipState{
-		Now:       alloc.now().Unix(),
-		Nicknames: alloc.nicknames,
+		Now:          alloc.now().Unix(),
+		Nicknames:    alloc.nicknames,
+		Reservations: alloc.reservations,
 	}
 
 	// We're only interested in Paxos until we have a Ring.
@@ -691,25 +753,19 @@ func (alloc *Allocator) SetInterfaces(gossip mesh.Gossip) {
 // ACTOR server
 
 func (alloc *Allocator) actorLoop(actionChan <-chan func(), stopChan <-chan struct{}) {
-	defer alloc.ticker.Stop()
+	var ticks <-chan time.Time
+	if alloc.ticker != nil {
+		defer alloc.ticker.Stop()
+		ticks = alloc.ticker.C
+	}
 	for {
 		select {
 		case action := <-actionChan:
 			action()
 		case <-stopChan:
 			return
-		case <-alloc.ticker.C:
-			// Retry things in case messages got lost between here and recipients
-			if alloc.awaitingConsensus {
-				alloc.propose()
-			} else if alloc.havePendingOps() {
-				if alloc.ring.Empty() {
-					alloc.establishRing()
-				} else {
-					alloc.tryPendingOps()
-				}
-			}
-			alloc.removeDeadContainers()
+		case <-ticks:
+			alloc.tick()
 		}
 
 		alloc.assertInvariants()
@@ -719,6 +775,21 @@ func (alloc *Allocator) actorLoop(actionChan <-chan func(), stopChan <-chan stru
 
 // Helper functions
 
+// Retry things in case messages got lost between here and recipients
+func (alloc *Allocator) tick() {
+	if alloc.awaitingConsensus {
+		alloc.propose()
+	} else if alloc.havePendingOps() {
+		if alloc.ring.Empty() {
+			alloc.establishRing()
+		} else {
+			alloc.tryPendingOps()
+		}
+	}
+	alloc.removeDeadContainers()
+	alloc.deleteReservationTombstones()
+}
+
 // Ensure we are making progress towards an established ring
 func (alloc *Allocator) establishRing() {
 	if !alloc.ring.Empty() || alloc.awaitingConsensus {
@@ -749,6 +820,7 @@ func (alloc *Allocator) ringUpdated() {
 		alloc.paxos = nil
 	}
 
+	alloc.adoptRingRange()
 	alloc.persistRing()
 	alloc.space.UpdateRanges(alloc.ring.OwnedRanges())
 	alloc.tryPendingOps()
@@ -838,6 +910,10 @@ func (alloc *Allocator) update(sender mesh.PeerName, msg []byte) error {
 		alloc.nicknames[peer] = nickname
 	}
 
+	if alloc.reservations.merge(data.Reservations) {
+		alloc.reservationsUpdated()
+	}
+
 	switch {
 	// If someone sent us a ring, merge it into ours. Note this will move us
 	// out of the awaiting-consensus state if we didn't have a ring already.
@@ -854,7 +930,7 @@ func (alloc *Allocator) update(sender mesh.PeerName, msg []byte) error {
 				alloc.annotatePeernames(data.Ring.Seeds), alloc.annotatePeernames(alloc.ring.Seeds))
 		case ring.ErrDifferentRange:
 			return fmt.Errorf("Incompatible IP allocation ranges (received: %s, ours: %s)",
-				data.Ring.Range().AsCIDRString(), alloc.ring.Range().AsCIDRString())
+				data.Ring.RangeString(), alloc.ring.RangeString())
 		default:
 			return err
 		}
@@ -907,11 +983,22 @@ func (alloc *Allocator) donateSpace(r address.Range, to mesh.PeerName) {
 	// more.
 	defer alloc.sendRingUpdate(to)
 
-	chunk, ok := alloc.space.Donate(r)
+	alloc.holdReservedAddresses()
+	// A request for a single reserved address comes from a peer
+	// claiming it for a container which matches the reservation
+	if held := alloc.held[r.Start]; held != "" && r.Size() == 1 {
+		alloc.releaseHold(r.Start)
+	}
+	limit := alloc.donationLimit(to)
+	chunk, ok := alloc.space.DonateUpTo(r, limit)
 	if !ok {
-		free := alloc.space.NumFreeAddressesInRange(r)
-		common.Assert(free == 0)
-		alloc.debugln("No space to give to peer", to)
+		if limit == 0 {
+			alloc.debugln("Quota prevents giving space to peer", to)
+		} else {
+			free := alloc.space.NumFreeAddressesInRange(r)
+			common.Assert(free == 0)
+			alloc.debugln("No space to give to peer", to)
+		}
 		// separate message maintains backwards-compatibility:
 		// down-level peers will ignore this and still get the ring update.
 		alloc.sendSpaceRequestDenied(to, r)
@@ -919,6 +1006,7 @@ func (alloc *Allocator) donateSpace(r address.Range, to mesh.PeerName) {
 	}
 	alloc.debugln("Giving range", chunk, "to", to)
 	alloc.ring.GrantRangeToHost(chunk.Start, chunk.End, to)
+	alloc.auditRanges(AuditDonate, []address.Range{chunk}, to, "space request")
 	alloc.persistRing()
 	alloc.gossip.GossipBroadcast(alloc.Gossip())
 }
@@ -961,13 +1049,25 @@ const (
 	ownedIdent = "ownedAddresses"
 )
 
+// Key under which to persist data, distinct for each allocator on this peer
+func (alloc *Allocator) persistenceIdent(ident string) string {
+	return persistenceKey(alloc.name, ident)
+}
+
+func persistenceKey(name, ident string) string {
+	if name == "" {
+		return ident
+	}
+	return ident + "-" + name
+}
+
 func (alloc *Allocator) persistRing() {
 	// It would be better if these two Save operations happened in the same transaction
 	if err := alloc.db.Save(db.NameIdent, alloc.ourName); err != nil {
 		alloc.fatalf("Error persisting ring data: %s", err)
 		return
 	}
-	if err := alloc.db.Save(ringIdent, alloc.ring); err != nil {
+	if err := alloc.db.Save(alloc.persistenceIdent(ringIdent), alloc.ring); err != nil {
 		alloc.fatalf("Error persisting ring data: %s", err)
 	}
 }
@@ -980,12 +1080,12 @@ func (alloc *Allocator) loadPersistedData() bool {
 		alloc.fatalf("Error loading persisted peer name: %s", err)
 	}
 	var persistedRing *ring.Ring
-	ringFound, err := alloc.db.Load(ringIdent, &persistedRing)
+	ringFound, err := alloc.db.Load(alloc.persistenceIdent(ringIdent), &persistedRing)
 	if err != nil {
 		alloc.fatalf("Error loading persisted IPAM data: %s", err)
 	}
 	var persistedOwned map[string]ownedData
-	ownedFound, err := alloc.db.Load(ownedIdent, &persistedOwned)
+	ownedFound, err := alloc.db.Load(alloc.persistenceIdent(ownedIdent), &persistedOwned)
 	if err != nil {
 		alloc.fatalf("Error loading persisted address data: %s", err)
 	}
@@ -1006,12 +1106,23 @@ func (alloc *Allocator) loadPersistedData() bool {
 		return false
 	}
 
-	if persistedRing.Range() != alloc.universe.Range() {
-		overwritePersisted("Deleting persisted data for IPAM range %s; our range is %s", persistedRing.Range(), alloc.universe)
+	universeRing := ring.New(alloc.universe.Range().Start, alloc.universe.Range().End, alloc.ourName, nil)
+	universeRing.Upper = alloc.universe.Upper
+	switch {
+	case persistedRing.Range() == universeRing.Range() && persistedRing.Upper == universeRing.Upper:
+	case persistedRing.Encloses(universeRing):
+		alloc.infof("IPAM range %s has been expanded to %s", alloc.universe, persistedRing.RangeString())
+	case universeRing.Encloses(persistedRing):
+		alloc.infof("Expanding persisted IPAM range %s to %s", persistedRing.RangeString(), alloc.universe)
+		persistedRing.Expand(universeRing.Start, universeRing.End)
+	default:
+		overwritePersisted("Deleting persisted data for IPAM range %s; our range is %s", persistedRing.RangeString(), alloc.universe)
 		return false
 	}
 
 	alloc.ring.Restore(persistedRing)
+	alloc.adoptRingRange()
+	alloc.persistRing()
 	alloc.space.UpdateRanges(alloc.ring.OwnedRanges())
 
 	if ownedFound {
@@ -1026,7 +1137,7 @@ func (alloc *Allocator) loadPersistedData() bool {
 }
 
 func (alloc *Allocator) persistOwned() {
-	if err := alloc.db.Save(ownedIdent, alloc.owned); err != nil {
+	if err := alloc.db.Save(alloc.persistenceIdent(ownedIdent), alloc.owned); err != nil {
 		alloc.fatalf("Error persisting address data: %s", err)
 	}
 }
@@ -1044,6 +1155,7 @@ func (alloc *Allocator) addOwned(ident string, cidr address.CIDR, isContainer bo
 	d.IsContainer = isContainer
 	d.Cidrs = append(d.Cidrs, cidr)
 	alloc.owned[ident] = d
+	alloc.renewLease(ident)
 	alloc.persistOwned()
 }
 
@@ -1054,10 +1166,12 @@ func (alloc *Allocator) removeAllOwned(ident string) []address.CIDR {
 	return a.Cidrs
 }
 
-func (alloc *Allocator) removeOwned(ident string, addrToFree address.Address) bool {
+// removeOwned returns the CIDR that ident owned, including its prefix
+// length, if found
+func (alloc *Allocator) removeOwned(ident string, upper address.Upper96, addrToFree address.Address) (address.CIDR, bool) {
 	d := alloc.owned[ident]
 	for i, ownedCidr := range d.Cidrs {
-		if ownedCidr.Addr == addrToFree {
+		if ownedCidr.Addr == addrToFree && ownedCidr.Upper == upper {
 			if len(d.Cidrs) == 1 {
 				delete(alloc.owned, ident)
 			} else {
@@ -1065,26 +1179,26 @@ func (alloc *Allocator) removeOwned(ident string, addrToFree address.Address) bo
 				alloc.owned[ident] = d
 			}
 			alloc.persistOwned()
-			return true
+			return ownedCidr, true
 		}
 	}
-	return false
+	return address.CIDR{}, false
 }
 
 func (alloc *Allocator) ownedInRange(ident string, r address.Range) []address.CIDR {
 	var c []address.CIDR
 	for _, cidr := range alloc.owned[ident].Cidrs {
-		if r.Contains(cidr.Addr) {
+		if cidr.Upper == alloc.universe.Upper && r.Contains(cidr.Addr) {
 			c = append(c, cidr)
 		}
 	}
 	return c
 }
 
-func (alloc *Allocator) findOwner(addr address.Address) string {
+func (alloc *Allocator) findOwner(upper address.Upper96, addr address.Address) string {
 	for ident, d := range alloc.owned {
 		for _, candidate := range d.Cidrs {
-			if candidate.Addr == addr {
+			if candidate.Addr == addr && candidate.Upper == upper {
 				return ident
 			}
 		}
@@ -1102,6 +1216,7 @@ func (alloc *Allocator) pruneOwned(ids map[string]struct{}) {
 		if _, found := ids[ident]; !found {
 			for _, cidr := range d.Cidrs {
 				alloc.space.Free(cidr.Addr)
+				alloc.auditAddress(AuditFree, ident, cidr, "container not running")
 			}
 			alloc.debugf("Deleting old entry %s: %v", ident, d.Cidrs)
 			delete(alloc.owned, ident)
@@ -1122,7 +1237,7 @@ func (alloc *Allocator) warnf(fmt string, args ...interface{}) {
 	alloc.logf(common.Log.Warnf, fmt, args...)
 }
 func (alloc *Allocator) errorf(fmt string, args ...interface{}) {
-	common.Log.Errorf("[allocator %s] "+fmt, append([]interface{}{alloc.ourName}, args...)...)
+	alloc.logf(common.Log.Errorf, fmt, args...)
 }
 func (alloc *Allocator) infof(fmt string, args ...interface{}) {
 	alloc.logf(common.Log.Infof, fmt, args...)
@@ -1131,8 +1246,14 @@ func (alloc *Allocator) debugf(fmt string, args ...interface{}) {
 	alloc.logf(common.Log.Debugf, fmt, args...)
 }
 func (alloc *Allocator) logf(f func(string, ...interface{}), fmt string, args ...interface{}) {
-	f("[allocator %s] "+fmt, append([]interface{}{alloc.ourName}, args...)...)
+	f("[%s] "+fmt, append([]interface{}{alloc.logName()}, args...)...)
 }
 func (alloc *Allocator) debugln(args ...interface{}) {
-	common.Log.Debugln(append([]interface{}{fmt.Sprintf("[allocator %s]:", alloc.ourName)}, args...)...)
+	common.Log.Debugln(append([]interface{}{fmt.Sprintf("[%s]:", alloc.logName())}, args...)...)
+}
+func (alloc *Allocator) logName() string {
+	if alloc.name == "" {
+		return fmt.Sprintf("allocator %s", alloc.ourName)
+	}
+	return fmt.Sprintf("allocator %s %s", alloc.name, alloc.ourName)
 }
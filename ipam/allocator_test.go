@@ -3,6 +3,7 @@ package ipam
 import (
 	"fmt"
 	"math/rand"
+	"net"
 	"sync"
 	"testing"
 	"time"
@@ -669,7 +670,145 @@ func TestSpaceRequest(t *testing.T) {
 	require.Equal(t, cidrRanges("10.40.0.0/13"), alloc2.OwnedRanges(), "")
 }
 
+func TestSpaceRequestQuota(t *testing.T) {
+	const (
+		container1 = "cont-1"
+		container2 = "cont-2"
+		universe   = "10.32.0.0/12"
+	)
+	quotas := Quotas{"02:00:00:02:00:00": {MaxOwned: 256}}
+	allocs, router, subnet := makeNetworkOfAllocators(1, universe)
+	defer stopNetworkOfAllocators(allocs, router)
+	alloc1 := allocs[0]
+	alloc1.actionChan <- func() { alloc1.quotas = quotas }
+
+	addr, err := alloc1.Allocate(container1, subnet, true, returnFalse)
+	require.Nil(t, err, "")
+	err = alloc1.Free(container1, addr)
+	require.Nil(t, err, "")
+
+	alloc2, _ := makeAllocator("02:00:00:02:00:00", universe, 2)
+	alloc2.quotas = quotas
+	alloc2.SetInterfaces(router.Connect(alloc2.ourName, alloc2))
+	alloc2.Start()
+	defer alloc2.Stop()
+	alloc2.Allocate(container2, subnet, true, returnFalse)
+
+	// alloc2 may own no more than 256 addresses
+	require.Equal(t, cidrRanges("10.47.255.0/24"), alloc2.OwnedRanges(), "")
+	status := NewStatus(alloc1, subnet)
+	require.Equal(t, []QuotaStatus{{Peer: "02:00:00:02:00:00", Nickname: "nick-02:00:00:02:00:00", MaxOwned: 256, Owned: 256}}, status.Quotas)
+}
+
+func TestReservationGossip(t *testing.T) {
+	const universe = "10.32.0.0/12"
+	allocs, router, _ := makeNetworkOfAllocators(2, universe)
+	defer stopNetworkOfAllocators(allocs, router)
+	alloc1, alloc2 := allocs[0], allocs[1]
+
+	cidr, _ := address.ParseCIDR("10.32.0.7/12")
+	require.NoError(t, alloc1.Reserve("web", cidr))
+	require.Error(t, alloc1.Reserve("db", cidr), "address already reserved")
+	router.Flush()
+	require.Equal(t, []Reservation{{Pattern: "web", CIDR: cidr, Version: 1}}, alloc2.Reservations())
+
+	require.NoError(t, alloc2.Unreserve("web"))
+	router.Flush()
+	require.Empty(t, alloc1.Reservations())
+	require.Error(t, alloc1.Unreserve("web"), "already deleted")
+
+	numReservations := func() int {
+		resultChan := make(chan int)
+		alloc1.actionChan <- func() { resultChan <- len(alloc1.reservations) }
+		return <-resultChan
+	}
+	alloc1.Tick()
+	require.Equal(t, 1, numReservations(), "tombstone kept until it has reached every peer")
+	alloc1.actionChan <- func() {
+		alloc1.now = func() time.Time { return time.Now().Add(reservationTombstoneTimeout * 2) }
+	}
+	alloc1.Tick()
+	require.Equal(t, 0, numReservations(), "tombstone expired")
+}
+
 func cidrRanges(s string) []address.Range {
 	c, _ := address.ParseCIDR(s)
 	return []address.Range{c.Range()}
 }
+
+func TestLeaseExpiry(t *testing.T) {
+	const (
+		running  = "running"
+		podAddr  = "pod-by-address"
+		leaked   = "leaked"
+		ttl      = time.Minute
+		universe = "10.0.3.0/26"
+	)
+	alloc, subnet := makeAllocatorWithMockGossip(t, "01:00:00:01:00:00", universe, 1)
+	defer alloc.Stop()
+	alloc.claimRingForTesting()
+
+	_, err := alloc.SimplyAllocate(running, subnet)
+	require.NoError(t, err)
+	pod, err := alloc.Allocate(podAddr, subnet, false, returnFalse)
+	require.NoError(t, err)
+	leakedAddr, err := alloc.Allocate(leaked, subnet, false, returnFalse)
+	require.NoError(t, err)
+	_, err = alloc.Allocate("weave:expose", subnet, false, returnFalse)
+	require.NoError(t, err)
+	// As allocated by the Docker plugin, filed under the address
+	pluginAddr, err := alloc.Allocate(api.NoContainerID, subnet, false, returnFalse)
+	require.NoError(t, err)
+
+	idents, addrs := []string{running}, []net.IP{pod.IP4()}
+	require.Empty(t, alloc.ExpireLeases(idents, addrs, ttl, false), "nothing has expired yet")
+
+	alloc.actionChan <- func() { alloc.now = func() time.Time { return time.Now().Add(ttl * 2) } }
+	expected := []Lease{{Ident: leaked, Addresses: []string{address.MakeCIDR(subnet, leakedAddr).String()}}}
+	stale := alloc.ExpireLeases(idents, addrs, ttl, true)
+	for i := range stale {
+		stale[i].Renewed = time.Time{}
+	}
+	require.Equal(t, expected, stale, "dry run")
+	free := alloc.NumFreeAddresses(subnet.Range())
+
+	require.Len(t, alloc.ExpireLeases(idents, addrs, ttl, false), 1)
+	require.Equal(t, free+1, alloc.NumFreeAddresses(subnet.Range()))
+	require.Empty(t, alloc.ExpireLeases(idents, addrs, ttl, false), "only freed once")
+	addrs2, _ := alloc.Lookup(podAddr, subnet.Range())
+	require.Len(t, addrs2, 1, "address in use is kept")
+	addrs2, _ = alloc.Lookup(pluginAddr.String(), subnet.Range())
+	require.Len(t, addrs2, 1, "address allocated without a container ID is kept")
+}
+
+func TestExpandRange(t *testing.T) {
+	allocs, router, subnet := makeNetworkOfAllocators(2, "10.0.4.0/24")
+	defer stopNetworkOfAllocators(allocs, router)
+	alloc1, alloc2 := allocs[0], allocs[1]
+
+	bigger, _ := address.ParseCIDR("10.0.4.0/23")
+	require.Error(t, alloc1.Expand(bigger), "not initialised yet")
+
+	_, err := alloc1.SimplyAllocate("first", subnet)
+	require.NoError(t, err)
+	router.Flush()
+
+	for _, s := range []string{"10.0.5.0/24", "10.0.4.0/24", "10.0.4.0/25", "fd00::/120"} {
+		cidr, _ := address.ParseCIDR(s)
+		require.Error(t, alloc1.Expand(cidr), s)
+	}
+	require.NoError(t, alloc1.Expand(bigger))
+	router.Flush()
+	for _, alloc := range allocs {
+		require.Equal(t, bigger, alloc.Universe())
+		require.Equal(t, bigger, Pool{Allocator: alloc, DefaultSubnet: subnet}.Subnet(), "default subnet grows with the range")
+	}
+
+	// Addresses in the new space can be had from either peer
+	newSpace, _ := address.ParseCIDR("10.0.5.0/24")
+	for i, alloc := range []*Allocator{alloc1, alloc2} {
+		addr, err := alloc.SimplyAllocate(fmt.Sprintf("new%d", i), newSpace)
+		require.NoError(t, err)
+		require.True(t, newSpace.Contains(address.Upper96{}, addr))
+	}
+}
@@ -0,0 +1,296 @@
+package ipam
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/weaveworks/mesh"
+
+	"github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/net/address"
+)
+
+// Kinds of AuditEvent
+const (
+	AuditAllocate = "allocate"
+	AuditClaim    = "claim"
+	AuditFree     = "free"
+	AuditDonate   = "donate"
+	AuditTransfer = "transfer"
+)
+
+// AuditEvent records a change in who has an address, or a range of
+// addresses.  Written to the audit log as one line of JSON each.
+type AuditEvent struct {
+	Time    time.Time
+	Event   string // one of the Audit* constants
+	Ident   string `json:",omitempty"` // the container or other holder of an address
+	Address string // an address in CIDR notation, or a range of addresses
+	Peer    string // the peer making the change
+	To      string `json:",omitempty"` // for donate and transfer, the peer given the range
+	Reason  string `json:",omitempty"`
+}
+
+func (ev AuditEvent) matches(ident, addr string) bool {
+	return (ident == "" || ev.Ident == ident) && (addr == "" || ev.Address == addr || ev.addressWithoutPrefix() == addr)
+}
+
+func (ev AuditEvent) addressWithoutPrefix() string {
+	if cidr, err := address.ParseCIDR(ev.Address); err == nil {
+		return cidr.IP().String()
+	}
+	return ev.Address
+}
+
+// AuditLog is an append-only log of AuditEvents, kept in a file which
+// is rotated when it reaches maxSize bytes, keeping maxBackups old
+// files as path.1 (the most recent) to path.<maxBackups>.
+type AuditLog struct {
+	sync.Mutex
+	path        string
+	maxSize     int64
+	maxBackups  int
+	file        *os.File
+	size        int64
+	subscribers map[chan AuditEvent]struct{}
+}
+
+// Number of events a streaming client may fall behind by before it
+// is cut off
+const auditSubscriberBuffer = 256
+
+func NewAuditLog(path string, maxSize int64, maxBackups int) (*AuditLog, error) {
+	l := &AuditLog{
+		path:        path,
+		maxSize:     maxSize,
+		maxBackups:  maxBackups,
+		subscribers: make(map[chan AuditEvent]struct{}),
+	}
+	return l, l.open()
+}
+
+func (l *AuditLog) open() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file, l.size = file, info.Size()
+	return nil
+}
+
+func (l *AuditLog) backupPath(n int) string {
+	return fmt.Sprintf("%s.%d", l.path, n)
+}
+
+func (l *AuditLog) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	for n := l.maxBackups; n > 1; n-- {
+		if err := os.Rename(l.backupPath(n-1), l.backupPath(n)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if l.maxBackups > 0 {
+		if err := os.Rename(l.path, l.backupPath(1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(l.path); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+// Record appends ev to the log, and passes it on to anyone streaming
+// the log.  A nil AuditLog discards everything.
+func (l *AuditLog) Record(ev AuditEvent) {
+	if l == nil {
+		return
+	}
+	line, err := json.Marshal(ev)
+	if err != nil {
+		common.Log.Errorln("[allocator]: audit log:", err)
+		return
+	}
+	line = append(line, '\n')
+
+	l.Lock()
+	defer l.Unlock()
+	if l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			common.Log.Errorln("[allocator]: rotating audit log:", err)
+			return
+		}
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		common.Log.Errorln("[allocator]: writing audit log:", err)
+	}
+	for ch := range l.subscribers {
+		select {
+		case ch <- ev:
+		default: // too far behind; the reader will notice the channel closing
+			close(ch)
+			delete(l.subscribers, ch)
+		}
+	}
+}
+
+func (l *AuditLog) Close() error {
+	l.Lock()
+	defer l.Unlock()
+	for ch := range l.subscribers {
+		close(ch)
+	}
+	l.subscribers = nil
+	return l.file.Close()
+}
+
+// history calls f on every event in the log, oldest first.  If follow
+// is true, it goes on to return a channel carrying later events.
+func (l *AuditLog) history(f func(AuditEvent), follow bool) (chan AuditEvent, error) {
+	// Open the files under the lock, so none is rotated away before
+	// we have it, and so the channel picks up where they leave off
+	l.Lock()
+	var files []*os.File
+	var err error
+	for n := l.maxBackups; n >= 0 && err == nil; n-- {
+		path := l.path
+		if n > 0 {
+			path = l.backupPath(n)
+		}
+		var file *os.File
+		if file, err = os.Open(path); err == nil {
+			files = append(files, file)
+		} else if os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	size := l.size
+	var ch chan AuditEvent
+	if follow && err == nil && l.subscribers != nil {
+		ch = make(chan AuditEvent, auditSubscriberBuffer)
+		l.subscribers[ch] = struct{}{}
+	}
+	l.Unlock()
+
+	for i, file := range files {
+		if err == nil {
+			limit := int64(-1)
+			if i == len(files)-1 {
+				limit = size
+			}
+			err = readAuditFile(file, limit, f)
+		}
+		file.Close()
+	}
+	if err != nil && ch != nil {
+		l.unsubscribe(ch)
+		ch = nil
+	}
+	return ch, err
+}
+
+func (l *AuditLog) unsubscribe(ch chan AuditEvent) {
+	l.Lock()
+	defer l.Unlock()
+	if _, found := l.subscribers[ch]; found {
+		close(ch)
+		delete(l.subscribers, ch)
+	}
+}
+
+// Read the events in file, up to limit bytes if limit is not negative
+func readAuditFile(file *os.File, limit int64, f func(AuditEvent)) error {
+	var read int64
+	scanner := bufio.NewScanner(file)
+	for (limit < 0 || read < limit) && scanner.Scan() {
+		read += int64(len(scanner.Bytes())) + 1
+		var ev AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			continue // e.g. a line cut short by a crash
+		}
+		f(ev)
+	}
+	return scanner.Err()
+}
+
+// HandleHTTP wires up the audit log's HTTP endpoint.  GET /audit
+// returns the logged events as lines of JSON, optionally only those
+// for the ident or address given as form values; with follow=true it
+// then streams further events as they happen.
+func (l *AuditLog) HandleHTTP(router *mux.Router) {
+	router.Methods("GET").Path("/audit").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ident, addr := r.FormValue("ident"), r.FormValue("address")
+		encoder := json.NewEncoder(w)
+		write := func(ev AuditEvent) {
+			if ev.matches(ident, addr) {
+				encoder.Encode(ev)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		ch, err := l.history(write, r.FormValue("follow") == "true")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if ch == nil {
+			return
+		}
+		defer l.unsubscribe(ch)
+		flusher, _ := w.(http.Flusher)
+		closed := w.(http.CloseNotifier).CloseNotify()
+		for {
+			if flusher != nil {
+				flusher.Flush()
+			}
+			select {
+			case ev, ok := <-ch:
+				if !ok {
+					return
+				}
+				write(ev)
+			case <-closed:
+				return
+			}
+		}
+	})
+}
+
+// Allocator helpers
+
+func (alloc *Allocator) auditAddress(event, ident string, cidr address.CIDR, reason string) {
+	alloc.auditLog.Record(AuditEvent{
+		Time:    alloc.now(),
+		Event:   event,
+		Ident:   ident,
+		Address: cidr.String(),
+		Peer:    alloc.annotatePeernames([]mesh.PeerName{alloc.ourName})[0],
+		Reason:  reason,
+	})
+}
+
+func (alloc *Allocator) auditRanges(event string, ranges []address.Range, to mesh.PeerName, reason string) {
+	for _, r := range ranges {
+		alloc.auditLog.Record(AuditEvent{
+			Time:    alloc.now(),
+			Event:   event,
+			Address: alloc.universe.Upper.RangeString(r),
+			Peer:    alloc.annotatePeernames([]mesh.PeerName{alloc.ourName})[0],
+			To:      alloc.annotatePeernames([]mesh.PeerName{to})[0],
+			Reason:  reason,
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package ipam
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/weave/net/address"
+)
+
+func readAuditHistory(t *testing.T, l *AuditLog) []AuditEvent {
+	var events []AuditEvent
+	_, err := l.history(func(ev AuditEvent) { events = append(events, ev) }, false)
+	require.NoError(t, err)
+	return events
+}
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipam-audit")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	l, err := NewAuditLog(path, 1024, 2)
+	require.NoError(t, err)
+	defer func() { l.Close() }()
+
+	alloc, subnet := makeAllocatorWithMockGossip(t, "01:00:00:01:00:00", "10.0.3.0/26", 1)
+	defer alloc.Stop()
+	alloc.actionChan <- func() { alloc.auditLog = l }
+	alloc.claimRingForTesting()
+
+	addr, err := alloc.SimplyAllocate("c1", subnet)
+	require.NoError(t, err)
+	require.NoError(t, alloc.Delete("c1"))
+	cidr := address.MakeCIDR(subnet, addr).String()
+
+	events := readAuditHistory(t, l)
+	require.Len(t, events, 2)
+	require.Equal(t, AuditAllocate, events[0].Event)
+	require.Equal(t, AuditFree, events[1].Event)
+	for _, ev := range events {
+		require.Equal(t, "c1", ev.Ident)
+		require.Equal(t, cidr, ev.Address)
+		require.True(t, ev.matches("", addr.String()), "matches address without prefix")
+	}
+
+	// Freeing records the address with the prefix it was allocated with
+	narrow, _ := address.ParseCIDR("10.0.3.16/28")
+	addr, err = alloc.SimplyAllocate("c3", narrow)
+	require.NoError(t, err)
+	require.NoError(t, alloc.Free("c3", addr))
+	events = readAuditHistory(t, l)
+	require.Equal(t, AuditFree, events[len(events)-1].Event)
+	require.Equal(t, address.MakeCIDR(narrow, addr).String(), events[len(events)-1].Address)
+
+	// Followers see new events, after the old ones
+	ch, err := l.history(func(AuditEvent) {}, true)
+	require.NoError(t, err)
+	l.Record(AuditEvent{Event: AuditClaim, Ident: "c2"})
+	require.Equal(t, "c2", (<-ch).Ident)
+	l.unsubscribe(ch)
+
+	// The log is rotated, dropping the oldest events, and survives reopening
+	for i := 0; i < 100; i++ {
+		l.Record(AuditEvent{Event: AuditClaim, Ident: fmt.Sprintf("filler%03d", i)})
+	}
+	require.NoError(t, l.Close())
+	l, err = NewAuditLog(path, 1024, 2)
+	require.NoError(t, err)
+	events = readAuditHistory(t, l)
+	require.True(t, len(events) < 100, "old events dropped")
+	require.Equal(t, "filler099", events[len(events)-1].Ident)
+	for i := 1; i < len(events); i++ {
+		require.True(t, events[i-1].Ident < events[i].Ident, "in order")
+	}
+	for _, p := range []string{path + ".1", path + ".2"} {
+		_, err := os.Stat(p)
+		require.NoError(t, err)
+	}
+	_, err = os.Stat(path + ".3")
+	require.True(t, os.IsNotExist(err))
+}
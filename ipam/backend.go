@@ -0,0 +1,165 @@
+package ipam
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/common/docker"
+	"github.com/weaveworks/weave/net/address"
+)
+
+// Backend is where a pool gets addresses from, both for the HTTP API
+// and for freeing those of containers that have gone away.  The
+// Allocator, handing out addresses from the space it owns in the
+// ring, is the default; an HTTPBackend takes them from some other IPAM
+// system.
+type Backend interface {
+	docker.ContainerObserver
+	Universe() address.CIDR
+	Allocate(ident string, subnet address.CIDR, isContainer bool, hasBeenCancelled func() bool) (address.Address, error)
+	Claim(ident string, cidr address.CIDR, isContainer, noErrorOnUnknown bool, hasBeenCancelled func() bool) error
+	Lookup(ident string, r address.Range) ([]address.CIDR, error)
+	Free(ident string, addr address.Address) error
+	Delete(ident string) error
+	// PruneOwned frees the addresses of containers not in ids, e.g.
+	// those that went away while weave was not running
+	PruneOwned(ids []string)
+}
+
+const externalIPAMTimeout = 30 * time.Second
+
+// HTTPBackend delegates to an external IPAM service, for the addresses
+// in universe.  The service is expected to offer the same endpoints as
+// weave's own IPAM API:
+//
+//	POST   /ip/<ident>/<subnet-ip>/<prefixlen>  allocate; returns ip/prefixlen
+//	PUT    /ip/<ident>/<ip>/<prefixlen>         claim the given address
+//	GET    /ip/<ident>                          all addresses of ident, space-separated
+//	DELETE /ip/<ident>/<ip>                     free one address
+//	DELETE /ip/<ident>                          free all addresses of ident
+//
+// with any status other than 2xx, or 404 for a lookup, being an error
+// described by the response body.
+type HTTPBackend struct {
+	url      string
+	universe address.CIDR
+	client   *http.Client
+}
+
+func NewHTTPBackend(baseURL string, universe address.CIDR) *HTTPBackend {
+	return &HTTPBackend{
+		url:      strings.TrimSuffix(baseURL, "/"),
+		universe: universe,
+		client:   &http.Client{Timeout: externalIPAMTimeout},
+	}
+}
+
+func (b *HTTPBackend) do(method string, path string, values url.Values) (int, string, error) {
+	req, err := http.NewRequest(method, b.url+path, strings.NewReader(values.Encode()))
+	if err != nil {
+		return 0, "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return 0, "", fmt.Errorf("external IPAM: %s", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, "", fmt.Errorf("external IPAM: %s", err)
+	}
+	result := strings.TrimSpace(string(body))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, "", fmt.Errorf("external IPAM: %s: %s", resp.Status, result)
+	}
+	return resp.StatusCode, result, nil
+}
+
+func identPath(ident string) string {
+	return "/ip/" + url.PathEscape(ident)
+}
+
+func (b *HTTPBackend) Universe() address.CIDR {
+	return b.universe
+}
+
+func (b *HTTPBackend) Allocate(ident string, subnet address.CIDR, isContainer bool, hasBeenCancelled func() bool) (address.Address, error) {
+	if hasBeenCancelled != nil && hasBeenCancelled() {
+		return 0, &errorCancelled{"Allocate", ident}
+	}
+	_, body, err := b.do("POST", identPath(ident)+"/"+subnet.String(), nil)
+	if err != nil {
+		return 0, err
+	}
+	cidr, err := address.ParseCIDR(body)
+	if err != nil {
+		return 0, fmt.Errorf("external IPAM: bad address %q: %s", body, err)
+	}
+	if cidr.Upper != subnet.Upper || !subnet.Range().Contains(cidr.Addr) {
+		return 0, fmt.Errorf("external IPAM: address %s is outside %s", cidr, subnet)
+	}
+	return cidr.Addr, nil
+}
+
+func (b *HTTPBackend) Claim(ident string, cidr address.CIDR, isContainer, noErrorOnUnknown bool, hasBeenCancelled func() bool) error {
+	if hasBeenCancelled != nil && hasBeenCancelled() {
+		return &errorCancelled{"Claim", ident}
+	}
+	_, _, err := b.do("PUT", identPath(ident)+"/"+cidr.String(), nil)
+	return err
+}
+
+func (b *HTTPBackend) Lookup(ident string, r address.Range) ([]address.CIDR, error) {
+	status, body, err := b.do("GET", identPath(ident), nil)
+	switch {
+	case status == http.StatusNotFound:
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	var result []address.CIDR
+	for _, s := range strings.Fields(body) {
+		cidr, err := address.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("external IPAM: bad address %q: %s", s, err)
+		}
+		if cidr.Upper == b.universe.Upper && r.Contains(cidr.Addr) {
+			result = append(result, cidr)
+		}
+	}
+	return result, nil
+}
+
+func (b *HTTPBackend) Free(ident string, addr address.Address) error {
+	_, _, err := b.do("DELETE", identPath(ident)+"/"+b.universe.Upper.IP(addr).String(), nil)
+	return err
+}
+
+func (b *HTTPBackend) Delete(ident string) error {
+	_, _, err := b.do("DELETE", identPath(ident), nil)
+	return err
+}
+
+// The service is not told about containers starting or dying, since a
+// container that dies may be restarted with the same addresses
+func (b *HTTPBackend) ContainerStarted(ident string) {}
+func (b *HTTPBackend) ContainerDied(ident string)    {}
+
+// ContainerDestroyed frees the addresses of a container that is gone
+// for good
+func (b *HTTPBackend) ContainerDestroyed(ident string) {
+	if err := b.Delete(ident); err != nil {
+		common.Log.Warningf("[allocator]: unable to free addresses of %s: %s", ident, err)
+	}
+}
+
+// PruneOwned does nothing, since the service offers no list of the
+// idents it has given addresses to; it is up to the service to free
+// those of containers that went away while weave was not running.
+func (b *HTTPBackend) PruneOwned(ids []string) {}
@@ -0,0 +1,119 @@
+package ipam
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/weave/net/address"
+)
+
+// A stand-in for an external IPAM service, handing out addresses in
+// order from the subnet asked for
+type stubIPAM struct {
+	sync.Mutex
+	next  int
+	owned map[string][]string
+}
+
+func newStubIPAM() *httptest.Server {
+	stub := &stubIPAM{owned: make(map[string][]string)}
+	router := mux.NewRouter()
+	router.Methods("POST").Path("/ip/{id}/{ip}/{prefixlen}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		stub.Lock()
+		defer stub.Unlock()
+		stub.next++
+		ip := strings.TrimSuffix(vars["ip"], "0") + fmt.Sprint(stub.next)
+		stub.owned[vars["id"]] = append(stub.owned[vars["id"]], ip+"/"+vars["prefixlen"])
+		fmt.Fprint(w, ip+"/"+vars["prefixlen"])
+	})
+	router.Methods("PUT").Path("/ip/{id}/{ip}/{prefixlen}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		stub.Lock()
+		defer stub.Unlock()
+		stub.owned[vars["id"]] = append(stub.owned[vars["id"]], vars["ip"]+"/"+vars["prefixlen"])
+		w.WriteHeader(204)
+	})
+	router.Methods("GET").Path("/ip/{id}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stub.Lock()
+		defer stub.Unlock()
+		owned, found := stub.owned[mux.Vars(r)["id"]]
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, strings.Join(owned, " "))
+	})
+	router.Methods("DELETE").Path("/ip/{id}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stub.Lock()
+		defer stub.Unlock()
+		if _, found := stub.owned[mux.Vars(r)["id"]]; !found {
+			http.Error(w, "unknown", http.StatusBadRequest)
+			return
+		}
+		delete(stub.owned, mux.Vars(r)["id"])
+		w.WriteHeader(204)
+	})
+	return httptest.NewServer(router)
+}
+
+func TestHTTPExternalBackend(t *testing.T) {
+	stub := newStubIPAM()
+	defer stub.Close()
+
+	// As set up for --ipalloc-external, with no allocator of our own
+	universe, _ := address.ParseCIDR("10.0.0.0/16")
+	subnet, _ := address.ParseCIDR("10.0.3.0/24")
+	pool := Pool{DefaultSubnet: subnet, Backend: NewHTTPBackend(stub.URL+"/", universe)}
+	require.Equal(t, universe, pool.Universe())
+	require.Equal(t, subnet, pool.Subnet())
+	require.Nil(t, pool.Status())
+	port := listenHTTPPools(Pools{pool})
+
+	require.Equal(t, "10.0.3.1/24", HTTPPost(t, identURL(port, "c1")))
+	require.Equal(t, "10.0.3.1/24", HTTPGet(t, identURL(port, "c1")))
+	require.Equal(t, "10.0.3.2/24", HTTPPost(t, allocURL(port, "10.0.3.0/24", "c2")))
+
+	resp, err := doHTTP("PUT", allocURL(port, "10.0.3.200/24", "c3"))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.Equal(t, "10.0.3.200/24", HTTPGet(t, identURL(port, "c3")))
+
+	resp, err = doHTTP("DELETE", identURL(port, "c1"))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp, err = doHTTP("DELETE", identURL(port, "c1"))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode, "error from the external service")
+	require.Equal(t, "", HTTPGet(t, identURL(port, "c1")))
+
+	// Addresses are freed through the backend when a container is
+	// destroyed, but not when it merely dies
+	pool.ContainerObserver().ContainerDied("c2")
+	require.Equal(t, "10.0.3.2/24", HTTPGet(t, identURL(port, "c2")))
+	pool.ContainerObserver().ContainerDestroyed("c2")
+	require.Equal(t, "", HTTPGet(t, identURL(port, "c2")))
+
+	// Operations on the ring itself are refused
+	for _, req := range []struct{ method, path string }{
+		{"POST", "/range?range=10.0.0.0/16"},
+		{"PUT", "/reservation/web?address=10.0.3.7"},
+	} {
+		resp, err = doHTTP(req.method, fmt.Sprintf("http://localhost:%d%s", port, req.path))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode, req.path)
+	}
+	require.Equal(t, "[]\n", HTTPGet(t, fmt.Sprintf("http://localhost:%d/reservation", port)))
+
+	// Requests not tied to a live connection need not be cancellable
+	addr, err := pool.Backend.Allocate("c4", subnet, false, nil)
+	require.NoError(t, err)
+	require.Equal(t, subnet.Addr+3, addr)
+}
@@ -15,6 +15,7 @@ type claim struct {
 	tryCount         int
 	ident            string       // a container ID, something like "weave:expose", or api.NoContainerID
 	cidr             address.CIDR // single address being claimed
+	name             string       // container name or namespace/pod, to match reservations; may be empty
 	isContainer      bool         // true if ident is a container ID
 	noErrorOnUnknown bool         // if false, error or block if we don't know; if true return ok but keep trying
 	hasBeenCancelled func() bool
@@ -45,17 +46,24 @@ func (c *claim) Try(alloc *Allocator) bool {
 
 	c.tryCount++
 
+	if r, found := alloc.reservations.forAddr(c.cidr.Upper, c.cidr.Addr); found && !r.matches(c.name) &&
+		alloc.findOwner(c.cidr.Upper, c.cidr.Addr) != c.ident {
+		c.sendResult(fmt.Errorf("address %s is reserved for %s", c.cidr, r.Pattern))
+		return true
+	}
+
 	addOwned := func() {
-		if c.ident == api.NoContainerID {
-			alloc.addOwned(c.cidr.Addr.String(), c.cidr, c.isContainer)
-		} else {
-			alloc.addOwned(c.ident, c.cidr, c.isContainer)
+		ident := c.ident
+		if ident == api.NoContainerID {
+			ident = c.cidr.IP().String()
 		}
+		alloc.addOwned(ident, c.cidr, c.isContainer)
+		alloc.auditAddress(AuditClaim, ident, c.cidr, "")
 	}
 
-	if !alloc.ring.Contains(c.cidr.Addr) {
+	if c.cidr.Upper != alloc.universe.Upper || !alloc.ring.Contains(c.cidr.Addr) {
 		alloc.infof("Address %s claimed by %s - not in our range", c.cidr, c.ident)
-		previousOwner := alloc.findOwner(c.cidr.Addr)
+		previousOwner := alloc.findOwner(c.cidr.Upper, c.cidr.Addr)
 		switch {
 		case previousOwner == "":
 			addOwned()
@@ -63,7 +71,8 @@ func (c *claim) Try(alloc *Allocator) bool {
 		case c.ident == api.NoContainerID: // already owned by anonymous container
 			// do nothing (no automatic fall-through in Go)
 		case !alloc.dead[previousOwner].IsZero(): // already owned by dead container
-			alloc.removeOwned(previousOwner, c.cidr.Addr)
+			alloc.removeOwned(previousOwner, c.cidr.Upper, c.cidr.Addr)
+			alloc.auditAddress(AuditFree, previousOwner, c.cidr, "claimed by "+c.ident)
 			addOwned()
 		default:
 			c.sendResult(fmt.Errorf("address %s already in use by %s", c.cidr, previousOwner))
@@ -104,8 +113,12 @@ func (c *claim) Try(alloc *Allocator) bool {
 		return false
 	}
 
-	// We are the owner, check we haven't given it to another container
-	existingIdent := alloc.findOwner(c.cidr.Addr)
+	// We are the owner; if we were holding the address for the
+	// reservation checked above, this claim may now have it
+	alloc.releaseHold(c.cidr.Addr)
+
+	// Check we haven't given it to another container
+	existingIdent := alloc.findOwner(c.cidr.Upper, c.cidr.Addr)
 	switch {
 	case existingIdent == "":
 		// Unused address, we try to claim it:
@@ -116,11 +129,11 @@ func (c *claim) Try(alloc *Allocator) bool {
 		} else {
 			c.sendResult(err)
 		}
-	case (existingIdent == c.ident) || (c.ident == api.NoContainerID && existingIdent == c.cidr.Addr.String()):
+	case (existingIdent == c.ident) || (c.ident == api.NoContainerID && existingIdent == c.cidr.IP().String()):
 		// same identifier is claiming same address; that's OK
 		alloc.debugln("Re-Claimed", c.cidr, "for", c.ident)
 		c.sendResult(nil)
-	case existingIdent == c.cidr.Addr.String():
+	case existingIdent == c.cidr.IP().String():
 		// Address already allocated via api.NoContainerID name and current ID is a real container ID:
 		c.sendResult(fmt.Errorf("address %s already in use", c.cidr))
 	case c.ident == api.NoContainerID:
@@ -0,0 +1,66 @@
+package ipam
+
+import (
+	"fmt"
+
+	"github.com/weaveworks/weave/net/address"
+)
+
+// The range of our ring, as a CIDR; the ring only ever grows to an
+// enclosing CIDR, so it always is one
+func (alloc *Allocator) ringCIDR() address.CIDR {
+	cidr, ok := rangeCIDR(alloc.universe.Upper, alloc.ring.Range())
+	if !ok {
+		alloc.fatalf("IPAM range %s is not a CIDR", alloc.ring.RangeString())
+	}
+	return cidr
+}
+
+func rangeCIDR(upper address.Upper96, r address.Range) (address.CIDR, bool) {
+	cidrs := r.CIDRs()
+	if len(cidrs) != 1 {
+		return address.CIDR{}, false
+	}
+	cidr := cidrs[0]
+	if cidr.Upper = upper; cidr.IsIPv6() {
+		cidr.PrefixLen += 96
+	}
+	return cidr, true
+}
+
+// Catch up with any expansion of our ring, by ourselves or by others
+func (alloc *Allocator) adoptRingRange() {
+	if alloc.ring.Range() == alloc.universe.Range() {
+		return
+	}
+	universe := alloc.ringCIDR()
+	alloc.infof("IPAM range expanded from %s to %s", alloc.universe, universe)
+	alloc.universeLock.Lock()
+	alloc.universe = universe
+	alloc.universeLock.Unlock()
+}
+
+// Expand (Sync) - grow the range we allocate from to cidr, which must
+// enclose the current range.  The new addresses go to the owner of
+// the range at the end of the ring, from where they are handed out on
+// request as usual; other peers learn of the expansion through gossip.
+func (alloc *Allocator) Expand(cidr address.CIDR) error {
+	resultChan := make(chan error)
+	alloc.actionChan <- func() {
+		switch {
+		case !cidr.IsSubnet():
+			resultChan <- fmt.Errorf("%s is not a subnet address", cidr)
+		case cidr.Upper != alloc.universe.Upper || cidr.PrefixLen >= alloc.universe.PrefixLen ||
+			!cidr.Contains(alloc.universe.Upper, alloc.universe.Addr):
+			resultChan <- fmt.Errorf("%s does not enclose the current range %s", cidr, alloc.universe)
+		case alloc.ring.Empty():
+			resultChan <- fmt.Errorf("IP allocation has not been initialised yet; change --ipalloc-range instead")
+		default:
+			alloc.ring.Expand(cidr.Range().Start, cidr.Range().End)
+			alloc.ringUpdated()
+			alloc.gossip.GossipBroadcast(alloc.Gossip())
+			resultChan <- nil
+		}
+	}
+	return <-resultChan
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/gorilla/mux"
 
@@ -63,20 +64,48 @@ func cancellationErr(w http.ResponseWriter, err error) bool {
 	return false
 }
 
-func (alloc *Allocator) handleHTTPAllocate(dockerCli *docker.Client, w http.ResponseWriter, ident string, checkAlive bool, subnet address.CIDR) {
-	addr, err := alloc.Allocate(ident, subnet, checkAlive,
-		hasBeenCancelled(dockerCli, w.(http.CloseNotifier).CloseNotify(), ident, checkAlive))
+// The name reservations are matched against: as given in the request,
+// or else that of the container ident, if we can ask Docker
+func containerName(dockerCli *docker.Client, r *http.Request, ident string, checkAlive bool) string {
+	if name := r.FormValue("name"); name != "" || dockerCli == nil || !checkAlive {
+		return name
+	}
+	container, err := dockerCli.InspectContainer(ident)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimPrefix(container.Name, "/")
+}
+
+func (pool Pool) handleHTTPAllocate(dockerCli *docker.Client, w http.ResponseWriter, r *http.Request, ident string, checkAlive bool, subnet address.CIDR) {
+	cancelled := hasBeenCancelled(dockerCli, w.(http.CloseNotifier).CloseNotify(), ident, checkAlive)
+	if pool.Backend == nil && len(pool.Reservations()) > 0 {
+		if name := containerName(dockerCli, r, ident, checkAlive); name != "" {
+			cidr, found, err := pool.AllocateReserved(ident, name, subnet, checkAlive, cancelled)
+			switch {
+			case err != nil:
+				if !cancellationErr(w, err) {
+					badRequest(w, err)
+				}
+				return
+			case found:
+				fmt.Fprint(w, address.MakeCIDR(subnet, cidr.Addr))
+				return
+			}
+		}
+	}
+	addr, err := pool.backend().Allocate(ident, subnet, checkAlive, cancelled)
 	if err != nil {
 		if !cancellationErr(w, err) {
 			badRequest(w, err)
 		}
 		return
 	}
-	fmt.Fprintf(w, "%s/%d", addr, subnet.PrefixLen)
+	fmt.Fprint(w, address.MakeCIDR(subnet, addr))
 }
 
-func (alloc *Allocator) handleHTTPClaim(dockerCli *docker.Client, w http.ResponseWriter, ident string, cidr address.CIDR, checkAlive, noErrorOnUnknown bool) {
-	err := alloc.Claim(ident, cidr, checkAlive, noErrorOnUnknown,
+func (pool Pool) handleHTTPClaim(dockerCli *docker.Client, w http.ResponseWriter, ident string, cidr address.CIDR, checkAlive, noErrorOnUnknown bool) {
+	err := pool.backend().Claim(ident, cidr, checkAlive, noErrorOnUnknown,
 		hasBeenCancelled(dockerCli, w.(http.CloseNotifier).CloseNotify(), ident, checkAlive))
 	if err != nil {
 		if !cancellationErr(w, err) {
@@ -87,30 +116,123 @@ func (alloc *Allocator) handleHTTPClaim(dockerCli *docker.Client, w http.Respons
 	w.WriteHeader(204)
 }
 
+var errNoRing = fmt.Errorf("not available for addresses from an external IPAM service")
+
+// Operations on the ring itself need the pool's own Allocator
+func noRing(w http.ResponseWriter, pool Pool) bool {
+	if pool.Allocator == nil {
+		badRequest(w, errNoRing)
+		return true
+	}
+	return false
+}
+
+func noPool(w http.ResponseWriter, ipv6 bool) {
+	family := "IPv4"
+	if ipv6 {
+		family = "IPv6"
+	}
+	badRequest(w, fmt.Errorf("no IP allocation range configured for %s addresses", family))
+}
+
+func (pools Pools) forName(w http.ResponseWriter, name string) (Pool, bool) {
+	pool, found := pools.ForName(name)
+	if !found {
+		badRequest(w, fmt.Errorf("unknown IP allocation pool %q", name))
+	}
+	return pool, found
+}
+
+// Pick the pool named by the "pool" or "family" form value, or the first one
+func (pools Pools) forRequest(w http.ResponseWriter, r *http.Request) (Pool, bool) {
+	if name := r.FormValue("pool"); name != "" {
+		return pools.forName(w, name)
+	}
+	switch family := r.FormValue("family"); family {
+	case "":
+		return pools[0], true
+	case "4", "6":
+		pool, found := pools.ForFamily(family == "6")
+		if !found {
+			noPool(w, family == "6")
+		}
+		return pool, found
+	default:
+		badRequest(w, fmt.Errorf("unknown address family %q", family))
+		return Pool{}, false
+	}
+}
+
+// Pick the pool named by the "pool" form value, or the one for cidr
+func (pools Pools) forCIDR(w http.ResponseWriter, r *http.Request, cidr address.CIDR) (Pool, bool) {
+	if name := r.FormValue("pool"); name != "" {
+		return pools.forName(w, name)
+	}
+	pool, found := pools.ForCIDR(cidr)
+	if !found {
+		noPool(w, cidr.IsIPv6())
+	}
+	return pool, found
+}
+
 // HandleHTTP wires up ipams HTTP endpoints to the provided mux.
 func (alloc *Allocator) HandleHTTP(router *mux.Router, defaultSubnet address.CIDR, dockerCli *docker.Client) {
+	Pools{{Allocator: alloc, DefaultSubnet: defaultSubnet}}.HandleHTTP(router, dockerCli)
+}
+
+// HandleHTTP wires up ipams HTTP endpoints to the provided mux,
+// dispatching each request to the pool for the addresses concerned.
+func (pools Pools) HandleHTTP(router *mux.Router, dockerCli *docker.Client) {
 	router.Methods("GET").Path("/ipinfo/defaultsubnet").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, "%s", defaultSubnet)
+		if pool, ok := pools.forRequest(w, r); ok {
+			fmt.Fprintf(w, "%s", pool.Subnet())
+		}
 	})
 
 	router.Methods("PUT").Path("/ip/{id}/{ip}/{prefixlen}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		if cidr, ok := parseCIDR(w, vars["ip"]+"/"+vars["prefixlen"], false); ok {
-			ident := vars["id"]
-			checkAlive := r.FormValue("check-alive") == "true"
-			noErrorOnUnknown := r.FormValue("noErrorOnUnknown") == "true"
-			alloc.handleHTTPClaim(dockerCli, w, ident, cidr, checkAlive, noErrorOnUnknown)
+			if pool, ok := pools.forCIDR(w, r, cidr); ok {
+				ident := vars["id"]
+				checkAlive := r.FormValue("check-alive") == "true"
+				noErrorOnUnknown := r.FormValue("noErrorOnUnknown") == "true"
+				pool.handleHTTPClaim(dockerCli, w, ident, cidr, checkAlive, noErrorOnUnknown)
+			}
 		}
 	})
 
 	router.Methods("GET").Path("/ring").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		alloc.Prime()
+		for _, pool := range pools {
+			if pool.Allocator != nil {
+				pool.Prime()
+			}
+		}
+	})
+
+	router.Methods("POST").Path("/range").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cidr, ok := parseCIDR(w, r.FormValue("range"), true)
+		if !ok {
+			return
+		}
+		pool, ok := pools.forCIDR(w, r, cidr)
+		if !ok || noRing(w, pool) {
+			return
+		}
+		if err := pools.Expand(pool, cidr); err != nil {
+			badRequest(w, fmt.Errorf("Unable to expand range: %s", err))
+			return
+		}
+		w.WriteHeader(204)
 	})
 
 	router.Methods("GET").Path("/ip/{id}/{ip}/{prefixlen}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		if subnet, ok := parseCIDR(w, vars["ip"]+"/"+vars["prefixlen"], true); ok {
-			cidrs, err := alloc.Lookup(vars["id"], subnet.HostRange())
+			pool, ok := pools.forCIDR(w, r, subnet)
+			if !ok {
+				return
+			}
+			cidrs, err := pool.backend().Lookup(vars["id"], subnet.HostRange())
 			if err != nil {
 				http.NotFound(w, r)
 				return
@@ -120,7 +242,11 @@ func (alloc *Allocator) HandleHTTP(router *mux.Router, defaultSubnet address.CID
 	})
 
 	router.Methods("GET").Path("/ip/{id}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		addrs, err := alloc.Lookup(mux.Vars(r)["id"], defaultSubnet.HostRange())
+		pool, ok := pools.forRequest(w, r)
+		if !ok {
+			return
+		}
+		addrs, err := pool.backend().Lookup(mux.Vars(r)["id"], pool.Subnet().HostRange())
 		if err != nil {
 			http.NotFound(w, r)
 			return
@@ -138,22 +264,29 @@ func (alloc *Allocator) HandleHTTP(router *mux.Router, defaultSubnet address.CID
 			Owned []mapping `json:"owned"`
 		}
 
-		resultChan := make(chan mappings)
-		alloc.actionChan <- func() {
-			ms := mappings{}
-			for containerid, d := range alloc.owned {
-				m := mapping{
-					ContainerID: containerid,
-					Addrs:       []string{},
-				}
-				for _, addr := range d.Cidrs {
-					m.Addrs = append(m.Addrs, addr.String())
+		ms := mappings{}
+		for _, pool := range pools {
+			alloc := pool.Allocator
+			if alloc == nil { // the external IPAM has the list
+				continue
+			}
+			resultChan := make(chan []mapping)
+			alloc.actionChan <- func() {
+				var owned []mapping
+				for containerid, d := range alloc.owned {
+					m := mapping{
+						ContainerID: containerid,
+						Addrs:       []string{},
+					}
+					for _, addr := range d.Cidrs {
+						m.Addrs = append(m.Addrs, addr.String())
+					}
+					owned = append(owned, m)
 				}
-				ms.Owned = append(ms.Owned, m)
+				resultChan <- owned
 			}
-			resultChan <- ms
+			ms.Owned = append(ms.Owned, <-resultChan...)
 		}
-		ms := <-resultChan
 
 		w.Header().Set("Content-Type", "application/json")
 		if err := json.NewEncoder(w).Encode(ms); err != nil {
@@ -164,23 +297,36 @@ func (alloc *Allocator) HandleHTTP(router *mux.Router, defaultSubnet address.CID
 	router.Methods("POST").Path("/ip/{id}/{ip}/{prefixlen}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		if subnet, ok := parseCIDR(w, vars["ip"]+"/"+vars["prefixlen"], true); ok {
-			alloc.handleHTTPAllocate(dockerCli, w, vars["id"], r.FormValue("check-alive") == "true", subnet)
+			if pool, ok := pools.forCIDR(w, r, subnet); ok {
+				pool.handleHTTPAllocate(dockerCli, w, r, vars["id"], r.FormValue("check-alive") == "true", subnet)
+			}
 		}
 	})
 
 	router.Methods("POST").Path("/ip/{id}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
-		alloc.handleHTTPAllocate(dockerCli, w, vars["id"], r.FormValue("check-alive") == "true", defaultSubnet)
+		if pool, ok := pools.forRequest(w, r); ok {
+			pool.handleHTTPAllocate(dockerCli, w, r, vars["id"], r.FormValue("check-alive") == "true", pool.Subnet())
+		}
 	})
 
 	router.Methods("DELETE").Path("/ip/{id}/{ip}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		ident := vars["id"]
 		ipStr := vars["ip"]
-		if ip, err := address.ParseIP(ipStr); err != nil {
+		ip, err := address.ParseHost(ipStr)
+		if err != nil {
 			badRequest(w, err)
 			return
-		} else if err := alloc.Free(ident, ip); err != nil {
+		}
+		pool, ok := pools.forCIDR(w, r, ip)
+		if !ok {
+			return
+		}
+		if ip.Upper != pool.Universe().Upper {
+			badRequest(w, fmt.Errorf("Unable to free: address %s not found for %s", ipStr, ident))
+			return
+		} else if err := pool.backend().Free(ident, ip.Addr); err != nil {
 			badRequest(w, fmt.Errorf("Unable to free: %s", err))
 			return
 		}
@@ -190,7 +336,14 @@ func (alloc *Allocator) HandleHTTP(router *mux.Router, defaultSubnet address.CID
 
 	router.Methods("DELETE").Path("/ip/{id}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ident := mux.Vars(r)["id"]
-		if err := alloc.Delete(ident); err != nil {
+		var err error
+		deleted := false
+		for _, pool := range pools {
+			if err = pool.backend().Delete(ident); err == nil {
+				deleted = true
+			}
+		}
+		if !deleted {
 			badRequest(w, err)
 			return
 		}
@@ -198,9 +351,84 @@ func (alloc *Allocator) HandleHTTP(router *mux.Router, defaultSubnet address.CID
 		w.WriteHeader(204)
 	})
 
+	router.Methods("GET").Path("/reservation").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		type reservation struct {
+			Pattern string `json:"pattern"`
+			Address string `json:"address"`
+			Pool    string `json:"pool,omitempty"`
+		}
+
+		reservations := []reservation{}
+		for _, pool := range pools {
+			if pool.Allocator == nil {
+				continue
+			}
+			for _, res := range pool.Reservations() {
+				reservations = append(reservations, reservation{res.Pattern, res.CIDR.String(), pool.Name})
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(reservations); err != nil {
+			common.Log.Warningln("[allocator]:", err.Error())
+		}
+	})
+
+	router.Methods("PUT").Path("/reservation/{pattern:.+}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pattern := mux.Vars(r)["pattern"]
+		addrStr := r.FormValue("address")
+		var cidr address.CIDR
+		var err error
+		if strings.Contains(addrStr, "/") {
+			cidr, err = address.ParseCIDR(addrStr)
+		} else {
+			cidr, err = address.ParseHost(addrStr)
+		}
+		if err != nil {
+			badRequest(w, err)
+			return
+		}
+		pool, ok := pools.forCIDR(w, r, cidr)
+		if !ok || noRing(w, pool) {
+			return
+		}
+		if !strings.Contains(addrStr, "/") { // take the prefix of the subnet it is in
+			cidr.PrefixLen = pool.Universe().PrefixLen
+			if subnet := pool.Subnet(); subnet.Contains(cidr.Upper, cidr.Addr) {
+				cidr.PrefixLen = subnet.PrefixLen
+			}
+		}
+		if err := pool.Reserve(pattern, cidr); err != nil {
+			badRequest(w, fmt.Errorf("Unable to reserve: %s", err))
+			return
+		}
+		w.WriteHeader(204)
+	})
+
+	router.Methods("DELETE").Path("/reservation/{pattern:.+}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pattern := mux.Vars(r)["pattern"]
+		err := errNoRing
+		deleted := false
+		for _, pool := range pools {
+			if pool.Allocator == nil {
+				continue
+			}
+			if err = pool.Unreserve(pattern); err == nil {
+				deleted = true
+			}
+		}
+		if !deleted {
+			badRequest(w, err)
+			return
+		}
+		w.WriteHeader(204)
+	})
+
+	pools.handleStateHTTP(router)
+
 	router.Methods("GET").Path("/ipinfo/tracker").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		tracker := ""
-		if alloc.tracker != nil {
+		if alloc := pools[0].Allocator; alloc != nil && alloc.tracker != nil {
 			tracker = alloc.tracker.String()
 		}
 		fmt.Fprintf(w, tracker)
@@ -39,11 +39,15 @@ func doHTTP(method string, url string) (resp *http.Response, err error) {
 }
 
 func listenHTTP(alloc *Allocator, subnet address.CIDR) int {
+	return listenHTTPPools(Pools{{Allocator: alloc, DefaultSubnet: subnet}})
+}
+
+func listenHTTPPools(pools Pools) int {
 	router := mux.NewRouter()
 	router.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
-		io.WriteString(w, fmt.Sprintln(alloc))
+		io.WriteString(w, fmt.Sprintln(pools[0].Allocator))
 	})
-	alloc.HandleHTTP(router, subnet, nil)
+	pools.HandleHTTP(router, nil)
 
 	httpListener, err := net.Listen("tcp", ":0")
 	if err != nil {
@@ -114,6 +118,119 @@ func TestHttp(t *testing.T) {
 	// See https://groups.google.com/forum/#!topic/golang-nuts/vLHWa5sHnCE
 }
 
+func TestHTTPDualStack(t *testing.T) {
+	var (
+		containerID = "deadbeef"
+		universe4   = "10.0.0.0/8"
+		universe6   = "fd00:a:b::/112"
+		testCIDR6   = "fd00:a:b::100/120"
+	)
+
+	alloc4, cidr4 := makeAllocatorWithMockGossip(t, "08:00:27:01:c3:9a", universe4, 1)
+	defer alloc4.Stop()
+	alloc6, cidr6 := makeAllocatorWithMockGossip(t, "08:00:27:01:c3:9a", universe6, 1)
+	defer alloc6.Stop()
+	port := listenHTTPPools(Pools{{Allocator: alloc4, DefaultSubnet: cidr4}, {Allocator: alloc6, DefaultSubnet: cidr6}})
+	alloc4.claimRingForTesting()
+	alloc6.claimRingForTesting()
+
+	require.Equal(t, "10.0.0.1/8", HTTPPost(t, identURL(port, containerID)), "address")
+	require.Equal(t, "fd00:a:b::1/112", HTTPPost(t, identURL(port, containerID)+"?family=6"), "address")
+	require.Equal(t, "fd00:a:b::101/120", HTTPPost(t, allocURL(port, testCIDR6, containerID)), "address")
+	require.Equal(t, "fd00:a:b::/112", HTTPGet(t, fmt.Sprintf("http://localhost:%d/ipinfo/defaultsubnet?family=6", port)))
+
+	resp, err := doHTTP("DELETE", fmt.Sprintf("http://localhost:%d/ip/%s/fd00:a:b::101", port, containerID))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode, "http response")
+	resp, err = doHTTP("DELETE", identURL(port, containerID))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode, "http response")
+	require.Equal(t, "fd00:a:b::1/112", HTTPPost(t, identURL(port, "baddf00d")+"?family=6"), "address")
+}
+
+func TestHTTPNamedPools(t *testing.T) {
+	var (
+		containerID = "deadbeef"
+		universe    = "10.0.0.0/16"
+		batch       = "10.128.0.0/16"
+	)
+
+	alloc, cidr := makeAllocatorWithMockGossip(t, "08:00:27:01:c3:9a", universe, 1)
+	defer alloc.Stop()
+	batchAlloc, batchCIDR := makeAllocatorWithMockGossip(t, "08:00:27:01:c3:9a", batch, 1)
+	defer batchAlloc.Stop()
+	port := listenHTTPPools(Pools{{Allocator: alloc, DefaultSubnet: cidr}, {Allocator: batchAlloc, DefaultSubnet: batchCIDR, Name: "batch"}})
+	alloc.claimRingForTesting()
+	batchAlloc.claimRingForTesting()
+
+	require.Equal(t, "10.0.0.1/16", HTTPPost(t, identURL(port, containerID)), "address")
+	require.Equal(t, "10.128.0.1/16", HTTPPost(t, identURL(port, containerID)+"?pool=batch"), "address")
+	require.Equal(t, "10.128.0.1/16", HTTPGet(t, identURL(port, containerID)+"?pool=batch"), "address")
+	require.Equal(t, "10.128.1.1/24", HTTPPost(t, allocURL(port, "10.128.1.0/24", containerID)), "address")
+	require.Equal(t, batch, HTTPGet(t, fmt.Sprintf("http://localhost:%d/ipinfo/defaultsubnet?pool=batch", port)))
+
+	resp, err := http.Post(identURL(port, containerID)+"?pool=prod", "", nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode, "http response")
+}
+
+func TestHTTPExpandOverlappingPool(t *testing.T) {
+	alloc, cidr := makeAllocatorWithMockGossip(t, "08:00:27:01:c3:9a", "10.0.0.0/16", 1)
+	defer alloc.Stop()
+	batchAlloc, batchCIDR := makeAllocatorWithMockGossip(t, "08:00:27:01:c3:9a", "10.40.0.0/16", 1)
+	defer batchAlloc.Stop()
+	port := listenHTTPPools(Pools{{Allocator: alloc, DefaultSubnet: cidr}, {Allocator: batchAlloc, DefaultSubnet: batchCIDR, Name: "batch"}})
+	alloc.claimRingForTesting()
+	batchAlloc.claimRingForTesting()
+
+	// Taking in the batch pool's addresses would have both rings
+	// hand them out
+	resp, err := http.Post(fmt.Sprintf("http://localhost:%d/range?range=10.0.0.0/8", port), "", nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode, "http response")
+	require.Equal(t, "10.0.0.0/16", alloc.Universe().String())
+
+	ExpectBroadcastMessage(alloc, nil)
+	resp, err = http.Post(fmt.Sprintf("http://localhost:%d/range?range=10.0.0.0/15", port), "", nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode, "http response")
+	require.Equal(t, "10.0.0.0/15", alloc.Universe().String())
+	CheckAllExpectedMessagesSent(alloc)
+}
+
+func TestHTTPReservations(t *testing.T) {
+	var (
+		universe = "10.0.3.0/29"
+	)
+
+	alloc, cidr := makeAllocatorWithMockGossip(t, "08:00:27:01:c3:9a", universe, 1)
+	defer alloc.Stop()
+	port := listenHTTP(alloc, cidr)
+	alloc.claimRingForTesting()
+
+	ExpectBroadcastMessage(alloc, nil)
+	resp, err := doHTTP("PUT", fmt.Sprintf("http://localhost:%d/reservation/default/web-*?address=10.0.3.1", port))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode, "http response")
+	require.Equal(t, `[{"pattern":"default/web-*","address":"10.0.3.1/29"}]`+"\n",
+		HTTPGet(t, fmt.Sprintf("http://localhost:%d/reservation", port)))
+
+	// The reserved address is not handed out to anyone else...
+	require.Equal(t, "10.0.3.2/29", HTTPPost(t, identURL(port, "deadbeef")), "address")
+	resp, err = doHTTP("PUT", allocURL(port, "10.0.3.1/29", "baddf00d"))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode, "http response")
+	// ...but is given to a matching container
+	require.Equal(t, "10.0.3.1/29", HTTPPost(t, identURL(port, "b01df00d")+"?name=default/web-0"), "address")
+
+	ExpectBroadcastMessage(alloc, nil)
+	resp, err = doHTTP("DELETE", fmt.Sprintf("http://localhost:%d/reservation/default/web-*", port))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode, "http response")
+	require.Equal(t, "[]\n", HTTPGet(t, fmt.Sprintf("http://localhost:%d/reservation", port)))
+	CheckAllExpectedMessagesSent(alloc)
+}
+
 func TestBadHttp(t *testing.T) {
 	var (
 		containerID = "deadbeef"
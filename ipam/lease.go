@@ -0,0 +1,261 @@
+package ipam
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/weaveworks/weave/api"
+	"github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/common/docker"
+	"github.com/weaveworks/weave/net/address"
+)
+
+// A Runtime tells the lease collector which allocations are still in
+// use, so that those left behind when a container went away without
+// telling us can be freed.
+type Runtime interface {
+	// InUse returns the idents of live containers and any addresses
+	// known to be in use, e.g. pod IPs reported by the kubelet.
+	InUse() (idents []string, addrs []net.IP, err error)
+}
+
+// DockerRuntime reports the running Docker containers
+type DockerRuntime struct {
+	*docker.Client
+}
+
+func (d DockerRuntime) InUse() ([]string, []net.IP, error) {
+	ids, err := d.RunningContainerIDs()
+	return ids, nil, err
+}
+
+// KubeletRuntime reports the addresses of the pods on this node, as
+// listed by the kubelet read-only API at URL, e.g.
+// http://127.0.0.1:10255
+type KubeletRuntime struct {
+	URL string
+}
+
+func (k KubeletRuntime) InUse() ([]string, []net.IP, error) {
+	resp, err := http.Get(strings.TrimSuffix(k.URL, "/") + "/pods")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("kubelet pod list: %s", resp.Status)
+	}
+	var podList struct {
+		Items []struct {
+			Status struct {
+				PodIP  string `json:"podIP"`
+				PodIPs []struct {
+					IP string `json:"ip"`
+				} `json:"podIPs"`
+			} `json:"status"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&podList); err != nil {
+		return nil, nil, fmt.Errorf("kubelet pod list: %s", err)
+	}
+	var addrs []net.IP
+	for _, pod := range podList.Items {
+		ips := []string{pod.Status.PodIP}
+		for _, podIP := range pod.Status.PodIPs {
+			ips = append(ips, podIP.IP)
+		}
+		for _, ip := range ips {
+			if parsed := net.ParseIP(ip); parsed != nil {
+				addrs = append(addrs, parsed)
+			}
+		}
+	}
+	return nil, addrs, nil
+}
+
+// The allocations a runtime says are in use
+type inUse struct {
+	idents map[string]struct{}
+	addrs  map[string]struct{} // net.IP.String() of each address
+}
+
+func newInUse(idents []string, addrs []net.IP) inUse {
+	u := inUse{idents: make(map[string]struct{}), addrs: make(map[string]struct{})}
+	for _, ident := range idents {
+		u.idents[ident] = struct{}{}
+	}
+	for _, addr := range addrs {
+		u.addrs[addr.String()] = struct{}{}
+	}
+	return u
+}
+
+func (u inUse) contains(ident string, cidrs []address.CIDR) bool {
+	if _, found := u.idents[ident]; found {
+		return true
+	}
+	for _, cidr := range cidrs {
+		if _, found := u.addrs[cidr.IP().String()]; found {
+			return true
+		}
+	}
+	return false
+}
+
+// Addresses held by weave itself rather than by a container never
+// expire, nor do those allocated without a container ID, e.g. by the
+// Docker IPAM plugin, which are filed under the address itself and
+// freed only when their user says so.
+func leaseExempt(ident string) bool {
+	return ident == api.NoContainerID || strings.HasPrefix(ident, "weave:") || net.ParseIP(ident) != nil
+}
+
+// Lease describes an allocation found stale by the lease collector
+type Lease struct {
+	Ident     string
+	Pool      string `json:",omitempty"`
+	Addresses []string
+	Renewed   time.Time // when the allocation was last known to be in use
+}
+
+// Renew the lease on ident's addresses
+func (alloc *Allocator) renewLease(ident string) {
+	alloc.leases[ident] = alloc.now()
+}
+
+// Renew the leases on allocations in use; free those whose lease has
+// run out, unless dryRun.  Returns the allocations found stale.
+func (alloc *Allocator) expireLeases(u inUse, ttl time.Duration, dryRun bool) []Lease {
+	for ident := range alloc.leases {
+		if _, found := alloc.owned[ident]; !found {
+			delete(alloc.leases, ident)
+		}
+	}
+	var stale []Lease
+	cutoff := alloc.now().Add(-ttl)
+	for ident, d := range alloc.owned {
+		renewed, found := alloc.leases[ident]
+		switch {
+		case leaseExempt(ident):
+			continue
+		case !found || u.contains(ident, d.Cidrs):
+			// No record yet, e.g. just after restart, counts as in use
+			alloc.renewLease(ident)
+			continue
+		case !renewed.Before(cutoff):
+			continue
+		}
+		lease := Lease{Ident: ident, Renewed: renewed}
+		for _, cidr := range d.Cidrs {
+			lease.Addresses = append(lease.Addresses, cidr.String())
+		}
+		stale = append(stale, lease)
+	}
+	sort.Slice(stale, func(i, j int) bool { return stale[i].Ident < stale[j].Ident })
+	if !dryRun {
+		for _, lease := range stale {
+			alloc.infof("Lease on %v for %s expired; freeing", lease.Addresses, lease.Ident)
+			alloc.delete(lease.Ident, "lease expired")
+			delete(alloc.leases, lease.Ident)
+		}
+	}
+	return stale
+}
+
+// ExpireLeases (Sync) - see expireLeases; the idents and addrs are
+// those in use according to the container runtime
+func (alloc *Allocator) ExpireLeases(idents []string, addrs []net.IP, ttl time.Duration, dryRun bool) []Lease {
+	u := newInUse(idents, addrs)
+	resultChan := make(chan []Lease)
+	alloc.actionChan <- func() {
+		resultChan <- alloc.expireLeases(u, ttl, dryRun)
+	}
+	return <-resultChan
+}
+
+// LeaseCollector periodically reconciles the allocations of some
+// pools against a container runtime, freeing those that are neither
+// in use nor renewed within the lease TTL.
+type LeaseCollector struct {
+	pools    Pools
+	runtime  Runtime // may be nil, in which case leases are only renewed by requests
+	ttl      time.Duration
+	stopChan chan struct{}
+}
+
+func NewLeaseCollector(pools Pools, runtime Runtime, ttl time.Duration) *LeaseCollector {
+	return &LeaseCollector{pools: pools, runtime: runtime, ttl: ttl, stopChan: make(chan struct{})}
+}
+
+// Collect runs one reconciliation, returning the stale allocations;
+// with dryRun they are only reported, not freed.
+func (c *LeaseCollector) Collect(dryRun bool) ([]Lease, error) {
+	var idents []string
+	var addrs []net.IP
+	if c.runtime != nil {
+		var err error
+		if idents, addrs, err = c.runtime.InUse(); err != nil {
+			return nil, err
+		}
+	}
+	stale := []Lease{}
+	for _, pool := range c.pools {
+		if pool.Allocator == nil { // an external IPAM keeps its own leases
+			continue
+		}
+		for _, lease := range pool.ExpireLeases(idents, addrs, c.ttl, dryRun) {
+			lease.Pool = pool.Name
+			stale = append(stale, lease)
+		}
+	}
+	return stale, nil
+}
+
+// Start runs Collect every half TTL until Stop is called
+func (c *LeaseCollector) Start() {
+	go func() {
+		ticker := time.NewTicker(c.ttl / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := c.Collect(false); err != nil {
+					common.Log.Warningln("[allocator]: lease collection failed:", err)
+				}
+			case <-c.stopChan:
+				return
+			}
+		}
+	}()
+}
+
+func (c *LeaseCollector) Stop() {
+	close(c.stopChan)
+}
+
+// HandleHTTP wires up the lease collector's HTTP endpoints: GET /gc
+// reports what would be freed, and POST /gc frees it.
+func (c *LeaseCollector) HandleHTTP(router *mux.Router) {
+	handle := func(dryRun bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			stale, err := c.Collect(dryRun)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(stale); err != nil {
+				common.Log.Warningln("[allocator]:", err)
+			}
+		}
+	}
+	router.Methods("GET").Path("/gc").HandlerFunc(handle(true))
+	router.Methods("POST").Path("/gc").HandlerFunc(handle(false))
+}
@@ -0,0 +1,119 @@
+package ipam
+
+import (
+	"fmt"
+
+	"github.com/weaveworks/weave/common/docker"
+	"github.com/weaveworks/weave/net/address"
+)
+
+// Pool is an Allocator together with the subnet it allocates within
+// when a request does not name one.  A pool that takes its addresses
+// from an external IPAM has a Backend instead, and no Allocator, so
+// none of the operations on the ring itself.
+type Pool struct {
+	*Allocator
+	DefaultSubnet address.CIDR
+	Name          string  // empty for the pools given by --ipalloc-range
+	Backend       Backend // if set, addresses come from here rather than the Allocator
+}
+
+func (pool Pool) backend() Backend {
+	if pool.Backend != nil {
+		return pool.Backend
+	}
+	return pool.Allocator
+}
+
+// ContainerObserver is what hears of the pool's containers coming and
+// going, to free their addresses
+func (pool Pool) ContainerObserver() docker.ContainerObserver {
+	return pool.backend()
+}
+
+// PruneOwned frees the addresses of containers not in ids
+func (pool Pool) PruneOwned(ids []string) {
+	pool.backend().PruneOwned(ids)
+}
+
+// Universe returns the range of addresses the pool allocates from
+func (pool Pool) Universe() address.CIDR {
+	return pool.backend().Universe()
+}
+
+// Status returns the status of the pool's allocator, labelled with
+// the pool name.
+func (pool Pool) Status() *Status {
+	status := NewStatus(pool.Allocator, pool.Subnet())
+	if status != nil {
+		status.Pool = pool.Name
+	}
+	return status
+}
+
+// Subnet returns the subnet to allocate within when a request does not
+// name one: DefaultSubnet, unless that was the whole of a range which
+// has since been expanded, in which case the expanded range.
+func (pool Pool) Subnet() address.CIDR {
+	if pool.Allocator != nil && pool.DefaultSubnet == pool.configUniverse {
+		return pool.Universe()
+	}
+	return pool.DefaultSubnet
+}
+
+// Pools are the allocators run by one peer: at most one unnamed pool
+// per address family, plus any number of named pools.  The first is
+// used for requests naming neither a subnet, a pool nor an address
+// family.
+type Pools []Pool
+
+// ForFamily returns the unnamed pool allocating IPv6 addresses if
+// ipv6 is true, otherwise the one allocating IPv4 addresses.
+func (pools Pools) ForFamily(ipv6 bool) (Pool, bool) {
+	for _, pool := range pools {
+		if pool.Name == "" && pool.Universe().IsIPv6() == ipv6 {
+			return pool, true
+		}
+	}
+	return Pool{}, false
+}
+
+// ForName returns the pool with the given name.
+func (pools Pools) ForName(name string) (Pool, bool) {
+	for _, pool := range pools {
+		if pool.Name == name {
+			return pool, true
+		}
+	}
+	return Pool{}, false
+}
+
+// ForCIDR returns the pool responsible for addresses in cidr: the one
+// whose universe overlaps it or, failing that, the unnamed one for
+// its family.
+func (pools Pools) ForCIDR(cidr address.CIDR) (Pool, bool) {
+	for _, pool := range pools {
+		if universe := pool.Universe(); universe.Upper == cidr.Upper && universe.Range().Overlaps(cidr.Range()) {
+			return pool, true
+		}
+	}
+	return pools.ForFamily(cidr.IsIPv6())
+}
+
+// Expand grows the range pool allocates from to cidr, which must not
+// overlap the range of any other pool: their rings are independent,
+// so they would hand out the same addresses.
+func (pools Pools) Expand(pool Pool, cidr address.CIDR) error {
+	for _, other := range pools {
+		if other.Name == pool.Name && other.Universe().IsIPv6() == pool.Universe().IsIPv6() {
+			continue
+		}
+		if universe := other.Universe(); universe.Upper == cidr.Upper && universe.Range().Overlaps(cidr.Range()) {
+			if other.Name == "" {
+				return fmt.Errorf("%s overlaps with the allocation range %s", cidr, universe)
+			}
+			return fmt.Errorf("%s overlaps with pool %s (%s)", cidr, other.Name, universe)
+		}
+	}
+	return pool.Expand(cidr)
+}
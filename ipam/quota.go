@@ -0,0 +1,99 @@
+package ipam
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/weaveworks/mesh"
+
+	"github.com/weaveworks/weave/net/address"
+)
+
+// Quota bounds the address space owned by a peer.
+type Quota struct {
+	MinReserved address.Count // the peer never donates space below this
+	MaxOwned    address.Count // the peer is never given space above this; zero means no limit
+}
+
+// Quotas are indexed by peer name or nickname; the entry for
+// AnyPeer, if present, applies to peers not otherwise listed.
+type Quotas map[string]Quota
+
+// AnyPeer is the Quotas key for peers without a quota of their own
+const AnyPeer = "*"
+
+// ParseQuota parses a quota written as peer=min:max, where either
+// count may be left empty, e.g. "host1=256:" or "*=:4096".
+func ParseQuota(s string) (string, Quota, error) {
+	var quota Quota
+	peerAndLimits := strings.SplitN(s, "=", 2)
+	if len(peerAndLimits) != 2 || peerAndLimits[0] == "" {
+		return "", quota, fmt.Errorf("invalid quota %q: must be peer=min:max", s)
+	}
+	limits := strings.SplitN(peerAndLimits[1], ":", 2)
+	if len(limits) != 2 {
+		return "", quota, fmt.Errorf("invalid quota %q: must be peer=min:max", s)
+	}
+	for i, dest := range []*address.Count{&quota.MinReserved, &quota.MaxOwned} {
+		if limits[i] == "" {
+			continue
+		}
+		n, err := strconv.ParseUint(limits[i], 10, 32)
+		if err != nil {
+			return "", quota, fmt.Errorf("invalid quota %q: %s", s, err)
+		}
+		*dest = address.Count(n)
+	}
+	if quota.MaxOwned != 0 && quota.MaxOwned < quota.MinReserved {
+		return "", quota, fmt.Errorf("invalid quota %q: maximum is less than minimum", s)
+	}
+	return peerAndLimits[0], quota, nil
+}
+
+func (quotas Quotas) lookup(peer mesh.PeerName, nickname string) (Quota, bool) {
+	if quota, found := quotas[peer.String()]; found {
+		return quota, true
+	}
+	if quota, found := quotas[nickname]; found && nickname != "" {
+		return quota, true
+	}
+	quota, found := quotas[AnyPeer]
+	return quota, found
+}
+
+func (alloc *Allocator) quotaFor(peer mesh.PeerName) Quota {
+	quota, _ := alloc.quotas.lookup(peer, alloc.nicknames[peer])
+	return quota
+}
+
+// How many addresses we may give to peer without breaking its quota
+// or ours
+func (alloc *Allocator) donationLimit(to mesh.PeerName) address.Count {
+	ours, owned := alloc.quotaFor(alloc.ourName), alloc.ring.NumOwnedBy(alloc.ourName)
+	if owned <= ours.MinReserved {
+		return 0
+	}
+	limit := owned - ours.MinReserved
+	if theirs := alloc.quotaFor(to); theirs.MaxOwned != 0 {
+		theirOwned := alloc.ring.NumOwnedBy(to)
+		if theirOwned >= theirs.MaxOwned {
+			return 0
+		}
+		if theirs.MaxOwned-theirOwned < limit {
+			limit = theirs.MaxOwned - theirOwned
+		}
+	}
+	return limit
+}
+
+// Is peer worth asking for space, as far as quotas go?
+func (alloc *Allocator) canDonate(peer mesh.PeerName) bool {
+	return alloc.ring.NumOwnedBy(peer) > alloc.quotaFor(peer).MinReserved
+}
+
+// Are we allowed to ask for more space?
+func (alloc *Allocator) belowMaxOwned() bool {
+	max := alloc.quotaFor(alloc.ourName).MaxOwned
+	return max == 0 || alloc.ring.NumOwnedBy(alloc.ourName) < max
+}
@@ -0,0 +1,24 @@
+package ipam
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseQuota(t *testing.T) {
+	peer, quota, err := ParseQuota("host1=256:4096")
+	require.NoError(t, err)
+	require.Equal(t, "host1", peer)
+	require.Equal(t, Quota{MinReserved: 256, MaxOwned: 4096}, quota)
+
+	peer, quota, err = ParseQuota("*=:1024")
+	require.NoError(t, err)
+	require.Equal(t, AnyPeer, peer)
+	require.Equal(t, Quota{MaxOwned: 1024}, quota)
+
+	for _, bad := range []string{"host1", "=1:2", "host1=12", "host1=a:", "host1=10:5"} {
+		_, _, err = ParseQuota(bad)
+		require.Error(t, err, bad)
+	}
+}
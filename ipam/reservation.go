@@ -0,0 +1,238 @@
+package ipam
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/weaveworks/weave/net/address"
+)
+
+const (
+	reservationsIdent = "reservations"
+
+	// Tombstones of deleted reservations need only last long enough
+	// to reach every peer.  As for weaveDNS entries, this allows for
+	// 15 minutes of clock skew.
+	reservationTombstoneTimeout = 30 * time.Minute
+)
+
+// Reservation ties an address to the containers whose name matches
+// Pattern: a container name, or namespace/pod for Kubernetes, in
+// which '*' matches any run of characters other than '/'.
+// This type is persisted and gossiped, hence all fields exported.
+type Reservation struct {
+	Pattern   string
+	CIDR      address.CIDR
+	Version   uint32
+	Tombstone int64 // time of deletion, or 0 if live
+}
+
+func (r Reservation) matches(name string) bool {
+	if name == "" {
+		return false
+	}
+	matched, err := path.Match(r.Pattern, name)
+	return err == nil && matched
+}
+
+// Does r win over other, when merging reservations for the same pattern?
+func (r Reservation) supersedes(other Reservation) bool {
+	switch {
+	case r.Version != other.Version:
+		return r.Version > other.Version
+	case r.Tombstone != other.Tombstone:
+		return r.Tombstone > other.Tombstone
+	default: // concurrent changes; any consistent choice will do
+		return r.CIDR.String() > other.CIDR.String()
+	}
+}
+
+type reservations map[string]Reservation
+
+func (rs reservations) merge(other reservations) (updated bool) {
+	for pattern, theirs := range other {
+		if ours, found := rs[pattern]; !found || theirs.supersedes(ours) {
+			rs[pattern] = theirs
+			updated = true
+		}
+	}
+	return
+}
+
+func (rs reservations) live() []Reservation {
+	var result []Reservation
+	for _, r := range rs {
+		if r.Tombstone == 0 {
+			result = append(result, r)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Pattern < result[j].Pattern })
+	return result
+}
+
+// The reservation for name, preferring an exact match to a wildcard one
+func (rs reservations) forName(name string) (Reservation, bool) {
+	if r, found := rs[name]; found && r.Tombstone == 0 {
+		return r, true
+	}
+	for _, r := range rs.live() {
+		if r.matches(name) {
+			return r, true
+		}
+	}
+	return Reservation{}, false
+}
+
+func (rs reservations) forAddr(upper address.Upper96, addr address.Address) (Reservation, bool) {
+	for _, r := range rs {
+		if r.Tombstone == 0 && r.CIDR.Upper == upper && r.CIDR.Addr == addr {
+			return r, true
+		}
+	}
+	return Reservation{}, false
+}
+
+// Claim, in our space, free addresses that are reserved, so we never
+// hand them out to anyone else; release those no longer reserved.
+func (alloc *Allocator) holdReservedAddresses() {
+	for addr := range alloc.held {
+		if _, found := alloc.reservations.forAddr(alloc.universe.Upper, addr); !found {
+			alloc.releaseHold(addr)
+		}
+	}
+	for _, r := range alloc.reservations {
+		if r.Tombstone == 0 && r.CIDR.Upper == alloc.universe.Upper && alloc.held[r.CIDR.Addr] == "" &&
+			alloc.space.Claim(r.CIDR.Addr) == nil {
+			alloc.debugln("Holding", r.CIDR, "reserved for", r.Pattern)
+			alloc.held[r.CIDR.Addr] = r.Pattern
+		}
+	}
+}
+
+func (alloc *Allocator) releaseHold(addr address.Address) {
+	if _, found := alloc.held[addr]; found {
+		// Fails harmlessly if the address has since moved to another peer
+		alloc.space.Free(addr)
+		delete(alloc.held, addr)
+	}
+}
+
+func (alloc *Allocator) reservationsUpdated() {
+	alloc.holdReservedAddresses()
+	if err := alloc.db.Save(alloc.persistenceIdent(reservationsIdent), alloc.reservations); err != nil {
+		alloc.fatalf("Error persisting reservations: %s", err)
+	}
+}
+
+// Forget reservations deleted longer ago than the tombstone timeout
+func (alloc *Allocator) deleteReservationTombstones() {
+	now := alloc.now().Unix()
+	deleted := false
+	for pattern, r := range alloc.reservations {
+		if r.Tombstone != 0 && now-r.Tombstone > int64(reservationTombstoneTimeout/time.Second) {
+			delete(alloc.reservations, pattern)
+			deleted = true
+		}
+	}
+	if deleted {
+		alloc.reservationsUpdated()
+	}
+}
+
+func (alloc *Allocator) loadReservations() {
+	if _, err := alloc.db.Load(alloc.persistenceIdent(reservationsIdent), &alloc.reservations); err != nil {
+		alloc.errorf("Error loading persisted reservations: %s", err)
+	}
+	if alloc.reservations == nil {
+		alloc.reservations = make(reservations)
+	}
+}
+
+// Actor client API
+
+// Reservations (Sync) - the live reservations, ordered by pattern
+func (alloc *Allocator) Reservations() []Reservation {
+	resultChan := make(chan []Reservation)
+	alloc.actionChan <- func() {
+		resultChan <- alloc.reservations.live()
+	}
+	return <-resultChan
+}
+
+// Reserve (Sync) - reserve cidr.Addr for containers matching pattern,
+// replacing any previous reservation for that pattern
+func (alloc *Allocator) Reserve(pattern string, cidr address.CIDR) error {
+	if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+		return fmt.Errorf("invalid reservation pattern %q", pattern)
+	}
+	resultChan := make(chan error)
+	alloc.actionChan <- func() {
+		if cidr.Upper != alloc.universe.Upper || !alloc.universe.Range().Contains(cidr.Addr) {
+			resultChan <- fmt.Errorf("address %s is outside the allocation range %s", cidr, alloc.universe)
+			return
+		}
+		if other, found := alloc.reservations.forAddr(cidr.Upper, cidr.Addr); found && other.Pattern != pattern {
+			resultChan <- fmt.Errorf("address %s is already reserved for %s", cidr, other.Pattern)
+			return
+		}
+		alloc.reservations[pattern] = Reservation{
+			Pattern: pattern,
+			CIDR:    cidr,
+			Version: alloc.reservations[pattern].Version + 1,
+		}
+		alloc.reservationsUpdated()
+		alloc.gossip.GossipBroadcast(alloc.Gossip())
+		resultChan <- nil
+	}
+	return <-resultChan
+}
+
+// Unreserve (Sync) - delete the reservation for pattern
+func (alloc *Allocator) Unreserve(pattern string) error {
+	resultChan := make(chan error)
+	alloc.actionChan <- func() {
+		r, found := alloc.reservations[pattern]
+		if !found || r.Tombstone != 0 {
+			resultChan <- fmt.Errorf("no reservation for %s", pattern)
+			return
+		}
+		r.Version++
+		r.Tombstone = alloc.now().Unix()
+		alloc.reservations[pattern] = r
+		alloc.reservationsUpdated()
+		alloc.gossip.GossipBroadcast(alloc.Gossip())
+		resultChan <- nil
+	}
+	return <-resultChan
+}
+
+// AllocateReserved (Sync) - if an address within subnet is reserved
+// for name, claim it for ident.  found is false if there is no such
+// reservation, in which case the caller should allocate as usual.
+func (alloc *Allocator) AllocateReserved(ident, name string, subnet address.CIDR, isContainer bool, hasBeenCancelled func() bool) (cidr address.CIDR, found bool, err error) {
+	resultChan := make(chan Reservation)
+	alloc.actionChan <- func() {
+		r, found := alloc.reservations.forName(name)
+		if found && (r.CIDR.Upper != subnet.Upper || !subnet.Range().Contains(r.CIDR.Addr)) {
+			r = Reservation{}
+		}
+		resultChan <- r
+	}
+	r := <-resultChan
+	if r.Pattern == "" {
+		return address.CIDR{}, false, nil
+	}
+	errChan := make(chan error)
+	op := &claim{
+		resultChan:       errChan,
+		ident:            ident,
+		name:             name,
+		cidr:             r.CIDR,
+		isContainer:      isContainer,
+		hasBeenCancelled: hasBeenCancelled,
+	}
+	alloc.doOperation(op, &alloc.pendingClaims)
+	return r.CIDR, true, <-errChan
+}
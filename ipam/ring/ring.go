@@ -10,7 +10,6 @@ import (
 	"io"
 	"math/rand"
 	"sort"
-	"time"
 
 	"github.com/weaveworks/mesh"
 
@@ -26,6 +25,7 @@ type Ring struct {
 	Peer       mesh.PeerName   // name of peer owning this ring instance
 	Entries    entries         // list of entries sorted by token
 	Seeds      []mesh.PeerName // peers with which the ring was seeded
+	Upper      address.Upper96 // upper bits of all addresses in an IPv6 ring; zero for IPv4
 	onUpdate   OnUpdate
 }
 
@@ -117,6 +117,40 @@ func New(start, end address.Address, peer mesh.PeerName, f OnUpdate) *Ring {
 	return ring
 }
 
+// Entry is a token in the ring, in the form exported for backups
+type Entry struct {
+	Token   address.Address
+	Peer    mesh.PeerName
+	Version uint32
+	Free    address.Count
+}
+
+// Export returns the entries of the ring, sorted by token
+func (r *Ring) Export() []Entry {
+	result := make([]Entry, len(r.Entries))
+	for i, e := range r.Entries {
+		result[i] = Entry{Token: e.Token, Peer: e.Peer, Version: e.Version, Free: e.Free}
+	}
+	return result
+}
+
+// Import creates a ring belonging to peer from exported entries,
+// checking that they make a valid ring.
+func Import(start, end address.Address, upper address.Upper96, peer mesh.PeerName, seeds []mesh.PeerName, entries []Entry) (*Ring, error) {
+	if start >= end {
+		return nil, fmt.Errorf("Invalid ring range %s-%s", start, end)
+	}
+	r := New(start, end, peer, nil)
+	r.Upper, r.Seeds = upper, seeds
+	for _, e := range entries {
+		r.Entries = append(r.Entries, &entry{Token: e.Token, Peer: e.Peer, Version: e.Version, Free: e.Free})
+	}
+	if err := r.checkInvariants(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
 func (r *Ring) Restore(other *Ring) {
 	defer r.trackUpdates()()
 
@@ -125,10 +159,33 @@ func (r *Ring) Restore(other *Ring) {
 	r.onUpdate = onUpdate
 }
 
+// Expand grows the ring to [start, end), which must enclose its
+// current range.  No tokens are added, so the new addresses go to the
+// owner of the range which wraps around the end of the ring; every
+// peer that expands its copy of the ring in the same way therefore
+// arrives at the same result, and peers whose rings differ only in
+// how far they have been expanded can still merge them.
+func (r *Ring) Expand(start, end address.Address) {
+	common.Assert(start <= r.Start && r.End <= end)
+
+	defer r.trackUpdates()()
+	r.Start, r.End = start, end
+}
+
+// Encloses is true if r's range contains the whole of other's
+func (r *Ring) Encloses(other *Ring) bool {
+	return r.Upper == other.Upper && r.Start <= other.Start && other.End <= r.End
+}
+
 func (r *Ring) Range() address.Range {
 	return address.Range{Start: r.Start, End: r.End}
 }
 
+// RangeString returns the range of this ring, in CIDR notation if possible
+func (r *Ring) RangeString() string {
+	return r.Upper.RangeString(r.Range())
+}
+
 // Returns the distance between two tokens on this ring, dealing
 // with ranges which cross the origin
 func (r *Ring) distance(start, end address.Address) address.Count {
@@ -234,11 +291,23 @@ func (r *Ring) Merge(gossip Ring, hasAllocations func(r []address.Range) bool) (
 		}
 	}
 
-	if r.Start != gossip.Start || r.End != gossip.End {
+	// Rings grow but never shrink, so a ring with a larger range is
+	// a later version of the same ring; we take the larger.  An empty
+	// ring, though, has never agreed on a range with anyone, so it
+	// must match exactly.  The merge is done against a copy of the
+	// ring carrying the merged range, so nothing changes on error.
+	merged := *r
+	switch {
+	case r.Range() == gossip.Range() && r.Upper == gossip.Upper:
+	case gossip.Encloses(r):
+		merged.Start, merged.End = gossip.Start, gossip.End
+	case r.Encloses(&gossip) && !r.Empty():
+	default:
 		return false, ErrDifferentRange
 	}
+	expanded := merged.Range() != r.Range()
 
-	result, updated, err := r.Entries.merge(gossip.Entries, r.Peer, r, hasAllocations)
+	result, updated, err := r.Entries.merge(gossip.Entries, r.Peer, &merged, hasAllocations)
 
 	if err != nil {
 		return false, err
@@ -247,23 +316,24 @@ func (r *Ring) Merge(gossip Ring, hasAllocations func(r []address.Range) bool) (
 	// reset the free space for entries if there is invalid free space
 	// due to accepting an unexpected update from the peers
 	for i := 0; i < len(result); i++ {
-		distance := r.distance(result.entry(i).Token, result.entry(i+1).Token)
+		distance := merged.distance(result.entry(i).Token, result.entry(i+1).Token)
 		if result.entry(i).Peer == r.Peer && result.entry(i).Free > distance {
 			// case that can arise when a range that we own that got split and had no allocations
 			result.entry(i).Free = distance
 		}
 	}
 
-	if err := r.checkEntries(result); err != nil {
+	if err := merged.checkEntries(result); err != nil {
 		return false, fmt.Errorf("Merge of incoming data causes: %s", err)
 	}
 
 	if len(r.Seeds) == 0 {
 		r.Seeds = gossip.Seeds
 	}
+	r.Start, r.End = merged.Start, merged.End
 	r.Entries = result
 
-	return updated, nil
+	return updated || expanded, nil
 }
 
 // Merge other entries into ours, and complain when that stomps on
@@ -421,6 +491,17 @@ func (r *Ring) OwnedRangesOfPeer(peer mesh.PeerName) (result []address.Range) {
 	return r.splitRangesOverZero(result)
 }
 
+// NumOwnedBy returns the number of addresses in the ranges owned by peer.
+func (r *Ring) NumOwnedBy(peer mesh.PeerName) address.Count {
+	var total address.Count
+	for i, entry := range r.Entries {
+		if entry.Peer == peer {
+			total += r.distance(entry.Token, r.Entries.entry(i+1).Token)
+		}
+	}
+	return total
+}
+
 // For printing status
 type RangeInfo struct {
 	Peer mesh.PeerName
@@ -476,14 +557,14 @@ func (r *Ring) FprintWithNicknames(w io.Writer, m map[mesh.PeerName]string) {
 			nickname = fmt.Sprintf(" (%s)", nickname)
 		}
 
-		fmt.Fprintf(w, "\n  %s -> %s%s (v%d)", entry.Token,
+		fmt.Fprintf(w, "\n  %s -> %s%s (v%d)", r.Upper.IP(entry.Token),
 			entry.Peer, nickname, entry.Version)
 	}
 }
 
 func (r *Ring) String() string {
 	var buffer bytes.Buffer
-	fmt.Fprintf(&buffer, "Ring [%s, %s)", r.Start, r.End)
+	fmt.Fprintf(&buffer, "Ring [%s, %s)", r.Upper.IP(r.Start), r.Upper.IP(r.End))
 	r.FprintWithNicknames(&buffer, make(map[mesh.PeerName]string))
 	return buffer.String()
 }
@@ -546,8 +627,10 @@ func (ws weightedPeers) Len() int           { return len(ws) }
 func (ws weightedPeers) Swap(i, j int)      { ws[i], ws[j] = ws[j], ws[i] }
 
 // ChoosePeersToAskForSpace returns all peers we can ask for space in
-// the range [start, end), in weighted-random order.  Assumes start<end.
-func (r *Ring) ChoosePeersToAskForSpace(start, end address.Address) []mesh.PeerName {
+// the range [start, end), in weighted-random order, drawing on rnd.
+// Assumes start<end.  Peers for which isEligible returns false are
+// left out; isEligible may be nil.
+func (r *Ring) ChoosePeersToAskForSpace(start, end address.Address, isEligible func(mesh.PeerName) bool, rnd *rand.Rand) []mesh.PeerName {
 	totalSpacePerPeer := make(map[mesh.PeerName]address.Count)
 
 	// iterate through tokens
@@ -569,15 +652,26 @@ func (r *Ring) ChoosePeersToAskForSpace(start, end address.Address) []mesh.PeerN
 			continue
 		}
 
+		if isEligible != nil && !isEligible(entry.Peer) {
+			continue
+		}
+
 		totalSpacePerPeer[entry.Peer] += entry.Free
 	}
 
 	// Compute weighted random numbers, then sort.
 	// This isn't perfect, e.g. an item with weight 2 will get chosen more than
 	// twice as often as an item with weight 1, but it's good enough for our purposes.
+	// Go through the peers in a fixed order, so the result only depends
+	// on the random number source.
+	peers := make([]mesh.PeerName, 0, len(totalSpacePerPeer))
+	for peername := range totalSpacePerPeer {
+		peers = append(peers, peername)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i] < peers[j] })
 	ws := make(weightedPeers, 0, len(totalSpacePerPeer))
-	for peername, space := range totalSpacePerPeer {
-		ws = append(ws, weightedPeer{weight: float64(space) * rand.Float64(), peername: peername})
+	for _, peername := range peers {
+		ws = append(ws, weightedPeer{weight: float64(totalSpacePerPeer[peername]) * rnd.Float64(), peername: peername})
 	}
 	sort.Sort(ws)
 	result := make([]mesh.PeerName, len(ws))
@@ -654,7 +748,3 @@ func (r *Ring) PeerNames() map[mesh.PeerName]struct{} {
 
 	return res
 }
-
-func init() {
-	rand.Seed(time.Now().UTC().UnixNano())
-}
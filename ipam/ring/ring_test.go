@@ -306,6 +306,12 @@ func TestMergeErrors(t *testing.T) {
 	ring2.Entries = []*entry{}
 	require.True(t, merge(ring1, ring2) == ErrDifferentRange, "Expected ErrDifferentRange")
 
+	// Should not Merge two rings for the same range in different IPv6 /96s
+	ring2 = NewRing(start, end, peer2name)
+	ring2.Upper = address.Upper96{0xfd}
+	require.True(t, merge(ring1, ring2) == ErrDifferentRange, "Expected ErrDifferentRange")
+	ring2 = NewRing(start, middle, peer2name)
+
 	// Cannot Merge two entries with same version but different hosts
 	ring1.Entries = []*entry{{Token: start, Peer: peer1name}}
 	ring2.Entries = []*entry{{Token: start, Peer: peer2name}}
@@ -438,7 +444,7 @@ func TestGossip(t *testing.T) {
 }
 
 func assertPeersWithSpace(t *testing.T, ring *Ring, start, end address.Address, expected int) []mesh.PeerName {
-	peers := ring.ChoosePeersToAskForSpace(start, end)
+	peers := ring.ChoosePeersToAskForSpace(start, end, nil, rand.New(rand.NewSource(1)))
 	require.Equal(t, expected, len(peers))
 	return peers
 }
@@ -477,6 +483,20 @@ func TestFindFree(t *testing.T) {
 
 	assertPeersWithSpace(t, ring1, start, end, 2)
 	ring1.assertInvariants()
+
+	// Ineligible peers are left out
+	peers = ring1.ChoosePeersToAskForSpace(start, end, func(peer mesh.PeerName) bool { return peer != peer2name }, rand.New(rand.NewSource(1)))
+	require.Equal(t, []mesh.PeerName{peer3name}, peers)
+
+	// The order only depends on the random source
+	choose := func(seed int64) []mesh.PeerName {
+		return ring1.ChoosePeersToAskForSpace(start, end, nil, rand.New(rand.NewSource(seed)))
+	}
+	for seed := int64(0); seed < 10; seed++ {
+		require.Equal(t, choose(seed), choose(seed))
+	}
+	require.Equal(t, address.Count(middle-start), ring1.NumOwnedBy(peer2name))
+	require.Equal(t, address.Count(0), ring1.NumOwnedBy(peer1name))
 }
 
 func TestReportFree(t *testing.T) {
@@ -556,6 +576,38 @@ func TestOwnedRange(t *testing.T) {
 
 }
 
+func TestExpand(t *testing.T) {
+	bigStart, bigEnd := ParseIP("9.255.255.0"), ParseIP("10.0.2.0")
+
+	ring1 := NewRing(start, end, peer1name)
+	ring1.ClaimItAll()
+	ring1.GrantRangeToHost(middle, end, peer2name)
+	ring2 := NewRing(start, end, peer2name)
+	require.NoError(t, merge(ring2, ring1))
+
+	// The new space goes to the owner of the range wrapping around the end
+	ring1.Expand(bigStart, bigEnd)
+	require.NoError(t, ring1.checkInvariants())
+	require.Equal(t, []address.Range{{Start: start, End: middle}}, ring1.OwnedRanges())
+	require.Equal(t, []address.Range{{Start: bigStart, End: start}, {Start: middle, End: bigEnd}}, ring1.OwnedRangesOfPeer(peer2name))
+
+	// An unexpanded ring is expanded when merging an expanded one...
+	ring3 := NewRing(start, end, peer2name)
+	require.NoError(t, merge(ring3, ring2))
+	require.NoError(t, merge(ring2, ring1))
+	require.Equal(t, ring1.Range(), ring2.Range())
+	require.Equal(t, ring1.OwnedRangesOfPeer(peer2name), ring2.OwnedRanges())
+
+	// ...and an expanded ring can take updates from an unexpanded one
+	ring3.GrantRangeToHost(middle, dot245, peer3name)
+	require.NoError(t, merge(ring1, ring3))
+	require.Equal(t, ring2.Range(), ring1.Range())
+	require.Equal(t, []address.Range{{Start: middle, End: dot245}}, ring1.OwnedRangesOfPeer(peer3name))
+
+	// But an empty ring only merges its own range
+	require.True(t, merge(NewRing(bigStart, bigEnd, peer3name), ring3) == ErrDifferentRange, "Expected ErrDifferentRange")
+}
+
 func TestTransfer(t *testing.T) {
 	// First test just checks if we can grant some range to a host, when we transfer it, we get it back
 	ring1 := NewRing(start, end, peer1name)
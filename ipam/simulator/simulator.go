@@ -0,0 +1,585 @@
+/*
+Package simulator runs a number of IPAM allocators in one process over
+a virtual network, for testing.  Message delivery, partitions, the
+clock and the allocators' periodic retries are all driven by the
+caller one step at a time, and every choice the simulator makes comes
+from a seeded random source, so a scenario involving consensus and
+ring merging under partitions, restarts and peer removals plays out
+the same way every time it is run.
+
+After every step the simulator checks that no address is allocated
+twice; Settle checks that the peers' rings eventually converge.
+*/
+package simulator
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/weaveworks/mesh"
+
+	"github.com/weaveworks/weave/ipam"
+	"github.com/weaveworks/weave/net/address"
+)
+
+type Config struct {
+	Peers     int
+	Universe  string  // allocation range, e.g. "10.0.0.0/22"
+	Seed      int64   // for all random choices, including those of the allocators
+	MaxDelay  int     // messages take between 1 and MaxDelay+1 steps to arrive
+	Loss      float64 // proportion of messages dropped
+	TickEvery int     // steps between the peers' periodic retries and gossip; default 10
+	MaxSteps  int     // how long Allocate and Settle wait before giving up; default 1000
+}
+
+// Virtual time that passes with each step
+const stepDuration = time.Second
+
+type messageKind int
+
+const (
+	unicast messageKind = iota
+	broadcast
+	gossip
+)
+
+type message struct {
+	due             int // step at which to deliver
+	seq             int // keeps the delivery order stable
+	kind            messageKind
+	from, to        int
+	fromIncarnation int
+	toIncarnation   int
+	buf             []byte          // for unicast
+	data            mesh.GossipData // for broadcast and gossip, encoded on delivery
+}
+
+type peer struct {
+	index       int
+	name        mesh.PeerName
+	uid         mesh.PeerUID
+	db          *memDB
+	alloc       *ipam.Allocator
+	client      *client
+	incarnation int  // bumped on each restart
+	group       int  // peers only talk to others in the same group
+	removed     bool // stopped for good
+}
+
+type Simulator struct {
+	sync.Mutex // protects everything touched by the allocators
+	config     Config
+	universe   address.CIDR
+	rand       *rand.Rand
+	step       int
+	now        time.Time
+	seq        int
+	inFlight   []*message
+	peers      []*peer
+}
+
+// New creates a simulator, with its peers started but not yet in
+// touch with each other.
+func New(config Config) (*Simulator, error) {
+	universe, err := ipam.ParseCIDRSubnet(config.Universe)
+	if err != nil {
+		return nil, err
+	}
+	if config.Peers < 1 {
+		return nil, fmt.Errorf("need at least one peer")
+	}
+	if config.TickEvery <= 0 {
+		config.TickEvery = 10
+	}
+	if config.MaxSteps <= 0 {
+		config.MaxSteps = 1000
+	}
+	sim := &Simulator{
+		config:   config,
+		universe: universe,
+		rand:     rand.New(rand.NewSource(config.Seed)),
+		now:      time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	for i := 0; i < config.Peers; i++ {
+		name, err := mesh.PeerNameFromString(fmt.Sprintf("%02x:00:00:00:00:%02x", i/256, i%256+1))
+		if err != nil {
+			return nil, err
+		}
+		p := &peer{index: i, name: name, uid: mesh.PeerUID(i + 1), db: newMemDB()}
+		sim.peers = append(sim.peers, p)
+		sim.start(p)
+	}
+	return sim, nil
+}
+
+func (sim *Simulator) start(p *peer) {
+	sim.Lock()
+	p.incarnation++
+	// Each incarnation has its own random source, seeded from ours
+	rnd := rand.New(rand.NewSource(sim.rand.Int63()))
+	sim.Unlock()
+	p.alloc = ipam.NewAllocator(ipam.Config{
+		OurName:     p.name,
+		OurUID:      p.uid,
+		OurNickname: fmt.Sprintf("peer%d", p.index),
+		Universe:    sim.universe,
+		Quorum:      func() uint { return uint(sim.config.Peers/2 + 1) },
+		Db:          p.db,
+		IsKnownPeer: sim.isKnownPeer,
+		Now:         sim.clock,
+		Rand:        rnd,
+		NoTicker:    true,
+	})
+	p.client = &client{sim: sim, peer: p, incarnation: p.incarnation}
+	p.alloc.SetInterfaces(p.client)
+	p.alloc.Start()
+}
+
+// Stop stops all the allocators
+func (sim *Simulator) Stop() {
+	for _, p := range sim.live() {
+		p.alloc.Stop()
+	}
+}
+
+func (sim *Simulator) clock() time.Time {
+	sim.Lock()
+	defer sim.Unlock()
+	return sim.now
+}
+
+func (sim *Simulator) isKnownPeer(name mesh.PeerName) bool {
+	sim.Lock()
+	defer sim.Unlock()
+	for _, p := range sim.peers {
+		if p.name == name {
+			return !p.removed
+		}
+	}
+	return false
+}
+
+func (sim *Simulator) live() []*peer {
+	var result []*peer
+	for _, p := range sim.peers {
+		if !p.removed {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// Name returns the peer name of peer i
+func (sim *Simulator) Name(i int) mesh.PeerName {
+	return sim.peers[i].name
+}
+
+// Allocator returns the allocator of peer i, e.g. to make requests the
+// simulator has no shorthand for.  It changes when the peer restarts.
+func (sim *Simulator) Allocator(i int) *ipam.Allocator {
+	return sim.peers[i].alloc
+}
+
+// Steps returns the number of steps taken so far
+func (sim *Simulator) Steps() int {
+	return sim.step
+}
+
+// Network
+
+// client is the mesh.Gossip of one incarnation of a peer
+type client struct {
+	sim         *Simulator
+	peer        *peer
+	incarnation int
+}
+
+func (c *client) GossipUnicast(dst mesh.PeerName, buf []byte) error {
+	c.sim.Lock()
+	defer c.sim.Unlock()
+	for _, p := range c.sim.peers {
+		if p.name == dst {
+			c.sim.send(c, p, &message{kind: unicast, buf: append([]byte(nil), buf...)})
+		}
+	}
+	return nil
+}
+
+func (c *client) GossipBroadcast(update mesh.GossipData) {
+	c.sim.sendAll(c, broadcast, update)
+}
+
+func (c *client) GossipNeighbourSubset(update mesh.GossipData) {
+	c.sim.sendAll(c, gossip, update)
+}
+
+func (sim *Simulator) sendAll(c *client, kind messageKind, update mesh.GossipData) {
+	sim.Lock()
+	defer sim.Unlock()
+	for _, p := range sim.peers {
+		if p != c.peer {
+			sim.send(c, p, &message{kind: kind, data: update})
+		}
+	}
+}
+
+// Queue m from c to p, unless it is lost; called with the lock held
+func (sim *Simulator) send(c *client, p *peer, m *message) {
+	if p.removed || c.peer.group != p.group || sim.rand.Float64() < sim.config.Loss {
+		return
+	}
+	sim.seq++
+	m.due = sim.step + 1 + sim.rand.Intn(sim.config.MaxDelay+1)
+	m.seq = sim.seq
+	m.from, m.to = c.peer.index, p.index
+	m.fromIncarnation, m.toIncarnation = c.incarnation, p.incarnation
+	sim.inFlight = append(sim.inFlight, m)
+}
+
+func (sim *Simulator) deliver(m *message) error {
+	sim.Lock()
+	from, to := sim.peers[m.from], sim.peers[m.to]
+	// Connections are lost when either end restarts or is cut off
+	lost := from.removed || to.removed || from.group != to.group ||
+		from.incarnation != m.fromIncarnation || to.incarnation != m.toIncarnation
+	sim.Unlock()
+	if lost {
+		return nil
+	}
+	var err error
+	switch m.kind {
+	case unicast:
+		err = to.alloc.OnGossipUnicast(from.name, m.buf)
+	case broadcast:
+		for _, buf := range m.data.Encode() {
+			if _, err = to.alloc.OnGossipBroadcast(from.name, buf); err != nil {
+				break
+			}
+		}
+	case gossip:
+		for _, buf := range m.data.Encode() {
+			if _, err = to.alloc.OnGossip(buf); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("step %d: peer %d receiving from peer %d: %s", sim.step, m.to, m.from, err)
+	}
+	return nil
+}
+
+// Partition splits the network into the given groups of peers, plus
+// one more group of any peers not mentioned.  Messages in flight
+// between groups are lost.
+func (sim *Simulator) Partition(groups ...[]int) {
+	sim.Lock()
+	defer sim.Unlock()
+	for _, p := range sim.peers {
+		p.group = 0
+	}
+	for i, group := range groups {
+		for _, index := range group {
+			sim.peers[index].group = i + 1
+		}
+	}
+}
+
+// Heal reconnects all the peers
+func (sim *Simulator) Heal() {
+	sim.Partition()
+}
+
+// Step advances the clock by one step, delivering the messages due by
+// then; every TickEvery steps each peer also retries whatever it is
+// waiting for and gossips its state to all the others.  Returns an
+// error if a peer rejected a message or the allocations no longer
+// pass Check.
+func (sim *Simulator) Step() error {
+	sim.Lock()
+	sim.step++
+	sim.now = sim.now.Add(stepDuration)
+	var due, later []*message
+	for _, m := range sim.inFlight {
+		if m.due <= sim.step {
+			due = append(due, m)
+		} else {
+			later = append(later, m)
+		}
+	}
+	sim.inFlight = later
+	sim.Unlock()
+
+	sort.Slice(due, func(i, j int) bool {
+		if due[i].due != due[j].due {
+			return due[i].due < due[j].due
+		}
+		return due[i].seq < due[j].seq
+	})
+	for _, m := range due {
+		if err := sim.deliver(m); err != nil {
+			return err
+		}
+	}
+	if sim.step%sim.config.TickEvery == 0 {
+		for _, p := range sim.live() {
+			p.alloc.Tick()
+		}
+		for _, p := range sim.live() {
+			sim.sendAll(p.client, gossip, p.alloc.Gossip())
+		}
+	}
+	return sim.Check()
+}
+
+// Run takes n steps, stopping at the first error
+func (sim *Simulator) Run(n int) error {
+	for i := 0; i < n; i++ {
+		if err := sim.Step(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Settle takes steps until no messages are in flight and the peers
+// agree on the ring, or returns an error if that has not happened
+// within MaxSteps.  Peers in different partitions never agree.
+func (sim *Simulator) Settle() error {
+	for n := 0; ; n++ {
+		sim.Lock()
+		quiet := len(sim.inFlight) == 0
+		sim.Unlock()
+		err := sim.CheckConverged()
+		switch {
+		case quiet && err == nil:
+			return nil
+		case n == sim.config.MaxSteps && err != nil:
+			return fmt.Errorf("not converged after %d steps: %s", n, err)
+		case n == sim.config.MaxSteps:
+			return fmt.Errorf("messages still in flight after %d steps", n)
+		}
+		if err := sim.Step(); err != nil {
+			return err
+		}
+	}
+}
+
+// Scripted events
+
+// Allocate asks peer i for an address for ident, taking steps until
+// the allocation completes or MaxSteps have passed.  In the latter
+// case the request is cancelled and an error returned.
+func (sim *Simulator) Allocate(i int, ident string) (address.Address, error) {
+	p := sim.peers[i]
+	if p.removed {
+		return 0, fmt.Errorf("peer %d has been removed", i)
+	}
+	type result struct {
+		addr address.Address
+		err  error
+	}
+	resultChan := make(chan result, 1)
+	started := make(chan struct{})
+	cancelled := make(chan struct{})
+	var once sync.Once
+	// The allocator calls this whenever it tries the request, which
+	// tells us the request has reached it
+	hasBeenCancelled := func() bool {
+		once.Do(func() { close(started) })
+		select {
+		case <-cancelled:
+			return true
+		default:
+			return false
+		}
+	}
+	go func() {
+		addr, err := p.alloc.Allocate(ident, sim.universe, true, hasBeenCancelled)
+		resultChan <- result{addr, err}
+	}()
+	<-started
+
+	for n := 0; ; n++ {
+		// Lookup also waits for the allocator to finish trying the request
+		if cidrs, err := p.alloc.Lookup(ident, sim.universe.Range()); err != nil {
+			close(cancelled)
+			return 0, err
+		} else if len(cidrs) > 0 {
+			res := <-resultChan
+			return res.addr, res.err
+		}
+		if n == sim.config.MaxSteps {
+			break
+		}
+		if err := sim.Step(); err != nil {
+			close(cancelled)
+			return 0, err
+		}
+	}
+	// The request stays pending until the allocator next tries it
+	close(cancelled)
+	return 0, fmt.Errorf("allocation for %s on peer %d not done after %d steps", ident, i, sim.config.MaxSteps)
+}
+
+// Free releases the addresses of ident on peer i
+func (sim *Simulator) Free(i int, ident string) error {
+	return sim.peers[i].alloc.Delete(ident)
+}
+
+// Restart stops peer i and starts it again from its persisted data,
+// losing any messages in flight to or from it.
+func (sim *Simulator) Restart(i int) {
+	p := sim.peers[i]
+	p.alloc.Stop()
+	sim.start(p)
+}
+
+// Remove stops peer i for good, and has peer by take over its
+// ranges, like `weave rmpeer`.  Returns the number of addresses
+// taken over.
+func (sim *Simulator) Remove(i, by int) address.Count {
+	p := sim.peers[i]
+	p.alloc.Stop()
+	sim.Lock()
+	p.removed = true
+	sim.Unlock()
+	return sim.peers[by].alloc.AdminTakeoverRanges(p.name.String())
+}
+
+// Invariants
+
+type peerState struct {
+	index int
+	ipam.AllocatorState
+}
+
+func (sim *Simulator) states() ([]peerState, error) {
+	var result []peerState
+	for _, p := range sim.live() {
+		st, err := p.alloc.State()
+		if err != nil {
+			return nil, fmt.Errorf("peer %d: %s", p.index, err)
+		}
+		result = append(result, peerState{p.index, st})
+	}
+	return result, nil
+}
+
+// Check returns an error if any address is allocated by more than one
+// live peer, or more than once by the same peer.
+func (sim *Simulator) Check() error {
+	states, err := sim.states()
+	if err != nil {
+		return err
+	}
+	type holder struct {
+		peer  int
+		ident string
+	}
+	holders := make(map[string]holder)
+	for _, st := range states {
+		for _, owned := range st.Owned {
+			for _, addr := range owned.Addresses {
+				cidr, err := address.ParseCIDR(addr)
+				if err != nil {
+					return err
+				}
+				ip := cidr.IP().String()
+				if h, found := holders[ip]; found {
+					return fmt.Errorf("step %d: address %s allocated to %s on peer %d and to %s on peer %d",
+						sim.step, ip, h.ident, h.peer, owned.Ident, st.index)
+				}
+				holders[ip] = holder{st.index, owned.Ident}
+			}
+		}
+	}
+	return nil
+}
+
+// CheckConverged returns an error unless all live peers have the same
+// ring, and each peer's addresses are in the ranges the ring gives it.
+func (sim *Simulator) CheckConverged() error {
+	states, err := sim.states()
+	if err != nil {
+		return err
+	}
+	for _, st := range states[1:] {
+		if st.Range != states[0].Range || !reflect.DeepEqual(st.Ring, states[0].Ring) {
+			return fmt.Errorf("peers %d and %d have different rings", states[0].index, st.index)
+		}
+	}
+	ring := states[0].Ring
+	if len(ring) == 0 {
+		return nil
+	}
+	tokens := make([]address.Address, len(ring))
+	for i, e := range ring {
+		host, err := address.ParseHost(e.Token)
+		if err != nil {
+			return err
+		}
+		tokens[i] = host.Addr
+	}
+	for _, st := range states {
+		name := sim.peers[st.index].name.String()
+		for _, owned := range st.Owned {
+			for _, addr := range owned.Addresses {
+				cidr, err := address.ParseCIDR(addr)
+				if err != nil {
+					return err
+				}
+				// The owner is that of the last token at or before the
+				// address, wrapping round to the last token of all
+				i := sort.Search(len(tokens), func(i int) bool { return tokens[i] > cidr.Addr }) - 1
+				if i < 0 {
+					i = len(tokens) - 1
+				}
+				if ring[i].Peer != name {
+					return fmt.Errorf("address %s of %s on peer %d is in a range owned by %s", addr, owned.Ident, st.index, ring[i].Peer)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Persistence
+
+// memDB keeps data in memory, encoded as by the real thing so nothing
+// is shared with the allocator that saved it
+type memDB struct {
+	sync.Mutex
+	data map[string][]byte
+}
+
+func newMemDB() *memDB {
+	return &memDB{data: make(map[string][]byte)}
+}
+
+func (d *memDB) Load(key string, val interface{}) (bool, error) {
+	d.Lock()
+	buf, found := d.data[key]
+	d.Unlock()
+	if !found {
+		return false, nil
+	}
+	return true, gob.NewDecoder(bytes.NewReader(buf)).Decode(val)
+}
+
+func (d *memDB) Save(key string, val interface{}) error {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(val); err != nil {
+		return err
+	}
+	d.Lock()
+	d.data[key] = buf.Bytes()
+	d.Unlock()
+	return nil
+}
@@ -0,0 +1,97 @@
+package simulator
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/weave/ipam"
+	"github.com/weaveworks/weave/net/address"
+)
+
+// A scenario touching on everything the simulator can do; returns the
+// addresses allocated, in order, and the state each peer ends up in.
+func runScenario(t *testing.T, seed int64) ([]address.Address, []ipam.AllocatorState) {
+	sim, err := New(Config{Peers: 5, Universe: "10.0.0.0/24", Seed: seed, MaxDelay: 3})
+	require.NoError(t, err)
+	defer sim.Stop()
+
+	var addrs []address.Address
+	allocate := func(i int, ident string) {
+		addr, err := sim.Allocate(i, ident)
+		require.NoError(t, err, ident)
+		addrs = append(addrs, addr)
+	}
+
+	for i := 0; i < 5; i++ {
+		allocate(i, fmt.Sprintf("c%d", i))
+	}
+	require.NoError(t, sim.Settle())
+
+	// Both sides of a partition carry on allocating from the space
+	// they have, and the rings merge again when it heals
+	sim.Partition([]int{0, 1, 2}, []int{3, 4})
+	for i := 0; i < 5; i++ {
+		for j := 0; j < 10; j++ {
+			allocate(i, fmt.Sprintf("p%d-%d", i, j))
+		}
+	}
+	sim.Heal()
+	require.NoError(t, sim.Settle())
+
+	// A restarted peer keeps its addresses
+	sim.Restart(2)
+	allocate(2, "p2-0")
+	require.Equal(t, addrs[len(addrs)-1], addrs[5+2*10])
+	require.NoError(t, sim.Free(2, "p2-0"))
+	require.NoError(t, sim.Settle())
+
+	// A removed peer's space is taken over
+	require.True(t, sim.Remove(4, 0) > 0)
+	require.NoError(t, sim.Settle())
+	for i := 0; i < 4; i++ {
+		allocate(i, fmt.Sprintf("r%d", i))
+	}
+	require.NoError(t, sim.Settle())
+
+	// A peer needing more than its share asks others for space,
+	// choosing whom to ask at random
+	for j := 0; j < 80; j++ {
+		allocate(0, fmt.Sprintf("b%d", j))
+	}
+	require.NoError(t, sim.Settle())
+
+	var states []ipam.AllocatorState
+	for i := 0; i < 4; i++ {
+		st, err := sim.Allocator(i).State()
+		require.NoError(t, err)
+		states = append(states, st)
+	}
+	return addrs, states
+}
+
+func TestSimulator(t *testing.T) {
+	addrs, states := runScenario(t, 42)
+	for i := 0; i < 3; i++ {
+		addrs2, states2 := runScenario(t, 42)
+		require.Equal(t, addrs, addrs2, "same seed, same addresses")
+		require.Equal(t, states, states2, "same seed, same division of space")
+	}
+}
+
+func TestDoubleAllocationDetected(t *testing.T) {
+	sim, err := New(Config{Peers: 2, Universe: "10.0.0.0/28", Seed: 1})
+	require.NoError(t, err)
+	defer sim.Stop()
+	addr, err := sim.Allocate(0, "c0")
+	require.NoError(t, err)
+	require.NoError(t, sim.Settle())
+
+	// Peer 1 wrongly taking over peer 0's space leads to trouble
+	sim.Partition([]int{0}, []int{1})
+	sim.Allocator(1).AdminTakeoverRanges(sim.Name(0).String())
+	cidr := address.MakeCIDR(sim.universe, addr)
+	require.NoError(t, sim.Allocator(1).Claim("c1", cidr, true, false, nil))
+	require.Error(t, sim.Check())
+}
@@ -142,9 +142,14 @@ func (s *Space) biggestFreeRange(r address.Range) (biggest address.Range) {
 }
 
 func (s *Space) Donate(r address.Range) (address.Range, bool) {
+	return s.DonateUpTo(r, r.Size())
+}
+
+// DonateUpTo is like Donate, but gives away at most limit addresses.
+func (s *Space) DonateUpTo(r address.Range, limit address.Count) (address.Range, bool) {
 	biggest := s.biggestFreeRange(r)
 
-	if biggest.Size() == 0 {
+	if biggest.Size() == 0 || limit == 0 {
 		return address.Range{}, false
 	}
 
@@ -154,6 +159,10 @@ func (s *Space) Donate(r address.Range) (address.Range, bool) {
 		// rounds up, and in particular can't be empty.
 		biggest.Start = address.Add(biggest.Start, address.Offset(biggest.Size()/2))
 	}
+	// Halving keeps the chunk CIDR-aligned
+	for biggest.Size() > limit {
+		biggest.Start = address.Add(biggest.Start, address.Offset(biggest.Size()/2))
+	}
 
 	s.ours = subtract(s.ours, biggest.Start, biggest.End)
 	s.free = subtract(s.free, biggest.Start, biggest.End)
@@ -257,6 +266,15 @@ func (s *Space) OwnedRanges() []address.Range {
 	return result
 }
 
+// FreeRanges returns slice of Ranges, ordered by IP, of free addresses
+func (s *Space) FreeRanges() []address.Range {
+	result := make([]address.Range, len(s.free)/2)
+	for i := 0; i < len(s.free); i += 2 {
+		result[i/2] = address.Range{Start: s.free[i], End: s.free[i+1]}
+	}
+	return result
+}
+
 // Create a Space that has free space in all the supplied Ranges.
 func (s *Space) AddRanges(ranges []address.Range) {
 	for _, r := range ranges {
@@ -71,6 +71,13 @@ func TestLowlevel(t *testing.T) {
 	require.True(t, ok, "donate")
 	require.Equal(t, address.NewRange(0xa0, 0x20), r, "donate")
 
+	// test DonateUpTo limits the size of the donation
+	r, ok = s.DonateUpTo(address.NewRange(0, 1000), 10)
+	require.True(t, ok, "donate")
+	require.Equal(t, address.NewRange(0x78, 0x8), r, "donate")
+	_, ok = s.DonateUpTo(address.NewRange(0, 1000), 0)
+	require.True(t, !ok, "donate of nothing should fail")
+
 	// test Donate when addresses are scarce
 	s = New()
 	r, ok = s.Donate(address.NewRange(0, 1000))
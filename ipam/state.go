@@ -0,0 +1,412 @@
+package ipam
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/weaveworks/mesh"
+
+	"github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/db"
+	"github.com/weaveworks/weave/ipam/ring"
+	"github.com/weaveworks/weave/ipam/space"
+	"github.com/weaveworks/weave/net/address"
+)
+
+// StateVersion is the version of the State document format written by
+// this code; documents with any other version are rejected.
+const StateVersion = 1
+
+// State is everything IPAM on one peer knows about who has which
+// addresses, in a form that can be saved as JSON and restored onto a
+// fresh peer, e.g. to rebuild a cluster after losing its data.
+type State struct {
+	Version    int
+	Peer       string // the peer the state was exported from
+	Allocators []AllocatorState
+}
+
+// AllocatorState is the state of one of a peer's allocators
+type AllocatorState struct {
+	Name  string `json:",omitempty"` // see Config.Name
+	Range string
+	Seeds []string `json:",omitempty"`
+	Ring  []EntryState
+	Free  []RangeState // addresses in our ranges not allocated
+	Owned []OwnedState
+}
+
+type EntryState struct {
+	Token   string
+	Peer    string
+	Version uint32
+	Free    address.Count
+}
+
+type RangeState struct {
+	Start string
+	Size  address.Count
+}
+
+type OwnedState struct {
+	Ident       string
+	IsContainer bool `json:",omitempty"`
+	Addresses   []string
+}
+
+func newAllocatorState(name string, r *ring.Ring, s *space.Space, owned map[string]ownedData) (AllocatorState, error) {
+	universe, ok := rangeCIDR(r.Upper, r.Range())
+	if !ok {
+		return AllocatorState{}, fmt.Errorf("IPAM range %s is not a CIDR", r.RangeString())
+	}
+	st := AllocatorState{Name: name, Range: universe.String(), Ring: []EntryState{}, Free: []RangeState{}, Owned: []OwnedState{}}
+	for _, seed := range r.Seeds {
+		st.Seeds = append(st.Seeds, seed.String())
+	}
+	for _, e := range r.Export() {
+		st.Ring = append(st.Ring, EntryState{Token: r.Upper.IP(e.Token).String(), Peer: e.Peer.String(), Version: e.Version, Free: e.Free})
+	}
+	for _, free := range s.FreeRanges() {
+		st.Free = append(st.Free, RangeState{Start: r.Upper.IP(free.Start).String(), Size: free.Size()})
+	}
+	idents := make([]string, 0, len(owned))
+	for ident := range owned {
+		idents = append(idents, ident)
+	}
+	sort.Strings(idents)
+	for _, ident := range idents {
+		o := OwnedState{Ident: ident, IsContainer: owned[ident].IsContainer, Addresses: []string{}}
+		for _, cidr := range owned[ident].Cidrs {
+			o.Addresses = append(o.Addresses, cidr.String())
+		}
+		st.Owned = append(st.Owned, o)
+	}
+	return st, nil
+}
+
+func parseAddress(upper address.Upper96, s string) (address.Address, error) {
+	host, err := address.ParseHost(s)
+	if err != nil {
+		return 0, err
+	}
+	if host.Upper != upper {
+		return 0, fmt.Errorf("address %s is not in the same family and /96 as the range", s)
+	}
+	return host.Addr, nil
+}
+
+// decode checks st for consistency and turns it into a ring and owned
+// addresses belonging to peer.  If st was exported by a
+// different peer, from, the ranges of that peer are transferred to
+// peer, as if it had taken them over.
+func (st AllocatorState) decode(from, peer mesh.PeerName) (*ring.Ring, map[string]ownedData, error) {
+	universe, err := address.ParseCIDR(st.Range)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !universe.IsSubnet() {
+		return nil, nil, fmt.Errorf("range %s is not a subnet address", universe)
+	}
+	var seeds []mesh.PeerName
+	for _, s := range st.Seeds {
+		seed, err := mesh.PeerNameFromString(s)
+		if err != nil {
+			return nil, nil, err
+		}
+		seeds = append(seeds, seed)
+	}
+	var entries []ring.Entry
+	for _, e := range st.Ring {
+		token, err := parseAddress(universe.Upper, e.Token)
+		if err != nil {
+			return nil, nil, err
+		}
+		owner, err := mesh.PeerNameFromString(e.Peer)
+		if err != nil {
+			return nil, nil, err
+		}
+		entries = append(entries, ring.Entry{Token: token, Peer: owner, Version: e.Version, Free: e.Free})
+	}
+	r, err := ring.Import(universe.Range().Start, universe.Range().End, universe.Upper, peer, seeds, entries)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid ring for %s: %s", universe, err)
+	}
+	if from != peer {
+		r.Transfer(from, peer)
+	}
+
+	s := space.New()
+	s.AddRanges(r.OwnedRanges())
+	owned := make(map[string]ownedData)
+	for _, o := range st.Owned {
+		if _, found := owned[o.Ident]; found {
+			return nil, nil, fmt.Errorf("duplicate entry for %s", o.Ident)
+		}
+		d := ownedData{IsContainer: o.IsContainer}
+		for _, a := range o.Addresses {
+			cidr, err := address.ParseCIDR(a)
+			if err != nil {
+				return nil, nil, err
+			}
+			if cidr.Upper != universe.Upper {
+				return nil, nil, fmt.Errorf("address %s of %s is outside range %s", cidr, o.Ident, universe)
+			}
+			if err := s.Claim(cidr.Addr); err != nil {
+				return nil, nil, fmt.Errorf("address %s of %s is not free in the peer's ranges", cidr, o.Ident)
+			}
+			d.Cidrs = append(d.Cidrs, cidr)
+		}
+		owned[o.Ident] = d
+	}
+	for _, f := range st.Free {
+		start, err := parseAddress(universe.Upper, f.Start)
+		if err != nil {
+			return nil, nil, err
+		}
+		free := address.NewRange(start, address.Offset(f.Size))
+		if s.NumFreeAddressesInRange(free) != free.Size() {
+			return nil, nil, fmt.Errorf("free range %s does not match the ring and owned addresses", universe.Upper.RangeString(free))
+		}
+	}
+	return r, owned, nil
+}
+
+func parseState(st *State) (mesh.PeerName, error) {
+	if st.Version != StateVersion {
+		return mesh.UnknownPeerName, fmt.Errorf("unsupported IPAM state version %d; expected %d", st.Version, StateVersion)
+	}
+	return mesh.PeerNameFromString(st.Peer)
+}
+
+// Actor client API
+
+// State (Sync) - our ring, space and owned addresses, for export
+func (alloc *Allocator) State() (AllocatorState, error) {
+	type result struct {
+		st  AllocatorState
+		err error
+	}
+	resultChan := make(chan result)
+	alloc.actionChan <- func() {
+		st, err := newAllocatorState(alloc.name, alloc.ring, &alloc.space, alloc.owned)
+		resultChan <- result{st, err}
+	}
+	res := <-resultChan
+	return res.st, res.err
+}
+
+// Restore (Sync) - take on st, as exported by peer from.  Only
+// allowed before we have any IPAM data of our own, and for the same
+// range we were configured with, or one enclosing or enclosed by it.
+func (alloc *Allocator) Restore(st AllocatorState, from mesh.PeerName) error {
+	r, owned, err := st.decode(from, alloc.ourName)
+	if err != nil {
+		return err
+	}
+	resultChan := make(chan error)
+	alloc.actionChan <- func() {
+		switch {
+		case !alloc.ring.Empty() || len(alloc.owned) > 0:
+			resultChan <- fmt.Errorf("IPAM already has data; reset this peer before importing")
+			return
+		case r.Range() == alloc.ring.Range() && r.Upper == alloc.ring.Upper, r.Encloses(alloc.ring):
+		case alloc.ring.Encloses(r):
+			r.Expand(alloc.ring.Start, alloc.ring.End)
+		default:
+			resultChan <- fmt.Errorf("range %s does not match our range %s", st.Range, alloc.universe)
+			return
+		}
+		alloc.infof("Restoring IPAM state exported by %s", alloc.annotatePeernames([]mesh.PeerName{from})[0])
+		alloc.ring.Restore(r)
+		alloc.space.UpdateRanges(alloc.ring.OwnedRanges())
+		// Claim owned addresses before ringUpdated() lets pending
+		// requests loose on the space
+		alloc.owned = owned
+		for ident, d := range alloc.owned {
+			for _, cidr := range d.Cidrs {
+				alloc.space.Claim(cidr.Addr)
+			}
+			alloc.renewLease(ident)
+		}
+		alloc.persistOwned()
+		alloc.ringUpdated()
+		alloc.gossip.GossipBroadcast(alloc.Gossip())
+		resultChan <- nil
+	}
+	return <-resultChan
+}
+
+// State returns the state of all the pools, for export
+func (pools Pools) State() (*State, error) {
+	for _, pool := range pools {
+		if pool.Allocator == nil {
+			return nil, errNoRing
+		}
+	}
+	st := &State{Version: StateVersion, Peer: pools[0].ourName.String()}
+	for _, pool := range pools {
+		allocState, err := pool.Allocator.State()
+		if err != nil {
+			return nil, err
+		}
+		st.Allocators = append(st.Allocators, allocState)
+	}
+	return st, nil
+}
+
+// Restore restores st onto the pools, matching allocators by name.
+// Everything is checked before anything is restored.
+func (pools Pools) Restore(st *State) error {
+	from, err := parseState(st)
+	if err != nil {
+		return err
+	}
+	targets := make([]*Allocator, len(st.Allocators))
+	for i, allocState := range st.Allocators {
+		for _, pool := range pools {
+			if pool.Allocator != nil && pool.name == allocState.Name {
+				targets[i] = pool.Allocator
+			}
+		}
+		if targets[i] == nil {
+			return fmt.Errorf("no allocator for range %s on this peer", allocState.Range)
+		}
+		if _, _, err := allocState.decode(from, targets[i].ourName); err != nil {
+			return err
+		}
+	}
+	for i, allocState := range st.Allocators {
+		if err := targets[i].Restore(allocState, from); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleStateHTTP wires up the export and import endpoints: GET /export
+// returns the pools' State as JSON, and POST /import restores a State
+// given as the request body.
+func (pools Pools) handleStateHTTP(router *mux.Router) {
+	router.Methods("GET").Path("/export").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		st, err := pools.State()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(st); err != nil {
+			common.Log.Warningln("[allocator]:", err)
+		}
+	})
+
+	router.Methods("POST").Path("/import").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var st State
+		if err := json.NewDecoder(r.Body).Decode(&st); err != nil {
+			badRequest(w, err)
+			return
+		}
+		if err := pools.Restore(&st); err != nil {
+			badRequest(w, fmt.Errorf("Unable to import: %s", err))
+			return
+		}
+		w.WriteHeader(204)
+	})
+}
+
+// Offline access, for a peer that is not running
+
+// PersistedAllocatorNames returns the names of the allocators which
+// have persisted a ring under one of idents, e.g. as listed by
+// db.BoltDB.Idents
+func PersistedAllocatorNames(idents []string) []string {
+	var names []string
+	for _, ident := range idents {
+		switch {
+		case ident == ringIdent:
+			names = append(names, "")
+		case strings.HasPrefix(ident, ringIdent+"-"):
+			names = append(names, strings.TrimPrefix(ident, ringIdent+"-"))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// PersistedState reads the state of the named allocators (see
+// Config.Name) from d, skipping any that have no data.
+func PersistedState(d db.DB, names []string) (*State, error) {
+	var peer mesh.PeerName
+	if _, err := d.Load(db.NameIdent, &peer); err != nil {
+		return nil, err
+	}
+	st := &State{Version: StateVersion, Peer: peer.String(), Allocators: []AllocatorState{}}
+	for _, name := range names {
+		var r *ring.Ring
+		if found, err := d.Load(persistenceKey(name, ringIdent), &r); err != nil {
+			return nil, err
+		} else if !found || r == nil {
+			continue
+		}
+		var owned map[string]ownedData
+		if _, err := d.Load(persistenceKey(name, ownedIdent), &owned); err != nil {
+			return nil, err
+		}
+		s := space.New()
+		s.AddRanges(r.OwnedRanges())
+		for _, o := range owned {
+			for _, cidr := range o.Cidrs {
+				s.Claim(cidr.Addr)
+			}
+		}
+		allocState, err := newAllocatorState(name, r, s, owned)
+		if err != nil {
+			return nil, err
+		}
+		st.Allocators = append(st.Allocators, allocState)
+	}
+	return st, nil
+}
+
+// RestorePersisted writes st to d as the data of peer, to be picked
+// up when it next starts.  d must not already hold IPAM data.
+func RestorePersisted(d db.DB, st *State, peer mesh.PeerName) error {
+	from, err := parseState(st)
+	if err != nil {
+		return err
+	}
+	type decoded struct {
+		name  string
+		ring  *ring.Ring
+		owned map[string]ownedData
+	}
+	var all []decoded
+	for _, allocState := range st.Allocators {
+		var existing *ring.Ring
+		if found, err := d.Load(persistenceKey(allocState.Name, ringIdent), &existing); err != nil {
+			return err
+		} else if found && existing != nil && !existing.Empty() {
+			return fmt.Errorf("IPAM data for range %s already present; reset this peer before importing", existing.RangeString())
+		}
+		r, owned, err := allocState.decode(from, peer)
+		if err != nil {
+			return err
+		}
+		all = append(all, decoded{allocState.Name, r, owned})
+	}
+	if err := d.Save(db.NameIdent, peer); err != nil {
+		return err
+	}
+	for _, a := range all {
+		if err := d.Save(persistenceKey(a.name, ringIdent), a.ring); err != nil {
+			return err
+		}
+		if err := d.Save(persistenceKey(a.name, ownedIdent), a.owned); err != nil {
+			return err
+		}
+	}
+	return nil
+}
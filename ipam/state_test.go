@@ -0,0 +1,74 @@
+package ipam
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/weave/net/address"
+)
+
+func TestExportImport(t *testing.T) {
+	alloc1, subnet := makeAllocatorWithMockGossip(t, "01:00:00:01:00:00", "10.0.3.0/26", 1)
+	defer alloc1.Stop()
+	alloc1.claimRingForTesting()
+	addr1, err := alloc1.SimplyAllocate("c1", subnet)
+	require.NoError(t, err)
+	_, err = alloc1.SimplyAllocate("c2", subnet)
+	require.NoError(t, err)
+
+	st, err := Pools{{Allocator: alloc1, DefaultSubnet: subnet}}.State()
+	require.NoError(t, err)
+	buf, err := json.Marshal(st)
+	require.NoError(t, err)
+	var doc State
+	require.NoError(t, json.Unmarshal(buf, &doc))
+	require.Equal(t, StateVersion, doc.Version)
+	require.Len(t, doc.Allocators[0].Owned, 2)
+
+	// A fresh peer takes over the ranges and addresses of the exporter
+	alloc2, _ := makeAllocatorWithMockGossip(t, "02:00:00:02:00:00", "10.0.3.0/26", 1)
+	defer alloc2.Stop()
+	pools2 := Pools{{Allocator: alloc2, DefaultSubnet: subnet}}
+	ExpectBroadcastMessage(alloc2, nil)
+	require.NoError(t, pools2.Restore(&doc))
+	CheckAllExpectedMessagesSent(alloc2)
+	cidrs, err := alloc2.Lookup("c1", subnet.Range())
+	require.NoError(t, err)
+	require.Equal(t, addr1, cidrs[0].Addr)
+	require.Equal(t, alloc1.OwnedRanges(), alloc2.OwnedRanges())
+	require.Equal(t, address.Count(subnet.Size()-2), alloc2.NumFreeAddresses(subnet.Range()))
+	require.Error(t, pools2.Restore(&doc), "already has data")
+
+	// Inconsistent documents are rejected before anything changes
+	alloc3, _ := makeAllocatorWithMockGossip(t, "03:00:00:03:00:00", "10.0.3.0/26", 1)
+	defer alloc3.Stop()
+	pools3 := Pools{{Allocator: alloc3, DefaultSubnet: subnet}}
+	bad := doc
+	bad.Version = StateVersion + 1
+	require.Error(t, pools3.Restore(&bad), "version")
+
+	bad = doc
+	bad.Allocators = []AllocatorState{doc.Allocators[0]}
+	bad.Allocators[0].Owned = append([]OwnedState{}, doc.Allocators[0].Owned...)
+	bad.Allocators[0].Owned[1].Addresses = doc.Allocators[0].Owned[0].Addresses
+	require.Error(t, pools3.Restore(&bad), "address owned twice")
+
+	bad.Allocators[0] = doc.Allocators[0]
+	bad.Allocators[0].Free = []RangeState{{Start: "10.0.3.0", Size: 64}}
+	require.Error(t, pools3.Restore(&bad), "allocated address in free list")
+
+	bad.Allocators[0] = doc.Allocators[0]
+	bad.Allocators[0].Range = "10.0.4.0/26"
+	require.Error(t, pools3.Restore(&bad), "different range")
+
+	cidrs, err = alloc3.Lookup("c1", subnet.Range())
+	require.NoError(t, err)
+	require.Len(t, cidrs, 0)
+}
+
+func TestPersistedAllocatorNames(t *testing.T) {
+	idents := []string{"peername", "ring", "ownedAddresses", "ring-v6", "ownedAddresses-v6", "ring-pool-batch", "reservations-pool-batch"}
+	require.Equal(t, []string{"", "pool-batch", "v6"}, PersistedAllocatorNames(idents))
+}
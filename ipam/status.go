@@ -2,11 +2,14 @@ package ipam
 
 import (
 	"fmt"
+	"sort"
+
 	"github.com/weaveworks/weave/ipam/paxos"
 	"github.com/weaveworks/weave/net/address"
 )
 
 type Status struct {
+	Pool             string `json:"Pool,omitempty"`
 	Paxos            *paxos.Status
 	Range            string
 	RangeNumIPs      int
@@ -15,6 +18,7 @@ type Status struct {
 	Entries          []EntryStatus
 	PendingClaims    []ClaimStatus
 	PendingAllocates []string
+	Quotas           []QuotaStatus `json:"Quotas,omitempty"`
 }
 
 type EntryStatus struct {
@@ -26,6 +30,14 @@ type EntryStatus struct {
 	Version     uint32
 }
 
+type QuotaStatus struct {
+	Peer        string
+	Nickname    string
+	MinReserved uint32
+	MaxOwned    uint32
+	Owned       uint32
+}
+
 type ClaimStatus struct {
 	Ident string
 	CIDR  address.CIDR
@@ -50,6 +62,7 @@ func NewStatus(allocator *Allocator, defaultSubnet address.CIDR) *Status {
 	resultChan := make(chan *Status)
 	allocator.actionChan <- func() {
 		resultChan <- &Status{
+			"",
 			paxosStatus,
 			allocator.universe.String(),
 			int(allocator.universe.Size()),
@@ -57,7 +70,8 @@ func NewStatus(allocator *Allocator, defaultSubnet address.CIDR) *Status {
 			defaultSubnet.String(),
 			newEntryStatusSlice(allocator),
 			newClaimStatusSlice(allocator),
-			newAllocateIdentSlice(allocator)}
+			newAllocateIdentSlice(allocator),
+			newQuotaStatusSlice(allocator)}
 	}
 
 	return <-resultChan
@@ -72,7 +86,7 @@ func newEntryStatusSlice(allocator *Allocator) []EntryStatus {
 
 	for _, r := range allocator.ring.AllRangeInfo() {
 		slice = append(slice, EntryStatus{
-			Token:       r.Start.String(),
+			Token:       allocator.universe.Upper.IP(r.Start).String(),
 			Size:        uint32(r.Size()),
 			Peer:        r.Peer.String(),
 			Nickname:    allocator.nicknames[r.Peer],
@@ -84,6 +98,31 @@ func newEntryStatusSlice(allocator *Allocator) []EntryStatus {
 	return slice
 }
 
+func newQuotaStatusSlice(allocator *Allocator) []QuotaStatus {
+	var slice []QuotaStatus
+	if len(allocator.quotas) == 0 {
+		return slice
+	}
+
+	peers := allocator.ring.PeerNames()
+	peers[allocator.ourName] = struct{}{}
+	for peer := range peers {
+		quota, found := allocator.quotas.lookup(peer, allocator.nicknames[peer])
+		if !found {
+			continue
+		}
+		slice = append(slice, QuotaStatus{
+			Peer:        peer.String(),
+			Nickname:    allocator.nicknames[peer],
+			MinReserved: uint32(quota.MinReserved),
+			MaxOwned:    uint32(quota.MaxOwned),
+			Owned:       uint32(allocator.ring.NumOwnedBy(peer)),
+		})
+	}
+	sort.Slice(slice, func(i, j int) bool { return slice[i].Peer < slice[j].Peer })
+	return slice
+}
+
 func newClaimStatusSlice(allocator *Allocator) []ClaimStatus {
 	var slice []ClaimStatus
 	for _, op := range allocator.pendingClaims {
@@ -0,0 +1,181 @@
+package nameserver
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	DefaultCacheSize = 1024
+
+	// Upper limit on how long we keep any response, whatever its TTL
+	maxCacheTTL = time.Hour
+)
+
+type cacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+	do     bool // DNSSEC records wanted
+}
+
+type cacheEntry struct {
+	key      cacheKey
+	response *dns.Msg
+	stored   time.Time
+	expires  time.Time
+}
+
+// cache holds responses from upstream servers, positive and negative,
+// for as long as their TTLs allow, evicting the least recently used
+// when full.
+type cache struct {
+	sync.Mutex
+	size    int
+	entries map[cacheKey]*list.Element
+	lru     *list.List // front is most recently used
+	hits    uint64
+	misses  uint64
+	now     func() time.Time
+}
+
+func newCache(size int) *cache {
+	return &cache{
+		size:    size,
+		entries: make(map[cacheKey]*list.Element),
+		lru:     list.New(),
+		now:     time.Now,
+	}
+}
+
+func makeCacheKey(req *dns.Msg) (cacheKey, bool) {
+	if len(req.Question) != 1 {
+		return cacheKey{}, false
+	}
+	q := req.Question[0]
+	key := cacheKey{name: strings.ToLower(q.Name), qtype: q.Qtype, qclass: q.Qclass}
+	if opt := req.IsEdns0(); opt != nil {
+		key.do = opt.Do()
+	}
+	return key, true
+}
+
+// get returns a copy of the cached response to req, with its TTLs
+// reduced by the time it has spent in the cache.
+func (c *cache) get(req *dns.Msg) *dns.Msg {
+	key, ok := makeCacheKey(req)
+	if !ok {
+		return nil
+	}
+	c.Lock()
+	defer c.Unlock()
+	elem, found := c.entries[key]
+	if found && c.now().After(elem.Value.(*cacheEntry).expires) {
+		c.remove(elem)
+		found = false
+	}
+	if !found {
+		c.misses++
+		return nil
+	}
+	c.hits++
+	c.lru.MoveToFront(elem)
+
+	entry := elem.Value.(*cacheEntry)
+	response := entry.response.Copy()
+	response.Id = req.Id
+	age := uint32(c.now().Sub(entry.stored) / time.Second)
+	for _, rrs := range [][]dns.RR{response.Answer, response.Ns, response.Extra} {
+		for _, rr := range rrs {
+			if hdr := rr.Header(); hdr.Rrtype != dns.TypeOPT {
+				hdr.Ttl -= age
+			}
+		}
+	}
+	return response
+}
+
+// put stores response to req, if it is cacheable.
+func (c *cache) put(req, response *dns.Msg) {
+	key, ok := makeCacheKey(req)
+	if !ok || response.Truncated {
+		return
+	}
+	ttl, ok := cacheTTL(response)
+	if !ok || ttl == 0 {
+		return
+	}
+	if ttl > maxCacheTTL {
+		ttl = maxCacheTTL
+	}
+	c.Lock()
+	defer c.Unlock()
+	if elem, found := c.entries[key]; found {
+		c.remove(elem)
+	}
+	now := c.now()
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, response: response.Copy(), stored: now, expires: now.Add(ttl)})
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+// removeZone drops the responses for names in zone
+func (c *cache) removeZone(zone string) {
+	c.Lock()
+	defer c.Unlock()
+	for key, elem := range c.entries {
+		if dns.IsSubDomain(zone, key.name) {
+			c.remove(elem)
+		}
+	}
+}
+
+func (c *cache) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*cacheEntry).key)
+}
+
+func (c *cache) stats() (entries int, hits, misses uint64) {
+	c.Lock()
+	defer c.Unlock()
+	return c.lru.Len(), c.hits, c.misses
+}
+
+// cacheTTL returns how long response may be cached: the smallest TTL
+// of its records if it has answers, otherwise, per RFC2308, what the
+// SOA record in the authority section allows.  Failures and negative
+// responses without an SOA are not cached.
+func cacheTTL(response *dns.Msg) (time.Duration, bool) {
+	var (
+		ttl   uint32
+		found bool
+	)
+	min := func(v uint32) {
+		if !found || v < ttl {
+			ttl, found = v, true
+		}
+	}
+	switch {
+	case response.Rcode == dns.RcodeSuccess && len(response.Answer) > 0:
+		for _, rrs := range [][]dns.RR{response.Answer, response.Ns, response.Extra} {
+			for _, rr := range rrs {
+				if rr.Header().Rrtype != dns.TypeOPT {
+					min(rr.Header().Ttl)
+				}
+			}
+		}
+	case response.Rcode == dns.RcodeSuccess || response.Rcode == dns.RcodeNameError:
+		for _, rr := range response.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				min(soa.Hdr.Ttl)
+				min(soa.Minttl)
+			}
+		}
+	}
+	return time.Duration(ttl) * time.Second, found
+}
@@ -0,0 +1,102 @@
+package nameserver
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func makeQuery(name string) *dns.Msg {
+	req := &dns.Msg{}
+	req.SetQuestion(name, dns.TypeA)
+	return req
+}
+
+func makeAnswer(req *dns.Msg, ttl uint32) *dns.Msg {
+	response := &dns.Msg{}
+	response.SetReply(req)
+	response.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+		A:   net.ParseIP("192.0.2.1"),
+	}}
+	return response
+}
+
+func TestCache(t *testing.T) {
+	c := newCache(2)
+	now := time.Unix(1000, 0)
+	c.now = func() time.Time { return now }
+
+	req := makeQuery("example.com.")
+	require.Nil(t, c.get(req))
+	c.put(req, makeAnswer(req, 30))
+
+	// Served with the TTL reduced, until expiry
+	now = now.Add(10 * time.Second)
+	req2 := makeQuery("EXAMPLE.com.")
+	response := c.get(req2)
+	require.NotNil(t, response)
+	require.Equal(t, req2.Id, response.Id)
+	require.Equal(t, uint32(20), response.Answer[0].Header().Ttl)
+	dnssec := makeQuery("example.com.")
+	dnssec.SetEdns0(4096, true)
+	require.Nil(t, c.get(dnssec))
+	now = now.Add(21 * time.Second)
+	require.Nil(t, c.get(req))
+
+	// Negative responses are cached for the SOA minimum, if there is one
+	nx := makeQuery("nowhere.example.com.")
+	response = &dns.Msg{}
+	response.SetRcode(nx, dns.RcodeNameError)
+	c.put(nx, response)
+	require.Nil(t, c.get(nx))
+	response.Ns = []dns.RR{&dns.SOA{
+		Hdr:    dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+		Minttl: 60,
+	}}
+	c.put(nx, response)
+	now = now.Add(59 * time.Second)
+	require.Equal(t, dns.RcodeNameError, c.get(nx).Rcode)
+	now = now.Add(2 * time.Second)
+	require.Nil(t, c.get(nx))
+
+	// Failures and truncated responses are not cached
+	response = &dns.Msg{}
+	response.SetRcode(req, dns.RcodeServerFailure)
+	c.put(req, response)
+	response = makeAnswer(req, 30)
+	response.Truncated = true
+	c.put(req, response)
+	require.Nil(t, c.get(req))
+
+	// The least recently used response is evicted
+	reqs := []*dns.Msg{makeQuery("a.example.com."), makeQuery("b.example.com."), makeQuery("c.example.com.")}
+	c.put(reqs[0], makeAnswer(reqs[0], 30))
+	c.put(reqs[1], makeAnswer(reqs[1], 30))
+	require.NotNil(t, c.get(reqs[0]))
+	c.put(reqs[2], makeAnswer(reqs[2], 30))
+	require.NotNil(t, c.get(reqs[0]))
+	require.Nil(t, c.get(reqs[1]))
+	require.NotNil(t, c.get(reqs[2]))
+
+	entries, hits, misses := c.stats()
+	require.Equal(t, 2, entries)
+	require.Equal(t, uint64(5), hits)
+	require.Equal(t, uint64(7), misses)
+}
+
+func TestCacheRemoveZone(t *testing.T) {
+	c := newCache(10)
+	for _, name := range []string{"corp.example.com.", "Host.Corp.example.com.", "example.com.", "notcorp.example.com."} {
+		req := makeQuery(name)
+		c.put(req, makeAnswer(req, 30))
+	}
+	c.removeZone("corp.example.com.")
+	require.Nil(t, c.get(makeQuery("corp.example.com.")))
+	require.Nil(t, c.get(makeQuery("host.corp.example.com.")))
+	require.NotNil(t, c.get(makeQuery("example.com.")))
+	require.NotNil(t, c.get(makeQuery("notcorp.example.com.")))
+}
@@ -7,6 +7,7 @@ import (
 	"net"
 	"os"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -17,10 +18,12 @@ import (
 )
 
 const (
-	topDomain        = "."
-	reverseDNSdomain = "in-addr.arpa."
-	udpBuffSize      = uint16(4096)
-	minUDPSize       = 512
+	topDomain         = "."
+	reverseDNSdomain  = "in-addr.arpa."
+	reverseIPv6domain = "ip6.arpa."
+	udpBuffSize       = uint16(4096)
+	minUDPSize        = 512
+	maxAliasDepth     = 8
 
 	DefaultListenAddress = "0.0.0.0:53"
 	DefaultTTL           = 1
@@ -96,17 +99,35 @@ type DNSServer struct {
 	upstream  Upstream
 	tcpClient *dns.Client
 	udpClient *dns.Client
+	cache     *cache // nil if caching is disabled
+	metrics   *queryMetrics
+
+	sync.RWMutex
+	forwarders map[string][]string // zone -> servers
+	policies   map[string]Policy   // domain -> policy
+	handlers   []*handler
+	logQueries bool
+
+	transferClients []*net.IPNet
 }
 
-func NewDNSServer(ns *Nameserver, domain, address string, upstream Upstream, ttl uint32, clientTimeout time.Duration) (*DNSServer, error) {
+// NewDNSServer creates a DNS server, caching up to cacheSize
+// responses from upstream servers; zero disables the cache.
+func NewDNSServer(ns *Nameserver, domain, address string, upstream Upstream, ttl uint32, clientTimeout time.Duration, cacheSize int) (*DNSServer, error) {
 	s := &DNSServer{
-		ns:        ns,
-		domain:    dns.Fqdn(domain),
-		ttl:       ttl,
-		address:   address,
-		upstream:  upstream,
-		tcpClient: &dns.Client{Net: "tcp", ReadTimeout: clientTimeout},
-		udpClient: &dns.Client{Net: "udp", ReadTimeout: clientTimeout, UDPSize: udpBuffSize},
+		ns:         ns,
+		domain:     dns.Fqdn(domain),
+		ttl:        ttl,
+		address:    address,
+		upstream:   upstream,
+		tcpClient:  &dns.Client{Net: "tcp", ReadTimeout: clientTimeout},
+		udpClient:  &dns.Client{Net: "udp", ReadTimeout: clientTimeout, UDPSize: udpBuffSize},
+		forwarders: make(map[string][]string),
+		policies:   make(map[string]Policy),
+		metrics:    newQueryMetrics(),
+	}
+	if cacheSize > 0 {
+		s.cache = newCache(cacheSize)
 	}
 
 	err := s.listen(address)
@@ -118,6 +139,12 @@ func (d *DNSServer) String() string {
 	fmt.Fprintf(&buf, "WeaveDNS (%s)\n", d.ns.ourName)
 	fmt.Fprintf(&buf, "  listening on %s, for domain %s\n", d.address, d.domain)
 	fmt.Fprintf(&buf, "  response ttl %d\n", d.ttl)
+	if d.cache != nil {
+		entries, hits, misses := d.cache.stats()
+		fmt.Fprintf(&buf, "  cache %d/%d entries, %d hits, %d misses\n", entries, d.cache.size, hits, misses)
+	}
+	buf.WriteString(d.forwardersString())
+	buf.WriteString(d.policiesString())
 	return buf.String()
 }
 
@@ -158,6 +185,7 @@ func (d *DNSServer) Stop() error {
 
 type handler struct {
 	*DNSServer
+	mux             *dns.ServeMux
 	maxResponseSize int
 	client          *dns.Client
 }
@@ -166,12 +194,22 @@ func (d *DNSServer) createMux(client *dns.Client, defaultMaxResponseSize int) *d
 	m := dns.NewServeMux()
 	h := &handler{
 		DNSServer:       d,
+		mux:             m,
 		maxResponseSize: defaultMaxResponseSize,
 		client:          client,
 	}
-	m.HandleFunc(d.domain, h.handleLocal)
-	m.HandleFunc(reverseDNSdomain, h.handleReverse)
-	m.HandleFunc(topDomain, h.handleRecursive)
+	m.HandleFunc(d.domain, h.instrument(sourceLocal, h.handleLocal))
+	m.HandleFunc(reverseDNSdomain, h.instrument(sourceReverse, h.handleReverse))
+	m.HandleFunc(reverseIPv6domain, h.instrument(sourceReverse, h.handleReverse))
+	m.HandleFunc(topDomain, h.instrument(sourceRecursive, h.handleRecursive))
+
+	// Forwarding zones take precedence over the default upstream
+	d.Lock()
+	defer d.Unlock()
+	for zone := range d.forwarders {
+		m.HandleFunc(zone, h.instrument(sourceForward, h.handleForward))
+	}
+	d.handlers = append(d.handlers, h)
 	return m
 }
 
@@ -181,38 +219,131 @@ func (h *handler) handleLocal(w dns.ResponseWriter, req *dns.Msg) {
 		h.nameError(w, req)
 		return
 	}
+	if qtype := req.Question[0].Qtype; qtype == dns.TypeAXFR || qtype == dns.TypeIXFR {
+		h.handleTransfer(w, req)
+		return
+	}
+	h.respond(w, h.localResponse(req, 0))
+}
 
+func (h *handler) localResponse(req *dns.Msg, depth int) *dns.Msg {
 	hostname := dns.Fqdn(req.Question[0].Name)
-	if strings.Count(hostname, ".") == 1 {
+	if !dns.IsSubDomain(h.domain, hostname) {
 		hostname = hostname + h.domain
 	}
-
-	addrs := h.ns.Lookup(hostname)
-	if len(addrs) == 0 {
-		h.nameError(w, req)
-		return
+	// Our domain itself always exists, with the records secondaries
+	// need to transfer it
+	apex := strings.EqualFold(hostname, h.domain)
+	if apex {
+		switch req.Question[0].Qtype {
+		case dns.TypeSOA:
+			return h.makeResponse(req, []dns.RR{h.makeSOA()})
+		case dns.TypeNS:
+			return h.makeResponse(req, []dns.RR{h.makeNS()})
+		}
 	}
-	// Per RFC4074, if we have an A but another type was requested,
-	// return 'no error' with empty answer section
-	if req.Question[0].Qtype != dns.TypeA {
-		h.respond(w, h.makeResponse(req, nil))
-		return
+	hostname, found := h.ns.Resolve(hostname)
+	switch {
+	case !found && apex:
+		return h.makeResponse(req, nil)
+	case !found:
+		return h.makeErrorResponse(req, dns.RcodeNameError)
+	}
+
+	if target, found := h.ns.LookupAlias(hostname); found {
+		return h.makeAliasResponse(req, target, depth)
 	}
 
+	// Per RFC4074, if we have the name but not the type requested,
+	// return 'no error' with empty answer section; likewise, per
+	// RFC8020, if we only have names below it
+	var answers []dns.RR
 	header := dns.RR_Header{
 		Name:   req.Question[0].Name,
-		Rrtype: dns.TypeA,
+		Rrtype: req.Question[0].Qtype,
 		Class:  dns.ClassINET,
 		Ttl:    h.ttl,
 	}
-	answers := make([]dns.RR, len(addrs))
-	for i, addr := range addrs {
-		ip := addr.IP4()
-		answers[i] = &dns.A{Hdr: header, A: ip}
+	switch req.Question[0].Qtype {
+	case dns.TypeA:
+		addrs := h.ns.lookupAddrs(hostname, false)
+		h.orderEntries(hostname, addrs)
+		for _, e := range addrs {
+			answers = append(answers, &dns.A{Hdr: header, A: e.Addr.IP4()})
+		}
+	case dns.TypeAAAA:
+		addrs6 := h.ns.lookupAddrs(hostname, true)
+		h.orderEntries(hostname, addrs6)
+		for _, e := range addrs6 {
+			answers = append(answers, &dns.AAAA{Hdr: header, AAAA: e.IP()})
+		}
+	case dns.TypeSRV:
+		return h.makeServiceResponse(req, header, h.ns.LookupServices(hostname))
+	}
+
+	return h.makeResponse(req, answers)
+}
+
+// makeAliasResponse answers with the CNAME record followed, unless
+// that was what was asked for, by the records of its target: from our
+// own entries if the target is in our domain, otherwise from upstream.
+// Per RFC6604 the response code is that of the target.
+func (h *handler) makeAliasResponse(req *dns.Msg, target string, depth int) *dns.Msg {
+	answers := []dns.RR{&dns.CNAME{
+		Hdr: dns.RR_Header{
+			Name:   req.Question[0].Name,
+			Rrtype: dns.TypeCNAME,
+			Class:  dns.ClassINET,
+			Ttl:    h.ttl,
+		},
+		Target: target,
+	}}
+	rcode := dns.RcodeSuccess
+	if req.Question[0].Qtype != dns.TypeCNAME && depth < maxAliasDepth {
+		chase := req.Copy()
+		chase.Question[0].Name = target
+		var response *dns.Msg
+		if dns.IsSubDomain(h.domain, target) {
+			response = h.localResponse(chase, depth+1)
+		} else {
+			response = h.externalResponse(chase)
+		}
+		answers = append(answers, response.Answer...)
+		rcode = response.Rcode
+	}
+	response := h.makeResponse(req, answers)
+	response.Rcode = rcode
+	return response
+}
+
+// makeServiceResponse answers an SRV query, with the addresses of the
+// targets in the additional section to save clients another lookup
+func (h *handler) makeServiceResponse(req *dns.Msg, header dns.RR_Header, services []Entry) *dns.Msg {
+	var answers, extra []dns.RR
+	targets := make(map[string]bool)
+	for _, e := range services {
+		answers = append(answers, &dns.SRV{Hdr: header, Priority: e.Priority, Weight: e.Weight, Port: e.Port, Target: e.Target})
+		if key := e.Target + " " + e.IP().String(); !targets[key] {
+			targets[key] = true
+			extraHeader := dns.RR_Header{Name: e.Target, Class: dns.ClassINET, Ttl: h.ttl}
+			if e.isIPv6() {
+				extraHeader.Rrtype = dns.TypeAAAA
+				extra = append(extra, &dns.AAAA{Hdr: extraHeader, AAAA: e.IP()})
+			} else {
+				extraHeader.Rrtype = dns.TypeA
+				extra = append(extra, &dns.A{Hdr: extraHeader, A: e.IP()})
+			}
+		}
 	}
 	shuffleAnswers(&answers)
 
-	h.respond(w, h.makeResponse(req, answers))
+	response := h.makeResponse(req, answers)
+	// The additional section is optional, so drop it rather than truncate
+	response.Extra = extra
+	if h.maxResponseSize > 0 && response.Len() > h.getMaxResponseSize(req) {
+		response.Extra = nil
+	}
+	return response
 }
 
 func (h *handler) handleReverse(w dns.ResponseWriter, req *dns.Msg) {
@@ -222,14 +353,26 @@ func (h *handler) handleReverse(w dns.ResponseWriter, req *dns.Msg) {
 		return
 	}
 
-	ipStr := strings.TrimSuffix(strings.ToLower(req.Question[0].Name), "."+reverseDNSdomain)
-	ip, err := address.ParseIP(ipStr)
-	if err != nil {
-		h.nameError(w, req)
-		return
+	name := strings.ToLower(req.Question[0].Name)
+	var (
+		hostname string
+		err      error
+	)
+	if strings.HasSuffix(name, "."+reverseIPv6domain) {
+		ip, ok := parseReverseIPv6(strings.TrimSuffix(name, "."+reverseIPv6domain))
+		if !ok {
+			h.nameError(w, req)
+			return
+		}
+		hostname, err = h.ns.ReverseLookupIPv6(ip)
+	} else {
+		ip, parseErr := address.ParseIP(strings.TrimSuffix(name, "."+reverseDNSdomain))
+		if parseErr != nil {
+			h.nameError(w, req)
+			return
+		}
+		hostname, err = h.ns.ReverseLookup(ip.Reverse())
 	}
-
-	hostname, err := h.ns.ReverseLookup(ip.Reverse())
 	if err != nil {
 		h.handleRecursive(w, req)
 		return
@@ -249,39 +392,184 @@ func (h *handler) handleReverse(w dns.ResponseWriter, req *dns.Msg) {
 	h.respond(w, h.makeResponse(req, answers))
 }
 
+// parseReverseIPv6 parses the 32 dot-separated nibbles, least
+// significant first, that make up an ipv6 address under ip6.arpa.
+func parseReverseIPv6(s string) (net.IP, bool) {
+	nibbles := strings.Split(s, ".")
+	if len(nibbles) != 2*net.IPv6len {
+		return nil, false
+	}
+	ip := make(net.IP, net.IPv6len)
+	for i, nibble := range nibbles {
+		v, err := strconv.ParseUint(nibble, 16, 4)
+		if err != nil || len(nibble) != 1 {
+			return nil, false
+		}
+		j := len(nibbles) - 1 - i
+		ip[j/2] |= byte(v) << (4 * uint(1-j%2))
+	}
+	return ip, true
+}
+
 func (h *handler) handleRecursive(w dns.ResponseWriter, req *dns.Msg) {
 	h.ns.debugf("recursive request: %+v", *req)
 
-	// Resolve unqualified names locally
+	// Resolve unqualified names locally, and names with more labels
+	// too if they are ours relative to our domain, as a client's
+	// search list would have them
 	if len(req.Question) == 1 {
 		hostname := dns.Fqdn(req.Question[0].Name)
-		if strings.Count(hostname, ".") == 1 {
+		if strings.Count(hostname, ".") == 1 || h.answersLocally(hostname+h.domain) {
 			h.handleLocal(w, req)
 			return
 		}
 	}
 
+	h.respond(w, h.upstreamResponse(req))
+}
+
+// answersLocally is true if we have entries for hostname, or a
+// wildcard for it; not a wildcard for our whole domain, though, which
+// would capture every name asked for.
+func (h *handler) answersLocally(hostname string) bool {
+	name, found := h.ns.Resolve(hostname)
+	return found && name != "*."+h.domain && h.ns.HasEntries(name)
+}
+
+func (h *handler) upstreamResponse(req *dns.Msg) *dns.Msg {
 	upstreamConfig, err := h.upstream.Config()
 	if err != nil {
 		h.ns.errorf("unable to read upstream config: %s", err)
 	}
-	for _, server := range upstreamConfig.Servers {
-		reqCopy := req.Copy()
-		reqCopy.Id = dns.Id()
-		response, _, err := h.client.Exchange(reqCopy, fmt.Sprintf("%s:%s", server, upstreamConfig.Port))
-		if (err != nil && err != dns.ErrTruncated) || response == nil {
-			h.ns.debugf("error trying %s: %v", server, err)
-			continue
+	servers := make([]string, len(upstreamConfig.Servers))
+	for i, server := range upstreamConfig.Servers {
+		servers[i] = net.JoinHostPort(server, upstreamConfig.Port)
+	}
+	return h.exchange(req, servers)
+}
+
+type exchangeResult struct {
+	server   string
+	response *dns.Msg
+	err      error
+}
+
+// exchange answers req from the cache, or by asking all of servers at
+// once and taking the first successful answer
+func (h *handler) exchange(req *dns.Msg, servers []string) *dns.Msg {
+	if h.cache != nil {
+		if response := h.cache.get(req); response != nil {
+			h.ns.debugf("cached response: %+v", response)
+			return h.fitResponse(req, response)
 		}
-		response.Id = req.Id
-		if h.responseTooBig(req, response) {
-			response.Compress = true
+	}
+
+	upstreamReq := upstreamRequest(req)
+	results := make(chan exchangeResult, len(servers))
+	for _, server := range servers {
+		go func(server string) {
+			response, err := h.exchangeWith(upstreamReq, server)
+			results <- exchangeResult{server, response, err}
+		}(server)
+	}
+
+	// Should every server fail, pass on the first failure they report
+	var failure *dns.Msg
+	for range servers {
+		result := <-results
+		switch {
+		case result.err != nil:
+			h.ns.debugf("error trying %s: %v", result.server, result.err)
+		case result.response.Rcode == dns.RcodeServerFailure || result.response.Rcode == dns.RcodeRefused:
+			h.ns.debugf("%s from %s", dns.RcodeToString[result.response.Rcode], result.server)
+			if failure == nil {
+				failure = result.response
+			}
+		default:
+			return h.upstreamAnswer(req, result.response)
 		}
-		h.respond(w, response)
-		return
 	}
+	if failure != nil {
+		return h.upstreamAnswer(req, failure)
+	}
+	return h.makeErrorResponse(req, dns.RcodeServerFailure)
+}
+
+// exchangeWith asks server, retrying over TCP if the answer over UDP
+// was truncated
+func (h *handler) exchangeWith(req *dns.Msg, server string) (*dns.Msg, error) {
+	reqCopy := req.Copy()
+	reqCopy.Id = dns.Id()
+	response, _, err := h.client.Exchange(reqCopy, server)
+	if h.client.Net != "tcp" && (err == dns.ErrTruncated || (err == nil && response.Truncated)) {
+		h.ns.debugf("truncated response from %s; retrying over tcp", server)
+		reqCopy.Id = dns.Id()
+		tcpResponse, _, tcpErr := h.tcpClient.Exchange(reqCopy, server)
+		if tcpErr == nil {
+			return tcpResponse, nil
+		}
+		h.ns.debugf("error retrying %s over tcp: %v", server, tcpErr)
+	}
+	if err == dns.ErrTruncated {
+		err = nil // make do with what we have
+	}
+	if err == nil && response == nil {
+		err = fmt.Errorf("no response")
+	}
+	return response, err
+}
+
+// upstreamRequest is req as we send it upstream: with its EDNS0
+// options, but advertising our buffer size rather than the client's,
+// since we make the answer fit the client ourselves
+func upstreamRequest(req *dns.Msg) *dns.Msg {
+	upstreamReq := req.Copy()
+	if opt := upstreamReq.IsEdns0(); opt != nil && opt.UDPSize() < udpBuffSize {
+		opt.SetUDPSize(udpBuffSize)
+	}
+	return upstreamReq
+}
+
+func (h *handler) upstreamAnswer(req, response *dns.Msg) *dns.Msg {
+	response.Id = req.Id
+	if h.cache != nil {
+		h.cache.put(req, response)
+	}
+	return h.fitResponse(req, response)
+}
 
-	h.respond(w, h.makeErrorResponse(req, dns.RcodeServerFailure))
+// fitResponse makes a response from upstream fit in the client's
+// buffer: compressed if need be, and if that is not enough truncated,
+// keeping only the EDNS0 record besides the answers that fit
+func (h *handler) fitResponse(req, response *dns.Msg) *dns.Msg {
+	if h.maxResponseSize <= 0 {
+		return response
+	}
+	maxSize := h.getMaxResponseSize(req)
+	if response.Len() <= maxSize {
+		return response
+	}
+	response.Compress = true
+	if response.Len() <= maxSize {
+		return response
+	}
+
+	response.Truncated = true
+	response.Ns = nil
+	extra := response.Extra
+	response.Extra = nil
+	for _, rr := range extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			response.Extra = append(response.Extra, rr)
+		}
+	}
+	answers := response.Answer
+	i := sort.Search(len(answers), func(i int) bool {
+		response.Answer = answers[:i+1]
+		return response.Len() > maxSize
+	})
+	response.Answer = answers[:i]
+	return response
 }
 
 func (h *handler) makeResponse(req *dns.Msg, answers []dns.RR) *dns.Msg {
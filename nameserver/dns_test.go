@@ -27,7 +27,7 @@ func startServer(t *testing.T, upstream *dns.ClientConfig) (*DNSServer, *Nameser
 	peername, err := mesh.PeerNameFromString("00:00:00:02:00:00")
 	require.Nil(t, err)
 	nameserver := New(peername, "", func(mesh.PeerName) bool { return true })
-	dnsserver, err := NewDNSServer(nameserver, "weave.local.", "0.0.0.0:0", &mockUpstream{upstream}, 30, 5*time.Second)
+	dnsserver, err := NewDNSServer(nameserver, "weave.local.", "0.0.0.0:0", &mockUpstream{upstream}, 30, 5*time.Second, DefaultCacheSize)
 	require.Nil(t, err)
 	udpPort := dnsserver.servers[0].PacketConn.LocalAddr().(*net.UDPAddr).Port
 	tcpPort := dnsserver.servers[1].Listener.Addr().(*net.TCPAddr).Port
@@ -81,6 +81,237 @@ func TestTruncation(t *testing.T) {
 	}
 }
 
+func TestIPv6(t *testing.T) {
+	dnsserver, nameserver, udpPort, _ := startServer(t, nil)
+	defer dnsserver.Stop()
+
+	nameserver.AddEntry("foo.weave.local.", "c1", mesh.UnknownPeerName, address.Address(1))
+	nameserver.AddEntryIP("foo.weave.local.", "c1", mesh.UnknownPeerName, net.ParseIP("fd00::1:2"))
+	nameserver.AddEntryIP("bar.weave.local.", "c2", mesh.UnknownPeerName, net.ParseIP("fd00::3"))
+
+	query := func(name string, qtype uint16) *dns.Msg {
+		request := &dns.Msg{}
+		request.SetQuestion(name, qtype)
+		response, _, err := (&dns.Client{}).Exchange(request, fmt.Sprintf("127.0.0.1:%d", udpPort))
+		require.NoError(t, err)
+		return response
+	}
+
+	response := query("foo.weave.local.", dns.TypeAAAA)
+	require.Len(t, response.Answer, 1)
+	require.Equal(t, "fd00::1:2", response.Answer[0].(*dns.AAAA).AAAA.String())
+
+	response = query("foo.weave.local.", dns.TypeA)
+	require.Len(t, response.Answer, 1)
+	require.Equal(t, "0.0.0.1", response.Answer[0].(*dns.A).A.String())
+
+	// A name with only ipv6 addresses exists, but has no A records
+	response = query("bar.weave.local.", dns.TypeA)
+	require.Equal(t, dns.RcodeSuccess, response.Rcode)
+	require.Len(t, response.Answer, 0)
+
+	reverse, err := dns.ReverseAddr("fd00::1:2")
+	require.NoError(t, err)
+	response = query(reverse, dns.TypePTR)
+	require.Len(t, response.Answer, 1)
+	require.Equal(t, "foo.weave.local.", response.Answer[0].(*dns.PTR).Ptr)
+
+	response = query("1.2.ip6.arpa.", dns.TypePTR)
+	require.Equal(t, dns.RcodeNameError, response.Rcode)
+}
+
+func TestServices(t *testing.T) {
+	dnsserver, nameserver, udpPort, _ := startServer(t, nil)
+	defer dnsserver.Stop()
+
+	ip1, ip2 := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")
+	nameserver.AddEntryFQDN("web1.weave.local.", "c1", nameserver.ourName, ip1)
+	nameserver.AddService("web1.weave.local.", "c1", nameserver.ourName, ip1, Service{Name: "_http._tcp", Port: 80, Priority: 10, Weight: 5})
+	nameserver.AddService("web1.weave.local.", "c1", nameserver.ourName, ip1, Service{Name: "_https._tcp", Port: 443})
+	nameserver.AddService("web.weave.local.", "c2", mesh.UnknownPeerName, ip2, Service{Name: "_http._tcp", Port: 8080})
+	nameserver.AddService("other.domain.", "c3", mesh.UnknownPeerName, ip2, Service{Name: "_http._tcp", Port: 80})
+
+	query := func(name string, qtype uint16) *dns.Msg {
+		request := &dns.Msg{}
+		request.SetQuestion(name, qtype)
+		response, _, err := (&dns.Client{}).Exchange(request, fmt.Sprintf("127.0.0.1:%d", udpPort))
+		require.NoError(t, err)
+		return response
+	}
+
+	response := query("_http._tcp.web1.weave.local.", dns.TypeSRV)
+	require.Len(t, response.Answer, 1)
+	srv := response.Answer[0].(*dns.SRV)
+	require.Equal(t, []interface{}{"web1.weave.local.", uint16(80), uint16(10), uint16(5)},
+		[]interface{}{srv.Target, srv.Port, srv.Priority, srv.Weight})
+	require.Len(t, response.Extra, 1)
+	require.Equal(t, "10.0.0.1", response.Extra[0].(*dns.A).A.String())
+
+	// Services don't show up as addresses, and vice versa
+	response = query("_http._tcp.web1.weave.local.", dns.TypeA)
+	require.Equal(t, dns.RcodeSuccess, response.Rcode)
+	require.Len(t, response.Answer, 0)
+	response = query("web1.weave.local.", dns.TypeSRV)
+	require.Len(t, response.Answer, 0)
+	response = query("web1.weave.local.", dns.TypeA)
+	require.Len(t, response.Answer, 1)
+
+	response = query("_http._tcp.web.weave.local.", dns.TypeSRV)
+	require.Len(t, response.Answer, 1)
+	require.Equal(t, uint16(8080), response.Answer[0].(*dns.SRV).Port)
+
+	// Deleting a name deletes the services of it
+	nameserver.Delete("web1.weave.local.", "*", "*", 0)
+	response = query("_https._tcp.web1.weave.local.", dns.TypeSRV)
+	require.Equal(t, dns.RcodeNameError, response.Rcode)
+}
+
+func TestAliases(t *testing.T) {
+	dnsserver, nameserver, udpPort, _ := startServer(t, nil)
+	defer dnsserver.Stop()
+
+	nameserver.AddEntry("web.weave.local.", "c1", mesh.UnknownPeerName, address.Address(1))
+	require.NoError(t, nameserver.AddAlias("www.weave.local.", "web.weave.local."))
+	require.NoError(t, nameserver.AddAlias("loop1.weave.local.", "loop2.weave.local."))
+	require.NoError(t, nameserver.AddAlias("loop2.weave.local.", "loop1.weave.local."))
+	require.NoError(t, nameserver.AddAlias("dangling.weave.local.", "gone.weave.local."))
+
+	query := func(name string, qtype uint16) *dns.Msg {
+		request := &dns.Msg{}
+		request.SetQuestion(name, qtype)
+		response, _, err := (&dns.Client{}).Exchange(request, fmt.Sprintf("127.0.0.1:%d", udpPort))
+		require.NoError(t, err)
+		return response
+	}
+
+	response := query("www.weave.local.", dns.TypeA)
+	require.Len(t, response.Answer, 2)
+	require.Equal(t, "web.weave.local.", response.Answer[0].(*dns.CNAME).Target)
+	require.Equal(t, "0.0.0.1", response.Answer[1].(*dns.A).A.String())
+
+	response = query("www.weave.local.", dns.TypeCNAME)
+	require.Len(t, response.Answer, 1)
+
+	// The response code is that of the target
+	response = query("dangling.weave.local.", dns.TypeA)
+	require.Equal(t, dns.RcodeNameError, response.Rcode)
+	require.Len(t, response.Answer, 1)
+	require.Equal(t, "gone.weave.local.", response.Answer[0].(*dns.CNAME).Target)
+
+	// A loop of aliases is followed only so far
+	response = query("loop1.weave.local.", dns.TypeA)
+	require.Equal(t, dns.RcodeSuccess, response.Rcode)
+	require.Len(t, response.Answer, maxAliasDepth+1)
+}
+
+// startUpstream runs handler on UDP and TCP on the same port
+func startUpstream(t *testing.T, handler dns.HandlerFunc) (func(), string) {
+	udpListener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := udpListener.LocalAddr().(*net.UDPAddr).Port
+	tcpListener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	require.NoError(t, err)
+	servers := []*dns.Server{
+		{PacketConn: udpListener, Handler: handler},
+		{Listener: tcpListener, Handler: handler},
+	}
+	for _, server := range servers {
+		go server.ActivateAndServe()
+	}
+	return func() {
+		for _, server := range servers {
+			server.Shutdown()
+		}
+	}, strconv.Itoa(port)
+}
+
+func TestUpstreamExchange(t *testing.T) {
+	gotOpt := make(chan *dns.OPT, 10)
+	// Made afresh each time, since packing records modifies them
+	answers := func(n int) []dns.RR {
+		var rrs []dns.RR
+		for i := 0; i < n; i++ {
+			rrs = append(rrs, &dns.A{
+				Hdr: dns.RR_Header{Name: "big.example.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 0},
+				A:   address.Address(i).IP4(),
+			})
+		}
+		return rrs
+	}
+	// Truncates over UDP like a real server, failing for a name we
+	// expect some other server to answer
+	stop, port := startUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		gotOpt <- req.IsEdns0()
+		response := &dns.Msg{}
+		response.SetReply(req)
+		if req.Question[0].Name == "elsewhere.example." {
+			response.Rcode = dns.RcodeServerFailure
+		} else {
+			response.Answer = answers(100)
+		}
+		if _, isUDP := w.RemoteAddr().(*net.UDPAddr); isUDP && response.Len() > dns.MinMsgSize {
+			response.Answer, response.Truncated = nil, true
+		}
+		require.NoError(t, w.WriteMsg(response))
+	})
+	defer stop()
+	// Slow, but the only one to know about elsewhere.example
+	slowStop, slowPort := startUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		response := &dns.Msg{}
+		response.SetReply(req)
+		if req.Question[0].Name == "elsewhere.example." {
+			response.Answer = answers(1)
+		} else {
+			time.Sleep(2 * time.Second)
+		}
+		w.WriteMsg(response) // we may have stopped waiting by now
+	})
+	defer slowStop()
+
+	dnsserver, _, udpPort, _ := startServer(t, &dns.ClientConfig{Servers: []string{"127.0.0.1"}, Port: port})
+	defer dnsserver.Stop()
+	dnsserver.cache = nil
+	require.NoError(t, dnsserver.AddForwarder("example.", []string{"127.0.0.1:" + port, "127.0.0.1:" + slowPort}))
+
+	query := func(name string, edns bool) *dns.Msg {
+		request := &dns.Msg{}
+		request.SetQuestion(name, dns.TypeA)
+		if edns {
+			request.SetEdns0(65535, true)
+			opt := request.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: dns.EDNS0LOCALSTART, Data: []byte("hello")})
+		}
+		response, _, err := (&dns.Client{UDPSize: 65535}).Exchange(request, fmt.Sprintf("127.0.0.1:%d", udpPort))
+		if err != dns.ErrTruncated {
+			require.NoError(t, err)
+		}
+		return response
+	}
+
+	// Retried over TCP, with the client's EDNS0 options passed on
+	start := time.Now()
+	response := query("big.example.", true)
+	require.True(t, time.Since(start) < time.Second, "did not wait for the slow server")
+	require.False(t, response.Truncated)
+	require.Len(t, response.Answer, 100)
+	opt := <-gotOpt
+	require.NotNil(t, opt)
+	require.True(t, opt.Do())
+	require.Equal(t, []byte("hello"), opt.Option[0].(*dns.EDNS0_LOCAL).Data)
+
+	// A client that can't take it all gets what fits
+	response = query("big.example.", false)
+	require.True(t, response.Truncated)
+	require.NotEmpty(t, response.Answer)
+	response.Compress = true
+	require.True(t, response.Len() <= dns.MinMsgSize)
+
+	// A failure from one server doesn't stop another answering
+	response = query("elsewhere.example.", false)
+	require.Equal(t, dns.RcodeSuccess, response.Rcode)
+	require.Len(t, response.Answer, 1)
+}
+
 func TestTruncateResponse(t *testing.T) {
 
 	header := dns.RR_Header{
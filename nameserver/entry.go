@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/gob"
 	"fmt"
+	"net"
 	"sort"
 	"strings"
 	"time"
@@ -18,11 +19,33 @@ var now = func() int64 { return time.Now().Unix() }
 type Entry struct {
 	ContainerID string
 	Origin      mesh.PeerName
+	Upper       address.Upper96 // zero for an ipv4 address
 	Addr        address.Address
 	Hostname    string // as supplied
 	lHostname   string // lowercased (not exported, so not encoded by gob)
 	Version     int
 	Tombstone   int64 // timestamp of when it was deleted
+	Stamp       int64 // of its latest change, from the clock of whoever made it
+
+	// Set by the origin while the container's health check, or a
+	// probe of the address, is failing; such entries are not answered
+	Unhealthy bool
+
+	// For ordering answers: the share of them an address should come
+	// first in, where zero counts as 1, and the locality zone of the
+	// origin peer
+	AnswerWeight uint16
+	Zone         string
+
+	// Set only for CNAME entries, which have no address
+	Alias string
+
+	// Set only for SRV entries, whose Hostname is the name of the
+	// service and whose address is that of Target
+	Target   string
+	Port     uint16
+	Priority uint16
+	Weight   uint16
 }
 
 type Entries []Entry
@@ -48,8 +71,14 @@ func (es CaseInsensitive) Less(i, j int) bool { return es[i].insensitiveLess(&es
 func (e1 Entry) equal(e2 Entry) bool {
 	return e1.ContainerID == e2.ContainerID &&
 		e1.Origin == e2.Origin &&
+		e1.Upper == e2.Upper &&
 		e1.Addr == e2.Addr &&
-		e1.Hostname == e2.Hostname
+		e1.Hostname == e2.Hostname &&
+		e1.Alias == e2.Alias &&
+		e1.Target == e2.Target &&
+		e1.Port == e2.Port &&
+		e1.Priority == e2.Priority &&
+		e1.Weight == e2.Weight
 }
 
 func (e1 *Entry) less(e2 *Entry) bool {
@@ -64,8 +93,14 @@ func (e1 *Entry) less(e2 *Entry) bool {
 	case e1.ContainerID != e2.ContainerID:
 		return e1.ContainerID < e2.ContainerID
 
-	default:
+	case e1.Upper != e2.Upper:
+		return bytes.Compare(e1.Upper[:], e2.Upper[:]) < 0
+
+	case e1.Addr != e2.Addr:
 		return e1.Addr < e2.Addr
+
+	default:
+		return e1.recordLess(e2)
 	}
 }
 
@@ -82,8 +117,33 @@ func (e1 *Entry) insensitiveLess(e2 *Entry) bool {
 	case e1.ContainerID != e2.ContainerID:
 		return e1.ContainerID < e2.ContainerID
 
-	default:
+	case e1.Upper != e2.Upper:
+		return bytes.Compare(e1.Upper[:], e2.Upper[:]) < 0
+
+	case e1.Addr != e2.Addr:
 		return e1.Addr < e2.Addr
+
+	default:
+		return e1.recordLess(e2)
+	}
+}
+
+func (e1 *Entry) recordLess(e2 *Entry) bool {
+	switch {
+	case e1.Alias != e2.Alias:
+		return e1.Alias < e2.Alias
+
+	case e1.Target != e2.Target:
+		return e1.Target < e2.Target
+
+	case e1.Port != e2.Port:
+		return e1.Port < e2.Port
+
+	case e1.Priority != e2.Priority:
+		return e1.Priority < e2.Priority
+
+	default:
+		return e1.Weight < e2.Weight
 	}
 }
 
@@ -93,16 +153,54 @@ func (e1 *Entry) merge(e2 *Entry) bool {
 	if e2.Version > e1.Version {
 		e1.Version = e2.Version
 		e1.Tombstone = e2.Tombstone
+		e1.copyAttributes(e2)
 		return true
 	} else if e2.Version == e1.Version && e2.Tombstone > e1.Tombstone {
 		e1.Tombstone = e2.Tombstone
+		e1.Stamp = e2.Stamp
 		return true
 	}
 	return false
 }
 
+// Attributes are what may change about an entry without it becoming a
+// different entry; like tombstoning, changing them bumps the version.
+// The Stamp of the change goes with them.
+func (e1 *Entry) sameAttributes(e2 *Entry) bool {
+	return e1.Unhealthy == e2.Unhealthy && e1.AnswerWeight == e2.AnswerWeight && e1.Zone == e2.Zone
+}
+
+func (e1 *Entry) copyAttributes(e2 *Entry) {
+	e1.Stamp = e2.Stamp
+	e1.Unhealthy = e2.Unhealthy
+	e1.AnswerWeight = e2.AnswerWeight
+	e1.Zone = e2.Zone
+}
+
 func (e1 *Entry) String() string {
-	return fmt.Sprintf("%s -> %s", e1.Hostname, e1.Addr.String())
+	if e1.isAlias() {
+		return fmt.Sprintf("%s -> %s", e1.Hostname, e1.Alias)
+	}
+	if e1.isService() {
+		return fmt.Sprintf("%s -> %s:%d (%s)", e1.Hostname, e1.Target, e1.Port, e1.IP().String())
+	}
+	return fmt.Sprintf("%s -> %s", e1.Hostname, e1.IP().String())
+}
+
+func (e1 *Entry) IP() net.IP {
+	return e1.Upper.IP(e1.Addr)
+}
+
+func (e1 *Entry) isIPv6() bool {
+	return e1.Upper != address.Upper96{}
+}
+
+func (e1 *Entry) isService() bool {
+	return e1.Target != ""
+}
+
+func (e1 *Entry) isAlias() bool {
+	return e1.Alias != ""
 }
 
 func (e1 *Entry) addLowercase() {
@@ -141,17 +239,17 @@ func (es *Entries) checkAndPanic() *Entries {
 	return es
 }
 
-func (es *Entries) add(hostname, containerid string, origin mesh.PeerName, addr address.Address) Entry {
+func (es *Entries) add(entry Entry) Entry {
 	defer es.checkAndPanic().checkAndPanic()
 
-	entry := Entry{Hostname: hostname, lHostname: strings.ToLower(hostname),
-		Origin: origin, ContainerID: containerid, Addr: addr}
+	entry.addLowercase()
 	i := sort.Search(len(*es), func(i int) bool {
 		return !(*es)[i].insensitiveLess(&entry)
 	})
 	if i < len(*es) && (*es)[i].equal(entry) {
-		if (*es)[i].Tombstone > 0 {
+		if (*es)[i].Tombstone > 0 || !(*es)[i].sameAttributes(&entry) {
 			(*es)[i].Tombstone = 0
+			(*es)[i].copyAttributes(&entry)
 			(*es)[i].Version++
 		}
 	} else {
@@ -262,9 +360,15 @@ func (es Entries) addLowercase() {
 	}
 }
 
+// Entries for ipv6 addresses, SRV and CNAME entries travel separately
+// in Entries6, Services and Aliases, so that peers which predate them,
+// and would decode them as plain ipv4 entries, never see them.
 type GossipData struct {
 	Timestamp int64
 	Entries
+	Entries6 Entries
+	Services Entries
+	Aliases  Entries
 }
 
 func (g *GossipData) Merge(o mesh.GossipData) mesh.GossipData {
@@ -282,14 +386,33 @@ func (g *GossipData) Decode(msg []byte) error {
 		return err
 	}
 
+	for _, es := range []Entries{g.Entries6, g.Services, g.Aliases} {
+		g.Entries = append(g.Entries, es...)
+	}
+	g.Entries6, g.Services, g.Aliases = nil, nil, nil
 	g.Entries.addLowercase() // lowercase strings not sent on the wire
 	sort.Sort(CaseInsensitive(g.Entries))
 	return nil
 }
 
 func (g *GossipData) Encode() [][]byte {
-	g2 := g.copy()
+	g2 := &GossipData{Timestamp: g.Timestamp}
+	for _, e := range g.Entries {
+		switch {
+		case e.isAlias():
+			g2.Aliases = append(g2.Aliases, e)
+		case e.isService():
+			g2.Services = append(g2.Services, e)
+		case e.isIPv6():
+			g2.Entries6 = append(g2.Entries6, e)
+		default:
+			g2.Entries = append(g2.Entries, e)
+		}
+	}
 	sort.Sort(CaseSensitive(g2.Entries))
+	sort.Sort(CaseSensitive(g2.Entries6))
+	sort.Sort(CaseSensitive(g2.Services))
+	sort.Sort(CaseSensitive(g2.Aliases))
 	buf := &bytes.Buffer{}
 	if err := gob.NewEncoder(buf).Encode(g2); err != nil {
 		panic(err)
@@ -1,6 +1,9 @@
 package nameserver
 
 import (
+	"bytes"
+	"encoding/gob"
+	"net"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -28,7 +31,7 @@ func TestAdd(t *testing.T) {
 	now = func() int64 { return 1234 }
 
 	entries := Entries{}
-	entries.add("A", "", mesh.UnknownPeerName, address.Address(0))
+	entries.add(Entry{Hostname: "A", Origin: mesh.UnknownPeerName, Addr: address.Address(0)})
 	expected := l(Entries{
 		Entry{Hostname: "A", Origin: mesh.UnknownPeerName, Addr: address.Address(0)},
 	})
@@ -40,7 +43,7 @@ func TestAdd(t *testing.T) {
 	})
 	require.Equal(t, entries, expected)
 
-	entries.add("A", "", mesh.UnknownPeerName, address.Address(0))
+	entries.add(Entry{Hostname: "A", Origin: mesh.UnknownPeerName, Addr: address.Address(0)})
 	expected = l(Entries{
 		Entry{Hostname: "A", Origin: mesh.UnknownPeerName, Addr: address.Address(0), Version: 2},
 	})
@@ -136,3 +139,30 @@ func TestGossipDataMerge(t *testing.T) {
 
 	require.Equal(t, GossipData{Entries: makeEntries("ABcDEf")}, *g3)
 }
+
+func TestGossipDataNewEntries(t *testing.T) {
+	upper, addr := address.FromIP6(net.ParseIP("fd00::1"))
+	g := GossipData{Timestamp: 1, Entries: l(Entries{
+		Entry{Hostname: "_http._tcp.B", Addr: address.Address(2), Target: "B", Port: 80},
+		Entry{Hostname: "A", Addr: address.Address(1)},
+		Entry{Hostname: "A", Upper: upper, Addr: addr},
+		Entry{Hostname: "B", Addr: address.Address(2)},
+	})}
+	msg := g.Encode()[0]
+
+	var decoded GossipData
+	require.NoError(t, decoded.Decode(msg))
+	require.Equal(t, g, decoded)
+
+	// Peers that know nothing of ipv6 or SRV entries only see the ipv4 ones
+	type oldEntry struct {
+		Hostname string
+		Addr     address.Address
+	}
+	var old struct {
+		Timestamp int64
+		Entries   []oldEntry
+	}
+	require.NoError(t, gob.NewDecoder(bytes.NewReader(msg)).Decode(&old))
+	require.Equal(t, []oldEntry{{"A", address.Address(1)}, {"B", address.Address(2)}}, old.Entries)
+}
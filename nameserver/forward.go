@@ -0,0 +1,151 @@
+package nameserver
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ParseForwarder parses a forwarding zone given as
+// <zone>=<server>[:<port>][,<server>[:<port>]...], e.g.
+// consul=127.0.0.1:8600
+func ParseForwarder(s string) (string, []string, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", nil, fmt.Errorf("invalid forwarder %q: expected <zone>=<server>[:<port>][,...]", s)
+	}
+	servers, err := parseServers(strings.Split(parts[1], ","))
+	return parts[0], servers, err
+}
+
+// parseServers returns servers as host:port, with port 53 unless given
+func parseServers(servers []string) ([]string, error) {
+	var result []string
+	for _, server := range servers {
+		if net.ParseIP(server) != nil {
+			result = append(result, net.JoinHostPort(server, "53"))
+			continue
+		}
+		host, port, err := net.SplitHostPort(server)
+		if err == nil {
+			_, err = strconv.ParseUint(port, 10, 16)
+		}
+		if err != nil || net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("invalid server address %q", server)
+		}
+		result = append(result, server)
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("no servers given")
+	}
+	return result, nil
+}
+
+// AddForwarder sends queries for names in zone to servers, each
+// host:port, rather than to the default upstream servers.  An
+// existing forwarder for zone is replaced.
+func (d *DNSServer) AddForwarder(zone string, servers []string) error {
+	zone = strings.ToLower(dns.Fqdn(zone))
+	if _, ok := dns.IsDomainName(zone); !ok {
+		return fmt.Errorf("invalid zone %q", zone)
+	}
+	switch {
+	case zone == topDomain || zone == reverseDNSdomain || zone == reverseIPv6domain:
+		return fmt.Errorf("cannot forward %s", zone)
+	case dns.IsSubDomain(d.domain, zone):
+		return fmt.Errorf("cannot forward %s, in domain %s", zone, d.domain)
+	case len(servers) == 0:
+		return fmt.Errorf("no servers given for %s", zone)
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	d.forwarders[zone] = servers
+	for _, h := range d.handlers {
+		h.mux.HandleFunc(zone, h.instrument(sourceForward, h.handleForward))
+	}
+	d.flushZone(zone)
+	d.ns.infof("forwarding %s to %s", zone, strings.Join(servers, ", "))
+	return nil
+}
+
+func (d *DNSServer) DeleteForwarder(zone string) {
+	zone = strings.ToLower(dns.Fqdn(zone))
+	d.Lock()
+	defer d.Unlock()
+	if _, found := d.forwarders[zone]; !found {
+		return
+	}
+	delete(d.forwarders, zone)
+	for _, h := range d.handlers {
+		h.mux.HandleRemove(zone)
+	}
+	d.flushZone(zone)
+	d.ns.infof("no longer forwarding %s", zone)
+}
+
+// flushZone drops cached responses for names in zone, which were got
+// from servers other than those now answering for it
+func (d *DNSServer) flushZone(zone string) {
+	if d.cache != nil {
+		d.cache.removeZone(zone)
+	}
+}
+
+// Forwarders returns the servers of each forwarding zone.
+func (d *DNSServer) Forwarders() map[string][]string {
+	d.RLock()
+	defer d.RUnlock()
+	result := make(map[string][]string, len(d.forwarders))
+	for zone, servers := range d.forwarders {
+		result[zone] = servers
+	}
+	return result
+}
+
+// forwarderFor returns the servers of the most specific zone name is in
+func (d *DNSServer) forwarderFor(name string) ([]string, bool) {
+	name = strings.ToLower(dns.Fqdn(name))
+	d.RLock()
+	defer d.RUnlock()
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if servers, found := d.forwarders[name[off:]]; found {
+			return servers, true
+		}
+	}
+	return nil, false
+}
+
+func (d *DNSServer) forwardersString() string {
+	forwarders := d.Forwarders()
+	zones := make([]string, 0, len(forwarders))
+	for zone := range forwarders {
+		zones = append(zones, zone)
+	}
+	sort.Strings(zones)
+	var lines []string
+	for _, zone := range zones {
+		lines = append(lines, fmt.Sprintf("  forwarding %s to %s\n", zone, strings.Join(forwarders[zone], ", ")))
+	}
+	return strings.Join(lines, "")
+}
+
+func (h *handler) handleForward(w dns.ResponseWriter, req *dns.Msg) {
+	h.ns.debugf("forward request: %+v", *req)
+	h.respond(w, h.externalResponse(req))
+}
+
+// externalResponse answers a query for a name outside our domain,
+// from the forwarder for the name's zone if any, otherwise upstream.
+func (h *handler) externalResponse(req *dns.Msg) *dns.Msg {
+	if len(req.Question) == 1 {
+		if servers, found := h.forwarderFor(req.Question[0].Name); found {
+			return h.exchange(req, servers)
+		}
+	}
+	return h.upstreamResponse(req)
+}
@@ -0,0 +1,84 @@
+package nameserver
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// startFakeServer answers every A query with ip, cacheable for a minute
+func startFakeServer(t *testing.T, ip string) (*dns.Server, int) {
+	mux := dns.NewServeMux()
+	mux.HandleFunc(topDomain, func(w dns.ResponseWriter, req *dns.Msg) {
+		response := &dns.Msg{}
+		response.SetReply(req)
+		response.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP(ip),
+		}}
+		require.NoError(t, w.WriteMsg(response))
+	})
+	udpListener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := &dns.Server{PacketConn: udpListener, Handler: mux}
+	go server.ActivateAndServe()
+	return server, udpListener.LocalAddr().(*net.UDPAddr).Port
+}
+
+func TestForwarders(t *testing.T) {
+	upstream, upstreamPort := startFakeServer(t, "192.0.2.1")
+	defer upstream.Shutdown()
+	corp, corpPort := startFakeServer(t, "192.0.2.2")
+	defer corp.Shutdown()
+
+	dnsserver, nameserver, udpPort, _ := startServer(t, &dns.ClientConfig{
+		Servers: []string{"127.0.0.1"},
+		Port:    strconv.Itoa(upstreamPort),
+	})
+	defer dnsserver.Stop()
+
+	query := func(name string) string {
+		request := &dns.Msg{}
+		request.SetQuestion(name, dns.TypeA)
+		response, _, err := (&dns.Client{}).Exchange(request, fmt.Sprintf("127.0.0.1:%d", udpPort))
+		require.NoError(t, err)
+		require.NotEmpty(t, response.Answer)
+		return response.Answer[len(response.Answer)-1].(*dns.A).A.String()
+	}
+
+	// Cached answers from before a forwarder is added are not used
+	require.Equal(t, "192.0.2.1", query("host.corp.example.com."))
+
+	zone, servers, err := ParseForwarder(fmt.Sprintf("Corp.Example.com=127.0.0.1:%d", corpPort))
+	require.NoError(t, err)
+	require.NoError(t, dnsserver.AddForwarder(zone, servers))
+	require.Error(t, dnsserver.AddForwarder("sub.weave.local", servers), "in our domain")
+	require.Error(t, dnsserver.AddForwarder("in-addr.arpa", servers), "our reverse zone")
+
+	require.Equal(t, "192.0.2.2", query("host.corp.example.com."))
+	require.Equal(t, "192.0.2.2", query("corp.example.com."))
+	require.Equal(t, "192.0.2.1", query("example.com."))
+
+	// Aliases to names in a forwarded zone are followed there
+	require.NoError(t, nameserver.AddAlias("intranet.weave.local", "www.corp.example.com"))
+	require.Equal(t, "192.0.2.2", query("intranet.weave.local."))
+
+	dnsserver.DeleteForwarder("corp.example.com")
+	require.Equal(t, "192.0.2.1", query("host.corp.example.com."))
+}
+
+func TestParseForwarder(t *testing.T) {
+	zone, servers, err := ParseForwarder("consul=127.0.0.1:8600,10.0.0.53,[fd00::53]:5353")
+	require.NoError(t, err)
+	require.Equal(t, "consul", zone)
+	require.Equal(t, []string{"127.0.0.1:8600", "10.0.0.53:53", "[fd00::53]:5353"}, servers)
+
+	for _, bad := range []string{"consul", "=10.0.0.53", "consul=", "consul=dns.example.com", "consul=10.0.0.53:"} {
+		_, _, err := ParseForwarder(bad)
+		require.Error(t, err, bad)
+	}
+}
@@ -0,0 +1,261 @@
+package nameserver
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	probeInterval = 5 * time.Second
+	probeTimeout  = 2 * time.Second
+)
+
+// Probe checks that an address is serving, either by connecting to
+// Port over TCP or, for HTTP, by getting Path from it and expecting a
+// 2xx or 3xx status.
+type Probe struct {
+	HTTP bool
+	Port uint16
+	Path string
+}
+
+// ParseProbe parses a probe given as tcp:<port> or
+// http:<port>[/<path>], e.g. http:8080/health
+func ParseProbe(s string) (Probe, error) {
+	var probe Probe
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return probe, fmt.Errorf("invalid probe %q: expected tcp:<port> or http:<port>[/<path>]", s)
+	}
+	port := parts[1]
+	switch parts[0] {
+	case "tcp":
+	case "http":
+		probe.HTTP = true
+		probe.Path = "/"
+		if i := strings.Index(port, "/"); i >= 0 {
+			port, probe.Path = port[:i], port[i:]
+		}
+	default:
+		return probe, fmt.Errorf("invalid probe %q: unknown kind %q", s, parts[0])
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || p == 0 {
+		return probe, fmt.Errorf("invalid probe %q: bad port %q", s, port)
+	}
+	probe.Port = uint16(p)
+	return probe, nil
+}
+
+func (p Probe) String() string {
+	if p.HTTP {
+		return fmt.Sprintf("http:%d%s", p.Port, p.Path)
+	}
+	return fmt.Sprintf("tcp:%d", p.Port)
+}
+
+var probeClient = &http.Client{
+	Timeout: probeTimeout,
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+func (p Probe) check(ip net.IP) bool {
+	addr := net.JoinHostPort(ip.String(), strconv.Itoa(int(p.Port)))
+	if !p.HTTP {
+		conn, err := net.DialTimeout("tcp", addr, probeTimeout)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}
+	resp, err := probeClient.Get("http://" + addr + p.Path)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode >= 200 && resp.StatusCode < 400
+}
+
+// An address probed for a name
+type probeKey struct {
+	hostname string // lowercased
+	ip       string
+}
+
+// probeName is the name whose probe applies to e: for a service, that
+// of its target.
+func (e1 *Entry) probeName() string {
+	if e1.isService() {
+		return strings.ToLower(e1.Target)
+	}
+	return strings.ToLower(e1.Hostname)
+}
+
+// ContainerHealthChanged is called when the Docker health check of a
+// container passes or fails.
+func (n *Nameserver) ContainerHealthChanged(ident string, healthy bool) {
+	n.Lock()
+	if healthy {
+		delete(n.unhealthy, ident)
+	} else {
+		n.unhealthy[ident] = true
+	}
+	entries := n.updateHealth()
+	n.Unlock()
+	n.broadcastEntries(entries...)
+}
+
+// AddProbe has the addresses of fqdn registered here checked every
+// few seconds with probe, and not answered while the check fails.  An
+// existing probe for fqdn is replaced.
+func (n *Nameserver) AddProbe(fqdn string, probe Probe) error {
+	hostname, err := n.checkStaticName(fqdn)
+	if err != nil {
+		return err
+	}
+	n.Lock()
+	defer n.Unlock()
+	n.probes[strings.ToLower(hostname)] = probe
+	n.infof("probing %s with %s", hostname, probe)
+	return nil
+}
+
+func (n *Nameserver) DeleteProbe(fqdn string) {
+	hostname := strings.ToLower(dns.Fqdn(fqdn))
+	n.Lock()
+	delete(n.probes, hostname)
+	for key := range n.probeFailed {
+		if key.hostname == hostname {
+			delete(n.probeFailed, key)
+		}
+	}
+	entries := n.updateHealth()
+	n.Unlock()
+	n.broadcastEntries(entries...)
+}
+
+// Probes returns the probe of each name being probed.
+func (n *Nameserver) Probes() map[string]Probe {
+	n.RLock()
+	defer n.RUnlock()
+	result := make(map[string]Probe, len(n.probes))
+	for hostname, probe := range n.probes {
+		result[hostname] = probe
+	}
+	return result
+}
+
+func (n *Nameserver) probesString() string {
+	probes := n.Probes()
+	hostnames := make([]string, 0, len(probes))
+	for hostname := range probes {
+		hostnames = append(hostnames, hostname)
+	}
+	sort.Strings(hostnames)
+	var lines []string
+	for _, hostname := range hostnames {
+		lines = append(lines, fmt.Sprintf("%s %s\n", hostname, probes[hostname]))
+	}
+	return strings.Join(lines, "")
+}
+
+// runProbes checks, concurrently, every address of ours with a probe
+// for its name, then updates our entries with the results.
+func (n *Nameserver) runProbes() {
+	type target struct {
+		probe Probe
+		ip    net.IP
+	}
+	targets := make(map[probeKey]target)
+	n.RLock()
+	if len(n.probes) == 0 {
+		n.RUnlock()
+		return
+	}
+	for _, e := range n.entries {
+		if e.Origin != n.ourName || e.Tombstone > 0 || e.isAlias() {
+			continue
+		}
+		if probe, found := n.probes[e.probeName()]; found {
+			ip := e.IP()
+			targets[probeKey{e.probeName(), ip.String()}] = target{probe, ip}
+		}
+	}
+	n.RUnlock()
+
+	var (
+		wg     sync.WaitGroup
+		mtx    sync.Mutex
+		failed = make(map[probeKey]bool)
+	)
+	for key, t := range targets {
+		wg.Add(1)
+		go func(key probeKey, t target) {
+			defer wg.Done()
+			if !t.probe.check(t.ip) {
+				mtx.Lock()
+				failed[key] = true
+				mtx.Unlock()
+			}
+		}(key, t)
+	}
+	wg.Wait()
+
+	n.Lock()
+	for key := range failed {
+		// The probe may have gone while we were checking
+		if _, found := n.probes[key.hostname]; !found {
+			delete(failed, key)
+		}
+	}
+	n.probeFailed = failed
+	entries := n.updateHealth()
+	n.Unlock()
+	n.broadcastEntries(entries...)
+}
+
+// Called with the lock held
+func (n *Nameserver) isUnhealthy(e *Entry) bool {
+	return n.unhealthy[e.ContainerID] || n.probeFailed[probeKey{e.probeName(), e.IP().String()}]
+}
+
+// updateHealth marks our entries Unhealthy, or not, as they now are,
+// returning those that changed.  Called with the lock held.
+func (n *Nameserver) updateHealth() Entries {
+	changed := Entries{}
+	for i := range n.entries {
+		e := &n.entries[i]
+		if e.Origin != n.ourName || e.Tombstone > 0 || e.isAlias() {
+			continue
+		}
+		if unhealthy := n.isUnhealthy(e); unhealthy != e.Unhealthy {
+			if len(changed) == 0 {
+				n.serial = uint32(n.nextStamp())
+			}
+			e.Unhealthy = unhealthy
+			e.Version++
+			e.Stamp = int64(n.serial)
+			n.infof("entry %s is now %s", e, healthString(unhealthy))
+			changed = append(changed, *e)
+		}
+	}
+	return changed
+}
+
+func healthString(unhealthy bool) string {
+	if unhealthy {
+		return "unhealthy"
+	}
+	return "healthy"
+}
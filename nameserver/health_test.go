@@ -0,0 +1,115 @@
+package nameserver
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/weave/net/address"
+)
+
+func TestParseProbe(t *testing.T) {
+	for s, expected := range map[string]Probe{
+		"tcp:80":            {Port: 80},
+		"http:8080":         {HTTP: true, Port: 8080, Path: "/"},
+		"http:8080/healthz": {HTTP: true, Port: 8080, Path: "/healthz"},
+	} {
+		probe, err := ParseProbe(s)
+		require.NoError(t, err, s)
+		require.Equal(t, expected, probe, s)
+		reparsed, err := ParseProbe(probe.String())
+		require.NoError(t, err, s)
+		require.Equal(t, probe, reparsed, s)
+	}
+	for _, s := range []string{"", "tcp", "udp:53", "tcp:0", "tcp:65536", "http:/healthz"} {
+		_, err := ParseProbe(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestContainerHealth(t *testing.T) {
+	nameservers, grouter := makeNetwork(2)
+	defer stopNetwork(nameservers, grouter)
+	ns, remote := nameservers[0], nameservers[1]
+
+	ns.AddEntry("web.", "c1", ns.ourName, address.Address(1))
+	ns.AddEntry("web.", "c2", ns.ourName, address.Address(2))
+	grouter.Flush()
+	require.Equal(t, []address.Address{1, 2}, ns.Lookup("web."))
+
+	ns.ContainerHealthChanged("c1", false)
+	grouter.Flush()
+	require.Equal(t, []address.Address{2}, ns.Lookup("web."))
+	require.Equal(t, []address.Address{2}, remote.Lookup("web."), "health is gossiped")
+
+	// Registering again does not make it healthy
+	ns.AddEntry("web.", "c1", ns.ourName, address.Address(1))
+	require.Equal(t, []address.Address{2}, ns.Lookup("web."))
+
+	ns.ContainerHealthChanged("c1", true)
+	grouter.Flush()
+	require.Equal(t, []address.Address{1, 2}, ns.Lookup("web."))
+	require.Equal(t, []address.Address{1, 2}, remote.Lookup("web."))
+
+	// A restarted container starts off healthy
+	ns.ContainerHealthChanged("c2", false)
+	ns.ContainerDied("c2")
+	ns.AddEntry("web.", "c2", ns.ourName, address.Address(2))
+	require.Equal(t, []address.Address{1, 2}, ns.Lookup("web."))
+}
+
+func TestProbes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	_, portStr, err := net.SplitHostPort(server.Listener.Addr().String())
+	require.NoError(t, err)
+	port, err := strconv.Atoi(portStr)
+	require.NoError(t, err)
+
+	nameservers, grouter := makeNetwork(2)
+	defer stopNetwork(nameservers, grouter)
+	ns, remote := nameservers[0], nameservers[1]
+
+	local := net.ParseIP("127.0.0.1")
+	dead := net.ParseIP("127.0.0.2") // nothing listens here
+	ns.AddEntryIP("web.", "c1", ns.ourName, local)
+	ns.AddEntryIP("web.", "c2", ns.ourName, dead)
+	ns.AddService("web.", "c1", ns.ourName, local, Service{Name: "_http._tcp", Port: uint16(port)})
+	ns.AddService("web.", "c2", ns.ourName, dead, Service{Name: "_http._tcp", Port: uint16(port)})
+	ns.AddEntryIP("other.", "c3", ns.ourName, dead)
+	grouter.Flush()
+
+	ns.runProbes()
+	require.Len(t, ns.Lookup("web."), 2, "no probes yet")
+
+	require.NoError(t, ns.AddProbe("web", Probe{HTTP: true, Port: uint16(port), Path: "/healthz"}))
+	ns.runProbes()
+	grouter.Flush()
+	_, local4 := splitIP(local)
+	require.Equal(t, []address.Address{local4}, ns.Lookup("web."))
+	require.Equal(t, []address.Address{local4}, remote.Lookup("web."), "health is gossiped")
+	require.Len(t, ns.LookupServices("_http._tcp.web."), 1, "services of a probed name are probed too")
+	require.Len(t, ns.Lookup("other."), 1, "other names are not probed")
+
+	// Replacing the probe
+	require.NoError(t, ns.AddProbe("web.", Probe{HTTP: true, Port: uint16(port), Path: "/down"}))
+	ns.runProbes()
+	require.Len(t, ns.Lookup("web."), 0)
+
+	ns.DeleteProbe("web.")
+	require.Len(t, ns.Lookup("web."), 2)
+	require.Len(t, ns.LookupServices("_http._tcp.web."), 2)
+	require.Equal(t, map[string]Probe{}, ns.Probes())
+
+	require.NoError(t, ns.AddProbe("web.", Probe{Port: uint16(port)}))
+	ns.runProbes()
+	require.Equal(t, []address.Address{local4}, ns.Lookup("web."), "tcp probe")
+}
@@ -3,6 +3,7 @@ package nameserver
 import (
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 
 	"github.com/gorilla/mux"
@@ -28,18 +29,44 @@ func (n *Nameserver) HandleHTTP(router *mux.Router, dockerCli *docker.Client) {
 			container = vars["container"]
 			ipStr     = vars["ip"]
 			fqdn      = r.FormValue("fqdn")
-			ip, err   = address.ParseIP(ipStr)
+			ip, err   = parseIP(ipStr)
 		)
 		if err != nil {
 			n.badRequest(w, err)
 			return
 		}
 
-		n.AddEntryFQDN(fqdn, container, n.ourName, ip)
+		var services []Service
+		for _, srv := range r.Form["srv"] {
+			service, err := ParseService(srv)
+			if err != nil {
+				n.badRequest(w, err)
+				return
+			}
+			services = append(services, service)
+		}
+		var weight uint16
+		if weightStr := r.FormValue("weight"); weightStr != "" {
+			if weight, err = ParseWeight(weightStr); err != nil {
+				n.badRequest(w, err)
+				return
+			}
+		}
+		labelServices, labelWeight := n.inspectContainer(dockerCli, container)
+		services = append(services, labelServices...)
+		if weight == 0 {
+			weight = labelWeight
+		}
+
+		n.AddWeightedEntryFQDN(fqdn, container, n.ourName, ip, weight)
+		for _, service := range services {
+			n.AddService(fqdn, container, n.ourName, ip, service)
+		}
 
 		if r.FormValue("check-alive") == "true" && dockerCli != nil && dockerCli.IsContainerNotRunning(container) {
 			n.infof("container '%s' is not running: removing", container)
-			n.Delete(dns.Fqdn(fqdn), container, ipStr, ip)
+			upper, addr := splitIP(ip)
+			n.delete(dns.Fqdn(fqdn), container, ipStr, upper, addr)
 		}
 
 		w.WriteHeader(204)
@@ -60,22 +87,99 @@ func (n *Nameserver) HandleHTTP(router *mux.Router, dockerCli *docker.Client) {
 			container = "*"
 		}
 
+		var (
+			upper address.Upper96
+			addr  address.Address
+		)
 		ipStr, ok := vars["ip"]
-		ip, err := address.ParseIP(ipStr)
-		if ok && err != nil {
-			n.badRequest(w, err)
-			return
-		} else if !ok {
+		if ok {
+			ip, err := parseIP(ipStr)
+			if err != nil {
+				n.badRequest(w, err)
+				return
+			}
+			upper, addr = splitIP(ip)
+		} else {
 			ipStr = "*"
 		}
 
-		n.Delete(hostname, container, ipStr, ip)
+		n.delete(hostname, container, ipStr, upper, addr)
 		w.WriteHeader(204)
 	}
 	router.Methods("DELETE").Path("/name/{container}/{ip}").HandlerFunc(deleteHandler)
 	router.Methods("DELETE").Path("/name/{container}").HandlerFunc(deleteHandler)
 	router.Methods("DELETE").Path("/name").HandlerFunc(deleteHandler)
 
+	router.Methods("PUT").Path("/static/name/{ip}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip, err := parseIP(mux.Vars(r)["ip"])
+		if err != nil {
+			n.badRequest(w, err)
+			return
+		}
+		if err := n.AddStatic(r.FormValue("fqdn"), ip); err != nil {
+			n.badRequest(w, err)
+			return
+		}
+		w.WriteHeader(204)
+	})
+
+	deleteStaticHandler := func(w http.ResponseWriter, r *http.Request) {
+		hostname := r.FormValue("fqdn")
+		if hostname == "" {
+			hostname = "*"
+		}
+		var ip net.IP
+		if ipStr, ok := mux.Vars(r)["ip"]; ok {
+			var err error
+			if ip, err = parseIP(ipStr); err != nil {
+				n.badRequest(w, err)
+				return
+			}
+		}
+		n.DeleteStatic(hostname, ip)
+		w.WriteHeader(204)
+	}
+	router.Methods("DELETE").Path("/static/name/{ip}").HandlerFunc(deleteStaticHandler)
+	router.Methods("DELETE").Path("/static/name").HandlerFunc(deleteStaticHandler)
+
+	router.Methods("PUT").Path("/static/cname").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := n.AddAlias(r.FormValue("fqdn"), r.FormValue("target")); err != nil {
+			n.badRequest(w, err)
+			return
+		}
+		w.WriteHeader(204)
+	})
+
+	router.Methods("DELETE").Path("/static/cname").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hostname := r.FormValue("fqdn")
+		if hostname == "" {
+			hostname = "*"
+		}
+		n.DeleteAlias(hostname)
+		w.WriteHeader(204)
+	})
+
+	router.Methods("GET").Path("/probe").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, n.probesString())
+	})
+
+	router.Methods("PUT").Path("/probe").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probe, err := ParseProbe(r.FormValue("probe"))
+		if err == nil {
+			err = n.AddProbe(r.FormValue("fqdn"), probe)
+		}
+		if err != nil {
+			n.badRequest(w, err)
+			return
+		}
+		w.WriteHeader(204)
+	})
+
+	router.Methods("DELETE").Path("/probe").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n.DeleteProbe(r.FormValue("fqdn"))
+		w.WriteHeader(204)
+	})
+
 	router.Methods("GET").Path("/name").Headers("Accept", "application/json").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		n.RLock()
 		defer n.RUnlock()
@@ -84,3 +188,79 @@ func (n *Nameserver) HandleHTTP(router *mux.Router, dockerCli *docker.Client) {
 		}
 	})
 }
+
+// inspectContainer returns the services listed in the ServiceLabel
+// of container and the weight in its WeightLabel, if we can find out.
+// The result of its health check reaches us as a container event.
+func (n *Nameserver) inspectContainer(dockerCli *docker.Client, container string) ([]Service, uint16) {
+	if dockerCli == nil {
+		return nil, 0
+	}
+	info, err := dockerCli.InspectContainer(container)
+	if err != nil || info.Config == nil {
+		return nil, 0
+	}
+	services, err := ParseServices(info.Config.Labels[ServiceLabel])
+	if err != nil {
+		n.infof("container %s: ignoring label %s: %s", container, ServiceLabel, err)
+	}
+	var weight uint16
+	if label, found := info.Config.Labels[WeightLabel]; found {
+		if weight, err = ParseWeight(label); err != nil {
+			n.infof("container %s: ignoring label %s: %s", container, WeightLabel, err)
+		}
+	}
+	return services, weight
+}
+
+func parseIP(s string) (net.IP, error) {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, &net.ParseError{Type: "IP Address", Text: s}
+	}
+	return ip, nil
+}
+
+func (d *DNSServer) HandleHTTP(router *mux.Router) {
+	router.Methods("GET").Path("/forward").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, d.forwardersString())
+	})
+
+	router.Methods("PUT").Path("/forward/{zone}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			d.ns.badRequest(w, err)
+			return
+		}
+		servers, err := parseServers(r.Form["server"])
+		if err == nil {
+			err = d.AddForwarder(mux.Vars(r)["zone"], servers)
+		}
+		if err != nil {
+			d.ns.badRequest(w, err)
+			return
+		}
+		w.WriteHeader(204)
+	})
+
+	router.Methods("DELETE").Path("/forward/{zone}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d.DeleteForwarder(mux.Vars(r)["zone"])
+		w.WriteHeader(204)
+	})
+
+	router.Methods("GET").Path("/policy").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, d.policiesString())
+	})
+
+	router.Methods("PUT").Path("/policy/{domain}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := d.SetPolicy(mux.Vars(r)["domain"], Policy(r.FormValue("policy"))); err != nil {
+			d.ns.badRequest(w, err)
+			return
+		}
+		w.WriteHeader(204)
+	})
+
+	router.Methods("DELETE").Path("/policy/{domain}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d.DeletePolicy(mux.Vars(r)["domain"])
+		w.WriteHeader(204)
+	})
+}
@@ -0,0 +1,114 @@
+package nameserver
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+func (e1 *Entry) isWildcard() bool {
+	return strings.HasPrefix(e1.Hostname, "*.")
+}
+
+// Called with the lock held
+func (n *Nameserver) hasEntries(hostname string) bool {
+	for _, e := range n.entries.lookup(hostname) {
+		if e.Tombstone == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// exists is true if hostname has entries, or is the parent of names
+// that do.  Called with the lock held.
+func (n *Nameserver) exists(hostname string) bool {
+	return n.names[strings.ToLower(hostname)] > 0
+}
+
+// index counts delta live entries for lHostname in n.names, and so
+// for each of its ancestors.  Called with the lock held.
+func (n *Nameserver) index(lHostname string, delta int) {
+	for off, end := 0, false; !end; off, end = dns.NextLabel(lHostname, off) {
+		name := lHostname[off:]
+		if n.names[name] += delta; n.names[name] == 0 {
+			delete(n.names, name)
+		}
+	}
+}
+
+// indexChanges runs f, which may add, revive or tombstone entries
+// equal to those of es, then brings n.names up to date with what it
+// did.  Called with the lock held.
+func (n *Nameserver) indexChanges(es Entries, f func()) {
+	wasLive := make([]bool, len(es))
+	for i := range es {
+		wasLive[i] = n.isLive(&es[i])
+	}
+	f()
+	for i := range es {
+		switch isLive := n.isLive(&es[i]); {
+		case isLive && !wasLive[i]:
+			n.index(es[i].lHostname, 1)
+		case !isLive && wasLive[i]:
+			n.index(es[i].lHostname, -1)
+		}
+	}
+}
+
+func (n *Nameserver) isLive(e *Entry) bool {
+	ours, found := n.entries.findEqual(e)
+	return found && ours.Tombstone == 0
+}
+
+// tombstone tombstones those of our entries f is true of, and returns
+// them.  Called with the lock held.
+func (n *Nameserver) tombstone(f func(*Entry) bool) Entries {
+	stamp := n.nextStamp()
+	entries := n.entries.tombstone(n.ourName, func(e *Entry) bool {
+		e.Stamp = stamp // kept only if e is tombstoned
+		return f(e)
+	})
+	for _, e := range entries {
+		n.index(e.lHostname, -1)
+	}
+	if len(entries) > 0 {
+		n.serial = uint32(stamp)
+	}
+	return entries
+}
+
+// HasEntries is true if hostname itself, not a wildcard, has entries.
+func (n *Nameserver) HasEntries(hostname string) bool {
+	n.RLock()
+	defer n.RUnlock()
+	return n.hasEntries(hostname)
+}
+
+// Resolve returns the name whose entries answer for hostname: hostname
+// itself if it exists, otherwise, per RFC4592, the wildcard
+// "*.<closest encloser>" if there is one, where the closest encloser
+// is the nearest ancestor of hostname that exists.  found is false if
+// neither does, i.e. hostname does not exist.
+func (n *Nameserver) Resolve(hostname string) (name string, found bool) {
+	hostname = dns.Fqdn(hostname)
+	n.RLock()
+	defer n.RUnlock()
+	if n.exists(hostname) {
+		return hostname, true
+	}
+	for off, end := dns.NextLabel(hostname, 0); !end; off, end = dns.NextLabel(hostname, off) {
+		ancestor := hostname[off:]
+		if !dns.IsSubDomain(n.domain, ancestor) {
+			break
+		}
+		if wildcard := "*." + ancestor; n.hasEntries(wildcard) {
+			n.debugf("resolve %s -> %s", hostname, wildcard)
+			return wildcard, true
+		}
+		if n.exists(ancestor) {
+			break
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,106 @@
+package nameserver
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+
+	"github.com/weaveworks/weave/net/address"
+)
+
+func TestResolve(t *testing.T) {
+	peername, err := mesh.PeerNameFromString("00:00:00:02:00:00")
+	require.NoError(t, err)
+	nameserver := New(peername, "weave.local.", func(mesh.PeerName) bool { return true })
+	nameserver.AddEntry("*.app.weave.local.", "c1", nameserver.ourName, address.Address(1))
+	nameserver.AddEntry("db.app.weave.local.", "c2", nameserver.ourName, address.Address(2))
+	nameserver.AddEntry("x.y.app.weave.local.", "c3", nameserver.ourName, address.Address(3))
+
+	for hostname, expected := range map[string]string{
+		"db.app.weave.local.":       "db.app.weave.local.",
+		"DB.App.weave.local.":       "DB.App.weave.local.",
+		"web.app.weave.local.":      "*.app.weave.local.",
+		"a.web.app.weave.local.":    "*.app.weave.local.",
+		"y.app.weave.local.":        "y.app.weave.local.", // exists, as the parent of x
+		"app.weave.local.":          "app.weave.local.",
+		"z.y.app.weave.local.":      "", // y is the closest encloser, and has no wildcard
+		"a.db.app.weave.local.":     "", // likewise db
+		"other.weave.local.":        "",
+		"web.app.weave.local.com.":  "",
+		"*.app.weave.local.":        "*.app.weave.local.",
+		"www.*.app.weave.local.":    "", // only the wildcard itself matches "*"
+		"web.app.other.weave.local": "",
+	} {
+		name, found := nameserver.Resolve(hostname)
+		require.Equal(t, expected != "", found, hostname)
+		require.Equal(t, expected, name, hostname)
+	}
+
+	// Tombstoned entries do not count
+	nameserver.Delete("x.y.app.weave.local.", "c3", "*", 0)
+	name, found := nameserver.Resolve("z.y.app.weave.local.")
+	require.True(t, found)
+	require.Equal(t, "*.app.weave.local.", name)
+
+	// Nor do the entries of peers that have gone, but revived ones do
+	other, err := mesh.PeerNameFromString("00:00:00:03:00:00")
+	require.NoError(t, err)
+	nameserver.AddEntry("a.b.other.weave.local.", "c4", other, address.Address(4))
+	_, found = nameserver.Resolve("b.other.weave.local.")
+	require.True(t, found)
+	nameserver.PeerGone(other)
+	_, found = nameserver.Resolve("b.other.weave.local.")
+	require.False(t, found)
+	nameserver.AddEntry("x.y.app.weave.local.", "c3", nameserver.ourName, address.Address(3))
+	_, found = nameserver.Resolve("z.y.app.weave.local.")
+	require.False(t, found)
+
+	_, err = nameserver.ReverseLookup(address.Address(1))
+	require.Error(t, err, "no reverse lookups of wildcards")
+}
+
+func TestWildcards(t *testing.T) {
+	dnsserver, nameserver, udpPort, _ := startServer(t, &dns.ClientConfig{})
+	defer dnsserver.Stop()
+	nameserver.AddEntryFQDN("*.app.weave.local.", "c1", nameserver.ourName, net.ParseIP("10.2.0.1"))
+	nameserver.AddEntryFQDN("db.app.weave.local.", "c2", nameserver.ourName, net.ParseIP("10.2.0.2"))
+	nameserver.AddEntryFQDN("db.prod.weave.local.", "c3", nameserver.ourName, net.ParseIP("10.2.0.3"))
+
+	query := func(name string, qtype uint16) *dns.Msg {
+		request := &dns.Msg{}
+		request.SetQuestion(name, qtype)
+		response, _, err := (&dns.Client{}).Exchange(request, fmt.Sprintf("127.0.0.1:%d", udpPort))
+		require.NoError(t, err)
+		return response
+	}
+	expectA := func(name, ip string) {
+		response := query(name, dns.TypeA)
+		require.Equal(t, dns.RcodeSuccess, response.Rcode, name)
+		require.Len(t, response.Answer, 1, name)
+		require.Equal(t, name, response.Answer[0].Header().Name, "answered for the name asked")
+		require.Equal(t, ip, response.Answer[0].(*dns.A).A.String(), name)
+	}
+
+	expectA("web.app.weave.local.", "10.2.0.1")
+	expectA("db.app.weave.local.", "10.2.0.2")
+
+	// The parent of registered names exists, with no records
+	response := query("prod.weave.local.", dns.TypeA)
+	require.Equal(t, dns.RcodeSuccess, response.Rcode)
+	require.Len(t, response.Answer, 0)
+	require.Equal(t, dns.RcodeNameError, query("web.prod.weave.local.", dns.TypeA).Rcode)
+
+	// Relative names are ours if we have them, however many labels,
+	// wildcards included
+	expectA("db.prod.", "10.2.0.3")
+	expectA("web.app.", "10.2.0.1")
+
+	// but a wildcard for the whole domain does not make every name ours
+	nameserver.AddEntryFQDN("*.weave.local.", "c4", nameserver.ourName, net.ParseIP("10.2.0.4"))
+	expectA("web.weave.local.", "10.2.0.4")
+	require.Equal(t, dns.RcodeServerFailure, query("www.example.com.", dns.TypeA).Rcode, "sent upstream")
+}
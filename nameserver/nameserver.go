@@ -2,6 +2,7 @@ package nameserver
 
 import (
 	"fmt"
+	"net"
 	"sync"
 	"time"
 
@@ -9,6 +10,7 @@ import (
 	"github.com/weaveworks/mesh"
 
 	"github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/db"
 	"github.com/weaveworks/weave/net/address"
 )
 
@@ -35,11 +37,20 @@ const (
 type Nameserver struct {
 	sync.RWMutex
 	ourName     mesh.PeerName
+	zone        string // locality, e.g. a datacenter, for answer ordering
 	domain      string
 	gossip      mesh.Gossip
 	entries     Entries
+	names       map[string]int // live entries at or below each name, lowercased
+	db          db.DB
 	isKnownPeer func(mesh.PeerName) bool
 	quit        chan struct{}
+	serial      uint32 // of our zone, for transfers: the latest Stamp of any change
+
+	// What decides whether our entries are Unhealthy
+	unhealthy   map[string]bool // containers whose health check is failing
+	probes      map[string]Probe
+	probeFailed map[probeKey]bool
 }
 
 func New(ourName mesh.PeerName, domain string, isKnownPeer func(mesh.PeerName) bool) *Nameserver {
@@ -48,6 +59,10 @@ func New(ourName mesh.PeerName, domain string, isKnownPeer func(mesh.PeerName) b
 		domain:      dns.Fqdn(domain),
 		isKnownPeer: isKnownPeer,
 		quit:        make(chan struct{}),
+		names:       make(map[string]int),
+		unhealthy:   make(map[string]bool),
+		probes:      make(map[string]Probe),
+		probeFailed: make(map[probeKey]bool),
 	}
 }
 
@@ -55,15 +70,30 @@ func (n *Nameserver) SetGossip(gossip mesh.Gossip) {
 	n.gossip = gossip
 }
 
+// SetDB sets where static entries are kept across restarts.
+func (n *Nameserver) SetDB(d db.DB) {
+	n.db = d
+}
+
+// SetZone sets the locality zone of our entries, for the local answer
+// policy to prefer addresses in the same zone.
+func (n *Nameserver) SetZone(zone string) {
+	n.zone = zone
+}
+
 func (n *Nameserver) Start() {
+	n.loadStatic()
 	go func() {
 		ticker := time.Tick(tombstoneTimeout)
+		probeTicker := time.Tick(probeInterval)
 		for {
 			select {
 			case <-n.quit:
 				return
 			case <-ticker:
 				n.deleteTombstones()
+			case <-probeTicker:
+				n.runProbes()
 			}
 		}
 	}()
@@ -84,49 +114,162 @@ func (n *Nameserver) broadcastEntries(es ...Entry) {
 }
 
 func (n *Nameserver) AddEntry(hostname, containerid string, origin mesh.PeerName, addr address.Address) {
+	n.addEntry(Entry{Hostname: hostname, ContainerID: containerid, Origin: origin, Addr: addr})
+}
+
+// AddEntryIP is like AddEntry, for an ipv4 or ipv6 address.
+func (n *Nameserver) AddEntryIP(hostname, containerid string, origin mesh.PeerName, ip net.IP) {
+	upper, addr := splitIP(ip)
+	n.addEntry(Entry{Hostname: hostname, ContainerID: containerid, Origin: origin, Upper: upper, Addr: addr})
+}
+
+func (n *Nameserver) addEntry(entry Entry) {
 	n.Lock()
-	n.infof("adding entry for %s: %s -> %s", containerid, hostname, addr.String())
-	entry := n.entries.add(hostname, containerid, origin, addr)
+	entry.Unhealthy = n.isUnhealthy(&entry)
+	if entry.Origin == n.ourName {
+		entry.Zone = n.zone
+	}
+	n.infof("adding entry for %s: %s", entry.ContainerID, entry.String())
+	entry.addLowercase()
+	if existing, found := n.entries.findEqual(&entry); !found || existing.Tombstone > 0 || !existing.sameAttributes(&entry) {
+		entry.Stamp = n.nextStamp()
+		n.serial = uint32(entry.Stamp)
+	}
+	n.indexChanges(Entries{entry}, func() {
+		entry = n.entries.add(entry)
+	})
 	n.Unlock()
 	n.broadcastEntries(entry)
 }
 
-func (n *Nameserver) AddEntryFQDN(fqdn, containerid string, origin mesh.PeerName, addr address.Address) {
+func (n *Nameserver) AddEntryFQDN(fqdn, containerid string, origin mesh.PeerName, ip net.IP) {
+	n.AddWeightedEntryFQDN(fqdn, containerid, origin, ip, 0)
+}
+
+// AddWeightedEntryFQDN is like AddEntryFQDN, giving the address a
+// weight for the weighted and local answer policies.
+func (n *Nameserver) AddWeightedEntryFQDN(fqdn, containerid string, origin mesh.PeerName, ip net.IP, weight uint16) {
 	hostname := dns.Fqdn(fqdn)
 	if !dns.IsSubDomain(n.domain, hostname) {
-		n.infof("Ignoring registration %s %s %s (not a subdomain of %s)", hostname, addr.String(), containerid, n.domain)
+		n.infof("Ignoring registration %s %s %s (not a subdomain of %s)", hostname, ip, containerid, n.domain)
+		return
+	}
+	upper, addr := splitIP(ip)
+	n.addEntry(Entry{Hostname: hostname, ContainerID: containerid, Origin: origin, Upper: upper, Addr: addr, AnswerWeight: weight})
+}
+
+// AddService registers service for the container with the given fqdn
+// and address, to be answered for SRV queries of service.Name+"."+fqdn
+func (n *Nameserver) AddService(fqdn, containerid string, origin mesh.PeerName, ip net.IP, service Service) {
+	target := dns.Fqdn(fqdn)
+	if !dns.IsSubDomain(n.domain, target) {
+		n.infof("Ignoring service %s of %s %s (not a subdomain of %s)", service, target, containerid, n.domain)
 		return
 	}
-	n.AddEntry(hostname, containerid, origin, addr)
+	upper, addr := splitIP(ip)
+	n.addEntry(Entry{
+		Hostname:    service.Name + "." + target,
+		ContainerID: containerid,
+		Origin:      origin,
+		Upper:       upper,
+		Addr:        addr,
+		Target:      target,
+		Port:        service.Port,
+		Priority:    service.Priority,
+		Weight:      service.Weight,
+	})
 }
 
+// Lookup returns the ipv4 addresses of hostname.
 func (n *Nameserver) Lookup(hostname string) []address.Address {
+	result := []address.Address{}
+	for _, e := range n.lookupAddrs(hostname, false) {
+		result = append(result, e.Addr)
+	}
+	return result
+}
+
+// LookupIPv6 returns the ipv6 addresses of hostname.
+func (n *Nameserver) LookupIPv6(hostname string) []net.IP {
+	result := []net.IP{}
+	for _, e := range n.lookupAddrs(hostname, true) {
+		result = append(result, e.IP())
+	}
+	return result
+}
+
+// lookupAddrs returns the entries for the ipv4, or ipv6, addresses of
+// hostname that may be answered.
+func (n *Nameserver) lookupAddrs(hostname string, ipv6 bool) []Entry {
 	n.RLock()
 	defer n.RUnlock()
 
 	entries := n.entries.lookup(hostname)
-	result := []address.Address{}
+	result := []Entry{}
 	for _, e := range entries {
-		if e.Tombstone > 0 {
+		if e.Tombstone > 0 || e.Unhealthy || e.isAlias() || e.isService() || e.isIPv6() != ipv6 {
 			continue
 		}
-		result = append(result, e.Addr)
+		result = append(result, e)
+	}
+	if ipv6 {
+		n.debugf("lookup ipv6 %s -> %v", hostname, result)
+	} else {
+		n.debugf("lookup %s -> %v", hostname, result)
+	}
+	return result
+}
+
+// LookupServices returns the SRV entries for name.
+func (n *Nameserver) LookupServices(name string) []Entry {
+	n.RLock()
+	defer n.RUnlock()
+
+	entries := n.entries.lookup(name)
+	result := []Entry{}
+	for _, e := range entries {
+		if e.Tombstone > 0 || e.Unhealthy || !e.isService() {
+			continue
+		}
+		result = append(result, e)
 	}
-	n.debugf("lookup %s -> %s", hostname, &result)
+	n.debugf("lookup services %s -> %v", name, result)
 	return result
 }
 
+// LookupAlias returns the name hostname is an alias of, if any.
+func (n *Nameserver) LookupAlias(hostname string) (string, bool) {
+	n.RLock()
+	defer n.RUnlock()
+
+	for _, e := range n.entries.lookup(hostname) {
+		if e.Tombstone == 0 && e.isAlias() {
+			n.debugf("lookup alias %s -> %s", hostname, e.Alias)
+			return e.Alias, true
+		}
+	}
+	return "", false
+}
+
 func (n *Nameserver) ReverseLookup(ip address.Address) (string, error) {
+	return n.reverseLookup(address.Upper96{}, ip)
+}
+
+func (n *Nameserver) ReverseLookupIPv6(ip net.IP) (string, error) {
+	return n.reverseLookup(splitIP(ip))
+}
+
+func (n *Nameserver) reverseLookup(upper address.Upper96, ip address.Address) (string, error) {
 	n.RLock()
 	defer n.RUnlock()
 
 	match, err := n.entries.first(func(e *Entry) bool {
-		return e.Tombstone == 0 && e.Addr == ip
+		return e.Tombstone == 0 && !e.isAlias() && !e.isService() && !e.isWildcard() && e.Upper == upper && e.Addr == ip
 	})
 	if err != nil {
 		return "", err
 	}
-	n.debugf("reverse lookup %s -> %s", ip, match.Hostname)
+	n.debugf("reverse lookup %s -> %s", upper.IP(ip), match.Hostname)
 	return match.Hostname, nil
 }
 
@@ -135,7 +278,8 @@ func (n *Nameserver) ContainerDestroyed(ident string) {}
 
 func (n *Nameserver) ContainerDied(ident string) {
 	n.Lock()
-	entries := n.entries.tombstone(n.ourName, func(e *Entry) bool {
+	delete(n.unhealthy, ident)
+	entries := n.tombstone(func(e *Entry) bool {
 		if e.ContainerID == ident {
 			n.infof("container %s died; tombstoning entry %s", ident, e.String())
 			return true
@@ -150,16 +294,33 @@ func (n *Nameserver) PeerGone(peer mesh.PeerName) {
 	n.infof("peer %s gone", peer.String())
 	n.Lock()
 	defer n.Unlock()
+	removed := false
 	n.entries.filter(func(e *Entry) bool {
-		return e.Origin != peer
+		if e.Origin != peer {
+			return true
+		}
+		if e.Tombstone == 0 {
+			n.index(e.lHostname, -1)
+			removed = true
+		}
+		return false
 	})
+	// No entry records the removal, so it is stamped here
+	if removed {
+		n.serial = uint32(n.nextStamp())
+	}
 }
 
 func (n *Nameserver) Delete(hostname, containerid, ipStr string, ip address.Address) {
+	n.delete(hostname, containerid, ipStr, address.Upper96{}, ip)
+}
+
+func (n *Nameserver) delete(hostname, containerid, ipStr string, upper address.Upper96, ip address.Address) {
 	n.Lock()
 	n.infof("tombstoning hostname=%s, container=%s, ip=%s", hostname, containerid, ipStr)
-	entries := n.entries.tombstone(n.ourName, func(e *Entry) bool {
-		if hostname != "*" && e.Hostname != hostname {
+	entries := n.tombstone(func(e *Entry) bool {
+		// A hostname matches the services it is the target of, too
+		if hostname != "*" && e.Hostname != hostname && e.Target != hostname {
 			return false
 		}
 
@@ -167,7 +328,7 @@ func (n *Nameserver) Delete(hostname, containerid, ipStr string, ip address.Addr
 			return false
 		}
 
-		if ipStr != "*" && e.Addr != ip {
+		if ipStr != "*" && (e.Upper != upper || e.Addr != ip) {
 			return false
 		}
 
@@ -241,7 +402,11 @@ func (n *Nameserver) receiveGossip(msg []byte) (mesh.GossipData, mesh.GossipData
 		return true
 	})
 
-	newEntries := n.entries.merge(gossip.Entries)
+	var newEntries Entries
+	n.indexChanges(gossip.Entries, func() {
+		newEntries = n.entries.merge(gossip.Entries)
+	})
+	n.sawChanges(newEntries)
 	n.Unlock() // unlock before attempting to broadcast
 
 	// Note that all overriddenEntries have been merged into our entries, either
@@ -268,6 +433,55 @@ func (n *Nameserver) OnGossipBroadcast(_ mesh.PeerName, msg []byte) (mesh.Gossip
 	return entries, err
 }
 
+// Serial is the serial number of our zone, which goes up whenever our
+// entries change.  It is the Stamp of the latest change, which travels
+// with the entry, so peers that have seen the same changes agree on it.
+func (n *Nameserver) Serial() uint32 {
+	n.RLock()
+	defer n.RUnlock()
+	return n.serial
+}
+
+// nextStamp returns the Stamp for a change made here: the current
+// time, or one more than the serial if that is later, so that every
+// change moves the serial on.  Called with the lock held.
+func (n *Nameserver) nextStamp() int64 {
+	if stamp := now(); stamp > int64(n.serial) {
+		return stamp
+	}
+	return int64(n.serial) + 1
+}
+
+// sawChanges moves the serial on for changed entries received from
+// other peers: to their latest Stamp, or, should that not be later,
+// e.g. for a change that took a while to reach us, or that came from
+// a peer which predates stamps, by a change of our own.  Called with
+// the lock held.
+func (n *Nameserver) sawChanges(changed Entries) {
+	if len(changed) == 0 {
+		return
+	}
+	var latest int64
+	for _, e := range changed {
+		if e.Stamp > latest {
+			latest = e.Stamp
+		}
+	}
+	if latest <= int64(n.serial) {
+		latest = n.nextStamp()
+	}
+	n.serial = uint32(latest)
+}
+
+// splitIP returns an ipv4 address with zero upper bits, as everywhere
+// else in weave, even if it is given in its 16-byte form.
+func splitIP(ip net.IP) (address.Upper96, address.Address) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return address.Upper96{}, address.FromIP4(ip4)
+	}
+	return address.FromIP6(ip)
+}
+
 // Logging
 
 func (n *Nameserver) infof(fmt string, args ...interface{}) {
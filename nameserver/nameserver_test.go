@@ -260,6 +260,7 @@ func TestTombstoneDeletion(t *testing.T) {
 		Hostname:    "hostname",
 		Version:     1,
 		Tombstone:   1234,
+		Stamp:       1235, // later than that of the addition, in the same second
 	}}), nameserver.entries)
 
 	now = func() int64 { return 1234 + int64(tombstoneTimeout/time.Second) + 1 }
@@ -0,0 +1,180 @@
+package nameserver
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// WeightLabel is the container label giving the weight of its
+// addresses, for the weighted and local answer policies
+const WeightLabel = "works.weave.dns.weight"
+
+// Policy is how the addresses of a name are ordered in answers; since
+// clients mostly use the first, it decides where traffic goes.
+type Policy string
+
+const (
+	// PolicyRandom shuffles addresses uniformly
+	PolicyRandom Policy = "random"
+	// PolicyWeighted shuffles them in proportion to their weights
+	PolicyWeighted Policy = "weighted"
+	// PolicyLocal puts the addresses of containers on this peer first,
+	// then those in its zone, then the rest, each weighted
+	PolicyLocal Policy = "local"
+)
+
+func checkPolicy(s string) (Policy, error) {
+	switch policy := Policy(s); policy {
+	case PolicyRandom, PolicyWeighted, PolicyLocal:
+		return policy, nil
+	}
+	return "", fmt.Errorf("invalid policy %q: expected %s, %s or %s", s, PolicyRandom, PolicyWeighted, PolicyLocal)
+}
+
+// ParsePolicy parses an answer policy given as [<domain>=]<policy>,
+// e.g. db.weave.local=local; the domain is empty if not given.
+func ParsePolicy(s string) (string, Policy, error) {
+	domain, name := "", s
+	if i := strings.Index(s, "="); i >= 0 {
+		domain, name = s[:i], s[i+1:]
+		if domain == "" {
+			return "", "", fmt.Errorf("invalid policy %q: empty domain", s)
+		}
+	}
+	policy, err := checkPolicy(name)
+	return domain, policy, err
+}
+
+// ParseWeight parses the weight of an address, from 1 to 65535
+func ParseWeight(s string) (uint16, error) {
+	weight, err := strconv.ParseUint(s, 10, 16)
+	if err != nil || weight == 0 {
+		return 0, fmt.Errorf("invalid weight %q: expected 1 to 65535", s)
+	}
+	return uint16(weight), nil
+}
+
+// SetPolicy orders answers for names in domain, which must be in ours,
+// according to policy.  The most specific domain's policy applies.
+func (d *DNSServer) SetPolicy(domain string, policy Policy) error {
+	domain = strings.ToLower(dns.Fqdn(domain))
+	if _, ok := dns.IsDomainName(domain); !ok || !dns.IsSubDomain(d.domain, domain) {
+		return fmt.Errorf("invalid domain %q: not in %s", domain, d.domain)
+	}
+	if _, err := checkPolicy(string(policy)); err != nil {
+		return err
+	}
+	d.Lock()
+	defer d.Unlock()
+	d.policies[domain] = policy
+	d.ns.infof("ordering answers in %s by %s policy", domain, policy)
+	return nil
+}
+
+func (d *DNSServer) DeletePolicy(domain string) {
+	domain = strings.ToLower(dns.Fqdn(domain))
+	d.Lock()
+	defer d.Unlock()
+	if _, found := d.policies[domain]; found {
+		delete(d.policies, domain)
+		d.ns.infof("no longer ordering answers in %s by policy", domain)
+	}
+}
+
+// Policies returns the policy of each domain that has one.
+func (d *DNSServer) Policies() map[string]Policy {
+	d.RLock()
+	defer d.RUnlock()
+	result := make(map[string]Policy, len(d.policies))
+	for domain, policy := range d.policies {
+		result[domain] = policy
+	}
+	return result
+}
+
+// policyFor returns the policy of the most specific domain name is in
+func (d *DNSServer) policyFor(name string) Policy {
+	name = strings.ToLower(dns.Fqdn(name))
+	d.RLock()
+	defer d.RUnlock()
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if policy, found := d.policies[name[off:]]; found {
+			return policy
+		}
+	}
+	return PolicyRandom
+}
+
+func (d *DNSServer) policiesString() string {
+	policies := d.Policies()
+	domains := make([]string, 0, len(policies))
+	for domain := range policies {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	var lines []string
+	for _, domain := range domains {
+		lines = append(lines, fmt.Sprintf("  %s policy for %s\n", policies[domain], domain))
+	}
+	return strings.Join(lines, "")
+}
+
+// orderEntries puts the address entries for name in the order its
+// policy calls for.
+func (d *DNSServer) orderEntries(name string, entries []Entry) {
+	switch d.policyFor(name) {
+	case PolicyWeighted:
+		weightedShuffle(entries)
+	case PolicyLocal:
+		var ours, zone, others []Entry
+		for _, e := range entries {
+			switch {
+			case e.Origin == d.ns.ourName:
+				ours = append(ours, e)
+			case d.ns.zone != "" && e.Zone == d.ns.zone:
+				zone = append(zone, e)
+			default:
+				others = append(others, e)
+			}
+		}
+		entries = entries[:0]
+		for _, es := range [][]Entry{ours, zone, others} {
+			weightedShuffle(es)
+			entries = append(entries, es...)
+		}
+	default:
+		for i := range entries {
+			j := rand.Intn(i + 1)
+			entries[i], entries[j] = entries[j], entries[i]
+		}
+	}
+}
+
+func (e1 *Entry) answerWeight() int {
+	if e1.AnswerWeight == 0 {
+		return 1
+	}
+	return int(e1.AnswerWeight)
+}
+
+// weightedShuffle picks each entry in turn from those left, with
+// probability in proportion to its weight
+func weightedShuffle(entries []Entry) {
+	total := 0
+	for i := range entries {
+		total += entries[i].answerWeight()
+	}
+	for i := range entries {
+		r, j := rand.Intn(total), i
+		for ; r >= entries[j].answerWeight(); j++ {
+			r -= entries[j].answerWeight()
+		}
+		entries[i], entries[j] = entries[j], entries[i]
+		total -= entries[i].answerWeight()
+	}
+}
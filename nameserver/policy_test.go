@@ -0,0 +1,104 @@
+package nameserver
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+
+	"github.com/weaveworks/weave/net/address"
+)
+
+func TestParsePolicy(t *testing.T) {
+	domain, policy, err := ParsePolicy("local")
+	require.NoError(t, err)
+	require.Equal(t, "", domain)
+	require.Equal(t, PolicyLocal, policy)
+
+	domain, policy, err = ParsePolicy("db.weave.local=weighted")
+	require.NoError(t, err)
+	require.Equal(t, "db.weave.local", domain)
+	require.Equal(t, PolicyWeighted, policy)
+
+	for _, s := range []string{"", "nearest", "=local", "db.weave.local="} {
+		_, _, err := ParsePolicy(s)
+		require.Error(t, err, s)
+	}
+
+	for _, s := range []string{"", "0", "65536", "-1", "one"} {
+		_, err := ParseWeight(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestWeightedShuffle(t *testing.T) {
+	entries := []Entry{{Addr: 1, AnswerWeight: 9}, {Addr: 2}}
+	first := make(map[address.Address]int)
+	for i := 0; i < 1000; i++ {
+		weightedShuffle(entries)
+		require.Len(t, entries, 2)
+		require.NotEqual(t, entries[0].Addr, entries[1].Addr)
+		first[entries[0].Addr]++
+	}
+	// 900 expected
+	require.InDelta(t, 900, first[1], 60)
+}
+
+func TestPolicies(t *testing.T) {
+	dnsserver, nameserver, udpPort, _ := startServer(t, nil)
+	defer dnsserver.Stop()
+	nameserver.SetZone("dc1")
+
+	other, _ := mesh.PeerNameFromString("00:00:00:03:00:00")
+	faraway, _ := mesh.PeerNameFromString("00:00:00:04:00:00")
+	nameserver.AddEntryFQDN("db.weave.local.", "c1", nameserver.ourName, address.Address(1).IP4())
+	nameserver.addEntry(Entry{Hostname: "db.weave.local.", ContainerID: "c2", Origin: other, Addr: 2, Zone: "dc1"})
+	nameserver.addEntry(Entry{Hostname: "db.weave.local.", ContainerID: "c3", Origin: faraway, Addr: 3, Zone: "dc2"})
+	nameserver.addEntry(Entry{Hostname: "db.weave.local.", ContainerID: "c4", Origin: faraway, Addr: 4, Zone: "dc2"})
+
+	query := func() []string {
+		request := &dns.Msg{}
+		request.SetQuestion("db.weave.local.", dns.TypeA)
+		response, _, err := (&dns.Client{}).Exchange(request, fmt.Sprintf("127.0.0.1:%d", udpPort))
+		require.NoError(t, err)
+		var addrs []string
+		for _, answer := range response.Answer {
+			addrs = append(addrs, answer.(*dns.A).A.String())
+		}
+		return addrs
+	}
+
+	require.Error(t, dnsserver.SetPolicy("example.com", PolicyLocal), "not our domain")
+	require.Error(t, dnsserver.SetPolicy("weave.local", "nearest"))
+	require.NoError(t, dnsserver.SetPolicy("weave.local", PolicyLocal))
+	for i := 0; i < 10; i++ {
+		addrs := query()
+		require.Len(t, addrs, 4)
+		require.Equal(t, []string{"0.0.0.1", "0.0.0.2"}, addrs[:2], "ours, then our zone's")
+		require.Subset(t, []string{"0.0.0.3", "0.0.0.4"}, addrs[2:])
+	}
+
+	// The most specific domain wins
+	require.NoError(t, dnsserver.SetPolicy("db.weave.local", PolicyWeighted))
+	require.Equal(t, map[string]Policy{"weave.local.": PolicyLocal, "db.weave.local.": PolicyWeighted}, dnsserver.Policies())
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		seen[query()[0]] = true
+	}
+	require.Len(t, seen, 4)
+
+	// Weights are attributes of an entry, updated by registering again
+	dnsserver.DeletePolicy("db.weave.local")
+	require.NoError(t, dnsserver.SetPolicy("weave.local", PolicyWeighted))
+	nameserver.AddWeightedEntryFQDN("db.weave.local.", "c1", nameserver.ourName, address.Address(1).IP4(), 1000)
+	require.Len(t, nameserver.Lookup("db.weave.local."), 4)
+	count := 0
+	for i := 0; i < 100; i++ {
+		if query()[0] == "0.0.0.1" {
+			count++
+		}
+	}
+	require.True(t, count > 90, "weighted first %d times", count)
+}
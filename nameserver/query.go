@@ -0,0 +1,131 @@
+package nameserver
+
+import (
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+
+	"github.com/weaveworks/weave/common"
+)
+
+// Where a query was answered from
+const (
+	sourceLocal     = "local"     // our domain
+	sourceReverse   = "reverse"   // reverse lookups of our addresses
+	sourceRecursive = "recursive" // the upstream servers
+	sourceForward   = "forward"   // a forwarding zone's servers
+)
+
+type queryMetrics struct {
+	queries  *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+}
+
+func newQueryMetrics() *queryMetrics {
+	return &queryMetrics{
+		queries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "weave_dns_queries_total",
+			Help: "Number of DNS queries answered.",
+		}, []string{"source", "type", "rcode"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "weave_dns_query_duration_seconds",
+			Help:    "Time taken to answer DNS queries.",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 4, 9),
+		}, []string{"source", "type"}),
+	}
+}
+
+// Describe and Collect make the DNS server a prometheus.Collector of
+// its query metrics.
+func (d *DNSServer) Describe(ch chan<- *prometheus.Desc) {
+	d.metrics.queries.Describe(ch)
+	d.metrics.duration.Describe(ch)
+}
+
+func (d *DNSServer) Collect(ch chan<- prometheus.Metric) {
+	d.metrics.queries.Collect(ch)
+	d.metrics.duration.Collect(ch)
+}
+
+// LogQueries turns logging of every query answered on or off.
+func (d *DNSServer) LogQueries(enable bool) {
+	d.Lock()
+	defer d.Unlock()
+	d.logQueries = enable
+}
+
+// Remembers the response written, to log and count it by
+type recordingWriter struct {
+	dns.ResponseWriter
+	response *dns.Msg
+}
+
+func (w *recordingWriter) WriteMsg(m *dns.Msg) error {
+	w.response = m
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// instrument wraps f so the queries it answers are counted, timed,
+// and logged if enabled.
+func (h *handler) instrument(source string, f dns.HandlerFunc) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, req *dns.Msg) {
+		start := time.Now()
+		rw := &recordingWriter{ResponseWriter: w}
+		f(rw, req)
+		h.observe(w, req, rw.response, source, time.Since(start))
+	}
+}
+
+func (h *handler) observe(w dns.ResponseWriter, req, response *dns.Msg, source string, latency time.Duration) {
+	var name, qtype string
+	if len(req.Question) == 1 {
+		name = req.Question[0].Name
+		qtype = typeString(req.Question[0].Qtype)
+	} else {
+		qtype = "none"
+	}
+	rcode := "none" // nothing was written
+	if response != nil {
+		rcode = rcodeString(response.Rcode)
+	}
+	h.metrics.queries.WithLabelValues(source, qtype, rcode).Inc()
+	h.metrics.duration.WithLabelValues(source, qtype).Observe(latency.Seconds())
+
+	h.RLock()
+	logQueries := h.logQueries
+	h.RUnlock()
+	if !logQueries {
+		return
+	}
+	client := w.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+	common.Log.WithFields(logrus.Fields{
+		"client":  client,
+		"name":    name,
+		"type":    qtype,
+		"rcode":   rcode,
+		"latency": latency,
+		"source":  source,
+	}).Infof("[nameserver %s] query", h.ns.ourName)
+}
+
+// Unknown types and rcodes are lumped together, to bound the number
+// of label values
+func typeString(qtype uint16) string {
+	if s, found := dns.TypeToString[qtype]; found {
+		return s
+	}
+	return "other"
+}
+
+func rcodeString(rcode int) string {
+	if s, found := dns.RcodeToString[rcode]; found {
+		return s
+	}
+	return "other"
+}
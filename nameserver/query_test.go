@@ -0,0 +1,72 @@
+package nameserver
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/weave/net/address"
+)
+
+// Returns the value of each counter and the count of each histogram,
+// by their label values joined with commas
+func collectQueryMetrics(t *testing.T, collector prometheus.Collector) (map[string]float64, map[string]uint64) {
+	ch := make(chan prometheus.Metric, 100)
+	collector.Collect(ch)
+	close(ch)
+	counts, durations := make(map[string]float64), make(map[string]uint64)
+	for metric := range ch {
+		var m dto.Metric
+		require.NoError(t, metric.Write(&m))
+		var key string
+		for i, label := range m.Label {
+			if i > 0 {
+				key += ","
+			}
+			key += label.GetValue()
+		}
+		if m.Counter != nil {
+			counts[key] = m.Counter.GetValue()
+		} else {
+			durations[key] = m.Histogram.GetSampleCount()
+		}
+	}
+	return counts, durations
+}
+
+func TestQueryMetrics(t *testing.T) {
+	dnsserver, nameserver, udpPort, _ := startServer(t, nil)
+	defer dnsserver.Stop()
+	dnsserver.LogQueries(true)
+	nameserver.AddEntry("test.weave.local.", "c1", nameserver.ourName, address.Address(1))
+
+	query := func(name string, qtype uint16) {
+		request := &dns.Msg{}
+		request.SetQuestion(name, qtype)
+		_, _, err := (&dns.Client{}).Exchange(request, fmt.Sprintf("127.0.0.1:%d", udpPort))
+		require.NoError(t, err)
+	}
+	query("test.weave.local.", dns.TypeA)
+	query("test.weave.local.", dns.TypeA)
+	query("test.weave.local.", dns.TypeMX)
+	query("nothing.weave.local.", dns.TypeA)
+	query("1.0.0.0.in-addr.arpa.", dns.TypePTR)
+
+	counts, durations := collectQueryMetrics(t, dnsserver)
+	// labels are sorted by name: rcode, source, type
+	require.Equal(t, map[string]float64{
+		"NOERROR,local,A":     2,
+		"NOERROR,local,MX":    1,
+		"NXDOMAIN,local,A":    1,
+		"NOERROR,reverse,PTR": 1,
+	}, counts)
+	require.Equal(t, map[string]uint64{
+		"local,A":     3,
+		"local,MX":    1,
+		"reverse,PTR": 1,
+	}, durations)
+}
@@ -0,0 +1,61 @@
+package nameserver
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ServiceLabel is the container label listing the services of a
+// container, in the form accepted by ParseServices
+const ServiceLabel = "works.weave.dns.srv"
+
+// Service is an SRV record of a container: the service name, like
+// _http._tcp, is prefixed to the container's fqdn to make the record name
+type Service struct {
+	Name     string
+	Port     uint16
+	Priority uint16
+	Weight   uint16
+}
+
+func (s Service) String() string {
+	return fmt.Sprintf("%s:%d:%d:%d", s.Name, s.Port, s.Priority, s.Weight)
+}
+
+// ParseService parses a service given as
+// _<service>._<proto>:<port>[:<priority>[:<weight>]]
+func ParseService(s string) (Service, error) {
+	fields := strings.Split(s, ":")
+	if len(fields) < 2 || len(fields) > 4 {
+		return Service{}, fmt.Errorf("invalid service %q: expected _<service>._<proto>:<port>[:<priority>[:<weight>]]", s)
+	}
+	labels := strings.Split(fields[0], ".")
+	if len(labels) != 2 || len(labels[0]) < 2 || len(labels[1]) < 2 ||
+		labels[0][0] != '_' || labels[1][0] != '_' {
+		return Service{}, fmt.Errorf("invalid service name %q: expected _<service>._<proto>", fields[0])
+	}
+	var numbers [3]uint16
+	for i, field := range fields[1:] {
+		v, err := strconv.ParseUint(field, 10, 16)
+		if err != nil {
+			return Service{}, fmt.Errorf("invalid service %q: %s", s, err)
+		}
+		numbers[i] = uint16(v)
+	}
+	return Service{Name: fields[0], Port: numbers[0], Priority: numbers[1], Weight: numbers[2]}, nil
+}
+
+// ParseServices parses a comma or space separated list of services, as
+// given in ServiceLabel
+func ParseServices(s string) ([]Service, error) {
+	var services []Service
+	for _, field := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' }) {
+		service, err := ParseService(field)
+		if err != nil {
+			return nil, err
+		}
+		services = append(services, service)
+	}
+	return services, nil
+}
@@ -0,0 +1,26 @@
+package nameserver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseServices(t *testing.T) {
+	services, err := ParseServices("_http._tcp:80, _sip._udp:5060:10:20 _ldap._tcp:389:1")
+	require.NoError(t, err)
+	require.Equal(t, []Service{
+		{Name: "_http._tcp", Port: 80},
+		{Name: "_sip._udp", Port: 5060, Priority: 10, Weight: 20},
+		{Name: "_ldap._tcp", Port: 389, Priority: 1},
+	}, services)
+
+	services, err = ParseServices("")
+	require.NoError(t, err)
+	require.Len(t, services, 0)
+
+	for _, bad := range []string{"_http._tcp", "http.tcp:80", "_http:80", "_http._tcp:http", "_http._tcp:65536", "_http._tcp:80:1:2:3"} {
+		_, err := ParseService(bad)
+		require.Error(t, err, bad)
+	}
+}
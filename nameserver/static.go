@@ -0,0 +1,157 @@
+package nameserver
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// StaticContainerID stands in for the container of entries added
+	// by the user rather than for a container
+	StaticContainerID = "weave:static"
+
+	staticIdent = "nameserver-static"
+)
+
+// A static entry, as persisted
+type staticEntry struct {
+	Hostname string
+	IP       net.IP
+	Alias    string
+}
+
+func (n *Nameserver) checkStaticName(fqdn string) (string, error) {
+	hostname := dns.Fqdn(fqdn)
+	if _, ok := dns.IsDomainName(hostname); !ok {
+		return "", fmt.Errorf("invalid name %q", fqdn)
+	}
+	if !dns.IsSubDomain(n.domain, hostname) {
+		return "", fmt.Errorf("%s is not a subdomain of %s", hostname, n.domain)
+	}
+	return hostname, nil
+}
+
+// AddStatic adds an entry for ip under fqdn that belongs to no
+// container, and so lasts until deleted.
+func (n *Nameserver) AddStatic(fqdn string, ip net.IP) error {
+	hostname, err := n.checkStaticName(fqdn)
+	if err != nil {
+		return err
+	}
+	// A name that is an alias can have no other records (RFC1034 3.6.2)
+	if _, found := n.LookupAlias(hostname); found {
+		return fmt.Errorf("%s is an alias", hostname)
+	}
+	upper, addr := splitIP(ip)
+	n.addEntry(Entry{Hostname: hostname, ContainerID: StaticContainerID, Origin: n.ourName, Upper: upper, Addr: addr})
+	n.saveStatic()
+	return nil
+}
+
+// AddAlias makes fqdn a CNAME for target, which may be inside or
+// outside our domain.
+func (n *Nameserver) AddAlias(fqdn, target string) error {
+	hostname, err := n.checkStaticName(fqdn)
+	if err != nil {
+		return err
+	}
+	target = dns.Fqdn(target)
+	if _, ok := dns.IsDomainName(target); !ok || target == "." {
+		return fmt.Errorf("invalid name %q", target)
+	}
+	if _, found := n.LookupAlias(hostname); found {
+		return fmt.Errorf("%s is already an alias", hostname)
+	}
+	if n.hasRecords(hostname) {
+		return fmt.Errorf("%s already has records, so cannot be an alias", hostname)
+	}
+	n.addEntry(Entry{Hostname: hostname, ContainerID: StaticContainerID, Origin: n.ourName, Alias: target})
+	n.saveStatic()
+	return nil
+}
+
+// hasRecords says whether hostname has records other than an alias
+func (n *Nameserver) hasRecords(hostname string) bool {
+	n.RLock()
+	defer n.RUnlock()
+	for _, e := range n.entries.lookup(hostname) {
+		if e.Tombstone == 0 && !e.isAlias() {
+			return true
+		}
+	}
+	return false
+}
+
+// DeleteStatic removes static address entries matching hostname and
+// ip, where "*" or nil match any.
+func (n *Nameserver) DeleteStatic(hostname string, ip net.IP) {
+	n.deleteStatic(func(e *Entry) bool {
+		if e.isAlias() || (hostname != "*" && e.Hostname != dns.Fqdn(hostname)) {
+			return false
+		}
+		if ip == nil {
+			return true
+		}
+		upper, addr := splitIP(ip)
+		return e.Upper == upper && e.Addr == addr
+	})
+}
+
+// DeleteAlias removes the alias hostname, or all of them for "*".
+func (n *Nameserver) DeleteAlias(hostname string) {
+	n.deleteStatic(func(e *Entry) bool {
+		return e.isAlias() && (hostname == "*" || e.Hostname == dns.Fqdn(hostname))
+	})
+}
+
+func (n *Nameserver) deleteStatic(f func(*Entry) bool) {
+	n.Lock()
+	entries := n.tombstone(func(e *Entry) bool {
+		if e.ContainerID != StaticContainerID || !f(e) {
+			return false
+		}
+		n.infof("tombstoning static entry %v", e)
+		return true
+	})
+	n.Unlock()
+	n.saveStatic()
+	n.broadcastEntries(entries...)
+}
+
+// Takes the write lock so that concurrent saves are not reordered
+func (n *Nameserver) saveStatic() {
+	if n.db == nil {
+		return
+	}
+	n.Lock()
+	defer n.Unlock()
+	var static []staticEntry
+	for _, e := range n.entries {
+		if e.ContainerID == StaticContainerID && e.Origin == n.ourName && e.Tombstone == 0 {
+			static = append(static, staticEntry{Hostname: e.Hostname, IP: e.IP(), Alias: e.Alias})
+		}
+	}
+	if err := n.db.Save(staticIdent, static); err != nil {
+		n.errorf("unable to save static entries: %s", err)
+	}
+}
+
+func (n *Nameserver) loadStatic() {
+	if n.db == nil {
+		return
+	}
+	var static []staticEntry
+	if _, err := n.db.Load(staticIdent, &static); err != nil {
+		n.errorf("unable to load static entries: %s", err)
+		return
+	}
+	for _, s := range static {
+		entry := Entry{Hostname: s.Hostname, ContainerID: StaticContainerID, Origin: n.ourName, Alias: s.Alias}
+		if !entry.isAlias() {
+			entry.Upper, entry.Addr = splitIP(s.IP)
+		}
+		n.addEntry(entry)
+	}
+}
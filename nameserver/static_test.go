@@ -0,0 +1,70 @@
+package nameserver
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+
+	"github.com/weaveworks/weave/db"
+	"github.com/weaveworks/weave/net/address"
+)
+
+func TestStatic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "weavedns")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	d, err := db.NewBoltDB(dir + "/")
+	require.NoError(t, err)
+	defer d.Close()
+
+	peername, err := mesh.PeerNameFromString("00:00:00:02:00:00")
+	require.NoError(t, err)
+	start := func() *Nameserver {
+		ns := New(peername, "weave.local", func(mesh.PeerName) bool { return true })
+		ns.SetDB(d)
+		ns.Start()
+		return ns
+	}
+
+	ns := start()
+	require.NoError(t, ns.AddStatic("db.weave.local", net.ParseIP("10.0.0.9")))
+	require.NoError(t, ns.AddStatic("db.weave.local", net.ParseIP("fd00::9")))
+	require.NoError(t, ns.AddAlias("www.weave.local", "web.weave.local"))
+	require.NoError(t, ns.AddAlias("ext.weave.local", "example.com"))
+	require.Error(t, ns.AddStatic("db.example.com", net.ParseIP("10.0.0.9")), "outside our domain")
+	require.Error(t, ns.AddAlias("www.weave.local", "web2.weave.local"), "already an alias")
+	require.Error(t, ns.AddAlias("empty.weave.local", ""), "no target")
+	require.Error(t, ns.AddAlias("db.weave.local", "web.weave.local"), "name has addresses")
+	require.Error(t, ns.AddStatic("www.weave.local", net.ParseIP("10.0.0.8")), "name is an alias")
+
+	require.Equal(t, []address.Address{address.FromIP4(net.ParseIP("10.0.0.9"))}, ns.Lookup("db.weave.local."))
+	target, found := ns.LookupAlias("www.weave.local.")
+	require.True(t, found)
+	require.Equal(t, "web.weave.local.", target)
+	ns.Stop()
+
+	// Static entries come back after a restart, deletions stick
+	ns = start()
+	require.Len(t, ns.Lookup("db.weave.local."), 1)
+	require.Len(t, ns.LookupIPv6("db.weave.local."), 1)
+	target, found = ns.LookupAlias("ext.weave.local.")
+	require.True(t, found)
+	require.Equal(t, "example.com.", target)
+
+	ns.DeleteStatic("*", net.ParseIP("fd00::9"))
+	ns.DeleteAlias("www.weave.local")
+	ns.Stop()
+
+	ns = start()
+	defer ns.Stop()
+	require.Len(t, ns.Lookup("db.weave.local."), 1)
+	require.Len(t, ns.LookupIPv6("db.weave.local."), 0)
+	_, found = ns.LookupAlias("www.weave.local.")
+	require.False(t, found)
+	_, found = ns.LookupAlias("ext.weave.local.")
+	require.True(t, found)
+}
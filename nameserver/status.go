@@ -1,11 +1,28 @@
 package nameserver
 
+import (
+	"net"
+	"strconv"
+)
+
 type Status struct {
 	Domain   string
 	Upstream []string
 	Address  string
 	TTL      uint32
 	Entries  []EntryStatus
+	Cache    *CacheStatus // nil if caching is disabled
+
+	Forwarders map[string][]string `json:",omitempty"`
+	Policies   map[string]Policy   `json:",omitempty"`
+	Zone       string              `json:",omitempty"`
+}
+
+type CacheStatus struct {
+	Size    int
+	Entries int
+	Hits    uint64
+	Misses  uint64
 }
 
 type EntryStatus struct {
@@ -15,6 +32,7 @@ type EntryStatus struct {
 	Address     string
 	Version     int
 	Tombstone   int64
+	Unhealthy   bool `json:",omitempty"`
 }
 
 func NewStatus(ns *Nameserver, dnsServer *DNSServer) *Status {
@@ -27,13 +45,24 @@ func NewStatus(ns *Nameserver, dnsServer *DNSServer) *Status {
 
 	var entryStatusSlice []EntryStatus
 	for _, entry := range ns.entries {
+		addr := entry.IP().String()
+		if entry.isService() {
+			addr = net.JoinHostPort(addr, strconv.Itoa(int(entry.Port)))
+		}
 		entryStatusSlice = append(entryStatusSlice, EntryStatus{
 			entry.Hostname,
 			entry.Origin.String(),
 			entry.ContainerID,
-			entry.Addr.String(),
+			addr,
 			entry.Version,
-			entry.Tombstone})
+			entry.Tombstone,
+			entry.Unhealthy})
+	}
+
+	var cacheStatus *CacheStatus
+	if dnsServer.cache != nil {
+		cacheStatus = &CacheStatus{Size: dnsServer.cache.size}
+		cacheStatus.Entries, cacheStatus.Hits, cacheStatus.Misses = dnsServer.cache.stats()
 	}
 
 	upstreamConfig, _ := dnsServer.upstream.Config()
@@ -42,5 +71,9 @@ func NewStatus(ns *Nameserver, dnsServer *DNSServer) *Status {
 		upstreamConfig.Servers,
 		dnsServer.address,
 		dnsServer.ttl,
-		entryStatusSlice}
+		entryStatusSlice,
+		cacheStatus,
+		dnsServer.Forwarders(),
+		dnsServer.Policies(),
+		ns.zone}
 }
@@ -0,0 +1,189 @@
+package nameserver
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// SOA timers: names come and go with containers, so secondaries
+	// should check for changes often, and stop answering if they
+	// cannot for long
+	soaRefresh = 60
+	soaRetry   = 10
+	soaExpire  = 3600
+
+	// Records per message of a zone transfer
+	transferChunk = 100
+)
+
+// ParseTransferClients parses the addresses of clients allowed zone
+// transfers, each an ip or CIDR
+func ParseTransferClients(clients []string) ([]*net.IPNet, error) {
+	var result []*net.IPNet
+	for _, client := range clients {
+		if ip := net.ParseIP(client); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			result = append(result, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(client)
+		if err != nil {
+			return nil, fmt.Errorf("invalid transfer client %q: expected an ip or CIDR", client)
+		}
+		result = append(result, ipnet)
+	}
+	return result, nil
+}
+
+// AllowTransfers lets clients in the given networks transfer our
+// domain, with AXFR or IXFR; nobody may by default.
+func (d *DNSServer) AllowTransfers(clients []*net.IPNet) {
+	d.Lock()
+	defer d.Unlock()
+	d.transferClients = clients
+}
+
+func (d *DNSServer) transferAllowed(addr net.Addr) bool {
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	case *net.UDPAddr:
+		ip = addr.IP
+	}
+	d.RLock()
+	defer d.RUnlock()
+	for _, ipnet := range d.transferClients {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Zone transfers are of our entries
+func (n *Nameserver) zoneEntries() []Entry {
+	n.RLock()
+	defer n.RUnlock()
+	var result []Entry
+	for _, e := range n.entries {
+		if e.Tombstone == 0 && !e.Unhealthy {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+func (h *handler) makeSOA() dns.RR {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: h.domain, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: h.ttl},
+		Ns:      "ns." + h.domain,
+		Mbox:    "hostmaster." + h.domain,
+		Serial:  h.ns.Serial(),
+		Refresh: soaRefresh,
+		Retry:   soaRetry,
+		Expire:  soaExpire,
+		Minttl:  h.ttl,
+	}
+}
+
+func (h *handler) makeNS() dns.RR {
+	return &dns.NS{
+		Hdr: dns.RR_Header{Name: h.domain, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: h.ttl},
+		Ns:  "ns." + h.domain,
+	}
+}
+
+// zoneRecords returns the records of every name in our domain, as
+// they would be answered, less duplicates.
+func (h *handler) zoneRecords() []dns.RR {
+	var (
+		records []dns.RR
+		seen    = make(map[string]bool)
+	)
+	for _, e := range h.ns.zoneEntries() {
+		if !dns.IsSubDomain(h.domain, e.Hostname) {
+			continue
+		}
+		header := dns.RR_Header{Name: e.Hostname, Class: dns.ClassINET, Ttl: h.ttl}
+		var rr dns.RR
+		switch {
+		case e.isAlias():
+			header.Rrtype = dns.TypeCNAME
+			rr = &dns.CNAME{Hdr: header, Target: e.Alias}
+		case e.isService():
+			header.Rrtype = dns.TypeSRV
+			rr = &dns.SRV{Hdr: header, Priority: e.Priority, Weight: e.Weight, Port: e.Port, Target: e.Target}
+		case e.isIPv6():
+			header.Rrtype = dns.TypeAAAA
+			rr = &dns.AAAA{Hdr: header, AAAA: e.IP()}
+		default:
+			header.Rrtype = dns.TypeA
+			rr = &dns.A{Hdr: header, A: e.IP()}
+		}
+		if key := strings.ToLower(rr.String()); !seen[key] {
+			seen[key] = true
+			records = append(records, rr)
+		}
+	}
+	return records
+}
+
+// handleTransfer answers an AXFR or IXFR query for our domain.  We keep
+// no history, so IXFR gets the whole zone, as RFC1995 allows, unless
+// the client is up to date.
+func (h *handler) handleTransfer(w dns.ResponseWriter, req *dns.Msg) {
+	q := req.Question[0]
+	if !h.transferAllowed(w.RemoteAddr()) || !strings.EqualFold(dns.Fqdn(q.Name), h.domain) {
+		h.ns.infof("refusing transfer of %s to %s", q.Name, w.RemoteAddr())
+		h.respond(w, h.makeErrorResponse(req, dns.RcodeRefused))
+		return
+	}
+	_, isTCP := w.RemoteAddr().(*net.TCPAddr)
+	soa := h.makeSOA()
+
+	if q.Qtype == dns.TypeIXFR {
+		upToDate := false
+		for _, rr := range req.Ns {
+			if clientSOA, ok := rr.(*dns.SOA); ok && clientSOA.Serial == soa.(*dns.SOA).Serial {
+				upToDate = true
+			}
+		}
+		// Over UDP, per RFC1995, the SOA alone tells the client to
+		// come back over TCP
+		if upToDate || !isTCP {
+			h.respond(w, h.makeResponse(req, []dns.RR{soa}))
+			return
+		}
+	} else if !isTCP {
+		h.respond(w, h.makeErrorResponse(req, dns.RcodeRefused))
+		return
+	}
+
+	records := append([]dns.RR{soa, h.makeNS()}, h.zoneRecords()...)
+	records = append(records, soa)
+	h.ns.infof("transferring %s to %s: %d records", h.domain, w.RemoteAddr(), len(records))
+	for len(records) > 0 {
+		n := transferChunk
+		if n > len(records) {
+			n = len(records)
+		}
+		response := &dns.Msg{}
+		response.SetReply(req)
+		response.Authoritative = true
+		response.Compress = true
+		response.Answer = records[:n]
+		records = records[n:]
+		if err := w.WriteMsg(response); err != nil {
+			h.ns.infof("error transferring %s: %v", h.domain, err)
+			return
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package nameserver
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+
+	"github.com/weaveworks/weave/net/address"
+)
+
+func TestParseTransferClients(t *testing.T) {
+	clients, err := ParseTransferClients([]string{"10.0.0.1", "192.168.0.0/16", "fd00::1"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"10.0.0.1/32", "192.168.0.0/16", "fd00::1/128"},
+		[]string{clients[0].String(), clients[1].String(), clients[2].String()})
+
+	_, err = ParseTransferClients([]string{"10.0.0.300"})
+	require.Error(t, err)
+}
+
+func TestZoneTransfer(t *testing.T) {
+	dnsserver, nameserver, udpPort, tcpPort := startServer(t, nil)
+	defer dnsserver.Stop()
+	tcpAddr := fmt.Sprintf("127.0.0.1:%d", tcpPort)
+	udpAddr := fmt.Sprintf("127.0.0.1:%d", udpPort)
+
+	nameserver.AddEntryFQDN("web.weave.local.", "c1", nameserver.ourName, net.ParseIP("10.2.0.1"))
+	nameserver.AddEntryFQDN("web.weave.local.", "c2", nameserver.ourName, net.ParseIP("10.2.0.1")) // same record
+	nameserver.AddEntryFQDN("web.weave.local.", "c3", nameserver.ourName, net.ParseIP("fd00::1"))
+	nameserver.AddService("web.weave.local.", "c1", nameserver.ourName, net.ParseIP("10.2.0.1"), Service{Name: "_http._tcp", Port: 80})
+	nameserver.AddEntryFQDN("*.app.weave.local.", "c4", nameserver.ourName, net.ParseIP("10.2.0.4"))
+	require.NoError(t, nameserver.AddAlias("www.weave.local", "web.weave.local"))
+	nameserver.AddEntryFQDN("gone.weave.local.", "c5", nameserver.ourName, net.ParseIP("10.2.0.5"))
+	nameserver.ContainerDied("c5")
+
+	transfer := func(qtype uint16, serial uint32) ([]string, error) {
+		request := &dns.Msg{}
+		if qtype == dns.TypeIXFR {
+			request.SetIxfr("weave.local.", serial, ".", ".")
+		} else {
+			request.SetAxfr("weave.local.")
+		}
+		envelopes, err := (&dns.Transfer{}).In(request, tcpAddr)
+		if err != nil {
+			return nil, err
+		}
+		var records []string
+		for envelope := range envelopes {
+			if envelope.Error != nil {
+				return nil, envelope.Error
+			}
+			for _, rr := range envelope.RR {
+				records = append(records, dns.TypeToString[rr.Header().Rrtype]+" "+rr.Header().Name)
+			}
+		}
+		return records, nil
+	}
+
+	_, err := transfer(dns.TypeAXFR, 0)
+	require.Error(t, err, "not allowed by default")
+
+	dnsserver.AllowTransfers([]*net.IPNet{{IP: net.ParseIP("10.0.0.0"), Mask: net.CIDRMask(8, 32)}})
+	_, err = transfer(dns.TypeAXFR, 0)
+	require.Error(t, err, "not allowed from here")
+
+	clients, err := ParseTransferClients([]string{"127.0.0.1"})
+	require.NoError(t, err)
+	dnsserver.AllowTransfers(clients)
+	records, err := transfer(dns.TypeAXFR, 0)
+	require.NoError(t, err)
+	require.Equal(t, "SOA weave.local.", records[0])
+	require.Equal(t, "SOA weave.local.", records[len(records)-1])
+	require.ElementsMatch(t, []string{
+		"NS weave.local.",
+		"A *.app.weave.local.",
+		"SRV _http._tcp.web.weave.local.",
+		"A web.weave.local.",
+		"AAAA web.weave.local.",
+		"CNAME www.weave.local.",
+	}, records[1:len(records)-1])
+
+	// The SOA is also answered over UDP, as secondaries check it
+	request := &dns.Msg{}
+	request.SetQuestion("weave.local.", dns.TypeSOA)
+	response, _, err := (&dns.Client{}).Exchange(request, udpAddr)
+	require.NoError(t, err)
+	require.Len(t, response.Answer, 1)
+	serial := response.Answer[0].(*dns.SOA).Serial
+	require.Equal(t, nameserver.Serial(), serial)
+
+	// Nothing changed: IXFR sends just the SOA
+	records, err = transfer(dns.TypeIXFR, serial)
+	require.NoError(t, err)
+	require.Equal(t, []string{"SOA weave.local."}, records)
+
+	// Any change bumps the serial, and IXFR then sends the whole zone
+	nameserver.ContainerDied("c4")
+	require.True(t, nameserver.Serial() > serial)
+	records, err = transfer(dns.TypeIXFR, serial)
+	require.NoError(t, err)
+	require.Len(t, records, 7)
+
+	// AXFR is refused over UDP
+	request = &dns.Msg{}
+	request.SetAxfr("weave.local.")
+	response, _, err = (&dns.Client{}).Exchange(request, udpAddr)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeRefused, response.Rcode)
+}
+
+func TestSerial(t *testing.T) {
+	oldNow := now
+	defer func() { now = oldNow }()
+	now = func() int64 { return 1000 }
+
+	peer1, _ := mesh.PeerNameFromString("00:00:00:02:00:00")
+	peer2, _ := mesh.PeerNameFromString("00:00:00:03:00:00")
+	ns1, ns2 := makeNameserver(peer1), makeNameserver(peer2)
+	sendGossip := func() {
+		_, err := ns2.OnGossip(ns1.Gossip().Encode()[0])
+		require.NoError(t, err)
+	}
+
+	ns1.AddEntry("web.weave.local.", "c1", peer1, address.Address(1))
+	require.Equal(t, uint32(1000), ns1.Serial())
+
+	// Adding it again changes nothing
+	ns1.AddEntry("web.weave.local.", "c1", peer1, address.Address(1))
+	require.Equal(t, uint32(1000), ns1.Serial())
+
+	// Peers agree on the serial, whatever their own clocks say
+	now = func() int64 { return 1500 }
+	sendGossip()
+	require.Equal(t, uint32(1000), ns2.Serial())
+
+	// A later change in the same second still moves it on
+	now = func() int64 { return 1000 }
+	ns1.ContainerDied("c1")
+	require.Equal(t, uint32(1001), ns1.Serial())
+	sendGossip()
+	require.Equal(t, uint32(1001), ns2.Serial())
+	ns1.ContainerDied("c1")
+	require.Equal(t, uint32(1001), ns1.Serial())
+}
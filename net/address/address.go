@@ -12,6 +12,12 @@ type Address uint32
 type Offset uint32
 type Count uint32
 
+// Upper96 holds the upper 96 bits of an IPv6 address.  The lower 32
+// bits are held in an Address, so that ranges of up to 2^31 IPv6
+// addresses can be handled exactly like IPv4 ones.  IPv4 addresses
+// have the zero Upper96.
+type Upper96 [12]byte
+
 type Range struct {
 	Start, End Address // [Start, End); Start <= End
 }
@@ -65,12 +71,13 @@ func (r Range) BiggestCIDRRange() Range {
 }
 
 func MakeCIDR(subnet CIDR, addr Address) CIDR {
-	return CIDR{Addr: addr, PrefixLen: subnet.PrefixLen}
+	return CIDR{Addr: addr, PrefixLen: subnet.PrefixLen, Upper: subnet.Upper}
 }
 
 type CIDR struct {
 	Addr      Address
-	PrefixLen int
+	PrefixLen int     // of the full address, i.e. up to 128 for IPv6
+	Upper     Upper96 // zero for IPv4
 }
 
 // CIDRs returns a list of CIDR-aligned ranges which cover this range.
@@ -94,7 +101,7 @@ func (r Range) CIDRs() []CIDR {
 			mask = tmpMask
 			prefixLen--
 		}
-		cidrs = append(cidrs, CIDR{start, prefixLen})
+		cidrs = append(cidrs, CIDR{Addr: start, PrefixLen: prefixLen})
 		// Apply mask
 		start |= ^mask
 		// Check for overflow
@@ -114,17 +121,39 @@ func ParseIP(s string) (Address, error) {
 	return 0, &net.ParseError{Type: "IP Address", Text: s}
 }
 
+// ParseCIDR parses an IPv4 or IPv6 CIDR.  Of an IPv6 CIDR with a
+// prefix of 97 bits or less, only the first 2^31 addresses are used
+// (see Size).
 func ParseCIDR(s string) (CIDR, error) {
 	if ip, ipnet, err := net.ParseCIDR(s); err != nil {
 		return CIDR{}, err
 	} else if ipnet.IP.To4() == nil {
-		return CIDR{}, &net.ParseError{Type: "Non-IPv4 address not supported", Text: s}
+		prefixLen, _ := ipnet.Mask.Size()
+		upper, addr := FromIP6(ip)
+		if upper == (Upper96{}) {
+			return CIDR{}, &net.ParseError{Type: "IPv4-compatible IPv6 address not supported", Text: s}
+		}
+		return CIDR{Addr: addr, PrefixLen: prefixLen, Upper: upper}, nil
 	} else {
 		prefixLen, _ := ipnet.Mask.Size()
 		return CIDR{Addr: FromIP4(ip), PrefixLen: prefixLen}, nil
 	}
 }
 
+// ParseHost parses an IPv4 or IPv6 address, returning it as a CIDR
+// covering just that address.
+func ParseHost(s string) (CIDR, error) {
+	ip := net.ParseIP(s)
+	switch {
+	case ip == nil:
+		return CIDR{}, &net.ParseError{Type: "IP Address", Text: s}
+	case ip.To4() == nil:
+		return ParseCIDR(s + "/128")
+	default:
+		return ParseCIDR(s + "/32")
+	}
+}
+
 func NewCIDRs(ranges []Range) (cidrs []CIDR) {
 	for _, r := range ranges {
 		cidrs = append(cidrs, r.CIDRs()...)
@@ -142,11 +171,33 @@ func (cidr CIDR) End() Address {
 }
 
 func (cidr CIDR) IsSubnet() bool {
-	mask := cidr.Size() - 1
-	return Offset(cidr.Addr)&mask == 0
+	ipnet := cidr.IPNet()
+	return ipnet.IP.Equal(ipnet.IP.Mask(ipnet.Mask))
+}
+
+// Most host bits of an IPv6 CIDR that we handle, as for Upper96
+const maxIPv6HostBits = 31
+
+// Size returns the number of addresses in the CIDR.  An IPv6 CIDR
+// with more host bits than we can handle is taken to be just its
+// first 2^31 addresses, i.e. the /97 at its start.
+func (cidr CIDR) Size() Offset {
+	hostBits := cidr.bits() - cidr.PrefixLen
+	if cidr.IsIPv6() && hostBits > maxIPv6HostBits {
+		hostBits = maxIPv6HostBits
+	}
+	return 1 << uint(hostBits)
 }
 
-func (cidr CIDR) Size() Offset { return 1 << uint(32-cidr.PrefixLen) }
+func (cidr CIDR) IsIPv6() bool { return cidr.Upper != Upper96{} }
+
+// number of bits in the full address
+func (cidr CIDR) bits() int {
+	if cidr.IsIPv6() {
+		return 8 * net.IPv6len
+	}
+	return 8 * net.IPv4len
+}
 
 func (cidr CIDR) Range() Range {
 	return NewRange(cidr.Addr, cidr.Size())
@@ -157,12 +208,22 @@ func (cidr CIDR) HostRange() Range {
 }
 
 func (cidr CIDR) String() string {
-	return fmt.Sprintf("%s/%d", cidr.Addr.String(), cidr.PrefixLen)
+	return fmt.Sprintf("%s/%d", cidr.IP(), cidr.PrefixLen)
+}
+
+// IP returns the address part of the CIDR
+func (cidr CIDR) IP() net.IP {
+	return cidr.Upper.IP(cidr.Addr)
 }
 
 func (cidr CIDR) IPNet() (r *net.IPNet) {
-	mask := net.CIDRMask(cidr.PrefixLen, 8*net.IPv4len)
-	return &net.IPNet{IP: cidr.Addr.IP4(), Mask: mask}
+	mask := net.CIDRMask(cidr.PrefixLen, cidr.bits())
+	return &net.IPNet{IP: cidr.IP(), Mask: mask}
+}
+
+// Contains returns true if the CIDR covers the address made of upper and addr
+func (cidr CIDR) Contains(upper Upper96, addr Address) bool {
+	return cidr.Upper == upper && cidr.Range().Contains(addr)
 }
 
 // FromIP4 converts an ipv4 address to our integer address type
@@ -184,6 +245,40 @@ func (addr Address) IP4() (r net.IP) {
 	return
 }
 
+// FromIP6 splits an ipv6 address into its upper 96 bits and our
+// integer address type holding the lower 32 bits
+func FromIP6(ip6 net.IP) (upper Upper96, addr Address) {
+	ip6 = ip6.To16()
+	copy(upper[:], ip6[:len(upper)])
+	return upper, FromIP4(ip6[len(upper):])
+}
+
+// IP returns addr as an ipv4 address if upper is zero, otherwise as
+// the ipv6 address whose upper 96 bits are upper
+func (upper Upper96) IP(addr Address) net.IP {
+	if upper == (Upper96{}) {
+		return addr.IP4()
+	}
+	r := make(net.IP, net.IPv6len)
+	copy(r, upper[:])
+	copy(r[len(upper):], addr.IP4())
+	return r
+}
+
+// RangeString returns the range r of addresses with these upper bits
+// in CIDR notation if possible, like Range.AsCIDRString
+func (upper Upper96) RangeString(r Range) string {
+	if upper == (Upper96{}) {
+		return r.AsCIDRString()
+	}
+	for _, cidr := range r.CIDRs() {
+		if cidr.Range() == r {
+			return CIDR{Addr: cidr.Addr, PrefixLen: cidr.PrefixLen + 128 - 32, Upper: upper}.String()
+		}
+	}
+	return fmt.Sprintf("%s-%s", upper.IP(r.Start), upper.IP(r.End-1))
+}
+
 func (addr Address) MarshalJSON() ([]byte, error) {
 	return []byte(fmt.Sprintf("%q", addr.String())), nil
 }
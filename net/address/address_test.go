@@ -80,3 +80,40 @@ func TestConversions(t *testing.T) {
 	_, ipnet, _ := net.ParseCIDR(cidrStr)
 	require.Equal(t, cidr.IPNet(), ipnet)
 }
+
+func TestIPv6Conversions(t *testing.T) {
+	cidrStr := "fd00:a:b::1:0/112"
+	cidr, err := ParseCIDR(cidrStr)
+	require.NoError(t, err)
+	require.True(t, cidr.IsIPv6())
+	require.Equal(t, cidrStr, cidr.String())
+	require.Equal(t, Offset(1<<16), cidr.Size())
+	require.Equal(t, ip("0.1.0.0"), cidr.Addr)
+	_, ipnet, _ := net.ParseCIDR(cidrStr)
+	require.Equal(t, ipnet, cidr.IPNet())
+	require.Equal(t, "fd00:a:b::1:5/112", MakeCIDR(cidr, cidr.Addr+5).String())
+	require.Equal(t, "fd00:a:b::1:0/112", cidr.Upper.RangeString(cidr.Range()))
+
+	host, err := ParseHost("fd00:a:b::1:5")
+	require.NoError(t, err)
+	require.True(t, cidr.Contains(host.Upper, host.Addr))
+	require.False(t, cidr.Contains(Upper96{}, host.Addr))
+
+	// Only the first 2^31 addresses of short prefixes are used
+	cidr, err = ParseCIDR("fd00:a:b::/64")
+	require.NoError(t, err)
+	require.True(t, cidr.IsSubnet())
+	require.Equal(t, "fd00:a:b::/64", cidr.String())
+	require.Equal(t, Offset(1<<31), cidr.Size())
+	require.Equal(t, "fd00:a:b::5/64", MakeCIDR(cidr, cidr.Addr+5).String())
+	require.Equal(t, "fd00:a:b::/97", cidr.Upper.RangeString(cidr.Range()))
+	cidr, err = ParseCIDR("fd00:a:b::1:0:0/64")
+	require.NoError(t, err)
+	require.False(t, cidr.IsSubnet(), "host bits above the lower 32 set")
+	cidr, err = ParseCIDR("fd00:a:b::8000:0/96")
+	require.NoError(t, err)
+	require.False(t, cidr.IsSubnet(), "host bit 31 set")
+
+	_, err = ParseCIDR("::10.0.0.0/120")
+	require.Error(t, err, "IPv4-compatible")
+}
@@ -0,0 +1,263 @@
+// package wireguard provides primitives for configuring a kernel
+// WireGuard interface for the wireguard overlay.
+package wireguard
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/sys/unix"
+
+	"github.com/weaveworks/mesh"
+)
+
+const (
+	KeySize = 32
+
+	// Generic netlink family, from include/uapi/linux/wireguard.h
+	genlName     = "wireguard"
+	genlVersion  = 1
+	cmdSetDevice = 1
+
+	deviceAttrIfindex    = 1
+	deviceAttrPrivateKey = 3
+	deviceAttrFlags      = 5
+	deviceAttrListenPort = 6
+	deviceAttrPeers      = 8
+
+	deviceFlagReplacePeers = 1
+
+	peerAttrPublicKey    = 1
+	peerAttrPresharedKey = 2
+	peerAttrFlags        = 3
+	peerAttrEndpoint     = 4
+	peerAttrKeepalive    = 5
+	peerAttrAllowedIPs   = 9
+
+	peerFlagRemove            = 1
+	peerFlagReplaceAllowedIPs = 2
+
+	allowedIPAttrFamily = 1
+	allowedIPAttrAddr   = 2
+	allowedIPAttrCIDR   = 3
+)
+
+// Key is a Curve25519 private or public key, or a preshared key.
+type Key [KeySize]byte
+
+// GenerateKey returns a new private key.
+func GenerateKey() (Key, error) {
+	var key Key
+	if _, err := io.ReadFull(rand.Reader, key[:]); err != nil {
+		return key, fmt.Errorf("crypto rand failed: %s", err)
+	}
+	// Clamp, as in RFC7748
+	key[0] &= 248
+	key[31] &= 127
+	key[31] |= 64
+	return key, nil
+}
+
+// PublicKey returns the public key of the private key k.
+func (k Key) PublicKey() Key {
+	var pub, priv [KeySize]byte
+	priv = k
+	curve25519.ScalarBaseMult(&pub, &priv)
+	return Key(pub)
+}
+
+func (k Key) String() string {
+	return base64.StdEncoding.EncodeToString(k[:])
+}
+
+// DeriveKey derives the preshared key of the connection connUID
+// between two peers from its session key.  Both ends derive the same
+// key, whichever way round they name the peers.
+func DeriveKey(sessionKey *[32]byte, connUID uint64, peer1, peer2 mesh.PeerName) (Key, error) {
+	var key Key
+
+	if peer2 < peer1 {
+		peer1, peer2 = peer2, peer1
+	}
+	salt := make([]byte, 8)
+	binary.BigEndian.PutUint64(salt, connUID)
+	info := make([]byte, 16)
+	binary.BigEndian.PutUint64(info, uint64(peer1))
+	binary.BigEndian.PutUint64(info[8:], uint64(peer2))
+
+	hkdf := hkdf.New(sha256.New, sessionKey[:], salt, info)
+	if _, err := io.ReadFull(hkdf, key[:]); err != nil {
+		return key, err
+	}
+	return key, nil
+}
+
+// Peer is the configuration of a peer of the interface
+type Peer struct {
+	PublicKey    Key
+	PresharedKey Key
+	// May be nil, for the kernel to learn it from the peer
+	Endpoint   *net.UDPAddr
+	AllowedIPs []net.IPNet
+	Keepalive  time.Duration
+}
+
+// Device is a kernel WireGuard interface
+type Device struct {
+	Name      string
+	Index     int
+	Port      int
+	PublicKey Key
+	family    uint16
+}
+
+// New (re)creates the WireGuard interface name, with a new private key,
+// listening on port, with the given address, and no peers.
+func New(name string, port int, mtu int, addr *net.IPNet) (*Device, error) {
+	family, err := netlink.GenlFamilyGet(genlName)
+	if err != nil {
+		return nil, errors.Wrap(err, "wireguard module not available")
+	}
+	privateKey, err := GenerateKey()
+	if err != nil {
+		return nil, errors.Wrap(err, "generate key")
+	}
+
+	// Delete any interface left from a previous run, with its keys
+	if link, err := netlink.LinkByName(name); err == nil {
+		if err := netlink.LinkDel(link); err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("link del %s", name))
+		}
+	}
+	link := &netlink.GenericLink{
+		LinkAttrs: netlink.LinkAttrs{Name: name, MTU: mtu},
+		LinkType:  genlName,
+	}
+	if err := netlink.LinkAdd(link); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("link add %s", name))
+	}
+	dev := &Device{
+		Name:      name,
+		Index:     link.Attrs().Index,
+		Port:      port,
+		PublicKey: privateKey.PublicKey(),
+		family:    family.ID,
+	}
+	if dev.Index == 0 {
+		l, err := netlink.LinkByName(name)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("link by name %s", name))
+		}
+		dev.Index = l.Attrs().Index
+	}
+
+	err = dev.setDevice(
+		nl.NewRtAttr(deviceAttrPrivateKey, privateKey[:]),
+		nl.NewRtAttr(deviceAttrListenPort, nl.Uint16Attr(uint16(port))),
+		nl.NewRtAttr(deviceAttrFlags, nl.Uint32Attr(deviceFlagReplacePeers)),
+	)
+	if err != nil {
+		dev.Destroy()
+		return nil, errors.Wrap(err, "wireguard set device")
+	}
+	if err := netlink.AddrAdd(link, &netlink.Addr{IPNet: addr, Flags: unix.IFA_F_NODAD}); err != nil {
+		dev.Destroy()
+		return nil, errors.Wrap(err, fmt.Sprintf("addr add %s", addr))
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		dev.Destroy()
+		return nil, errors.Wrap(err, fmt.Sprintf("link set up %s", name))
+	}
+	return dev, nil
+}
+
+// SetPeer adds the peer, or replaces its configuration
+func (dev *Device) SetPeer(peer Peer) error {
+	attr := peerAttr(peer.PublicKey, peerFlagReplaceAllowedIPs)
+	nl.NewRtAttrChild(attr, peerAttrPresharedKey, peer.PresharedKey[:])
+	if peer.Endpoint != nil {
+		nl.NewRtAttrChild(attr, peerAttrEndpoint, sockaddr(peer.Endpoint))
+	}
+	nl.NewRtAttrChild(attr, peerAttrKeepalive, nl.Uint16Attr(uint16(peer.Keepalive/time.Second)))
+	allowedIPs := nl.NewRtAttrChild(attr, peerAttrAllowedIPs|nl.NLA_F_NESTED, nil)
+	for _, ipnet := range peer.AllowedIPs {
+		family, ip := uint16(syscall.AF_INET6), ipnet.IP.To16()
+		if ip4 := ipnet.IP.To4(); ip4 != nil {
+			family, ip = syscall.AF_INET, ip4
+		}
+		ones, _ := ipnet.Mask.Size()
+		allowedIP := nl.NewRtAttrChild(allowedIPs, nl.NLA_F_NESTED, nil)
+		nl.NewRtAttrChild(allowedIP, allowedIPAttrFamily, nl.Uint16Attr(family))
+		nl.NewRtAttrChild(allowedIP, allowedIPAttrAddr, ip)
+		nl.NewRtAttrChild(allowedIP, allowedIPAttrCIDR, nl.Uint8Attr(uint8(ones)))
+	}
+	return dev.setPeers(attr)
+}
+
+// RemovePeer removes the peer with the public key, if present
+func (dev *Device) RemovePeer(publicKey Key) error {
+	return dev.setPeers(peerAttr(publicKey, peerFlagRemove))
+}
+
+// Destroy deletes the interface
+func (dev *Device) Destroy() error {
+	link, err := netlink.LinkByIndex(dev.Index)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("link by index %d", dev.Index))
+	}
+	return netlink.LinkDel(link)
+}
+
+func peerAttr(publicKey Key, flags uint32) *nl.RtAttr {
+	attr := nl.NewRtAttr(nl.NLA_F_NESTED, nil)
+	nl.NewRtAttrChild(attr, peerAttrPublicKey, publicKey[:])
+	nl.NewRtAttrChild(attr, peerAttrFlags, nl.Uint32Attr(flags))
+	return attr
+}
+
+func (dev *Device) setPeers(peers ...*nl.RtAttr) error {
+	attr := nl.NewRtAttr(deviceAttrPeers|nl.NLA_F_NESTED, nil)
+	for _, peer := range peers {
+		attr.AddChild(peer)
+	}
+	return dev.setDevice(attr)
+}
+
+func (dev *Device) setDevice(attrs ...*nl.RtAttr) error {
+	req := nl.NewNetlinkRequest(int(dev.family), unix.NLM_F_ACK)
+	req.AddData(&nl.Genlmsg{Command: cmdSetDevice, Version: genlVersion})
+	req.AddData(nl.NewRtAttr(deviceAttrIfindex, nl.Uint32Attr(uint32(dev.Index))))
+	for _, attr := range attrs {
+		req.AddData(attr)
+	}
+	_, err := req.Execute(unix.NETLINK_GENERIC, 0)
+	return err
+}
+
+// The struct sockaddr_in or sockaddr_in6 of addr
+func sockaddr(addr *net.UDPAddr) []byte {
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		buf := make([]byte, unix.SizeofSockaddrInet4)
+		nl.NativeEndian().PutUint16(buf, syscall.AF_INET)
+		binary.BigEndian.PutUint16(buf[2:], uint16(addr.Port))
+		copy(buf[4:], ip4)
+		return buf
+	}
+	buf := make([]byte, unix.SizeofSockaddrInet6)
+	nl.NativeEndian().PutUint16(buf, syscall.AF_INET6)
+	binary.BigEndian.PutUint16(buf[2:], uint16(addr.Port))
+	copy(buf[8:], addr.IP.To16())
+	return buf
+}
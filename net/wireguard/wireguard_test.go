@@ -0,0 +1,54 @@
+package wireguard
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/curve25519"
+)
+
+func TestKeys(t *testing.T) {
+	priv1, err := GenerateKey()
+	require.NoError(t, err)
+	priv2, err := GenerateKey()
+	require.NoError(t, err)
+	require.NotEqual(t, priv1, priv2)
+
+	// Both ends of a Diffie-Hellman exchange agree
+	var shared1, shared2 [KeySize]byte
+	pub1, pub2 := [KeySize]byte(priv1.PublicKey()), [KeySize]byte(priv2.PublicKey())
+	p1, p2 := [KeySize]byte(priv1), [KeySize]byte(priv2)
+	curve25519.ScalarMult(&shared1, &p1, &pub2)
+	curve25519.ScalarMult(&shared2, &p2, &pub1)
+	require.Equal(t, shared1, shared2)
+}
+
+func TestDeriveKey(t *testing.T) {
+	sessionKey := &[32]byte{1, 2, 3}
+	key, err := DeriveKey(sessionKey, 42, 1, 2)
+	require.NoError(t, err)
+
+	other, err := DeriveKey(sessionKey, 42, 2, 1)
+	require.NoError(t, err)
+	require.Equal(t, key, other, "same key at both ends")
+
+	other, err = DeriveKey(sessionKey, 43, 1, 2)
+	require.NoError(t, err)
+	require.NotEqual(t, key, other, "different key per connection")
+
+	other, err = DeriveKey(&[32]byte{3, 2, 1}, 42, 1, 2)
+	require.NoError(t, err)
+	require.NotEqual(t, key, other, "different key per session")
+}
+
+func TestSockaddr(t *testing.T) {
+	sa := sockaddr(&net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 6785})
+	require.Len(t, sa, 16)
+	require.Equal(t, []byte{0x1a, 0x81, 10, 0, 0, 1}, sa[2:8])
+
+	sa = sockaddr(&net.UDPAddr{IP: net.ParseIP("fd00::1"), Port: 6785})
+	require.Len(t, sa, 28)
+	require.Equal(t, []byte{0x1a, 0x81}, sa[2:4])
+	require.Equal(t, []byte(net.ParseIP("fd00::1")), sa[8:24])
+}
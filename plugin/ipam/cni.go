@@ -37,7 +37,11 @@ func (i *Ipam) Allocate(args *skel.CmdArgs) (types.Result, error) {
 	}
 	var ipnet *net.IPNet
 
-	if conf.Subnet == "" {
+	if conf.Subnet == "" && conf.Pool != "" {
+		ipnet, err = i.weave.AllocateIPInPool(containerID, conf.Pool, false)
+	} else if name := podName(args.Args); conf.Subnet == "" && name != "" {
+		ipnet, err = i.weave.AllocateIPForName(containerID, name, false)
+	} else if conf.Subnet == "" {
 		ipnet, err = i.weave.AllocateIP(containerID, false)
 	} else {
 		var subnet *net.IPNet
@@ -51,9 +55,13 @@ func (i *Ipam) Allocate(args *skel.CmdArgs) (types.Result, error) {
 	if err != nil {
 		return nil, err
 	}
+	version := "4"
+	if ipnet.IP.To4() == nil {
+		version = "6"
+	}
 	result := &current.Result{
 		IPs: []*current.IPConfig{{
-			Version: "4",
+			Version: version,
 			Address: *ipnet,
 			Gateway: conf.Gateway,
 		}},
@@ -70,8 +78,23 @@ func (i *Ipam) Release(args *skel.CmdArgs) error {
 	return i.weave.ReleaseIPsFor(args.ContainerID)
 }
 
+// Kubernetes passes the pod identity in CNI_ARGS; we give it as
+// namespace/pod, to be matched against IPAM reservations
+func podName(cniArgs string) string {
+	var k8sArgs struct {
+		types.CommonArgs
+		K8S_POD_NAMESPACE types.UnmarshallableString
+		K8S_POD_NAME      types.UnmarshallableString
+	}
+	if err := types.LoadArgs(cniArgs, &k8sArgs); err != nil || k8sArgs.K8S_POD_NAME == "" {
+		return ""
+	}
+	return string(k8sArgs.K8S_POD_NAMESPACE) + "/" + string(k8sArgs.K8S_POD_NAME)
+}
+
 type ipamConf struct {
 	Subnet  string         `json:"subnet,omitempty"`
+	Pool    string         `json:"pool,omitempty"`
 	Gateway net.IP         `json:"gateway,omitempty"`
 	Routes  []*types.Route `json:"routes"`
 }
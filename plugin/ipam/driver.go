@@ -32,10 +32,13 @@ func (i *Ipam) GetDefaultAddressSpaces() (string, string, error) {
 func (i *Ipam) RequestPool(addressSpace, pool, subPool string, options map[string]string, v6 bool) (poolname string, subnet *net.IPNet, data map[string]string, err error) {
 	i.logReq("RequestPool", addressSpace, pool, subPool, options)
 	defer func() { i.logRes("RequestPool", err, poolname, subnet, data) }()
-	if pool == "" {
-		subnet, err = i.weave.DefaultSubnet()
-	} else {
+	switch {
+	case pool != "":
 		_, subnet, err = net.ParseCIDR(pool)
+	case options["pool"] != "": // e.g. docker network create --ipam-opt pool=batch
+		subnet, err = i.weave.PoolSubnet(options["pool"])
+	default:
+		subnet, err = i.weave.DefaultSubnet()
 	}
 	if err != nil {
 		return
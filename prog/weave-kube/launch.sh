@@ -112,6 +112,8 @@ router_bridge_opts() {
     echo --datapath=datapath
     [ -z "$WEAVE_MTU" ] || echo --mtu "$WEAVE_MTU"
     [ -z "$WEAVE_NO_FASTDP" ] || echo --no-fastdp
+    [ -z "$WEAVE_WIREGUARD" ] || echo --wireguard
+    [ -z "$WEAVE_FASTDP_GENEVE" ] || echo --fastdp-geneve
 }
 
 if [ -z "$KUBE_PEERS" ]; then
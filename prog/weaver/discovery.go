@@ -12,6 +12,7 @@ import (
 	"github.com/gorilla/mux"
 
 	"github.com/weaveworks/weave/ipam"
+	"github.com/weaveworks/weave/net/address"
 )
 
 // TODO: move these definitions somewhere more shareable
@@ -75,15 +76,17 @@ func peerDiscoveryDelete(discoveryEndpoint, token, peername string) error {
 	return do("DELETE", discoveryEndpoint, token, request, nil)
 }
 
-func HandleHTTPPeer(router *mux.Router, alloc *ipam.Allocator, discoveryEndpoint, token, peername string) {
+func HandleHTTPPeer(router *mux.Router, pools ipam.Pools, discoveryEndpoint, token, peername string) {
 	router.Methods("DELETE").Path("/peer").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if discoveryEndpoint != "" && token != "" {
 			if err := peerDiscoveryDelete(discoveryEndpoint, token, peername); err != nil {
 				Log.Errorf("Error while deleting self from peer discovery: %s", err)
 			}
 		}
-		if alloc != nil {
-			alloc.Shutdown()
+		for _, pool := range pools {
+			if pool.Allocator != nil {
+				pool.Shutdown()
+			}
 		}
 		w.WriteHeader(204)
 	})
@@ -96,8 +99,13 @@ func HandleHTTPPeer(router *mux.Router, alloc *ipam.Allocator, discoveryEndpoint
 				Log.Errorf("Error while deleting self from peer discovery: %s", err)
 			}
 		}
-		if alloc != nil {
-			transferred := alloc.AdminTakeoverRanges(ident)
+		if pools != nil {
+			var transferred address.Count
+			for _, pool := range pools {
+				if pool.Allocator != nil {
+					transferred += pool.AdminTakeoverRanges(ident)
+				}
+			}
 			fmt.Fprintf(w, "%d IPs taken over from %s\n", transferred, ident)
 		}
 	})
@@ -16,7 +16,6 @@ import (
 	"github.com/weaveworks/weave/common"
 	"github.com/weaveworks/weave/ipam"
 	"github.com/weaveworks/weave/nameserver"
-	"github.com/weaveworks/weave/net/address"
 	"github.com/weaveworks/weave/plugin"
 	"github.com/weaveworks/weave/proxy"
 	weave "github.com/weaveworks/weave/router"
@@ -177,29 +176,9 @@ var statusTemplate = defTemplate("status", `\
     Connections: {{len .Router.Connections}}{{with printConnectionCounts .Router.Connections}} ({{.}}){{end}}
           Peers: {{len .Router.Peers}}{{with printPeerConnectionCounts .Router.Peers}} (with {{.}} connections){{end}}
  TrustedSubnets: {{printList .Router.TrustedSubnets}}
-{{if .IPAM}}\
-
-        Service: ipam
-{{if .IPAM.Entries}}\
-{{if allIPAMOwnersUnreachable .IPAM}}\
-         Status: all IP ranges owned by unreachable peers - use 'rmpeer' if they are dead
-{{else if len .IPAM.PendingAllocates}}\
-         Status: waiting for IP(s) to become available
-{{else}}\
-         Status: ready
-{{end}}\
-{{else if .IPAM.Paxos}}\
-{{if .IPAM.Paxos.Elector}}\
-         Status: awaiting consensus (quorum: {{.IPAM.Paxos.Quorum}}, known: {{.IPAM.Paxos.KnownNodes}})
-{{else}}\
-         Status: priming
-{{end}}\
-{{else}}\
-         Status: idle
-{{end}}\
-          Range: {{.IPAM.Range}}
-  DefaultSubnet: {{.IPAM.DefaultSubnet}}
-{{end}}\
+{{with .IPAM}}{{template "ipamStatus" .}}{{end}}\
+{{with .IPAM6}}{{template "ipamStatus" .}}{{end}}\
+{{range .IPAMPools}}{{template "ipamStatus" .}}{{end}}\
 {{if .DNS}}\
 
         Service: dns
@@ -224,6 +203,33 @@ var statusTemplate = defTemplate("status", `\
 {{end}}\
 `)
 
+var ipamStatusTemplate = defTemplate("ipamStatus", `\
+
+        Service: ipam
+{{with .Pool}}\
+           Pool: {{.}}
+{{end}}\
+{{if .Entries}}\
+{{if allIPAMOwnersUnreachable .}}\
+         Status: all IP ranges owned by unreachable peers - use 'rmpeer' if they are dead
+{{else if len .PendingAllocates}}\
+         Status: waiting for IP(s) to become available
+{{else}}\
+         Status: ready
+{{end}}\
+{{else if .Paxos}}\
+{{if .Paxos.Elector}}\
+         Status: awaiting consensus (quorum: {{.Paxos.Quorum}}, known: {{.Paxos.KnownNodes}})
+{{else}}\
+         Status: priming
+{{end}}\
+{{else}}\
+         Status: idle
+{{end}}\
+          Range: {{.Range}}
+  DefaultSubnet: {{.DefaultSubnet}}
+`)
+
 var targetsTemplate = defTemplate("targetsTemplate", `\
 {{range .Router.Targets}}{{.}}
 {{end}}\
@@ -231,7 +237,7 @@ var targetsTemplate = defTemplate("targetsTemplate", `\
 
 var connectionsTemplate = defTemplate("connectionsTemplate", `\
 {{range .Router.Connections}}\
-{{if .Outbound}}->{{else}}<-{{end}} {{printf "%-21v" .Address}} {{printf "%-11v" .State}} {{.Info}} {{range $key,$element := .Attrs}}{{if ne $key "name"}}{{$key}}={{$element}}{{end}}{{end}}
+{{if .Outbound}}->{{else}}<-{{end}} {{printf "%-21v" .Address}} {{printf "%-11v" .State}} {{.Info}}{{range $key,$element := .Attrs}}{{if ne $key "name"}} {{$key}}={{$element}}{{end}}{{end}}
 {{end}}\
 `)
 
@@ -251,7 +257,7 @@ var dnsEntriesTemplate = defTemplate("dnsEntries", `\
 {{range .DNS.Entries}}\
 {{if eq .Tombstone 0}}\
 {{$hostname := trimSuffix .Hostname $domain}}\
-{{printf "%-12v" $hostname}} {{printf "%-15v" .Address}} {{printf "%12.12v" .ContainerID}} {{.Origin}}
+{{printf "%-12v" $hostname}} {{printf "%-15v" .Address}} {{printf "%12.12v" .ContainerID}} {{.Origin}}{{if .Unhealthy}} unhealthy{{end}}
 {{end}}\
 {{end}}\
 `)
@@ -298,20 +304,52 @@ type WeaveStatus struct {
 	VersionCheck *VersionCheck              `json:"VersionCheck,omitempty"`
 	Router       *weave.NetworkRouterStatus `json:"Router,omitempty"`
 	IPAM         *ipam.Status               `json:"IPAM,omitempty"`
+	IPAM6        *ipam.Status               `json:"IPAM6,omitempty"`
+	IPAMPools    []*ipam.Status             `json:"IPAMPools,omitempty"`
 	DNS          *nameserver.Status         `json:"DNS,omitempty"`
 	Proxy        *proxy.Status              `json:"Proxy,omitempty"`
 	Plugin       *plugin.Status             `json:"Plugin,omitempty"`
 }
 
+// newIPAMStatuses returns the status of the first pool, of the other
+// unnamed pool if any (i.e. the IPv6 one), and of the named pools
+func newIPAMStatuses(pools ipam.Pools) (ipamStatus, ipam6Status *ipam.Status, poolStatuses []*ipam.Status) {
+	for i, pool := range pools {
+		switch {
+		case i == 0:
+			ipamStatus = pool.Status()
+		case pool.Name == "":
+			ipam6Status = pool.Status()
+		default:
+			poolStatuses = append(poolStatuses, pool.Status())
+		}
+	}
+	return
+}
+
+// allIPAMStatuses returns the status of every pool in s
+func (s WeaveStatus) allIPAMStatuses() []*ipam.Status {
+	var statuses []*ipam.Status
+	for _, status := range append([]*ipam.Status{s.IPAM, s.IPAM6}, s.IPAMPools...) {
+		if status != nil {
+			statuses = append(statuses, status)
+		}
+	}
+	return statuses
+}
+
 // Read-only functions, suitable for exposing on an unprotected socket
-func HandleHTTP(muxRouter *mux.Router, version string, router *weave.NetworkRouter, allocator *ipam.Allocator, defaultSubnet address.CIDR, ns *nameserver.Nameserver, dnsserver *nameserver.DNSServer, prxy *proxy.Proxy, plugin *plugin.Plugin, waitReady *common.WaitGroup) {
+func HandleHTTP(muxRouter *mux.Router, version string, router *weave.NetworkRouter, pools ipam.Pools, ns *nameserver.Nameserver, dnsserver *nameserver.DNSServer, prxy *proxy.Proxy, plugin *plugin.Plugin, waitReady *common.WaitGroup) {
 	status := func() WeaveStatus {
+		ipamStatus, ipam6Status, poolStatuses := newIPAMStatuses(pools)
 		return WeaveStatus{
 			waitReady.IsDone(),
 			version,
 			versionCheck(),
 			weave.NewNetworkRouterStatus(router),
-			ipam.NewStatus(allocator, defaultSubnet),
+			ipamStatus,
+			ipam6Status,
+			poolStatuses,
 			nameserver.NewStatus(ns, dnsserver),
 			proxy.NewStatus(prxy),
 			plugin.NewStatus(),
@@ -6,6 +6,7 @@ import (
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"regexp"
 	"runtime"
 	"strconv"
 	"strings"
@@ -36,9 +37,19 @@ var version = "unreleased"
 
 var Log = common.Log
 
+// Number of rotated IPAM audit log files to keep
+const auditLogBackups = 5
+
 type ipamConfig struct {
 	IPRangeCIDR   string
 	IPSubnetCIDR  string
+	Pools         []string
+	Quotas        []string
+	LeaseTTL      time.Duration
+	KubeletURL    string
+	AuditLogPath  string
+	AuditLogSize  int
+	ExternalURL   string
 	PeerCount     int
 	Mode          string
 	Observer      bool
@@ -50,7 +61,14 @@ type dnsConfig struct {
 	ListenAddress string
 	TTL           int
 	ClientTimeout time.Duration
+	CacheSize     int
 	ResolvConf    string
+	Forwarders    []string
+	Probes        []string
+	Policies      []string
+	Zone          string
+	LogQueries    bool
+	Transfers     []string
 }
 
 // return the address part of the DNS listen address, without ":53" on the end
@@ -68,12 +86,15 @@ func (c *ipamConfig) Enabled() bool {
 		hasMode      = c.HasMode()
 		hasRange     = c.IPRangeCIDR != ""
 		hasSubnet    = c.IPSubnetCIDR != ""
+		hasPools     = len(c.Pools) > 0
 	)
 	switch {
-	case !(hasPeerCount || hasMode || hasRange || hasSubnet):
+	case !(hasPeerCount || hasMode || hasRange || hasSubnet || hasPools):
 		return false
 	case !hasRange && hasSubnet:
 		Log.Fatal("--ipalloc-default-subnet specified without --ipalloc-range.")
+	case !hasRange && hasPools:
+		Log.Fatal("--ipalloc-pool specified without --ipalloc-range.")
 	case !hasRange:
 		Log.Fatal("--ipalloc-init specified without --ipalloc-range.")
 	}
@@ -153,6 +174,8 @@ func main() {
 		logLevel           = "info"
 		prof               string
 		bufSzMB            int
+		wireguard          bool
+		fastdpGeneve       bool
 		noDiscovery        bool
 		httpAddr           string
 		statusAddr         string
@@ -196,18 +219,34 @@ func main() {
 	mflag.StringVar(&statusAddr, []string{"-status-addr"}, "", "address to bind status+metrics interface to (disabled if blank, absolute path indicates unix domain socket)")
 	mflag.StringVar(&metricsAddr, []string{"-metrics-addr"}, "", "address to bind metrics interface to (disabled if blank, absolute path indicates unix domain socket)")
 	mflag.StringVar(&ipamConfig.Mode, []string{"-ipalloc-init"}, "", "allocator initialisation strategy (consensus, seed or observer)")
-	mflag.StringVar(&ipamConfig.IPRangeCIDR, []string{"-ipalloc-range"}, "", "IP address range reserved for automatic allocation, in CIDR notation")
-	mflag.StringVar(&ipamConfig.IPSubnetCIDR, []string{"-ipalloc-default-subnet"}, "", "subnet to allocate within by default, in CIDR notation")
+	mflag.StringVar(&ipamConfig.IPRangeCIDR, []string{"-ipalloc-range"}, "", "IP address range reserved for automatic allocation, in CIDR notation; at most one IPv4 and one IPv6 range, comma-separated")
+	mflag.StringVar(&ipamConfig.IPSubnetCIDR, []string{"-ipalloc-default-subnet"}, "", "subnet to allocate within by default, in CIDR notation; at most one per address family, comma-separated")
+	mflagext.ListVar(&ipamConfig.Quotas, []string{"-ipalloc-quota"}, nil, "minimum reserved and maximum owned addresses for a peer, as [pool/]peer=min:max where peer is a name, nickname or * for any other peer (e.g. host1=256:4096); without a pool, applies to --ipalloc-range")
+	mflag.DurationVar(&ipamConfig.LeaseTTL, []string{"-ipalloc-lease-ttl"}, 0, "free addresses whose container has not been seen for this long; 0 to disable")
+	mflag.StringVar(&ipamConfig.KubeletURL, []string{"-ipalloc-lease-kubelet"}, "", "kubelet read-only API URL (e.g. http://127.0.0.1:10255) to check leases against, instead of Docker")
+	mflag.StringVar(&ipamConfig.AuditLogPath, []string{"-ipalloc-audit-log"}, "", "file to record address allocations and transfers in")
+	mflag.IntVar(&ipamConfig.AuditLogSize, []string{"-ipalloc-audit-log-size"}, 10, "size in MB at which the IPAM audit log is rotated")
+	mflag.StringVar(&ipamConfig.ExternalURL, []string{"-ipalloc-external"}, "", "URL of an external IPAM service to take addresses from, instead of weave's own allocator")
+	mflagext.ListVar(&ipamConfig.Pools, []string{"-ipalloc-pool"}, nil, "additional named IP address range, allocated independently, as name=CIDR (e.g. batch=10.128.0.0/16)")
 	mflag.StringVar(&dockerAPI, []string{"-docker-api"}, defaultDockerHost, "Docker API endpoint")
 	mflag.BoolVar(&noDNS, []string{"-no-dns"}, false, "disable DNS server")
 	mflag.StringVar(&dnsConfig.Domain, []string{"-dns-domain"}, nameserver.DefaultDomain, "local domain to server requests for")
 	mflag.StringVar(&dnsConfig.ListenAddress, []string{"-dns-listen-address"}, nameserver.DefaultListenAddress, "address to listen on for DNS requests")
 	mflag.IntVar(&dnsConfig.TTL, []string{"-dns-ttl"}, nameserver.DefaultTTL, "TTL for DNS request from our domain")
 	mflag.DurationVar(&dnsConfig.ClientTimeout, []string{"-dns-fallback-timeout"}, nameserver.DefaultClientTimeout, "timeout for fallback DNS requests")
+	mflag.IntVar(&dnsConfig.CacheSize, []string{"-dns-cache-size"}, nameserver.DefaultCacheSize, "number of fallback DNS responses to cache (0 to disable)")
+	mflagext.ListVar(&dnsConfig.Forwarders, []string{"-dns-forward"}, nil, "forward DNS queries for a zone to other servers, as zone=server[:port][,...] (e.g. consul=127.0.0.1:8600)")
+	mflagext.ListVar(&dnsConfig.Probes, []string{"-dns-probe"}, nil, "check the addresses of a name with a probe, as name=tcp:<port> or name=http:<port>[/<path>], and drop those that fail from DNS answers")
+	mflagext.ListVar(&dnsConfig.Policies, []string{"-dns-policy"}, nil, "order addresses in DNS answers by a policy (random, weighted or local), as [domain=]policy")
+	mflag.StringVar(&dnsConfig.Zone, []string{"-dns-zone"}, "", "locality zone of this peer (e.g. a datacenter), which the local DNS policy prefers")
+	mflag.BoolVar(&dnsConfig.LogQueries, []string{"-dns-log-queries"}, false, "log every DNS query answered")
+	mflagext.ListVar(&dnsConfig.Transfers, []string{"-dns-allow-transfer"}, nil, "allow zone transfers (AXFR/IXFR) of the DNS domain to clients with this ip or in this CIDR")
 	mflag.StringVar(&dnsConfig.ResolvConf, []string{"-resolv-conf"}, "", "path to resolver configuration for fallback DNS lookups")
 	mflag.StringVar(&bridgeConfig.DatapathName, []string{"-datapath"}, "", "ODP datapath name")
 	mflag.BoolVar(&bridgeConfig.NoFastdp, []string{"-no-fastdp"}, false, "Disable Fast Datapath")
 	mflag.BoolVar(&bridgeConfig.NoBridgedFastdp, []string{"-no-bridged-fastdp"}, false, "Disable Bridged Fast Datapath")
+	mflag.BoolVar(&wireguard, []string{"-wireguard"}, false, "also offer a WireGuard overlay to peers (requires --password and the kernel wireguard module)")
+	mflag.BoolVar(&fastdpGeneve, []string{"-fastdp-geneve"}, false, "also offer Geneve encapsulation, with peer and policy metadata, to fast datapath peers")
 	mflag.StringVar(&trustedSubnetStr, []string{"-trusted-subnets"}, "", "comma-separated list of trusted subnets in CIDR notation")
 	mflag.StringVar(&dbPrefix, []string{"-db-prefix"}, "/weavedb/weave", "pathname/prefix of filename to store data")
 	mflag.StringVar(&procPath, []string{"-proc-path"}, "/proc", "path to reach host /proc filesystem")
@@ -319,7 +358,7 @@ func main() {
 
 	config.Password = determinePassword(password)
 
-	overlay, injectorConsumer := createOverlay(bridgeType, bridgeConfig, config.Host, config.Port, bufSzMB, config.Password != nil)
+	overlay, injectorConsumer := createOverlay(bridgeType, bridgeConfig, name, config.Host, config.Port, bufSzMB, config.Password != nil, wireguard, fastdpGeneve)
 	networkConfig.InjectorConsumer = injectorConsumer
 
 	if injectorConsumer != nil {
@@ -344,6 +383,23 @@ func main() {
 	if bridgeConfig.AWSVPC && !ipamConfig.Enabled() {
 		Log.Fatalf("--awsvpc mode requires IPAM enabled")
 	}
+	if bridgeConfig.AWSVPC && len(ipamConfig.Pools) > 0 {
+		Log.Fatalf("--awsvpc mode is not compatible with the --ipalloc-pool option")
+	}
+	if bridgeConfig.AWSVPC && ipamConfig.ExternalURL != "" {
+		Log.Fatalf("--awsvpc mode is not compatible with the --ipalloc-external option")
+	}
+	if ipamConfig.ExternalURL != "" {
+		// These all work on weave's own allocators
+		switch {
+		case ipamConfig.LeaseTTL > 0:
+			Log.Fatalf("--ipalloc-lease-ttl is not compatible with the --ipalloc-external option")
+		case ipamConfig.AuditLogPath != "":
+			Log.Fatalf("--ipalloc-audit-log is not compatible with the --ipalloc-external option")
+		case len(ipamConfig.Quotas) > 0:
+			Log.Fatalf("--ipalloc-quota is not compatible with the --ipalloc-external option")
+		}
+	}
 	if bridgeConfig.AWSVPC && bridgeConfig.NoMasqLocal {
 		Log.Fatalf("--awsvpc mode is not compatible with the --no-masq-local option")
 	}
@@ -404,8 +460,11 @@ func main() {
 	}
 
 	var (
+		pools         ipam.Pools
 		allocator     *ipam.Allocator
 		defaultSubnet address.CIDR
+		leases        *ipam.LeaseCollector
+		auditLog      *ipam.AuditLog
 	)
 	if ipamConfig.Enabled() {
 		var t tracker.LocalRangeTracker
@@ -424,13 +483,45 @@ func main() {
 		preClaims, err := findExistingAddresses(dockerCli, bridgeConfig.WeaveBridgeName)
 		checkFatal(err)
 
-		allocator, defaultSubnet = createAllocator(router, ipamConfig, preClaims, db, t, isKnownPeer)
-		observeContainers(allocator)
+		if ipamConfig.AuditLogPath != "" {
+			auditLog, err = ipam.NewAuditLog(ipamConfig.AuditLogPath, int64(ipamConfig.AuditLogSize)<<20, auditLogBackups)
+			checkFatal(err)
+			defer auditLog.Close()
+		}
+
+		quotas, err := parseQuotas(ipamConfig.Quotas)
+		checkFatal(err)
+
+		pools = createAllocators(router, ipamConfig, quotas, auditLog, preClaims, db, t, isKnownPeer)
+		allocator, defaultSubnet = pools[0].Allocator, pools[0].DefaultSubnet
+		if bridgeConfig.AWSVPC && allocator.Universe().IsIPv6() {
+			Log.Fatalf("--awsvpc mode requires an IPv4 allocation range")
+		}
+		for _, pool := range pools {
+			observeContainers(pool.ContainerObserver())
+		}
 
 		if dockerCli != nil {
 			allContainerIDs, err := dockerCli.RunningContainerIDs()
 			checkFatal(err)
-			allocator.PruneOwned(allContainerIDs)
+			for _, pool := range pools {
+				pool.PruneOwned(allContainerIDs)
+			}
+		}
+
+		if ipamConfig.LeaseTTL > 0 {
+			var runtime ipam.Runtime
+			switch {
+			case ipamConfig.KubeletURL != "":
+				runtime = ipam.KubeletRuntime{URL: ipamConfig.KubeletURL}
+			case dockerCli != nil:
+				runtime = ipam.DockerRuntime{Client: dockerCli}
+			default:
+				Log.Warningln("No container runtime to check IP address leases against; they will only be renewed by IPAM requests")
+			}
+			leases = ipam.NewLeaseCollector(pools, runtime, ipamConfig.LeaseTTL)
+			leases.Start()
+			defer leases.Stop()
 		}
 	}
 
@@ -439,7 +530,7 @@ func main() {
 		dnsserver *nameserver.DNSServer
 	)
 	if !noDNS {
-		ns, dnsserver = createDNSServer(dnsConfig, router.Router, isKnownPeer)
+		ns, dnsserver = createDNSServer(dnsConfig, router.Router, isKnownPeer, db)
 		observeContainers(ns)
 		ns.Start()
 		defer ns.Stop()
@@ -466,16 +557,23 @@ func main() {
 	// This is here to support stand-alone use of weaver.
 	if httpAddr != "" {
 		muxRouter := mux.NewRouter()
-		if allocator != nil {
-			allocator.HandleHTTP(muxRouter, defaultSubnet, dockerCli)
+		if pools != nil {
+			pools.HandleHTTP(muxRouter, dockerCli)
+		}
+		if leases != nil {
+			leases.HandleHTTP(muxRouter)
+		}
+		if auditLog != nil {
+			auditLog.HandleHTTP(muxRouter)
 		}
 		if ns != nil {
 			ns.HandleHTTP(muxRouter, dockerCli)
+			dnsserver.HandleHTTP(muxRouter)
 		}
 		router.HandleHTTP(muxRouter)
-		HandleHTTP(muxRouter, version, router, allocator, defaultSubnet, ns, dnsserver, proxy, plugin, &waitReady)
-		HandleHTTPPeer(muxRouter, allocator, discoveryEndpoint, token, name.String())
-		muxRouter.Methods("GET").Path("/metrics").Handler(metricsHandler(router, allocator, ns, dnsserver))
+		HandleHTTP(muxRouter, version, router, pools, ns, dnsserver, proxy, plugin, &waitReady)
+		HandleHTTPPeer(muxRouter, pools, discoveryEndpoint, token, name.String())
+		muxRouter.Methods("GET").Path("/metrics").Handler(metricsHandler(router, pools, ns, dnsserver))
 		if proxy != nil {
 			muxRouter.Methods("GET").Path("/proxyaddrs").HandlerFunc(proxy.StatusHTTP)
 		}
@@ -486,8 +584,8 @@ func main() {
 
 	if statusAddr != "" {
 		muxRouter := mux.NewRouter()
-		HandleHTTP(muxRouter, version, router, allocator, defaultSubnet, ns, dnsserver, proxy, plugin, &waitReady)
-		muxRouter.Methods("GET").Path("/metrics").Handler(metricsHandler(router, allocator, ns, dnsserver))
+		HandleHTTP(muxRouter, version, router, pools, ns, dnsserver, proxy, plugin, &waitReady)
+		muxRouter.Methods("GET").Path("/metrics").Handler(metricsHandler(router, pools, ns, dnsserver))
 		statusMux := http.NewServeMux()
 		statusMux.Handle("/", muxRouter)
 		Log.Println("Listening for status+metrics requests on", statusAddr)
@@ -496,7 +594,7 @@ func main() {
 
 	if metricsAddr != "" {
 		metricsMux := http.NewServeMux()
-		metricsMux.Handle("/metrics", metricsHandler(router, allocator, ns, dnsserver))
+		metricsMux.Handle("/metrics", metricsHandler(router, pools, ns, dnsserver))
 		Log.Println("Listening for metrics requests on", metricsAddr)
 		go listenAndServeHTTP(metricsAddr, metricsMux)
 	}
@@ -588,7 +686,7 @@ func newProxyConfig() *weaveproxy.Config {
 	return &proxyConfig
 }
 
-func createOverlay(bridgeType weavenet.Bridge, config weavenet.BridgeConfig, host string, port int, bufSzMB int, enableEncryption bool) (weave.NetworkOverlay, weave.InjectorConsumer) {
+func createOverlay(bridgeType weavenet.Bridge, config weavenet.BridgeConfig, name mesh.PeerName, host string, port int, bufSzMB int, enableEncryption bool, enableWireguard bool, enableGeneve bool) (weave.NetworkOverlay, weave.InjectorConsumer) {
 	overlay := weave.NewOverlaySwitch()
 	var injectorConsumer weave.InjectorConsumer
 	var ignoreSleeve bool
@@ -605,10 +703,13 @@ func createOverlay(bridgeType weavenet.Bridge, config weavenet.BridgeConfig, hos
 	case bridgeType.IsFastdp():
 		iface, err := weavenet.EnsureInterface(config.DatapathName)
 		checkFatal(err)
-		fastdp, err := weave.NewFastDatapath(iface, port, enableEncryption)
+		fastdp, err := weave.NewFastDatapath(iface, port, enableEncryption, enableGeneve)
 		checkFatal(err)
 		injectorConsumer = fastdp.InjectorConsumer()
 		overlay.Add("fastdp", fastdp.Overlay())
+		if fastdp.GeneveEnabled() {
+			overlay.AddFeature(weave.GeneveFeature, "true")
+		}
 	case !bridgeType.IsFastdp():
 		iface, err := weavenet.EnsureInterface(weavenet.PcapIfName)
 		checkFatal(err)
@@ -616,6 +717,17 @@ func createOverlay(bridgeType weavenet.Bridge, config weavenet.BridgeConfig, hos
 		checkFatal(err)
 	}
 
+	if enableWireguard && !config.AWSVPC {
+		// WireGuard keys come from the connection session key
+		if !enableEncryption {
+			Log.Warningf("Not using WireGuard: it requires --password")
+		} else if wg, err := weave.NewWireguardOverlay(name, port); err != nil {
+			Log.Warningf("Not using WireGuard: %s", err)
+		} else {
+			overlay.Add("wireguard", wg)
+		}
+	}
+
 	if !ignoreSleeve {
 		sleeve := weave.NewSleeveOverlay(host, port)
 		overlay.Add("sleeve", sleeve)
@@ -625,18 +737,148 @@ func createOverlay(bridgeType weavenet.Bridge, config weavenet.BridgeConfig, hos
 	return overlay, injectorConsumer
 }
 
-func createAllocator(router *weave.NetworkRouter, config ipamConfig, preClaims []ipam.PreClaim, db db.DB, track tracker.LocalRangeTracker, isKnownPeer func(mesh.PeerName) bool) (*ipam.Allocator, address.CIDR) {
-	ipRange, err := ipam.ParseCIDRSubnet(config.IPRangeCIDR)
-	checkFatal(err)
-	defaultSubnet := ipRange
+var poolNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// parseQuotas parses --ipalloc-quota options, written as
+// [pool/]peer=min:max, into the quotas of each pool.  Those without a
+// pool apply to the pools of --ipalloc-range, and are keyed by "".
+func parseQuotas(quotaStrs []string) (map[string]ipam.Quotas, error) {
+	quotas := make(map[string]ipam.Quotas)
+	for _, quotaStr := range quotaStrs {
+		var poolName string
+		if i := strings.Index(quotaStr, "/"); i >= 0 {
+			poolName, quotaStr = quotaStr[:i], quotaStr[i+1:]
+			if !poolNameRegexp.MatchString(poolName) {
+				return nil, fmt.Errorf("invalid pool name %q in --ipalloc-quota", poolName)
+			}
+		}
+		peer, quota, err := ipam.ParseQuota(quotaStr)
+		if err != nil {
+			return nil, err
+		}
+		if quotas[poolName] == nil {
+			quotas[poolName] = make(ipam.Quotas)
+		}
+		quotas[poolName][peer] = quota
+	}
+	return quotas, nil
+}
+
+func createAllocators(router *weave.NetworkRouter, config ipamConfig, quotas map[string]ipam.Quotas, auditLog *ipam.AuditLog, preClaims []ipam.PreClaim, db db.DB, track tracker.LocalRangeTracker, isKnownPeer func(mesh.PeerName) bool) ipam.Pools {
+	var defaultSubnets []address.CIDR
 	if config.IPSubnetCIDR != "" {
-		defaultSubnet, err = ipam.ParseCIDRSubnet(config.IPSubnetCIDR)
+		for _, subnetStr := range strings.Split(config.IPSubnetCIDR, ",") {
+			subnet, err := ipam.ParseCIDRSubnet(subnetStr)
+			checkFatal(err)
+			defaultSubnets = append(defaultSubnets, subnet)
+		}
+	}
+
+	var pools, namedPools ipam.Pools
+	for _, poolStr := range config.Pools {
+		nameAndRange := strings.SplitN(poolStr, "=", 2)
+		if len(nameAndRange) != 2 || !poolNameRegexp.MatchString(nameAndRange[0]) {
+			Log.Fatalf("Invalid --ipalloc-pool %q: must be name=CIDR", poolStr)
+		}
+		name := nameAndRange[0]
+		ipRange, err := ipam.ParseCIDRSubnet(nameAndRange[1])
+		checkFatal(err)
+		if _, found := namedPools.ForName(name); found {
+			Log.Fatalf("More than one IP address allocation pool named %q", name)
+		}
+		for _, other := range namedPools {
+			if overlaps(other.DefaultSubnet, ipRange) {
+				Log.Fatalf("IP address allocation pool %s overlaps with pool %s", poolStr, other.Name)
+			}
+		}
+		// Used below to route pre-existing addresses to their pool
+		namedPools = append(namedPools, ipam.Pool{DefaultSubnet: ipRange, Name: name})
+	}
+	for name := range quotas {
+		if _, found := namedPools.ForName(name); name != "" && !found {
+			Log.Fatalf("--ipalloc-quota given for unknown IP address allocation pool %q", name)
+		}
+	}
+	// Pre-existing addresses belong to the named pool containing
+	// them, or else to the unnamed pool of the same family
+	claimsFor := func(pool ipam.Pool) []ipam.PreClaim {
+		var claims []ipam.PreClaim
+		for _, claim := range preClaims {
+			var owner string
+			for _, named := range namedPools {
+				if named.DefaultSubnet.Contains(claim.Cidr.Upper, claim.Cidr.Addr) {
+					owner = named.Name
+				}
+			}
+			if owner == pool.Name && claim.Cidr.IsIPv6() == pool.DefaultSubnet.IsIPv6() {
+				claims = append(claims, claim)
+			}
+		}
+		return claims
+	}
+
+	for _, rangeStr := range strings.Split(config.IPRangeCIDR, ",") {
+		ipRange, err := ipam.ParseCIDRSubnet(rangeStr)
 		checkFatal(err)
-		if !ipRange.Range().Overlaps(defaultSubnet.Range()) {
-			Log.Fatalf("IP address allocation default subnet %s does not overlap with allocation range %s", defaultSubnet, ipRange)
+		if _, found := pools.ForFamily(ipRange.IsIPv6()); found {
+			Log.Fatalf("More than one IP address allocation range for the same address family: %s", config.IPRangeCIDR)
+		}
+		for _, named := range namedPools {
+			if overlaps(named.DefaultSubnet, ipRange) {
+				Log.Fatalf("IP address allocation range %s overlaps with pool %s", ipRange, named.Name)
+			}
+		}
+		defaultSubnet := ipRange
+		for _, subnet := range defaultSubnets {
+			if subnet.IsIPv6() != ipRange.IsIPv6() {
+				continue
+			}
+			if !overlaps(subnet, ipRange) {
+				Log.Fatalf("IP address allocation default subnet %s does not overlap with allocation range %s", subnet, ipRange)
+			}
+			defaultSubnet = subnet
+		}
+		// The IPv4 allocator keeps its original gossip channel and
+		// persisted data, so that it interoperates with older peers
+		name, channelName, poolTrack := "", "IPallocation", track
+		if ipRange.IsIPv6() {
+			name, channelName, poolTrack = "v6", "IPallocation-v6", nil
+		}
+		pool := ipam.Pool{DefaultSubnet: defaultSubnet}
+		if config.ExternalURL != "" {
+			pool.Backend = ipam.NewHTTPBackend(config.ExternalURL, ipRange)
+		} else {
+			pool.Allocator = createAllocator(router, config, ipRange, name, channelName, quotas[""], auditLog, claimsFor(pool), db, poolTrack, isKnownPeer)
+		}
+		pools = append(pools, pool)
+	}
+	for _, subnet := range defaultSubnets {
+		if _, found := pools.ForFamily(subnet.IsIPv6()); !found {
+			Log.Fatalf("IP address allocation default subnet %s has no allocation range of the same address family", subnet)
+		}
+	}
+	// The IPv4 allocator, if any, serves requests that don't say which family they want
+	if len(pools) > 1 && pools[0].Universe().IsIPv6() {
+		pools[0], pools[1] = pools[1], pools[0]
+	}
+
+	for _, pool := range namedPools {
+		if config.ExternalURL != "" {
+			pool.Backend = ipam.NewHTTPBackend(config.ExternalURL, pool.DefaultSubnet)
+		} else {
+			pool.Allocator = createAllocator(router, config, pool.DefaultSubnet, "pool-"+pool.Name, "IPallocation-pool-"+pool.Name, quotas[pool.Name], auditLog, claimsFor(pool), db, nil, isKnownPeer)
 		}
+		pools = append(pools, pool)
 	}
 
+	return pools
+}
+
+func overlaps(a, b address.CIDR) bool {
+	return a.Upper == b.Upper && a.Range().Overlaps(b.Range())
+}
+
+func createAllocator(router *weave.NetworkRouter, config ipamConfig, ipRange address.CIDR, name, channelName string, quotas ipam.Quotas, auditLog *ipam.AuditLog, preClaims []ipam.PreClaim, db db.DB, track tracker.LocalRangeTracker, isKnownPeer func(mesh.PeerName) bool) *ipam.Allocator {
 	c := ipam.Config{
 		OurName:     router.Ourself.Peer.Name,
 		OurUID:      router.Ourself.Peer.UID,
@@ -649,31 +891,67 @@ func createAllocator(router *weave.NetworkRouter, config ipamConfig, preClaims [
 		Db:          db,
 		IsKnownPeer: isKnownPeer,
 		Tracker:     track,
+		Name:        name,
+		Quotas:      quotas,
+		AuditLog:    auditLog,
 	}
-
 	allocator := ipam.NewAllocator(c)
 
-	gossip, err := router.NewGossip("IPallocation", allocator)
+	gossip, err := router.NewGossip(channelName, allocator)
 	checkFatal(err)
 	allocator.SetInterfaces(gossip)
 	allocator.Start()
 	router.Peers.OnGC(func(peer *mesh.Peer) { allocator.PeerGone(peer.Name) })
 
-	return allocator, defaultSubnet
+	return allocator
 }
 
-func createDNSServer(config dnsConfig, router *mesh.Router, isKnownPeer func(mesh.PeerName) bool) (*nameserver.Nameserver, *nameserver.DNSServer) {
+func createDNSServer(config dnsConfig, router *mesh.Router, isKnownPeer func(mesh.PeerName) bool, db db.DB) (*nameserver.Nameserver, *nameserver.DNSServer) {
 	ns := nameserver.New(router.Ourself.Peer.Name, config.Domain, isKnownPeer)
+	ns.SetDB(db)
+	ns.SetZone(config.Zone)
 	router.Peers.OnGC(func(peer *mesh.Peer) { ns.PeerGone(peer.Name) })
 	gossip, err := router.NewGossip("nameserver", ns)
 	checkFatal(err)
 	ns.SetGossip(gossip)
 	upstream := nameserver.NewUpstream(config.ResolvConf, config.addressOnly())
 	dnsserver, err := nameserver.NewDNSServer(ns, config.Domain, config.ListenAddress,
-		upstream, uint32(config.TTL), config.ClientTimeout)
+		upstream, uint32(config.TTL), config.ClientTimeout, config.CacheSize)
 	if err != nil {
 		Log.Fatal("Unable to start dns server: ", err)
 	}
+	dnsserver.LogQueries(config.LogQueries)
+	transferClients, err := nameserver.ParseTransferClients(config.Transfers)
+	checkFatal(err)
+	dnsserver.AllowTransfers(transferClients)
+	for _, forwarder := range config.Forwarders {
+		zone, servers, err := nameserver.ParseForwarder(forwarder)
+		if err == nil {
+			err = dnsserver.AddForwarder(zone, servers)
+		}
+		checkFatal(err)
+	}
+	for _, p := range config.Policies {
+		domain, policy, err := nameserver.ParsePolicy(p)
+		if err == nil {
+			if domain == "" {
+				domain = config.Domain
+			}
+			err = dnsserver.SetPolicy(domain, policy)
+		}
+		checkFatal(err)
+	}
+	for _, p := range config.Probes {
+		parts := strings.SplitN(p, "=", 2)
+		if len(parts) != 2 {
+			Log.Fatalf("invalid DNS probe %q: expected <name>=<probe>", p)
+		}
+		probe, err := nameserver.ParseProbe(parts[1])
+		if err == nil {
+			err = ns.AddProbe(parts[0], probe)
+		}
+		checkFatal(err)
+	}
 	Log.Println("Listening for DNS queries on", config.ListenAddress)
 	return ns, dnsserver
 }
@@ -9,20 +9,22 @@ import (
 
 	"github.com/weaveworks/weave/ipam"
 	"github.com/weaveworks/weave/nameserver"
-	"github.com/weaveworks/weave/net/address"
 	weave "github.com/weaveworks/weave/router"
 )
 
-func metricsHandler(router *weave.NetworkRouter, allocator *ipam.Allocator, ns *nameserver.Nameserver, dnsserver *nameserver.DNSServer) http.Handler {
+func metricsHandler(router *weave.NetworkRouter, pools ipam.Pools, ns *nameserver.Nameserver, dnsserver *nameserver.DNSServer) http.Handler {
 	reg := prometheus.NewRegistry()
 	reg.MustRegister(prometheus.NewProcessCollector(os.Getpid(), ""))
-	reg.MustRegister(newMetrics(router, allocator, ns, dnsserver))
+	reg.MustRegister(newMetrics(router, pools, ns, dnsserver))
+	if dnsserver != nil {
+		reg.MustRegister(dnsserver)
+	}
 	return promhttp.HandlerFor(reg, promhttp.HandlerOpts{})
 }
 
 type collector struct {
 	router    *weave.NetworkRouter
-	allocator *ipam.Allocator
+	pools     ipam.Pools
 	ns        *nameserver.Nameserver
 	dnsserver *nameserver.DNSServer
 }
@@ -58,16 +60,16 @@ var metrics = []metric{
 		func(s WeaveStatus, desc *prometheus.Desc, ch chan<- prometheus.Metric) {
 			ch <- uint64Counter(desc, uint64(s.Router.TerminationCount))
 		}},
-	{desc("weave_ips", "Number of IP addresses.", "state"),
+	{desc("weave_ips", "Number of IP addresses.", "state", "pool"),
 		func(s WeaveStatus, desc *prometheus.Desc, ch chan<- prometheus.Metric) {
-			if s.IPAM != nil {
-				ch <- intGauge(desc, s.IPAM.ActiveIPs, "local-used")
+			for _, status := range s.allIPAMStatuses() {
+				ch <- intGauge(desc, status.ActiveIPs, "local-used", poolLabel(status))
 			}
 		}},
-	{desc("weave_max_ips", "Size of IP address space used by allocator."),
+	{desc("weave_max_ips", "Size of IP address space used by allocator.", "pool"),
 		func(s WeaveStatus, desc *prometheus.Desc, ch chan<- prometheus.Metric) {
-			if s.IPAM != nil {
-				ch <- intGauge(desc, s.IPAM.RangeNumIPs)
+			for _, status := range s.allIPAMStatuses() {
+				ch <- intGauge(desc, status.RangeNumIPs, poolLabel(status))
 			}
 		}},
 	{desc("weave_dns_entries", "Number of DNS entries."),
@@ -76,47 +78,99 @@ var metrics = []metric{
 				ch <- intGauge(desc, countDNSEntriesForPeer(s.Router.Name, s.DNS.Entries))
 			}
 		}},
+	{desc("weave_dns_cache_entries", "Number of fallback DNS responses cached."),
+		func(s WeaveStatus, desc *prometheus.Desc, ch chan<- prometheus.Metric) {
+			if s.DNS != nil && s.DNS.Cache != nil {
+				ch <- intGauge(desc, s.DNS.Cache.Entries)
+			}
+		}},
+	{desc("weave_dns_cache_hits_total", "Number of fallback DNS queries answered from the cache."),
+		func(s WeaveStatus, desc *prometheus.Desc, ch chan<- prometheus.Metric) {
+			if s.DNS != nil && s.DNS.Cache != nil {
+				ch <- uint64Counter(desc, s.DNS.Cache.Hits)
+			}
+		}},
+	{desc("weave_dns_cache_misses_total", "Number of fallback DNS queries not found in the cache."),
+		func(s WeaveStatus, desc *prometheus.Desc, ch chan<- prometheus.Metric) {
+			if s.DNS != nil && s.DNS.Cache != nil {
+				ch <- uint64Counter(desc, s.DNS.Cache.Misses)
+			}
+		}},
 	{desc("weave_flows", "Number of FastDP flows."),
 		func(s WeaveStatus, desc *prometheus.Desc, ch chan<- prometheus.Metric) {
 			if metrics := fastDPMetrics(s); metrics != nil {
 				ch <- intGauge(desc, metrics.Flows)
 			}
 		}},
-	{desc("weave_ipam_unreachable_count", "Number of unreachable peers."),
+	trafficMetric("weave_connection_tx_packets_total", "Number of packets sent to a peer over an overlay.",
+		func(t weave.TrafficStats) uint64 { return t.TxPackets }),
+	trafficMetric("weave_connection_tx_bytes_total", "Number of bytes sent to a peer over an overlay.",
+		func(t weave.TrafficStats) uint64 { return t.TxBytes }),
+	trafficMetric("weave_connection_rx_packets_total", "Number of packets received from a peer over an overlay.",
+		func(t weave.TrafficStats) uint64 { return t.RxPackets }),
+	trafficMetric("weave_connection_rx_bytes_total", "Number of bytes received from a peer over an overlay.",
+		func(t weave.TrafficStats) uint64 { return t.RxBytes }),
+	trafficMetric("weave_connection_dropped_packets_total", "Number of packets to or from a peer dropped by an overlay.",
+		func(t weave.TrafficStats) uint64 { return t.Drops }),
+	trafficMetric("weave_connection_encryption_failures_total", "Number of encryption failures on the connection to a peer over an overlay.",
+		func(t weave.TrafficStats) uint64 { return t.EncryptionFailures }),
+	{desc("weave_ipam_unreachable_count", "Number of unreachable peers.", "pool"),
 		func(s WeaveStatus, desc *prometheus.Desc, ch chan<- prometheus.Metric) {
-			var count int
-			for _, entry := range summariseIpamStats(s.IPAM) {
-				if !entry.reachable {
-					count++
+			for _, status := range s.allIPAMStatuses() {
+				var count int
+				for _, entry := range summariseIpamStats(status) {
+					if !entry.reachable {
+						count++
+					}
 				}
+				ch <- intGauge(desc, count, poolLabel(status))
 			}
-			ch <- intGauge(desc, count)
 		}},
-	{desc("weave_ipam_unreachable_percentage", "Percentage of IP addresses owned  by unreachable peers."),
+	{desc("weave_ipam_unreachable_percentage", "Percentage of IP addresses owned  by unreachable peers.", "pool"),
 		func(s WeaveStatus, desc *prometheus.Desc, ch chan<- prometheus.Metric) {
-			var totalUnreachable uint32
-			for _, entry := range summariseIpamStats(s.IPAM) {
-				if !entry.reachable {
-					totalUnreachable += entry.ips
+			for _, status := range s.allIPAMStatuses() {
+				var totalUnreachable uint32
+				for _, entry := range summariseIpamStats(status) {
+					if !entry.reachable {
+						totalUnreachable += entry.ips
+					}
 				}
+				percentage := float64(totalUnreachable) * 100.0 / float64(status.RangeNumIPs)
+				ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, percentage, poolLabel(status))
 			}
-			percentage := float64(totalUnreachable) * 100.0 / float64(s.IPAM.RangeNumIPs)
-			ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, percentage)
 		}},
-	{desc("weave_ipam_pending_allocates", "Number of pending allocates."),
+	{desc("weave_ipam_pending_allocates", "Number of pending allocates.", "pool"),
 		func(s WeaveStatus, desc *prometheus.Desc, ch chan<- prometheus.Metric) {
-			if s.IPAM != nil {
-				ch <- intGauge(desc, len(s.IPAM.PendingAllocates))
+			for _, status := range s.allIPAMStatuses() {
+				ch <- intGauge(desc, len(status.PendingAllocates), poolLabel(status))
 			}
 		}},
-	{desc("weave_ipam_pending_claims", "Number of pending claims."),
+	{desc("weave_ipam_pending_claims", "Number of pending claims.", "pool"),
 		func(s WeaveStatus, desc *prometheus.Desc, ch chan<- prometheus.Metric) {
-			if s.IPAM != nil {
-				ch <- intGauge(desc, len(s.IPAM.PendingClaims))
+			for _, status := range s.allIPAMStatuses() {
+				ch <- intGauge(desc, len(status.PendingClaims), poolLabel(status))
 			}
 		}},
 }
 
+// The pool label of IPAM metrics: the name of a named pool, otherwise
+// the range of the pool, which tells apart the IPv4 and IPv6 ones
+func poolLabel(status *ipam.Status) string {
+	if status.Pool != "" {
+		return status.Pool
+	}
+	return status.Range
+}
+
+func trafficMetric(fqName, help string, value func(weave.TrafficStats) uint64) metric {
+	return metric{desc(fqName, help, "peer", "overlay"),
+		func(s WeaveStatus, desc *prometheus.Desc, ch chan<- prometheus.Metric) {
+			for _, traffic := range s.Router.Traffic {
+				ch <- uint64Counter(desc, value(traffic.TrafficStats), traffic.Peer, traffic.Overlay)
+			}
+		}}
+}
+
 func fastDPMetrics(s WeaveStatus) *weave.FastDPMetrics {
 	if diagMap, ok := s.Router.OverlayDiagnostics.(map[string]interface{}); ok {
 		if diag, ok := diagMap["fastdp"]; ok {
@@ -128,10 +182,10 @@ func fastDPMetrics(s WeaveStatus) *weave.FastDPMetrics {
 	return nil
 }
 
-func newMetrics(router *weave.NetworkRouter, allocator *ipam.Allocator, ns *nameserver.Nameserver, dnsserver *nameserver.DNSServer) *collector {
+func newMetrics(router *weave.NetworkRouter, pools ipam.Pools, ns *nameserver.Nameserver, dnsserver *nameserver.DNSServer) *collector {
 	return &collector{
 		router:    router,
-		allocator: allocator,
+		pools:     pools,
 		ns:        ns,
 		dnsserver: dnsserver,
 	}
@@ -141,8 +195,8 @@ func (m *collector) Collect(ch chan<- prometheus.Metric) {
 
 	status := WeaveStatus{
 		Router: weave.NewNetworkRouterStatus(m.router),
-		IPAM:   ipam.NewStatus(m.allocator, address.CIDR{}),
 		DNS:    nameserver.NewStatus(m.ns, m.dnsserver)}
+	status.IPAM, status.IPAM6, status.IPAMPools = newIPAMStatuses(m.pools)
 
 	for _, metric := range metrics {
 		metric.Collect(status, metric.Desc, ch)
@@ -126,9 +126,22 @@ func populateDNS(ns *nameserver.Nameserver, dockerCli *weavedocker.Client, ourNa
 					return nil, err
 				}
 				fqdn := container.Config.Hostname + "." + container.Config.Domainname
+				services, err := nameserver.ParseServices(container.Config.Labels[nameserver.ServiceLabel])
+				if err != nil {
+					Log.Warnf("container %s: ignoring label %s: %s", cid, nameserver.ServiceLabel, err)
+				}
+				var weight uint16
+				if label, found := container.Config.Labels[nameserver.WeightLabel]; found {
+					if weight, err = nameserver.ParseWeight(label); err != nil {
+						Log.Warnf("container %s: ignoring label %s: %s", cid, nameserver.WeightLabel, err)
+					}
+				}
 				for _, netDev := range netDevs {
 					for _, cidr := range netDev.CIDRs {
-						ns.AddEntryFQDN(fqdn, cid, ourName, address.FromIP4(cidr.IP))
+						ns.AddWeightedEntryFQDN(fqdn, cid, ourName, cidr.IP, weight)
+						for _, service := range services {
+							ns.AddService(fqdn, cid, ourName, cidr.IP, service)
+						}
 					}
 				}
 			}
@@ -0,0 +1,70 @@
+// Export and import the IPAM state in the Weave Net persistence DB
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/weaveworks/mesh"
+
+	"github.com/weaveworks/weave/db"
+	"github.com/weaveworks/weave/ipam"
+)
+
+func ipamExport(args []string) error {
+	if len(args) < 1 {
+		cmdUsage("ipam-export", "<db-prefix> [<allocator-name>...]")
+	}
+	d, err := db.NewBoltDBReadOnly(args[0])
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	names := args[1:]
+	if len(names) == 0 { // all of them
+		idents, err := d.Idents()
+		if err != nil {
+			return err
+		}
+		names = ipam.PersistedAllocatorNames(idents)
+	}
+	st, err := ipam.PersistedState(d, names)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(st)
+}
+
+func ipamImport(args []string) error {
+	if len(args) != 2 && len(args) != 3 {
+		cmdUsage("ipam-import", "<db-prefix> <file> [<peer-name>]")
+	}
+
+	file, err := os.Open(args[1])
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var st ipam.State
+	if err := json.NewDecoder(file).Decode(&st); err != nil {
+		return fmt.Errorf("%s: %s", args[1], err)
+	}
+	peerName := st.Peer
+	if len(args) == 3 {
+		peerName = args[2]
+	}
+	peer, err := mesh.PeerNameFromString(peerName)
+	if err != nil {
+		return err
+	}
+
+	d, err := db.NewBoltDB(args[0])
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return ipam.RestorePersisted(d, &st, peer)
+}
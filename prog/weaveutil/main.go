@@ -42,6 +42,8 @@ func init() {
 		"rewrite-etc-hosts":        rewriteEtcHosts,
 		"get-db-flag":              getDBFlag,
 		"set-db-flag":              setDBFlag,
+		"ipam-export":              ipamExport,
+		"ipam-import":              ipamImport,
 	}
 }
 
@@ -53,21 +53,36 @@ type FastDatapath struct {
 	// MACs seen on the bridge recently
 	seenMACs map[MAC]struct{}
 
-	// vxlan vports associated with the given UDP ports
-	vxlanUDPPorts    map[int]odp.VportID
-	vxlanVportIDs    map[odp.VportID]struct{}
+	// vxlan and geneve vports associated with the given UDP ports,
+	// and the other way around
+	tunnelUDPPorts   map[int]odp.VportID
+	tunnelVportIDs   map[odp.VportID]int
 	mainVxlanVportID odp.VportID
 	mainVxlanUDPPort int
 
+	// The geneve vport, if we offer geneve
+	geneve            bool
+	mainGeneveVportID odp.VportID
+	mainGeneveUDPPort int
+
 	// A singleton pool for the occasions when we need to decode
 	// the packet.
 	dec *EthernetDecoder
 
 	// forwarders by remote peer
 	forwarders map[mesh.PeerName]*fastDatapathForwarder
+
+	// The same forwarders by the far end of their tunnel, to
+	// tell which connections the traffic of flows went through
+	endpointForwarders map[tunnelEndpoint]*fastDatapathForwarder
+
+	// The flows last enumerated for diagnostics or traffic stats,
+	// which status reports ask for together
+	flows     []odp.FlowInfo
+	flowsTime time.Time
 }
 
-func NewFastDatapath(iface *net.Interface, port int, encryptionEnabled bool) (*FastDatapath, error) {
+func NewFastDatapath(iface *net.Interface, port int, encryptionEnabled bool, geneveEnabled bool) (*FastDatapath, error) {
 	var ipSec *ipsec.IPSec
 
 	dpif, err := odp.NewDpif()
@@ -98,24 +113,26 @@ func NewFastDatapath(iface *net.Interface, port int, encryptionEnabled bool) (*F
 	}
 
 	fastdp := &FastDatapath{
-		iface:         iface,
-		dpif:          dpif,
-		dp:            dp,
-		missHandlers:  make(map[odp.VportID]missHandler),
-		ipsec:         ipSec,
-		sendToPort:    nil,
-		sendToMAC:     make(map[MAC]bridgeSender),
-		seenMACs:      make(map[MAC]struct{}),
-		vxlanUDPPorts: make(map[int]odp.VportID),
-		vxlanVportIDs: make(map[odp.VportID]struct{}),
-		forwarders:    make(map[mesh.PeerName]*fastDatapathForwarder),
+		iface:          iface,
+		dpif:           dpif,
+		dp:             dp,
+		missHandlers:   make(map[odp.VportID]missHandler),
+		ipsec:          ipSec,
+		sendToPort:     nil,
+		sendToMAC:      make(map[MAC]bridgeSender),
+		seenMACs:       make(map[MAC]struct{}),
+		tunnelUDPPorts: make(map[int]odp.VportID),
+		tunnelVportIDs: make(map[odp.VportID]int),
+		forwarders:     make(map[mesh.PeerName]*fastDatapathForwarder),
+
+		endpointForwarders: make(map[tunnelEndpoint]*fastDatapathForwarder),
 	}
 
 	// This delete happens asynchronously in the kernel, meaning that
 	// we can sometimes fail to recreate the vxlan vport with EADDRINUSE -
 	// consequently we retry a small number of times in
-	// getVxlanVportIDHarder() to compensate.
-	if err := fastdp.deleteVxlanVports(); err != nil {
+	// getVportIDHarder() to compensate.
+	if err := fastdp.deleteTunnelVports(); err != nil {
 		return nil, err
 	}
 
@@ -132,11 +149,23 @@ func NewFastDatapath(iface *net.Interface, port int, encryptionEnabled bool) (*F
 	// them on the connecting side.  So we can wait to find out if
 	// anyone wants that.
 	fastdp.mainVxlanUDPPort = port + 1
-	fastdp.mainVxlanVportID, err = fastdp.getVxlanVportIDHarder(fastdp.mainVxlanUDPPort, 5, time.Millisecond*10)
+	fastdp.mainVxlanVportID, err = fastdp.getVportIDHarder(fastdp.getVxlanVportID, fastdp.mainVxlanUDPPort, 5, time.Millisecond*10)
 	if err != nil {
 		return nil, err
 	}
 
+	// Geneve is optional, so peers can carry on with vxlan if
+	// the kernel does not support it.
+	if geneveEnabled {
+		fastdp.mainGeneveUDPPort = port + GenevePortOffset
+		fastdp.mainGeneveVportID, err = fastdp.getVportIDHarder(fastdp.getGeneveVportID, fastdp.mainGeneveUDPPort, 5, time.Millisecond*10)
+		if err != nil {
+			log.Warning("Not offering geneve for fast datapath: ", err)
+		} else {
+			fastdp.geneve = true
+		}
+	}
+
 	// need to lock before we might receive events
 	fastdp.lock.Lock()
 	defer fastdp.lock.Unlock()
@@ -344,7 +373,13 @@ func (fastdp fastDatapathOverlay) Stop() {
 
 func (fastDatapathOverlay) AddFeaturesTo(features map[string]string) {
 	// Nothing needed.  Fast datapath support is indicated through
-	// OverlaySwitch.
+	// OverlaySwitch, and so is Geneve support (see GeneveEnabled).
+}
+
+// GeneveEnabled says whether we offer Geneve to peers, which is to
+// be indicated by the GeneveFeature.
+func (fastdp *FastDatapath) GeneveEnabled() bool {
+	return fastdp.geneve
 }
 
 type FastDPStatus struct {
@@ -401,7 +436,7 @@ func (fastdp fastDatapathOverlay) Diagnostics() interface{} {
 		vportStatuses = append(vportStatuses, VportStatus(vport))
 	}
 
-	flows, err := fastdp.dp.EnumerateFlows()
+	flows, err := fastdp.recentFlows()
 	checkWarn(err)
 	flowStatuses := make([]FlowStatus, 0, len(flows))
 	for _, flow := range flows {
@@ -414,6 +449,131 @@ func (fastdp fastDatapathOverlay) Diagnostics() interface{} {
 	}
 }
 
+func (fastdp fastDatapathOverlay) TrafficStats() []ConnectionTrafficStatus {
+	lock := fastdp.startLock()
+	defer lock.unlock()
+
+	flows, err := fastdp.recentFlows()
+	checkWarn(err)
+
+	// The traffic of the flows which have gone, plus that of the
+	// current flows
+	traffic := make(map[*fastDatapathForwarder]TrafficStats)
+	for _, fwd := range fastdp.forwarders {
+		traffic[fwd] = fwd.traffic.get()
+	}
+	for _, flow := range flows {
+		fastdp.flowTraffic(flow, func(fwd *fastDatapathForwarder, stats TrafficStats) {
+			traffic[fwd] = traffic[fwd].add(stats)
+		})
+	}
+
+	statuses := make([]ConnectionTrafficStatus, 0, len(traffic))
+	for fwd, stats := range traffic {
+		statuses = append(statuses, ConnectionTrafficStatus{
+			Peer:         fwd.remotePeer.Name.String(),
+			NickName:     fwd.remotePeer.NickName,
+			TrafficStats: stats,
+		})
+	}
+	return statuses
+}
+
+// recentFlows returns the flows of the datapath, reusing those
+// enumerated within the last second.  Called with the lock held.
+func (fastdp *FastDatapath) recentFlows() ([]odp.FlowInfo, error) {
+	if fastdp.flows != nil && time.Since(fastdp.flowsTime) < time.Second {
+		return fastdp.flows, nil
+	}
+
+	flows, err := fastdp.dp.EnumerateFlows()
+	if err != nil {
+		return nil, err
+	}
+
+	fastdp.flows, fastdp.flowsTime = flows, time.Now()
+	return flows, nil
+}
+
+// flowTraffic passes the traffic of a flow to account, for each
+// forwarder it went through.  Packets coming from a tunnel count as
+// received, or dropped if the flow discards them; packets going to a
+// tunnel count as sent.
+func (fastdp *FastDatapath) flowTraffic(flow odp.FlowInfo, account func(*fastDatapathForwarder, TrafficStats)) {
+	if tunnel, ok := flow.FlowKeys[odp.OVS_KEY_ATTR_TUNNEL].(odp.TunnelFlowKey); ok && !tunnel.Ignored() {
+		if inPort, ok := flow.FlowKeys[odp.OVS_KEY_ATTR_IN_PORT].(odp.InPortFlowKey); ok {
+			if udpPort, ok := fastdp.tunnelVportIDs[inPort.VportID()]; ok {
+				if fwd := fastdp.forwarderAt(tunnelSrcIP(tunnel.Key()), udpPort); fwd != nil {
+					if len(flow.Actions) == 0 {
+						account(fwd, TrafficStats{Drops: flow.Packets})
+					} else {
+						account(fwd, TrafficStats{RxPackets: flow.Packets, RxBytes: flow.Bytes})
+					}
+				}
+			}
+		}
+	}
+
+	// Each tunnel output follows the action setting its tunnel
+	var tunnelAttrs *odp.TunnelAttrs
+	for _, action := range flow.Actions {
+		switch a := action.(type) {
+		case odp.SetTunnelAction:
+			tunnelAttrs = &a.TunnelAttrs
+		case odp.OutputAction:
+			udpPort, ok := fastdp.tunnelVportIDs[a.VportID()]
+			if !ok || tunnelAttrs == nil {
+				continue
+			}
+			if fwd := fastdp.forwarderAt(tunnelDstIP(*tunnelAttrs), udpPort); fwd != nil {
+				account(fwd, TrafficStats{TxPackets: flow.Packets, TxBytes: flow.Bytes})
+			}
+		}
+	}
+}
+
+// Keep the traffic of a flow we are about to delete or clear, which
+// resets its stats.
+func (fastdp *FastDatapath) keepFlowTraffic(flow odp.FlowInfo) {
+	fastdp.flowTraffic(flow, func(fwd *fastDatapathForwarder, stats TrafficStats) {
+		fwd.traffic.add(stats)
+	})
+}
+
+// The far end of a tunnel: the IP address of a peer, and the UDP
+// port of the tunnel, which is that of the vport on both ends
+type tunnelEndpoint struct {
+	ip   [16]byte
+	port int
+}
+
+func makeTunnelEndpoint(ip net.IP, port int) (ep tunnelEndpoint) {
+	copy(ep.ip[:], ip.To16())
+	ep.port = port
+	return
+}
+
+// forwarderAt returns the forwarder to the peer at the given tunnel
+// endpoint, if any.  Called with the lock held.
+func (fastdp *FastDatapath) forwarderAt(ip net.IP, udpPort int) *fastDatapathForwarder {
+	return fastdp.endpointForwarders[makeTunnelEndpoint(ip, udpPort)]
+}
+
+// setEndpoint records the tunnel endpoint of a forwarder, given its
+// remote address, which may be nil if not known yet.  Called with the
+// lock held.
+func (fastdp *FastDatapath) setEndpoint(fwd *fastDatapathForwarder, remoteAddr *net.UDPAddr) {
+	if fastdp.endpointForwarders[fwd.endpoint] == fwd {
+		delete(fastdp.endpointForwarders, fwd.endpoint)
+	}
+
+	fwd.endpoint = tunnelEndpoint{}
+	if remoteAddr != nil {
+		fwd.endpoint = makeTunnelEndpoint(remoteAddr.IP, remoteAddr.Port)
+		fastdp.endpointForwarders[fwd.endpoint] = fwd
+	}
+}
+
 type FastDPMetrics struct {
 	Flows        int
 	TotalPackets uint64
@@ -444,31 +604,38 @@ func (fastdp fastDatapathOverlay) StartConsumingPackets(localPeer *mesh.Peer, pe
 	return nil
 }
 
-func (fastdp *FastDatapath) getVxlanVportIDHarder(udpPort int, retries int, duration time.Duration) (odp.VportID, error) {
-	var vxlanVportID odp.VportID
+func (fastdp *FastDatapath) getVportIDHarder(getVportID func(int) (odp.VportID, error), udpPort int, retries int, duration time.Duration) (odp.VportID, error) {
+	var vportID odp.VportID
 	var err error
 	for try := 0; try < retries; try++ {
-		vxlanVportID, err = fastdp.getVxlanVportID(udpPort)
+		vportID, err = getVportID(udpPort)
 		if err == nil || err != odp.NetlinkError(syscall.EADDRINUSE) {
-			return vxlanVportID, err
+			return vportID, err
 		}
-		log.Warning("Address already in use creating vxlan vport ", udpPort, " - retrying")
+		log.Warning("Address already in use creating vport for ", udpPort, " - retrying")
 		time.Sleep(duration)
 	}
 	return 0, err
 }
 
 func (fastdp *FastDatapath) getVxlanVportID(udpPort int) (odp.VportID, error) {
+	return fastdp.getTunnelVportID(odp.NewVxlanVportSpec(fmt.Sprintf("vxlan-%d", udpPort), uint16(udpPort)), udpPort)
+}
+
+func (fastdp *FastDatapath) getGeneveVportID(udpPort int) (odp.VportID, error) {
+	return fastdp.getTunnelVportID(odp.NewGeneveVportSpec(fmt.Sprintf("geneve-%d", udpPort), uint16(udpPort)), udpPort)
+}
+
+func (fastdp *FastDatapath) getTunnelVportID(spec odp.VportSpec, udpPort int) (odp.VportID, error) {
 	fastdp.lock.Lock()
 	defer fastdp.lock.Unlock()
 
-	if vxlanVportID, present := fastdp.vxlanUDPPorts[udpPort]; present {
-		return vxlanVportID, nil
+	if vportID, present := fastdp.tunnelUDPPorts[udpPort]; present {
+		return vportID, nil
 	}
 
-	name := fmt.Sprintf("vxlan-%d", udpPort)
-	vxlanVportID, err := fastdp.dp.CreateVport(
-		odp.NewVxlanVportSpec(name, uint16(udpPort)))
+	name := spec.Name()
+	vportID, err := fastdp.dp.CreateVport(spec)
 	if err != nil {
 		return 0, err
 	}
@@ -481,17 +648,17 @@ func (fastdp *FastDatapath) getVxlanVportID(udpPort int) (odp.VportID, error) {
 		if link.Attrs().Flags&net.FlagUp == 0 {
 			// The netdev interface is down, so most likely bringing it up
 			// has failed due to the UDP port being in use.
-			if err := fastdp.dp.DeleteVport(vxlanVportID); err != nil {
-				log.Warningf("Unable to remove vxlan vport %d: %s", vxlanVportID, err)
+			if err := fastdp.dp.DeleteVport(vportID); err != nil {
+				log.Warningf("Unable to remove %s vport %d: %s", spec.TypeName(), vportID, err)
 			}
 			return 0, odp.NetlinkError(syscall.EADDRINUSE)
 		}
 	}
 
-	fastdp.vxlanUDPPorts[udpPort] = vxlanVportID
-	fastdp.vxlanVportIDs[vxlanVportID] = struct{}{}
-	fastdp.missHandlers[vxlanVportID] = func(fks odp.FlowKeys, lock *fastDatapathLock) FlowOp {
-		log.Debug("ODP miss: ", fks, " on port ", vxlanVportID)
+	fastdp.tunnelUDPPorts[udpPort] = vportID
+	fastdp.tunnelVportIDs[vportID] = udpPort
+	fastdp.missHandlers[vportID] = func(fks odp.FlowKeys, lock *fastDatapathLock) FlowOp {
+		log.Debug("ODP miss: ", fks, " on port ", vportID)
 		tunnel := fks[odp.OVS_KEY_ATTR_TUNNEL].(odp.TunnelFlowKey)
 		tunKey := tunnel.Key()
 
@@ -514,7 +681,7 @@ func (fastdp *FastDatapath) getVxlanVportID(udpPort int) (odp.VportID, error) {
 				fastdp:  fastdp,
 				srcPeer: srcPeer,
 				sender: &net.UDPAddr{
-					IP:   net.IP(tunKey.Ipv4Src[:]),
+					IP:   tunnelSrcIP(tunKey),
 					Port: udpPort,
 				},
 			}
@@ -534,7 +701,17 @@ func (fastdp *FastDatapath) getVxlanVportID(udpPort int) (odp.VportID, error) {
 		return NewMultiFlowOp(false, odpFlowKey(tunnelFlowKey), consumer(key))
 	}
 
-	return vxlanVportID, nil
+	return vportID, nil
+}
+
+// The address a packet received through a vxlan tunnel came from
+func tunnelSrcIP(tunKey odp.TunnelAttrs) net.IP {
+	return net.IP(tunKey.Ipv4Src[:])
+}
+
+// The address a packet sent through a vxlan tunnel goes to
+func tunnelDstIP(tunAttrs odp.TunnelAttrs) net.IP {
+	return net.IP(tunAttrs.Ipv4Dst[:])
 }
 
 func (fastdp *FastDatapath) extractPeers(tunnelID [8]byte) (*mesh.Peer, *mesh.Peer) {
@@ -564,10 +741,12 @@ func (op vxlanSpecialPacketFlowOp) Process(frame []byte, dec *EthernetDecoder, b
 type fastDatapathForwarder struct {
 	fastdp         *FastDatapath
 	remotePeer     *mesh.Peer
-	localIP        [4]byte
+	localIP        net.IP
 	sendControlMsg func(byte, []byte) error
 	connUID        uint64
-	vxlanVportID   odp.VportID
+	tunnelVportID  odp.VportID
+	geneve         bool
+	traffic        *trafficCounters
 
 	sessionKey                 *[32]byte
 	isEncrypted                bool
@@ -576,6 +755,7 @@ type fastDatapathForwarder struct {
 	lock              sync.RWMutex
 	confirmed         bool
 	remoteAddr        *net.UDPAddr
+	endpoint          tunnelEndpoint // of remoteAddr; guarded by fastdp.lock
 	heartbeatInterval time.Duration
 	heartbeatTimer    *time.Timer // for sending
 	heartbeatTimeout  *time.Timer // for receiving
@@ -590,30 +770,41 @@ type fastDatapathForwarder struct {
 }
 
 func (fastdp fastDatapathOverlay) PrepareConnection(params mesh.OverlayConnectionParams) (mesh.OverlayConnection, error) {
-	vxlanVportID := fastdp.mainVxlanVportID
-	vxlanUDPPort := fastdp.mainVxlanUDPPort
+	// Use geneve if both peers offer it.  IPsec is only set up
+	// for vxlan, so encrypted connections stick to that.
+	_, remoteGeneve := params.Features[GeneveFeature]
+	geneve := fastdp.geneve && remoteGeneve && (fastdp.ipsec == nil || params.SessionKey == nil)
+
+	vportID, udpPort := fastdp.mainVxlanVportID, fastdp.mainVxlanUDPPort
+	getVportID, portOffset := fastdp.getVxlanVportID, 1
+	if geneve {
+		vportID, udpPort = fastdp.mainGeneveVportID, fastdp.mainGeneveUDPPort
+		getVportID, portOffset = fastdp.getGeneveVportID, GenevePortOffset
+	}
 
 	remoteAddr := makeUDPAddr(params.RemoteAddr)
 	if params.Outbound {
 		var err error
 		// The provided address contains the main weave port
 		// number to connect to.  We need to derive the vxlan
-		// port number from that.
-		vxlanRemoteAddr := *remoteAddr
-		vxlanRemoteAddr.Port++
-		remoteAddr = &vxlanRemoteAddr
-		vxlanUDPPort = remoteAddr.Port
-		vxlanVportID, err = fastdp.getVxlanVportID(vxlanUDPPort)
+		// (or geneve) port number from that.
+		tunnelRemoteAddr := *remoteAddr
+		tunnelRemoteAddr.Port += portOffset
+		remoteAddr = &tunnelRemoteAddr
+		udpPort = remoteAddr.Port
+		vportID, err = getVportID(udpPort)
 		if err != nil {
 			return nil, err
 		}
 	} else {
-		remoteAddr.Port = vxlanUDPPort
+		remoteAddr.Port = udpPort
 	}
 
-	localIP, err := ipv4Bytes(params.LocalAddr.IP)
-	if err != nil {
-		return nil, err
+	// The vendored go-odp only sets up IPv4 tunnels, so
+	// connections over IPv6 are left to sleeve
+	localIP := params.LocalAddr.IP.To4()
+	if localIP == nil {
+		return nil, fmt.Errorf("fast datapath over IPv6 is not supported")
 	}
 
 	fwd := &fastDatapathForwarder{
@@ -622,7 +813,9 @@ func (fastdp fastDatapathOverlay) PrepareConnection(params mesh.OverlayConnectio
 		localIP:        localIP,
 		sendControlMsg: params.SendControlMessage,
 		connUID:        params.ConnUID,
-		vxlanVportID:   vxlanVportID,
+		tunnelVportID:  vportID,
+		geneve:         geneve,
+		traffic:        &trafficCounters{},
 		sessionKey:     params.SessionKey,
 		healthy:        true,
 
@@ -638,14 +831,20 @@ func (fastdp fastDatapathOverlay) PrepareConnection(params mesh.OverlayConnectio
 	return fwd, nil
 }
 
-func ipv4Bytes(ip net.IP) (res [4]byte, err error) {
-	ipv4 := ip.To4()
-	if ipv4 != nil {
-		copy(res[:], ipv4)
-	} else {
-		err = fmt.Errorf("IP address %s is not IPv4", ip)
+// setTunnelIPs sets the addresses of the vxlan tunnel from localIP to
+// remoteIP, which must both be IPv4.
+func setTunnelIPs(sta *odp.SetTunnelAction, localIP, remoteIP net.IP) error {
+	local4, remote4 := localIP.To4(), remoteIP.To4()
+	if local4 == nil || remote4 == nil {
+		return fmt.Errorf("IP addresses %s and %s are not both IPv4", localIP, remoteIP)
 	}
-	return
+
+	var src, dst [4]byte
+	copy(src[:], local4)
+	copy(dst[:], remote4)
+	sta.SetIpv4Src(src)
+	sta.SetIpv4Dst(dst)
+	return nil
 }
 
 func (fwd *fastDatapathForwarder) logPrefix() string {
@@ -666,12 +865,13 @@ func (fwd *fastDatapathForwarder) Confirm() {
 		var err error
 		controlMsg, err = fwd.fastdp.ipsec.InitSALocal(
 			fwd.fastdp.localPeer.Name, fwd.remotePeer.Name, fwd.connUID,
-			net.IP(fwd.localIP[:]), fwd.remoteAddr.IP,
+			fwd.localIP, fwd.remoteAddr.IP,
 			fwd.remoteAddr.Port,
 			fwd.sessionKey,
 		)
 		if err != nil {
 			log.Error(fwd.logPrefix(), "ipsec init SA local failed: ", err)
+			fwd.traffic.addEncryptionFailure()
 			fwd.handleError(err)
 			fwd.lock.Unlock()
 			return
@@ -679,7 +879,7 @@ func (fwd *fastDatapathForwarder) Confirm() {
 	}
 
 	log.Debug(fwd.logPrefix(), "confirmed")
-	fwd.fastdp.addForwarder(fwd.remotePeer.Name, fwd)
+	fwd.fastdp.addForwarder(fwd.remotePeer.Name, fwd, fwd.remoteAddr)
 	fwd.confirmed = true
 
 	if fwd.remoteAddr != nil && (!fwd.isEncrypted || fwd.isOutboundIPSecEstablished) {
@@ -824,6 +1024,7 @@ func (fwd *fastDatapathForwarder) handleVxlanSpecialPacket(frame []byte, sender
 
 	if fwd.remoteAddr == nil {
 		fwd.remoteAddr = sender
+		fwd.fastdp.moveForwarder(fwd.remotePeer.Name, fwd, sender)
 
 		if fwd.confirmed {
 			fwd.heartbeatTimer.Reset(0)
@@ -831,6 +1032,7 @@ func (fwd *fastDatapathForwarder) handleVxlanSpecialPacket(frame []byte, sender
 	} else if !udpAddrsEqual(fwd.remoteAddr, sender) {
 		log.Info(fwd.logPrefix(), "Peer IP address changed to ", sender)
 		fwd.remoteAddr = sender
+		fwd.fastdp.moveForwarder(fwd.remotePeer.Name, fwd, sender)
 	}
 
 	if !fwd.ackedHeartbeat {
@@ -871,7 +1073,11 @@ func (fwd *fastDatapathForwarder) ControlMessage(tag byte, msg []byte) {
 }
 
 func (fwd *fastDatapathForwarder) Attrs() map[string]interface{} {
-	return map[string]interface{}{"name": "fastdp", "mtu": fwd.fastdp.iface.MTU}
+	encap := "vxlan"
+	if fwd.geneve {
+		encap = "geneve"
+	}
+	return map[string]interface{}{"name": "fastdp", "mtu": fwd.fastdp.iface.MTU, "encap": encap}
 }
 
 func (fwd *fastDatapathForwarder) handleHeartbeatAck() {
@@ -900,11 +1106,12 @@ func (fwd *fastDatapathForwarder) handleCryptoInitSARemote(msg []byte) {
 	err := fwd.fastdp.ipsec.InitSARemote(
 		msg,
 		fwd.fastdp.localPeer.Name, fwd.remotePeer.Name, fwd.connUID,
-		net.IP(fwd.localIP[:]), fwd.remoteAddr.IP, fwd.remoteAddr.Port,
+		fwd.localIP, fwd.remoteAddr.IP, fwd.remoteAddr.Port,
 		fwd.sessionKey,
 	)
 	if err != nil {
 		log.Warning(fwd.logPrefix(), "IPSec init SA remote failed: ", err)
+		fwd.traffic.addEncryptionFailure()
 		fwd.handleError(err)
 		return
 	}
@@ -933,21 +1140,17 @@ func (fwd *fastDatapathForwarder) Forward(key ForwardPacketKey) FlowOp {
 		return vetoFlowCreationFlowOp{}
 	}
 
-	remoteIP, err := ipv4Bytes(fwd.remoteAddr.IP)
-	if err != nil {
+	var sta odp.SetTunnelAction
+	sta.SetTunnelId(tunnelIDFor(key))
+	if err := setTunnelIPs(&sta, fwd.localIP, fwd.remoteAddr.IP); err != nil {
 		log.Error(err)
 		return DiscardingFlowOp{}
 	}
-
-	var sta odp.SetTunnelAction
-	sta.SetTunnelId(tunnelIDFor(key))
-	sta.SetIpv4Src(fwd.localIP)
-	sta.SetIpv4Dst(remoteIP)
 	sta.SetTos(0)
 	sta.SetTtl(64)
 	sta.SetDf(true)
 	sta.SetCsum(false)
-	return fwd.fastdp.odpActions(sta, odp.NewOutputAction(fwd.vxlanVportID))
+	return fwd.fastdp.odpActions(sta, odp.NewOutputAction(fwd.tunnelVportID))
 }
 
 func tunnelIDFor(key ForwardPacketKey) (tunnelID [8]byte) {
@@ -967,11 +1170,10 @@ func (fwd *fastDatapathForwarder) Stop() {
 	fwd.sendControlMsg = func(byte, []byte) error { return nil }
 
 	if fwd.isEncrypted {
-		localIP := net.IP(fwd.localIP[:])
 		log.Info("Destroying IPsec between ", fwd.fastdp.localPeer, " and ", fwd.remotePeer)
 		err := fwd.fastdp.ipsec.Destroy(
 			fwd.fastdp.localPeer.Name, fwd.remotePeer.Name, fwd.connUID,
-			localIP, fwd.remoteAddr.IP, fwd.remoteAddr.Port,
+			fwd.localIP, fwd.remoteAddr.IP, fwd.remoteAddr.Port,
 		)
 		if err != nil {
 			log.Errorf("ipsec destroy failed: %s", err)
@@ -985,13 +1187,24 @@ func (fwd *fastDatapathForwarder) Stop() {
 	}
 }
 
-func (fastdp *FastDatapath) addForwarder(peer mesh.PeerName, fwd *fastDatapathForwarder) {
+func (fastdp *FastDatapath) addForwarder(peer mesh.PeerName, fwd *fastDatapathForwarder, remoteAddr *net.UDPAddr) {
 	fastdp.lock.Lock()
 	defer fastdp.lock.Unlock()
 
 	// We shouldn't have two confirmed forwarders to the same
 	// remotePeer, due to the checks in LocalPeer AddConnection.
 	fastdp.forwarders[peer] = fwd
+	fastdp.setEndpoint(fwd, remoteAddr)
+}
+
+// moveForwarder follows a change of the remote address of a
+// forwarder
+func (fastdp *FastDatapath) moveForwarder(peer mesh.PeerName, fwd *fastDatapathForwarder, remoteAddr *net.UDPAddr) {
+	fastdp.lock.Lock()
+	defer fastdp.lock.Unlock()
+	if fastdp.forwarders[peer] == fwd {
+		fastdp.setEndpoint(fwd, remoteAddr)
+	}
 }
 
 func (fastdp *FastDatapath) removeForwarder(peer mesh.PeerName, fwd *fastDatapathForwarder) {
@@ -1000,6 +1213,7 @@ func (fastdp *FastDatapath) removeForwarder(peer mesh.PeerName, fwd *fastDatapat
 	if fastdp.forwarders[peer] == fwd {
 		delete(fastdp.forwarders, peer)
 	}
+	fastdp.setEndpoint(fwd, nil)
 }
 
 func (fastdp *FastDatapath) deleteFlows() error {
@@ -1010,7 +1224,12 @@ func (fastdp *FastDatapath) deleteFlows() error {
 		return err
 	}
 
+	// The stats of the flows go with them, so the flows
+	// enumerated before must not be counted again
+	fastdp.flows = nil
+
 	for _, flow := range flows {
+		fastdp.keepFlowTraffic(flow)
 		err = fastdp.dp.DeleteFlow(flow.FlowKeys)
 		if err != nil && !odp.IsNoSuchFlowError(err) {
 			return err
@@ -1020,14 +1239,14 @@ func (fastdp *FastDatapath) deleteFlows() error {
 	return nil
 }
 
-func (fastdp *FastDatapath) deleteVxlanVports() error {
+func (fastdp *FastDatapath) deleteTunnelVports() error {
 	vports, err := fastdp.dp.EnumerateVports()
 	if err != nil {
 		return err
 	}
 
 	for _, vport := range vports {
-		if vport.Spec.TypeName() != "vxlan" {
+		if typ := vport.Spec.TypeName(); typ != "vxlan" && typ != "geneve" {
 			continue
 		}
 
@@ -1076,11 +1295,26 @@ func (fastdp *FastDatapath) expireFlows() {
 	checkWarn(err)
 
 	for _, flow := range flows {
+		if flow.Used != 0 {
+			fastdp.touchFlow(flow.FlowKeys, &lock)
+		}
+	}
+
+	// Touching the flows takes a while, and traffic through them
+	// meanwhile would be lost by clearing their stats, so take the
+	// stats afresh just before clearing.
+	flows, err = fastdp.dp.EnumerateFlows()
+	checkWarn(err)
+
+	// Clearing resets the stats, as deleting does
+	fastdp.flows = nil
+
+	for _, flow := range flows {
+		fastdp.keepFlowTraffic(flow)
 		if flow.Used == 0 {
 			log.Debug("Expiring flow ", flow.FlowSpec)
 			err = fastdp.dp.DeleteFlow(flow.FlowKeys)
 		} else {
-			fastdp.touchFlow(flow.FlowKeys, &lock)
 			err = fastdp.dp.ClearFlow(flow.FlowSpec)
 		}
 
@@ -1182,9 +1416,9 @@ func (fastdp *FastDatapath) VportDeleted(dpid odp.DatapathID, vport odp.Vport) e
 
 func (fastdp *FastDatapath) makeBridgeVport(vport odp.Vport) {
 	// Set up a bridge port for netdev and internal vports.  vxlan
-	// vports are handled separately, as they do not correspond to
-	// bridge ports (we set up the miss handler for them in
-	// getVxlanVportID).
+	// and geneve vports are handled separately, as they do not
+	// correspond to bridge ports (we set up the miss handler for
+	// them in getTunnelVportID).
 	typ := vport.Spec.TypeName()
 	if typ != "netdev" && typ != "internal" {
 		return
@@ -1352,7 +1586,7 @@ func (fastdp *FastDatapath) isHairpinFlow(flow *odp.FlowSpec) bool {
 			}
 		case odp.OutputAction:
 			if a.VportID() == inVport {
-				if _, ok := fastdp.vxlanVportIDs[a.VportID()]; !ok {
+				if _, ok := fastdp.tunnelVportIDs[a.VportID()]; !ok {
 					return true
 				}
 			}
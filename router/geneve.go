@@ -0,0 +1,14 @@
+package router
+
+// Fast datapath can encapsulate with Geneve (RFC 8926) instead of
+// VXLAN, when both peers of a connection offer it.  The tunnel ID
+// holds the peer short IDs in the same way (see tunnelIDFor).
+
+const (
+	// Feature by which peers offer Geneve to each other
+	GeneveFeature = "FastDatapathGeneve"
+
+	// We use the weave port number plus 3 for geneve, after vxlan
+	// and WireGuard
+	GenevePortOffset = 3
+)
@@ -1,6 +1,7 @@
 package router
 
 import (
+	"sort"
 	"time"
 
 	"github.com/weaveworks/mesh"
@@ -11,6 +12,7 @@ type NetworkRouterStatus struct {
 	Interface    string
 	CaptureStats map[string]int
 	MACs         []MACStatus
+	Traffic      []ConnectionTrafficStatus `json:",omitempty"`
 }
 
 type MACStatus struct {
@@ -25,7 +27,26 @@ func NewNetworkRouterStatus(router *NetworkRouter) *NetworkRouterStatus {
 		mesh.NewStatus(router.Router),
 		router.InjectorConsumer.String(),
 		router.InjectorConsumer.Stats(),
-		NewMACStatusSlice(router.Macs)}
+		NewMACStatusSlice(router.Macs),
+		NewTrafficStatusSlice(router.Overlay)}
+}
+
+// NewTrafficStatusSlice returns the traffic of the connections of
+// overlay, if it counts it, ordered by peer and then overlay
+func NewTrafficStatusSlice(overlay mesh.Overlay) []ConnectionTrafficStatus {
+	reporter, ok := overlay.(TrafficReporter)
+	if !ok {
+		return nil
+	}
+
+	slice := reporter.TrafficStats()
+	sort.Slice(slice, func(i, j int) bool {
+		if slice[i].Peer != slice[j].Peer {
+			return slice[i].Peer < slice[j].Peer
+		}
+		return slice[i].Overlay < slice[j].Overlay
+	})
+	return slice
 }
 
 func NewMACStatusSlice(cache *MacCache) []MACStatus {
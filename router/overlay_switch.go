@@ -18,10 +18,14 @@ type OverlaySwitch struct {
 	overlays      map[string]NetworkOverlay
 	overlayNames  []string
 	compatOverlay NetworkOverlay
+	features      map[string]string
 }
 
 func NewOverlaySwitch() *OverlaySwitch {
-	return &OverlaySwitch{overlays: make(map[string]NetworkOverlay)}
+	return &OverlaySwitch{
+		overlays: make(map[string]NetworkOverlay),
+		features: make(map[string]string),
+	}
 }
 
 func (osw *OverlaySwitch) Add(name string, overlay NetworkOverlay) {
@@ -38,8 +42,18 @@ func (osw *OverlaySwitch) SetCompatOverlay(overlay NetworkOverlay) {
 	osw.compatOverlay = overlay
 }
 
+// AddFeature adds a connection feature for the switch to pass along
+// with its list of overlays, for options of the overlays that peers
+// negotiate.
+func (osw *OverlaySwitch) AddFeature(name string, value string) {
+	osw.features[name] = value
+}
+
 func (osw *OverlaySwitch) AddFeaturesTo(features map[string]string) {
 	features["Overlays"] = strings.Join(osw.overlayNames, " ")
+	for name, value := range osw.features {
+		features[name] = value
+	}
 }
 
 func (osw *OverlaySwitch) Diagnostics() interface{} {
@@ -50,6 +64,19 @@ func (osw *OverlaySwitch) Diagnostics() interface{} {
 	return diagnostics
 }
 
+func (osw *OverlaySwitch) TrafficStats() []ConnectionTrafficStatus {
+	var stats []ConnectionTrafficStatus
+	for _, name := range osw.overlayNames {
+		if reporter, ok := osw.overlays[name].(TrafficReporter); ok {
+			for _, s := range reporter.TrafficStats() {
+				s.Overlay = name
+				stats = append(stats, s)
+			}
+		}
+	}
+	return stats
+}
+
 func (osw *OverlaySwitch) Stop() {
 	for _, overlay := range osw.overlays {
 		overlay.Stop()
@@ -33,7 +33,7 @@ import (
 //
 //            <-------------------------- sleeveForwarder.maxPayload ->
 //
-// <---------->                                             UDPOverhead
+// <---------->                               UDPOverhead (UDP6Overhead)
 //
 //            <-------->                       Encryptor.PacketOverhead
 //
@@ -48,6 +48,7 @@ import (
 const (
 	EthernetOverhead  = 14
 	UDPOverhead       = 28 // 20 bytes for IPv4, 8 bytes for UDP
+	UDP6Overhead      = 48 // 40 bytes for IPv6, 8 bytes for UDP
 	DefaultMTU        = 65535
 	FragTestSize      = 60001
 	PMTUDiscoverySize = 60000
@@ -71,6 +72,7 @@ type SleeveOverlay struct {
 	consumer     OverlayConsumer
 	peers        *mesh.Peers
 	conn         *net.UDPConn
+	conn6        *net.UDPConn
 
 	lock       sync.Mutex
 	forwarders map[mesh.PeerName]*sleeveForwarder
@@ -81,47 +83,86 @@ func NewSleeveOverlay(host string, localPort int) NetworkOverlay {
 }
 
 func (sleeve *SleeveOverlay) StartConsumingPackets(localPeer *mesh.Peer, peers *mesh.Peers, consumer OverlayConsumer) error {
-	localAddr, err := net.ResolveUDPAddr("udp4", fmt.Sprint(sleeve.host, ":", sleeve.localPort))
+	// Listen on IPv4 and IPv6, unless the host is an address of
+	// one family.  Only the family of the host is required.
+	var conn, conn6 *net.UDPConn
+	hostIP := net.ParseIP(sleeve.host)
+	if hostIP == nil || hostIP.To4() != nil {
+		var err error
+		if conn, err = sleeve.listenUDP("udp4"); err != nil {
+			return err
+		}
+	}
+	if hostIP == nil || hostIP.To4() == nil {
+		var err error
+		if conn6, err = sleeve.listenUDP("udp6"); err != nil {
+			if hostIP != nil {
+				return err
+			}
+			log.Warning("sleeve: not using IPv6: ", err)
+		}
+	}
+
+	sleeve.lock.Lock()
+	defer sleeve.lock.Unlock()
+
+	if sleeve.localPeer != nil {
+		for _, c := range []*net.UDPConn{conn, conn6} {
+			if c != nil {
+				c.Close()
+			}
+		}
+		return fmt.Errorf("StartConsumingPackets already called")
+	}
+
+	sleeve.localPeer = localPeer
+	sleeve.localPeerBin = localPeer.NameByte
+	sleeve.consumer = consumer
+	sleeve.peers = peers
+	sleeve.conn = conn
+	sleeve.conn6 = conn6
+	sleeve.forwarders = make(map[mesh.PeerName]*sleeveForwarder)
+	for _, c := range []*net.UDPConn{conn, conn6} {
+		if c != nil {
+			go sleeve.readUDP(c)
+		}
+	}
+	return nil
+}
+
+func (sleeve *SleeveOverlay) listenUDP(network string) (*net.UDPConn, error) {
+	localAddr, err := net.ResolveUDPAddr(network, net.JoinHostPort(sleeve.host, fmt.Sprint(sleeve.localPort)))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	conn, err := net.ListenUDP("udp4", localAddr)
+	conn, err := net.ListenUDP(network, localAddr)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	f, err := conn.File()
 	if err != nil {
-		return err
+		conn.Close()
+		return nil, err
 	}
 
 	defer f.Close()
 	fd := int(f.Fd())
 
 	// This makes sure all packets we send out do not have DF set
-	// on them.
-	err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DONT)
-	if err != nil {
-		return err
+	// on them, or for IPv6, that the stack fragments them.
+	if network == "udp6" {
+		err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_DONT)
+	} else {
+		err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DONT)
 	}
-
-	sleeve.lock.Lock()
-	defer sleeve.lock.Unlock()
-
-	if sleeve.localPeer != nil {
+	if err != nil {
 		conn.Close()
-		return fmt.Errorf("StartConsumingPackets already called")
+		return nil, err
 	}
 
-	sleeve.localPeer = localPeer
-	sleeve.localPeerBin = localPeer.NameByte
-	sleeve.consumer = consumer
-	sleeve.peers = peers
-	sleeve.conn = conn
-	sleeve.forwarders = make(map[mesh.PeerName]*sleeveForwarder)
-	go sleeve.readUDP()
-	return nil
+	return conn, nil
 }
 
 func (*SleeveOverlay) InvalidateRoutes() {
@@ -144,6 +185,21 @@ func (*SleeveOverlay) Stop() {
 	// do nothing
 }
 
+func (sleeve *SleeveOverlay) TrafficStats() []ConnectionTrafficStatus {
+	sleeve.lock.Lock()
+	defer sleeve.lock.Unlock()
+
+	stats := make([]ConnectionTrafficStatus, 0, len(sleeve.forwarders))
+	for _, fwd := range sleeve.forwarders {
+		stats = append(stats, ConnectionTrafficStatus{
+			Peer:         fwd.remotePeer.Name.String(),
+			NickName:     fwd.remotePeer.NickName,
+			TrafficStats: fwd.traffic.get(),
+		})
+	}
+	return stats
+}
+
 func (sleeve *SleeveOverlay) lookupForwarder(peer mesh.PeerName) *sleeveForwarder {
 	sleeve.lock.Lock()
 	defer sleeve.lock.Unlock()
@@ -164,13 +220,13 @@ func (sleeve *SleeveOverlay) removeForwarder(peer mesh.PeerName, fwd *sleeveForw
 	}
 }
 
-func (sleeve *SleeveOverlay) readUDP() {
-	defer sleeve.conn.Close()
+func (sleeve *SleeveOverlay) readUDP(conn *net.UDPConn) {
+	defer conn.Close()
 	dec := NewEthernetDecoder()
 	buf := make([]byte, MaxUDPPacketSize)
 
 	for {
-		n, sender, err := sleeve.conn.ReadFromUDP(buf)
+		n, sender, err := conn.ReadFromUDP(buf)
 		if err == io.EOF {
 			return
 		} else if err != nil {
@@ -195,6 +251,11 @@ func (sleeve *SleeveOverlay) readUDP() {
 				sleeve.handleFrame(sender, fwd, src, dst, frame, dec)
 			})
 		if err != nil {
+			if fwd.encrypted {
+				fwd.traffic.addEncryptionFailure()
+			} else {
+				fwd.traffic.addDrops(1)
+			}
 			// Errors during UDP packet decoding /
 			// processing are non-fatal. One common cause
 			// is that we receive and attempt to decrypt a
@@ -246,6 +307,7 @@ func (sleeve *SleeveOverlay) handleFrame(sender *net.UDPAddr, fwd *sleeveForward
 		return
 	}
 
+	fwd.traffic.addRx(1, len(frame))
 	sleeve.sendToConsumer(srcPeer, dstPeer, frame, dec)
 }
 
@@ -271,6 +333,9 @@ type udpSender interface {
 func (sleeve *SleeveOverlay) send(msg []byte, raddr *net.UDPAddr) error {
 	sleeve.lock.Lock()
 	conn := sleeve.conn
+	if raddr.IP.To4() == nil {
+		conn = sleeve.conn6
+	}
 	sleeve.lock.Unlock()
 
 	if conn == nil {
@@ -303,8 +368,16 @@ func newSleeveCrypto(name []byte, sessionKey *[32]byte, outbound bool) sleeveCry
 	}
 }
 
-func (crypto sleeveCrypto) Overhead() int {
-	return UDPOverhead + crypto.EncDF.PacketOverhead() + crypto.EncDF.FrameOverhead() + EthernetOverhead
+func (crypto sleeveCrypto) Overhead(udpOverhead int) int {
+	return udpOverhead + crypto.EncDF.PacketOverhead() + crypto.EncDF.FrameOverhead() + EthernetOverhead
+}
+
+// udpOverheadFor returns the UDPOverhead of the IP version of ip
+func udpOverheadFor(ip net.IP) int {
+	if ip.To4() == nil {
+		return UDP6Overhead
+	}
+	return UDPOverhead
 }
 
 type sleeveForwarder struct {
@@ -314,6 +387,8 @@ type sleeveForwarder struct {
 	remotePeerBin  []byte
 	sendControlMsg func(byte, []byte) error
 	connUID        uint64
+	encrypted      bool
+	traffic        *trafficCounters
 
 	// Channels to communicate with the aggregator goroutine
 	aggregatorChan   chan<- aggregatorFrame
@@ -337,6 +412,10 @@ type sleeveForwarder struct {
 	mtu       int // the mtu for this link on the overlay network
 	stackFrag bool
 
+	// UDPOverhead or UDP6Overhead, as we talk to the peer over
+	// IPv4 or IPv6
+	udpOverhead int
+
 	// State only used within the forwarder goroutine
 	crypto     sleeveCrypto
 	senderDF   *udpSenderDF
@@ -391,6 +470,16 @@ func (sleeve *SleeveOverlay) PrepareConnection(params mesh.OverlayConnectionPara
 		remoteAddr = makeUDPAddr(params.RemoteAddr)
 	}
 
+	// The UDP traffic goes between the same addresses as the
+	// TCP connection, so it is of the same IP version
+	udpOverhead := udpOverheadFor(params.LocalAddr.IP)
+	sleeve.lock.Lock()
+	missingConn := (udpOverhead == UDPOverhead && sleeve.conn == nil) || (udpOverhead == UDP6Overhead && sleeve.conn6 == nil)
+	sleeve.lock.Unlock()
+	if missingConn {
+		return nil, fmt.Errorf("no UDP socket for %s", params.LocalAddr.IP)
+	}
+
 	crypto := newSleeveCrypto(sleeve.localPeer.NameByte, params.SessionKey, params.Outbound)
 
 	fwd := &sleeveForwarder{
@@ -399,6 +488,8 @@ func (sleeve *SleeveOverlay) PrepareConnection(params mesh.OverlayConnectionPara
 		remotePeerBin:    params.RemotePeer.NameByte,
 		sendControlMsg:   params.SendControlMessage,
 		connUID:          params.ConnUID,
+		encrypted:        params.SessionKey != nil,
+		traffic:          &trafficCounters{},
 		aggregatorChan:   aggChan,
 		aggregatorDFChan: aggDFChan,
 		specialChan:      specialChan,
@@ -409,9 +500,10 @@ func (sleeve *SleeveOverlay) PrepareConnection(params mesh.OverlayConnectionPara
 		errorChan:        make(chan error, 1),
 		remoteAddr:       remoteAddr,
 		mtu:              DefaultMTU,
+		udpOverhead:      udpOverhead,
 		crypto:           crypto,
-		maxPayload:       DefaultMTU - UDPOverhead,
-		overheadDF:       crypto.Overhead(),
+		maxPayload:       DefaultMTU - udpOverhead,
+		overheadDF:       crypto.Overhead(udpOverhead),
 		senderDF:         newUDPSenderDF(params.LocalAddr.IP, sleeve.localPort),
 	}
 
@@ -470,6 +562,7 @@ func (f curriedForward) Process(frame []byte, dec *EthernetDecoder, broadcast bo
 
 	if !haveContact {
 		log.Print(fwd.logPrefix(), "Cannot forward frame yet - awaiting contact")
+		fwd.traffic.addDrops(1)
 		return
 	}
 
@@ -499,10 +592,13 @@ func (f curriedForward) Process(frame []byte, dec *EthernetDecoder, broadcast bo
 		// destination MAC was not in our MAC cache.
 		if broadcast {
 			log.Print(fwd.logPrefix(), "dropping too big DF broadcast frame: len ", len(frame), " (", dec.IP.SrcIP, " -> ", dec.IP.DstIP, "): MTU=", mtu)
+			fwd.traffic.addDrops(1)
 			return
 		}
 
-		// Send an ICMP back to where the frame came from
+		// Send an ICMP back to where the frame came from, in
+		// place of the frame
+		fwd.traffic.addDrops(1)
 		fragNeededPacket, err := dec.makeICMPFragNeeded(mtu)
 		if err != nil {
 			log.Print(fwd.logPrefix(), err)
@@ -639,7 +735,7 @@ loop:
 	for err == nil {
 		select {
 		case frame := <-aggChan:
-			err = fwd.aggregateAndSend(frame, aggChan, fwd.crypto.Enc, fwd.sleeve, MaxUDPPacketSize-UDPOverhead)
+			err = fwd.aggregateAndSend(frame, aggChan, fwd.crypto.Enc, fwd.sleeve, MaxUDPPacketSize-fwd.udpOverhead)
 
 		case frame := <-aggDFChan:
 			err = fwd.aggregateAndSend(frame, aggDFChan, fwd.crypto.EncDF, fwd.senderDF, fwd.maxPayload)
@@ -700,16 +796,22 @@ func (fwd *sleeveForwarder) aggregateAndSend(frame aggregatorFrame, aggChan <-ch
 	// other activities of the forwarder goroutine.
 	i := 0
 
+	// The frames and bytes in enc, for the traffic stats
+	frames, bytes := 0, 0
+
 	for {
 		// Adding the first frame to an empty buffer
 		if !fits(frame, enc, limit) {
 			log.Print(fwd.logPrefix(), "Dropping too big frame during forwarding: frame len ", len(frame.frame), ", limit ", limit)
+			fwd.traffic.addDrops(1)
 			return nil
 		}
 
 		for {
 			enc.AppendFrame(frame.src, frame.dst, frame.frame)
 			i++
+			frames++
+			bytes += len(frame.frame)
 
 			gotOne := false
 			if i < 100 {
@@ -721,7 +823,7 @@ func (fwd *sleeveForwarder) aggregateAndSend(frame aggregatorFrame, aggChan <-ch
 			}
 
 			if !gotOne {
-				return fwd.flushEncryptor(enc, sender)
+				return fwd.flushEncryptor(enc, sender, frames, bytes)
 			}
 
 			// Accumulate frames until doing so would
@@ -735,9 +837,10 @@ func (fwd *sleeveForwarder) aggregateAndSend(frame aggregatorFrame, aggChan <-ch
 			}
 		}
 
-		if err := fwd.flushEncryptor(enc, sender); err != nil {
+		if err := fwd.flushEncryptor(enc, sender, frames, bytes); err != nil {
 			return err
 		}
+		frames, bytes = 0, 0
 	}
 }
 
@@ -745,18 +848,28 @@ func fits(frame aggregatorFrame, enc Encryptor, limit int) bool {
 	return enc.TotalLen()+enc.FrameOverhead()+len(frame.frame) <= limit
 }
 
-func (fwd *sleeveForwarder) flushEncryptor(enc Encryptor, sender udpSender) error {
+// Send what enc holds, which includes the given number of frames and
+// bytes of traffic, as opposed to special frames.
+func (fwd *sleeveForwarder) flushEncryptor(enc Encryptor, sender udpSender, frames int, bytes int) error {
 	msg, err := enc.Bytes()
 	if err != nil {
+		fwd.traffic.addEncryptionFailure()
+		fwd.traffic.addDrops(frames)
 		return err
 	}
 
-	return fwd.processSendError(sender.send(msg, fwd.remoteAddr))
+	err = sender.send(msg, fwd.remoteAddr)
+	if err != nil {
+		fwd.traffic.addDrops(frames)
+	} else {
+		fwd.traffic.addTx(frames, bytes)
+	}
+	return fwd.processSendError(err)
 }
 
 func (fwd *sleeveForwarder) sendSpecial(enc Encryptor, sender udpSender, data []byte) error {
 	enc.AppendFrame(fwd.sleeve.localPeerBin, fwd.remotePeerBin, data)
-	return fwd.flushEncryptor(enc, sender)
+	return fwd.flushEncryptor(enc, sender, 0, 0)
 }
 
 func (fwd *sleeveForwarder) handleSpecialFrame(special specialFrame) error {
@@ -929,7 +1042,7 @@ func (fwd *sleeveForwarder) processSendError(err error) error {
 		fwd.mtuLowestBad = mtu + 1
 		fwd.mtuCandidate = mtu
 		fwd.mtuTestsSent = 0
-		fwd.maxPayload = mtbe.underlayPMTU - UDPOverhead
+		fwd.maxPayload = mtbe.underlayPMTU - fwd.udpOverhead
 		fwd.mtu = mtu
 		return fwd.sendMTUTest()
 	}
@@ -995,7 +1108,7 @@ func (fwd *sleeveForwarder) searchMTU() error {
 		}
 
 		fwd.mtuCandidate = 0
-		fwd.maxPayload = mtu + fwd.overheadDF - UDPOverhead
+		fwd.maxPayload = mtu + fwd.overheadDF - fwd.udpOverhead
 		fwd.mtu = mtu
 		return nil
 	}
@@ -1022,9 +1135,9 @@ func newUDPSenderDF(localIP net.IP, localPort int) *udpSenderDF {
 			// UDP header is calculated with a phantom IP
 			// header. Yes, it's totally nuts. Thankfully,
 			// for UDP over IPv4, the checksum is
-			// optional. It's not optional for IPv6, but
-			// we'll ignore that for now. TODO
-			ComputeChecksums: false,
+			// optional. It's not optional for IPv6, so we
+			// give it the phantom header in dial().
+			ComputeChecksums: localIP.To4() == nil,
 		},
 		udpHeader: &layers.UDP{SrcPort: layers.UDPPort(localPort)},
 		localIP:   localIP,
@@ -1042,21 +1155,38 @@ func (sender *udpSenderDF) dial() error {
 
 	laddr := &net.IPAddr{IP: sender.localIP}
 	raddr := &net.IPAddr{IP: sender.remoteIP}
-	s, err := net.DialIP("ip4:UDP", laddr, raddr)
+	ipv6 := sender.localIP.To4() == nil
+	network := "ip4:UDP"
+	if ipv6 {
+		network = "ip6:UDP"
+	}
+	s, err := net.DialIP(network, laddr, raddr)
 	if err != nil {
 		return err
 	}
 
 	f, err := s.File()
 	if err != nil {
+		s.Close()
 		return err
 	}
 
 	defer f.Close()
 
-	// This makes sure all packets we send out have DF set on them.
-	err = syscall.SetsockoptInt(int(f.Fd()), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DO)
+	// This makes sure all packets we send out have DF set on
+	// them, or for IPv6, that the stack never fragments them.
+	if ipv6 {
+		err = syscall.SetsockoptInt(int(f.Fd()), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_DO)
+		sender.udpHeader.SetNetworkLayerForChecksum(&layers.IPv6{
+			SrcIP:      sender.localIP,
+			DstIP:      sender.remoteIP,
+			NextHeader: layers.IPProtocolUDP,
+		})
+	} else {
+		err = syscall.SetsockoptInt(int(f.Fd()), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DO)
+	}
 	if err != nil {
+		s.Close()
 		return err
 	}
 
@@ -1093,7 +1223,12 @@ func (sender *udpSenderDF) send(msg []byte, raddr *net.UDPAddr) error {
 	defer f.Close()
 
 	log.Debug("sleeve ->[", sender, "] expecting PMTU update (IP packet was ", len(packet), " bytes, payload was ", len(msg), " bytes)")
-	pmtu, err := syscall.GetsockoptInt(int(f.Fd()), syscall.IPPROTO_IP, syscall.IP_MTU)
+	var pmtu int
+	if sender.localIP.To4() == nil {
+		pmtu, err = syscall.GetsockoptInt(int(f.Fd()), syscall.IPPROTO_IPV6, syscall.IPV6_MTU)
+	} else {
+		pmtu, err = syscall.GetsockoptInt(int(f.Fd()), syscall.IPPROTO_IP, syscall.IP_MTU)
+	}
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,89 @@
+package router
+
+import (
+	"sync/atomic"
+)
+
+// TrafficStats counts the traffic of a connection over an overlay.
+// Packets and bytes are those of the frames carried, not of their
+// encapsulation.
+type TrafficStats struct {
+	TxPackets uint64
+	TxBytes   uint64
+	RxPackets uint64
+	RxBytes   uint64
+	// Frames we could not send to, or accept from, the peer
+	Drops uint64
+	// Packets which failed to encrypt or decrypt, or for fast
+	// datapath, failures to set up IPsec
+	EncryptionFailures uint64
+}
+
+// ConnectionTrafficStatus is the traffic of the connection to a peer
+// over an overlay
+type ConnectionTrafficStatus struct {
+	Peer     string
+	NickName string
+	Overlay  string `json:",omitempty"`
+	TrafficStats
+}
+
+// A TrafficReporter is a NetworkOverlay which counts the traffic of
+// its connections
+type TrafficReporter interface {
+	TrafficStats() []ConnectionTrafficStatus
+}
+
+// trafficCounters accumulates TrafficStats.  The fields are accessed
+// atomically, so it must be allocated on its own for their alignment.
+type trafficCounters struct {
+	stats TrafficStats
+}
+
+func (c *trafficCounters) addTx(packets, bytes int) {
+	atomic.AddUint64(&c.stats.TxPackets, uint64(packets))
+	atomic.AddUint64(&c.stats.TxBytes, uint64(bytes))
+}
+
+func (c *trafficCounters) addRx(packets, bytes int) {
+	atomic.AddUint64(&c.stats.RxPackets, uint64(packets))
+	atomic.AddUint64(&c.stats.RxBytes, uint64(bytes))
+}
+
+func (c *trafficCounters) addDrops(packets int) {
+	atomic.AddUint64(&c.stats.Drops, uint64(packets))
+}
+
+func (c *trafficCounters) add(stats TrafficStats) {
+	atomic.AddUint64(&c.stats.TxPackets, stats.TxPackets)
+	atomic.AddUint64(&c.stats.TxBytes, stats.TxBytes)
+	atomic.AddUint64(&c.stats.RxPackets, stats.RxPackets)
+	atomic.AddUint64(&c.stats.RxBytes, stats.RxBytes)
+	atomic.AddUint64(&c.stats.Drops, stats.Drops)
+	atomic.AddUint64(&c.stats.EncryptionFailures, stats.EncryptionFailures)
+}
+
+func (c *trafficCounters) addEncryptionFailure() {
+	atomic.AddUint64(&c.stats.EncryptionFailures, 1)
+}
+
+func (c *trafficCounters) get() TrafficStats {
+	return TrafficStats{
+		TxPackets:          atomic.LoadUint64(&c.stats.TxPackets),
+		TxBytes:            atomic.LoadUint64(&c.stats.TxBytes),
+		RxPackets:          atomic.LoadUint64(&c.stats.RxPackets),
+		RxBytes:            atomic.LoadUint64(&c.stats.RxBytes),
+		Drops:              atomic.LoadUint64(&c.stats.Drops),
+		EncryptionFailures: atomic.LoadUint64(&c.stats.EncryptionFailures),
+	}
+}
+
+func (stats TrafficStats) add(other TrafficStats) TrafficStats {
+	stats.TxPackets += other.TxPackets
+	stats.TxBytes += other.TxBytes
+	stats.RxPackets += other.RxPackets
+	stats.RxBytes += other.RxBytes
+	stats.Drops += other.Drops
+	stats.EncryptionFailures += other.EncryptionFailures
+	return stats
+}
@@ -0,0 +1,154 @@
+package router
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/go-odp/odp"
+	"github.com/weaveworks/mesh"
+)
+
+func TestTrafficCounters(t *testing.T) {
+	c := &trafficCounters{}
+	c.addTx(1, 100)
+	c.addTx(2, 200)
+	c.addRx(3, 300)
+	c.addDrops(4)
+	c.addEncryptionFailure()
+	require.Equal(t, TrafficStats{TxPackets: 3, TxBytes: 300, RxPackets: 3, RxBytes: 300, Drops: 4, EncryptionFailures: 1}, c.get())
+
+	c.add(TrafficStats{TxPackets: 1, TxBytes: 2, RxPackets: 3, RxBytes: 4, Drops: 5, EncryptionFailures: 6})
+	require.Equal(t, TrafficStats{TxPackets: 4, TxBytes: 302, RxPackets: 6, RxBytes: 304, Drops: 9, EncryptionFailures: 7}, c.get())
+}
+
+func TestTrafficStatsAdd(t *testing.T) {
+	a := TrafficStats{TxPackets: 1, TxBytes: 2, RxPackets: 3, RxBytes: 4, Drops: 5, EncryptionFailures: 6}
+	b := TrafficStats{TxPackets: 10, TxBytes: 20, RxPackets: 30, RxBytes: 40, Drops: 50, EncryptionFailures: 60}
+	require.Equal(t, TrafficStats{TxPackets: 11, TxBytes: 22, RxPackets: 33, RxBytes: 44, Drops: 55, EncryptionFailures: 66}, a.add(b))
+	require.Equal(t, TrafficStats{TxPackets: 1, TxBytes: 2, RxPackets: 3, RxBytes: 4, Drops: 5, EncryptionFailures: 6}, a, "unchanged")
+}
+
+const (
+	testMainVportID   = odp.VportID(1)
+	testTunnelVportID = odp.VportID(2)
+	testBridgeVportID = odp.VportID(3)
+)
+
+// A FastDatapath with just what flowTraffic needs, and forwarders to
+// two peers on the same host, told apart by their ports
+func newTrafficTestFastDatapath() (*FastDatapath, *fastDatapathForwarder, *fastDatapathForwarder) {
+	fastdp := &FastDatapath{
+		tunnelVportIDs:     map[odp.VportID]int{testMainVportID: 6784, testTunnelVportID: 7784},
+		forwarders:         make(map[mesh.PeerName]*fastDatapathForwarder),
+		endpointForwarders: make(map[tunnelEndpoint]*fastDatapathForwarder),
+	}
+	fwd1 := &fastDatapathForwarder{remotePeer: &mesh.Peer{Name: 1}}
+	fwd2 := &fastDatapathForwarder{remotePeer: &mesh.Peer{Name: 2}}
+	fastdp.forwarders[1] = fwd1
+	fastdp.setEndpoint(fwd1, &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 6784})
+	fastdp.forwarders[2] = fwd2
+	fastdp.setEndpoint(fwd2, &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 7784})
+	return fastdp, fwd1, fwd2
+}
+
+func testTunnelFlow(inVport odp.VportID, src [4]byte, actions ...odp.Action) odp.FlowInfo {
+	var tunnel odp.TunnelFlowKey
+	tunnel.SetTunnelId([8]byte{1})
+	tunnel.SetIpv4Src(src)
+	tunnel.SetIpv4Dst([4]byte{192, 0, 2, 100})
+	flow := odp.FlowInfo{FlowSpec: odp.NewFlowSpec(), Packets: 10, Bytes: 1000}
+	flow.AddKey(odp.NewInPortFlowKey(inVport))
+	flow.AddKey(tunnel)
+	flow.AddActions(actions)
+	return flow
+}
+
+func setTunnelTo(dst [4]byte) odp.SetTunnelAction {
+	var sta odp.SetTunnelAction
+	sta.SetTunnelId([8]byte{1})
+	sta.SetIpv4Src([4]byte{192, 0, 2, 100})
+	sta.SetIpv4Dst(dst)
+	return sta
+}
+
+func TestFlowTraffic(t *testing.T) {
+	fastdp, fwd1, fwd2 := newTrafficTestFastDatapath()
+	peerIP := [4]byte{192, 0, 2, 1}
+
+	traffic := func(flow odp.FlowInfo) map[*fastDatapathForwarder]TrafficStats {
+		res := make(map[*fastDatapathForwarder]TrafficStats)
+		fastdp.flowTraffic(flow, func(fwd *fastDatapathForwarder, stats TrafficStats) {
+			res[fwd] = res[fwd].add(stats)
+		})
+		return res
+	}
+
+	// Received from a tunnel, on the vport of the port of the first
+	// peer
+	require.Equal(t, map[*fastDatapathForwarder]TrafficStats{fwd1: {RxPackets: 10, RxBytes: 1000}},
+		traffic(testTunnelFlow(testMainVportID, peerIP, odp.NewOutputAction(testBridgeVportID))))
+
+	// Discarded
+	require.Equal(t, map[*fastDatapathForwarder]TrafficStats{fwd1: {Drops: 10}},
+		traffic(testTunnelFlow(testMainVportID, peerIP)))
+
+	// Received and relayed to the second peer, whose tunnel has the
+	// other port
+	require.Equal(t, map[*fastDatapathForwarder]TrafficStats{
+		fwd1: {RxPackets: 10, RxBytes: 1000},
+		fwd2: {TxPackets: 10, TxBytes: 1000},
+	}, traffic(testTunnelFlow(testMainVportID, peerIP, setTunnelTo(peerIP), odp.NewOutputAction(testTunnelVportID))))
+
+	// Sent from the bridge to both peers
+	flow := odp.FlowInfo{FlowSpec: odp.NewFlowSpec(), Packets: 2, Bytes: 200}
+	flow.AddKey(odp.NewInPortFlowKey(testBridgeVportID))
+	flow.AddActions([]odp.Action{
+		setTunnelTo(peerIP), odp.NewOutputAction(testMainVportID),
+		setTunnelTo(peerIP), odp.NewOutputAction(testTunnelVportID),
+		odp.NewOutputAction(testBridgeVportID),
+	})
+	require.Equal(t, map[*fastDatapathForwarder]TrafficStats{
+		fwd1: {TxPackets: 2, TxBytes: 200},
+		fwd2: {TxPackets: 2, TxBytes: 200},
+	}, traffic(flow))
+
+	// Nothing to or from unknown peers, or vports that are not
+	// tunnels
+	require.Empty(t, traffic(testTunnelFlow(testMainVportID, [4]byte{192, 0, 2, 2}, odp.NewOutputAction(testBridgeVportID))))
+	require.Empty(t, traffic(testTunnelFlow(testBridgeVportID, peerIP, odp.NewOutputAction(testBridgeVportID))))
+
+	// Once removed, or moved, a forwarder is no longer at its old
+	// endpoint
+	fastdp.moveForwarder(2, fwd2, &net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 7784})
+	require.Nil(t, fastdp.forwarderAt(net.ParseIP("192.0.2.1"), 7784))
+	require.Equal(t, fwd2, fastdp.forwarderAt(net.ParseIP("192.0.2.2"), 7784))
+	fastdp.removeForwarder(1, fwd1)
+	require.Empty(t, traffic(testTunnelFlow(testMainVportID, peerIP, odp.NewOutputAction(testBridgeVportID))))
+}
+
+type fakeTrafficReporter struct {
+	mesh.NullOverlay
+	stats []ConnectionTrafficStatus
+}
+
+func (r fakeTrafficReporter) TrafficStats() []ConnectionTrafficStatus {
+	return r.stats
+}
+
+func TestNewTrafficStatusSlice(t *testing.T) {
+	require.Nil(t, NewTrafficStatusSlice(mesh.NullOverlay{}))
+
+	reporter := fakeTrafficReporter{stats: []ConnectionTrafficStatus{
+		{Peer: "b", Overlay: "sleeve"},
+		{Peer: "b", Overlay: "fastdp"},
+		{Peer: "a", Overlay: "sleeve"},
+		{Peer: "c"},
+	}}
+	require.Equal(t, []ConnectionTrafficStatus{
+		{Peer: "a", Overlay: "sleeve"},
+		{Peer: "b", Overlay: "fastdp"},
+		{Peer: "b", Overlay: "sleeve"},
+		{Peer: "c"},
+	}, NewTrafficStatusSlice(reporter))
+}
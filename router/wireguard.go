@@ -0,0 +1,659 @@
+// This contains the Overlay implementation for WireGuard. The kernel
+// WireGuard interface only carries IP, so frames are sent over UDP
+// between per-peer tunnel addresses on that interface, which
+// encrypts them.
+
+package router
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink/nl"
+	"github.com/weaveworks/mesh"
+
+	"github.com/weaveworks/weave/net/wireguard"
+)
+
+const (
+	WireguardIfName = "weave-wg"
+	WireguardMTU    = 1420
+	// The WireGuard interface listens on the router port plus this
+	WireguardPortOffset = 2
+
+	// Keep NAT mappings towards peers open
+	WireguardKeepalive = 25 * time.Second
+
+	// UDP over IPv6, then the message type and peer names
+	WireguardOverhead = 48 + 1 + NameSize + NameSize
+)
+
+// Messages between tunnel addresses start with one of these
+const (
+	wireguardFrame = iota
+	wireguardHeartbeat
+)
+
+// Control message tags
+const (
+	WireguardHeartbeatAck = iota
+	WireguardPublicKey
+)
+
+// Tunnel addresses are in this unique local prefix ("\xfdweave"),
+// with the peer name in the low bits.
+var wireguardPrefix = []byte{0xfd, 0x77, 0x65, 0x61, 0x76, 0x65}
+
+func wireguardTunnelIP(peer mesh.PeerName) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, wireguardPrefix)
+	binary.BigEndian.PutUint64(ip[8:], uint64(peer))
+	return ip
+}
+
+func wireguardPeerName(ip net.IP) mesh.PeerName {
+	return mesh.PeerName(binary.BigEndian.Uint64(ip.To16()[8:]))
+}
+
+// wireguardPeers configures the peers of the WireGuard interface
+type wireguardPeers interface {
+	SetPeer(peer wireguard.Peer) error
+	RemovePeer(publicKey wireguard.Key) error
+}
+
+type WireguardOverlay struct {
+	dev      *wireguard.Device
+	devPeers wireguardPeers // dev, except in tests
+	port     int
+	conn     *net.UDPConn
+
+	// These fields are set in StartConsumingPackets, and not
+	// subsequently modified
+	localPeer *mesh.Peer
+	peers     *mesh.Peers
+	consumer  OverlayConsumer
+
+	lock       sync.Mutex
+	forwarders map[mesh.PeerName]*wireguardForwarder
+	stopped    bool
+}
+
+// NewWireguardOverlay sets up the WireGuard interface of the peer
+// name, and a socket on its tunnel address at port, from which only
+// packets arriving through the interface are read.
+func NewWireguardOverlay(name mesh.PeerName, port int) (*WireguardOverlay, error) {
+	addr := &net.IPNet{IP: wireguardTunnelIP(name), Mask: net.CIDRMask(64, 8*net.IPv6len)}
+	dev, err := wireguard.New(WireguardIfName, port+WireguardPortOffset, WireguardMTU, addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := listenWireguardUDP(&net.UDPAddr{IP: addr.IP, Port: port})
+	if err != nil {
+		dev.Destroy()
+		return nil, err
+	}
+	return &WireguardOverlay{dev: dev, devPeers: dev, port: port, conn: conn}, nil
+}
+
+// listenWireguardUDP opens the socket for messages between tunnel
+// addresses, asking to be told the interface each packet arrives
+// through.
+func listenWireguardUDP(addr *net.UDPAddr) (*net.UDPConn, error) {
+	conn, err := net.ListenUDP("udp6", addr)
+	if err != nil {
+		return nil, err
+	}
+	rawConn, err := conn.SyscallConn()
+	if err == nil {
+		rawConn.Control(func(fd uintptr) {
+			err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_RECVPKTINFO, 1)
+		})
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// arrivedThrough says whether the IPV6_PKTINFO in the control
+// messages of a packet has it arriving through interface index
+func arrivedThrough(oob []byte, index int) bool {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return false
+	}
+	for _, msg := range msgs {
+		if msg.Header.Level == syscall.IPPROTO_IPV6 && msg.Header.Type == syscall.IPV6_PKTINFO &&
+			len(msg.Data) >= syscall.SizeofInet6Pktinfo {
+			// struct in6_pktinfo: the address, then the index
+			return int(nl.NativeEndian().Uint32(msg.Data[net.IPv6len:])) == index
+		}
+	}
+	return false
+}
+
+func (wg *WireguardOverlay) StartConsumingPackets(localPeer *mesh.Peer, peers *mesh.Peers, consumer OverlayConsumer) error {
+	wg.lock.Lock()
+	defer wg.lock.Unlock()
+
+	if wg.localPeer != nil {
+		return fmt.Errorf("StartConsumingPackets already called")
+	}
+
+	wg.localPeer = localPeer
+	wg.peers = peers
+	wg.consumer = consumer
+	wg.forwarders = make(map[mesh.PeerName]*wireguardForwarder)
+	go wg.readUDP()
+	return nil
+}
+
+func (*WireguardOverlay) InvalidateRoutes() {
+	// no cached information, so nothing to do
+}
+
+func (*WireguardOverlay) InvalidateShortIDs() {
+	// no cached information, so nothing to do
+}
+
+func (*WireguardOverlay) AddFeaturesTo(map[string]string) {
+	// Nothing needed.  Keys are exchanged per connection, and
+	// WireGuard support is indicated through OverlaySwitch.
+}
+
+type WireguardStatus struct {
+	Interface string
+	PublicKey string
+	Port      int
+	Peers     []string
+}
+
+func (wg *WireguardOverlay) Diagnostics() interface{} {
+	wg.lock.Lock()
+	defer wg.lock.Unlock()
+
+	status := WireguardStatus{
+		Interface: wg.dev.Name,
+		PublicKey: wg.dev.PublicKey.String(),
+		Port:      wg.dev.Port,
+	}
+	for _, fwd := range wg.forwarders {
+		status.Peers = append(status.Peers, fwd.remotePeer.String())
+	}
+	sort.Strings(status.Peers)
+	return status
+}
+
+func (wg *WireguardOverlay) Stop() {
+	wg.lock.Lock()
+	defer wg.lock.Unlock()
+
+	if wg.stopped {
+		return
+	}
+	wg.stopped = true
+	wg.conn.Close()
+	if err := wg.dev.Destroy(); err != nil {
+		log.Errorf("wireguard destroy failed: %s", err)
+	}
+}
+
+func (wg *WireguardOverlay) lookupForwarder(peer mesh.PeerName) *wireguardForwarder {
+	wg.lock.Lock()
+	defer wg.lock.Unlock()
+	return wg.forwarders[peer]
+}
+
+func (wg *WireguardOverlay) addForwarder(peer mesh.PeerName, fwd *wireguardForwarder) {
+	wg.lock.Lock()
+	defer wg.lock.Unlock()
+
+	// We shouldn't have two confirmed forwarders to the same
+	// remotePeer, due to the checks in LocalPeer AddConnection.
+	wg.forwarders[peer] = fwd
+}
+
+// removeForwarder returns whether fwd was the forwarder to peer
+func (wg *WireguardOverlay) removeForwarder(peer mesh.PeerName, fwd *wireguardForwarder) bool {
+	wg.lock.Lock()
+	defer wg.lock.Unlock()
+	if wg.forwarders[peer] == fwd {
+		delete(wg.forwarders, peer)
+		return true
+	}
+	return false
+}
+
+func (wg *WireguardOverlay) isStopped() bool {
+	wg.lock.Lock()
+	defer wg.lock.Unlock()
+	return wg.stopped
+}
+
+func (wg *WireguardOverlay) readUDP() {
+	dec := NewEthernetDecoder()
+	buf := make([]byte, MaxUDPPacketSize)
+	oob := make([]byte, syscall.CmsgSpace(syscall.SizeofInet6Pktinfo))
+
+	for {
+		n, oobn, _, sender, err := wg.conn.ReadMsgUDP(buf, oob)
+		if err != nil {
+			if wg.isStopped() {
+				return
+			}
+			log.Print("ignoring wireguard read error ", err)
+			continue
+		} else if n < 1 {
+			continue
+		}
+
+		// WireGuard only lets a peer send from its own tunnel
+		// address, so the sender is authenticated, as long as
+		// the packet came through the WireGuard interface: the
+		// socket would also take packets for our tunnel address
+		// from other interfaces, which anyone on the underlay
+		// could send.
+		if !arrivedThrough(oob[:oobn], wg.dev.Index) {
+			continue
+		}
+		fwd := wg.lookupForwarder(wireguardPeerName(sender.IP))
+		if fwd == nil {
+			continue
+		}
+
+		switch buf[0] {
+		case wireguardHeartbeat:
+			if n == 1+8 {
+				fwd.handleHeartbeat(binary.BigEndian.Uint64(buf[1:]))
+			}
+		case wireguardFrame:
+			if n < 1+NameSize+NameSize {
+				log.Print(fwd.logPrefix(), "ignoring too short wireguard packet")
+				continue
+			}
+			srcPeer := wg.peers.Fetch(mesh.PeerNameFromBin(buf[1 : 1+NameSize]))
+			dstPeer := wg.peers.Fetch(mesh.PeerNameFromBin(buf[1+NameSize : 1+NameSize+NameSize]))
+			if srcPeer == nil || dstPeer == nil {
+				continue
+			}
+			frame := make([]byte, n-(1+NameSize+NameSize))
+			copy(frame, buf[1+NameSize+NameSize:n])
+			wg.sendToConsumer(srcPeer, dstPeer, frame, dec)
+		}
+	}
+}
+
+func (wg *WireguardOverlay) sendToConsumer(srcPeer, dstPeer *mesh.Peer, frame []byte, dec *EthernetDecoder) {
+	dec.DecodeLayers(frame)
+	if len(dec.decoded) == 0 {
+		return
+	}
+
+	fop := wg.consumer(ForwardPacketKey{
+		SrcPeer:   srcPeer,
+		DstPeer:   dstPeer,
+		PacketKey: dec.PacketKey(),
+	})
+	if fop != nil {
+		fop.Process(frame, dec, false)
+	}
+}
+
+func (wg *WireguardOverlay) send(msg []byte, raddr *net.UDPAddr) error {
+	_, err := wg.conn.WriteToUDP(msg, raddr)
+	return err
+}
+
+type wireguardForwarder struct {
+	wg             *WireguardOverlay
+	remotePeer     *mesh.Peer
+	remoteIP       net.IP
+	tunnelAddr     *net.UDPAddr
+	sendControlMsg func(byte, []byte) error
+	connUID        uint64
+	presharedKey   wireguard.Key
+
+	lock              sync.RWMutex
+	confirmed         bool
+	publicKey         *wireguard.Key // of the remote peer, once known
+	heartbeatInterval time.Duration
+	heartbeatTimer    *time.Timer // for sending
+	heartbeatTimeout  *time.Timer // for receiving
+	ackedHeartbeat    bool
+	stopChan          chan struct{}
+	stopped           bool
+	healthy           bool
+	established       bool
+	establishedChan   chan struct{}
+	errorChan         chan error
+	healthChan        chan bool
+}
+
+func (wg *WireguardOverlay) PrepareConnection(params mesh.OverlayConnectionParams) (mesh.OverlayConnection, error) {
+	// The preshared key comes from the session key, and the
+	// public keys are exchanged over the connection, so it had
+	// better be encrypted
+	if params.SessionKey == nil {
+		return nil, fmt.Errorf("wireguard requires an encrypted connection")
+	}
+	presharedKey, err := wireguard.DeriveKey(params.SessionKey, params.ConnUID, wg.localPeer.Name, params.RemotePeer.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	var remoteIP net.IP
+	if params.RemoteAddr != nil {
+		remoteIP = params.RemoteAddr.IP
+	}
+
+	fwd := &wireguardForwarder{
+		wg:             wg,
+		remotePeer:     params.RemotePeer,
+		remoteIP:       remoteIP,
+		tunnelAddr:     &net.UDPAddr{IP: wireguardTunnelIP(params.RemotePeer.Name), Port: wg.port},
+		sendControlMsg: params.SendControlMessage,
+		connUID:        params.ConnUID,
+		presharedKey:   presharedKey,
+		healthy:        true,
+
+		heartbeatInterval: FastHeartbeat,
+		stopChan:          make(chan struct{}),
+
+		establishedChan: make(chan struct{}),
+		errorChan:       make(chan error, 1),
+		healthChan:      make(chan bool),
+	}
+
+	return fwd, nil
+}
+
+func (fwd *wireguardForwarder) logPrefix() string {
+	return fmt.Sprintf("wireguard ->[%s|%s]: ", fwd.remoteIP, fwd.remotePeer)
+}
+
+func (fwd *wireguardForwarder) Confirm() {
+	fwd.lock.Lock()
+
+	if fwd.confirmed {
+		log.Fatal(fwd.logPrefix(), "already confirmed")
+	}
+
+	log.Debug(fwd.logPrefix(), "confirmed")
+	fwd.wg.addForwarder(fwd.remotePeer.Name, fwd)
+	fwd.confirmed = true
+
+	if fwd.publicKey != nil {
+		// have the goroutine send a heartbeat straight away
+		fwd.heartbeatTimer = time.NewTimer(0)
+	} else {
+		// we'll reset the timer when we learn the remote key
+		fwd.heartbeatTimer = time.NewTimer(MaxDuration)
+	}
+
+	fwd.heartbeatTimeout = time.NewTimer(HeartbeatTimeout)
+
+	// Stop replaces sendControlMsg under the lock
+	sendControlMsg := fwd.sendControlMsg
+	fwd.lock.Unlock() // unlock before calling send() which may block
+
+	msg := make([]byte, wireguard.KeySize+2)
+	copy(msg, fwd.wg.dev.PublicKey[:])
+	binary.BigEndian.PutUint16(msg[wireguard.KeySize:], uint16(fwd.wg.dev.Port))
+	if err := sendControlMsg(WireguardPublicKey, msg); err != nil {
+		log.Error(fwd.logPrefix(), "wireguard send public key failed: ", err)
+		fwd.lock.Lock()
+		fwd.handleError(err)
+		fwd.lock.Unlock()
+		return
+	}
+
+	go fwd.doHeartbeats()
+}
+
+func (fwd *wireguardForwarder) EstablishedChannel() <-chan struct{} {
+	return fwd.establishedChan
+}
+
+func (fwd *wireguardForwarder) ErrorChannel() <-chan error {
+	return fwd.errorChan
+}
+
+func (fwd *wireguardForwarder) HealthChannel() <-chan bool {
+	return fwd.healthChan
+}
+
+func (fwd *wireguardForwarder) doHeartbeats() {
+	for {
+		select {
+		case <-fwd.heartbeatTimer.C:
+			log.Debug(fwd.logPrefix(), "sending Heartbeat to peer")
+			fwd.sendHeartbeat()
+			fwd.lock.Lock()
+			fwd.heartbeatTimer.Reset(fwd.heartbeatInterval)
+			fwd.lock.Unlock()
+
+		case <-fwd.heartbeatTimeout.C:
+			log.Debug(fwd.logPrefix(), "missed Heartbeat from peer, marking wireguard forwarder as un-healthy")
+
+			fwd.lock.Lock()
+			// switch to slow heartbeats, as with fastdp
+			fwd.heartbeatInterval = SlowHeartbeat
+			fwd.heartbeatTimer.Reset(fwd.heartbeatInterval)
+			wasHealthy := fwd.healthy
+			fwd.healthy = false
+			fwd.lock.Unlock()
+
+			if wasHealthy {
+				fwd.notifyHealth(false)
+			}
+
+		case <-fwd.stopChan:
+			return
+		}
+	}
+}
+
+// Tell the OverlaySwitch whether this forwarder may be used, unless
+// it has stopped listening
+func (fwd *wireguardForwarder) notifyHealth(healthy bool) {
+	select {
+	case fwd.healthChan <- healthy:
+	case <-fwd.stopChan:
+	}
+}
+
+// Handle an error which leads to notifying the listener and
+// termination of the forwarder.  Called with the lock held.
+func (fwd *wireguardForwarder) handleError(err error) {
+	if err == nil {
+		return
+	}
+
+	select {
+	case fwd.errorChan <- err:
+	default:
+	}
+
+	// stop the heartbeat goroutine
+	if !fwd.stopped {
+		fwd.stopped = true
+		close(fwd.stopChan)
+	}
+}
+
+func (fwd *wireguardForwarder) sendHeartbeat() {
+	// the heartbeat payload is the 64-bit connection uid
+	buf := make([]byte, 1+8)
+	buf[0] = wireguardHeartbeat
+	binary.BigEndian.PutUint64(buf[1:], fwd.connUID)
+
+	// Sending fails until WireGuard has a handshake with the peer;
+	// missed heartbeats take care of that.
+	if err := fwd.wg.send(buf, fwd.tunnelAddr); err != nil {
+		log.Debug(fwd.logPrefix(), "sending Heartbeat failed: ", err)
+	}
+}
+
+func (fwd *wireguardForwarder) handleHeartbeat(connUID uint64) {
+	fwd.lock.Lock()
+
+	if connUID != fwd.connUID || fwd.stopped {
+		fwd.lock.Unlock()
+		return
+	}
+
+	if !fwd.ackedHeartbeat {
+		fwd.ackedHeartbeat = true
+		log.Debug(fwd.logPrefix(), "Ack Heartbeat from peer")
+		fwd.handleError(fwd.sendControlMsg(WireguardHeartbeatAck, nil))
+	}
+
+	becameHealthy := false
+	fwd.heartbeatTimeout.Reset(HeartbeatTimeout)
+	if !fwd.healthy {
+		log.Debug(fwd.logPrefix(), "got Heartbeat from peer, marking wireguard forwarder as healthy")
+		fwd.healthy = true
+		becameHealthy = true
+	}
+	fwd.lock.Unlock()
+
+	if becameHealthy {
+		fwd.notifyHealth(true)
+	}
+}
+
+func (fwd *wireguardForwarder) ControlMessage(tag byte, msg []byte) {
+	fwd.lock.Lock()
+	defer fwd.lock.Unlock()
+
+	switch tag {
+	case WireguardHeartbeatAck:
+		fwd.handleHeartbeatAck()
+	case WireguardPublicKey:
+		fwd.handlePublicKey(msg)
+
+	default:
+		log.Info(fwd.logPrefix(), "Ignoring unknown control message: ", tag)
+	}
+}
+
+func (fwd *wireguardForwarder) Attrs() map[string]interface{} {
+	return map[string]interface{}{"name": "wireguard", "mtu": WireguardMTU - WireguardOverhead - EthernetOverhead}
+}
+
+func (fwd *wireguardForwarder) handleHeartbeatAck() {
+	log.Debug(fwd.logPrefix(), "handleHeartbeatAck")
+
+	if !fwd.established {
+		close(fwd.establishedChan)
+		fwd.established = true
+	}
+
+	if fwd.heartbeatInterval != SlowHeartbeat {
+		fwd.heartbeatInterval = SlowHeartbeat
+		if fwd.heartbeatTimer != nil {
+			fwd.heartbeatTimer.Reset(fwd.heartbeatInterval)
+		}
+	}
+}
+
+// handlePublicKey adds the remote peer to the WireGuard interface,
+// with the public key and port it sent us.  It can be received before
+// Confirm'ing the connection.
+func (fwd *wireguardForwarder) handlePublicKey(msg []byte) {
+	if fwd.stopped {
+		log.Info(fwd.logPrefix(), "wireguard add peer failed: forwarder has already been stopped")
+		return
+	}
+	if len(msg) != wireguard.KeySize+2 {
+		log.Warning(fwd.logPrefix(), "wireguard public key message of ", len(msg), " bytes")
+		return
+	}
+
+	var publicKey wireguard.Key
+	copy(publicKey[:], msg)
+	peer := wireguard.Peer{
+		PublicKey:    publicKey,
+		PresharedKey: fwd.presharedKey,
+		AllowedIPs:   []net.IPNet{{IP: fwd.tunnelAddr.IP, Mask: net.CIDRMask(8*net.IPv6len, 8*net.IPv6len)}},
+		Keepalive:    WireguardKeepalive,
+	}
+	// Without an endpoint, WireGuard learns it when the peer
+	// sends to us
+	if fwd.remoteIP != nil {
+		peer.Endpoint = &net.UDPAddr{IP: fwd.remoteIP, Port: int(binary.BigEndian.Uint16(msg[wireguard.KeySize:]))}
+	}
+
+	log.Info(fwd.logPrefix(), "wireguard add peer ", publicKey)
+	if err := fwd.wg.devPeers.SetPeer(peer); err != nil {
+		log.Warning(fwd.logPrefix(), "wireguard add peer failed: ", err)
+		fwd.handleError(err)
+		return
+	}
+	fwd.publicKey = &publicKey
+
+	if fwd.confirmed {
+		fwd.heartbeatTimer.Reset(0)
+	}
+}
+
+type wireguardFlowOp struct {
+	NonDiscardingFlowOp
+	fwd    *wireguardForwarder
+	header []byte
+}
+
+func (fwd *wireguardForwarder) Forward(key ForwardPacketKey) FlowOp {
+	fwd.lock.RLock()
+	defer fwd.lock.RUnlock()
+
+	if fwd.publicKey == nil {
+		// The peer is not on the interface yet, so leave it
+		// to another overlay
+		return nil
+	}
+
+	header := make([]byte, 1+NameSize+NameSize)
+	header[0] = wireguardFrame
+	copy(header[1:], key.SrcPeer.NameByte)
+	copy(header[1+NameSize:], key.DstPeer.NameByte)
+	return wireguardFlowOp{fwd: fwd, header: header}
+}
+
+func (op wireguardFlowOp) Process(frame []byte, dec *EthernetDecoder, broadcast bool) {
+	msg := make([]byte, len(op.header)+len(frame))
+	copy(msg, op.header)
+	copy(msg[len(op.header):], frame)
+	if err := op.fwd.wg.send(msg, op.fwd.tunnelAddr); err != nil {
+		log.Debug(op.fwd.logPrefix(), err)
+	}
+}
+
+func (fwd *wireguardForwarder) Stop() {
+	active := fwd.wg.removeForwarder(fwd.remotePeer.Name, fwd)
+
+	fwd.lock.Lock()
+	defer fwd.lock.Unlock()
+	fwd.sendControlMsg = func(byte, []byte) error { return nil }
+
+	// Another connection to the same peer may have replaced this
+	// one, using the same WireGuard peer
+	if active && fwd.publicKey != nil {
+		log.Info(fwd.logPrefix(), "wireguard remove peer ", *fwd.publicKey)
+		if err := fwd.wg.devPeers.RemovePeer(*fwd.publicKey); err != nil {
+			log.Errorf("wireguard remove peer failed: %s", err)
+		}
+	}
+
+	// stop the heartbeat goroutine
+	if !fwd.stopped {
+		fwd.stopped = true
+		close(fwd.stopChan)
+	}
+}
@@ -0,0 +1,244 @@
+package router
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+
+	"github.com/weaveworks/weave/net/wireguard"
+)
+
+// Stands in for the peers of the kernel WireGuard interface
+type fakeWireguardPeers struct {
+	sync.Mutex
+	peers map[wireguard.Key]wireguard.Peer
+}
+
+func (f *fakeWireguardPeers) SetPeer(peer wireguard.Peer) error {
+	f.Lock()
+	defer f.Unlock()
+	f.peers[peer.PublicKey] = peer
+	return nil
+}
+
+func (f *fakeWireguardPeers) RemovePeer(publicKey wireguard.Key) error {
+	f.Lock()
+	defer f.Unlock()
+	delete(f.peers, publicKey)
+	return nil
+}
+
+func (f *fakeWireguardPeers) get(publicKey wireguard.Key) (wireguard.Peer, bool) {
+	f.Lock()
+	defer f.Unlock()
+	peer, found := f.peers[publicKey]
+	return peer, found
+}
+
+// An overlay with its socket on the IPv6 loopback address, taking
+// the interface at devIndex for the WireGuard one
+func newTestWireguardOverlay(t *testing.T, local mesh.PeerName, devIndex int) (*WireguardOverlay, *fakeWireguardPeers) {
+	privateKey, err := wireguard.GenerateKey()
+	require.NoError(t, err)
+	conn, err := listenWireguardUDP(&net.UDPAddr{IP: net.IPv6loopback})
+	require.NoError(t, err)
+	devPeers := &fakeWireguardPeers{peers: make(map[wireguard.Key]wireguard.Peer)}
+	wg := &WireguardOverlay{
+		dev:      &wireguard.Device{Name: WireguardIfName, Index: devIndex, Port: 6786, PublicKey: privateKey.PublicKey()},
+		devPeers: devPeers,
+		port:     6783,
+		conn:     conn,
+	}
+	require.NoError(t, wg.StartConsumingPackets(&mesh.Peer{Name: local}, nil, func(ForwardPacketKey) FlowOp { return nil }))
+	return wg, devPeers
+}
+
+type controlMsg struct {
+	tag byte
+	msg []byte
+}
+
+func prepareWireguardConnection(t *testing.T, wg *WireguardOverlay, remote mesh.PeerName, sessionKey *[32]byte) (*wireguardForwarder, chan controlMsg) {
+	sent := make(chan controlMsg, 10)
+	conn, err := wg.PrepareConnection(mesh.OverlayConnectionParams{
+		RemotePeer: &mesh.Peer{Name: remote},
+		RemoteAddr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 6783},
+		ConnUID:    42,
+		SessionKey: sessionKey,
+		SendControlMessage: func(tag byte, msg []byte) error {
+			sent <- controlMsg{tag, msg}
+			return nil
+		},
+	})
+	require.NoError(t, err)
+	return conn.(*wireguardForwarder), sent
+}
+
+func publicKeyMsg(key wireguard.Key, port int) []byte {
+	msg := make([]byte, wireguard.KeySize+2)
+	copy(msg, key[:])
+	binary.BigEndian.PutUint16(msg[wireguard.KeySize:], uint16(port))
+	return msg
+}
+
+func TestWireguardForwarder(t *testing.T) {
+	local, remote := mesh.PeerName(1), mesh.PeerName(2)
+	wg, devPeers := newTestWireguardOverlay(t, local, 0)
+	defer wg.Stop()
+
+	_, err := wg.PrepareConnection(mesh.OverlayConnectionParams{RemotePeer: &mesh.Peer{Name: remote}})
+	require.Error(t, err, "needs an encrypted connection")
+
+	sessionKey := &[32]byte{1, 2, 3}
+	fwd, sent := prepareWireguardConnection(t, wg, remote, sessionKey)
+	key := ForwardPacketKey{SrcPeer: &mesh.Peer{Name: local}, DstPeer: &mesh.Peer{Name: remote}}
+	require.Nil(t, fwd.Forward(key), "no peer on the interface yet")
+
+	// The remote public key puts the peer on the interface, before
+	// the connection is confirmed
+	remotePrivateKey, err := wireguard.GenerateKey()
+	require.NoError(t, err)
+	remoteKey := remotePrivateKey.PublicKey()
+	fwd.ControlMessage(WireguardPublicKey, []byte{1, 2, 3})
+	fwd.ControlMessage(255, nil)
+	_, found := devPeers.get(remoteKey)
+	require.False(t, found, "malformed and unknown messages are ignored")
+
+	fwd.ControlMessage(WireguardPublicKey, publicKeyMsg(remoteKey, 7000))
+	peer, found := devPeers.get(remoteKey)
+	require.True(t, found)
+	require.Equal(t, &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 7000}, peer.Endpoint)
+	presharedKey, err := wireguard.DeriveKey(sessionKey, 42, local, remote)
+	require.NoError(t, err)
+	require.Equal(t, presharedKey, peer.PresharedKey)
+	require.Equal(t, []net.IPNet{{IP: wireguardTunnelIP(remote), Mask: net.CIDRMask(128, 128)}}, peer.AllowedIPs)
+	require.NotNil(t, fwd.Forward(key))
+
+	// Confirming sends our own public key and port
+	fwd.Confirm()
+	select {
+	case msg := <-sent:
+		require.Equal(t, byte(WireguardPublicKey), msg.tag)
+		require.Equal(t, publicKeyMsg(wg.dev.PublicKey, wg.dev.Port), msg.msg)
+	case <-time.After(time.Second):
+		require.FailNow(t, "public key not sent")
+	}
+	require.Equal(t, fwd, wg.lookupForwarder(remote))
+
+	fwd.ControlMessage(WireguardHeartbeatAck, nil)
+	select {
+	case <-fwd.EstablishedChannel():
+	case <-time.After(time.Second):
+		require.FailNow(t, "not established by the heartbeat ack")
+	}
+
+	fwd.Stop()
+	_, found = devPeers.get(remoteKey)
+	require.False(t, found, "peer removed from the interface")
+	require.Nil(t, wg.lookupForwarder(remote))
+	require.NoError(t, fwd.sendControlMsg(WireguardHeartbeatAck, nil))
+	require.Len(t, sent, 0, "nothing sent once stopped")
+
+	// A public key arriving after Stop is ignored
+	fwd.ControlMessage(WireguardPublicKey, publicKeyMsg(remoteKey, 7000))
+	_, found = devPeers.get(remoteKey)
+	require.False(t, found)
+}
+
+func TestWireguardForwarderReplaced(t *testing.T) {
+	local, remote := mesh.PeerName(1), mesh.PeerName(2)
+	wg, devPeers := newTestWireguardOverlay(t, local, 0)
+	defer wg.Stop()
+
+	remotePrivateKey, err := wireguard.GenerateKey()
+	require.NoError(t, err)
+	remoteKey := remotePrivateKey.PublicKey()
+
+	// A second connection to the same peer uses the same WireGuard
+	// peer, which stopping the first must leave alone
+	var fwds []*wireguardForwarder
+	for i := 0; i < 2; i++ {
+		fwd, _ := prepareWireguardConnection(t, wg, remote, &[32]byte{byte(i)})
+		fwd.ControlMessage(WireguardPublicKey, publicKeyMsg(remoteKey, 7000))
+		fwd.Confirm()
+		fwds = append(fwds, fwd)
+	}
+	require.Equal(t, fwds[1], wg.lookupForwarder(remote))
+
+	fwds[0].Stop()
+	_, found := devPeers.get(remoteKey)
+	require.True(t, found)
+	require.Equal(t, fwds[1], wg.lookupForwarder(remote))
+
+	fwds[1].Stop()
+	_, found = devPeers.get(remoteKey)
+	require.False(t, found)
+}
+
+func TestWireguardForwarderStopDuringConfirm(t *testing.T) {
+	wg, _ := newTestWireguardOverlay(t, mesh.PeerName(1), 0)
+	defer wg.Stop()
+
+	// Stop may come while Confirm is sending our public key; best
+	// run with -race
+	for i := 0; i < 100; i++ {
+		fwd, _ := prepareWireguardConnection(t, wg, mesh.PeerName(2), &[32]byte{})
+		done := make(chan struct{})
+		go func() {
+			fwd.Confirm()
+			close(done)
+		}()
+		fwd.Stop()
+		<-done
+	}
+}
+
+func TestWireguardDropsPacketsFromOutsideDevice(t *testing.T) {
+	lo, err := net.InterfaceByName("lo")
+	require.NoError(t, err)
+
+	// Heartbeats come from ::1, the tunnel address of peer 1, and are
+	// acked only if they arrive through the WireGuard interface,
+	// played here by loopback
+	for _, test := range []struct {
+		devIndex int
+		accepted bool
+	}{
+		{lo.Index + 1000, false},
+		{lo.Index, true},
+	} {
+		wg, _ := newTestWireguardOverlay(t, mesh.PeerName(2), test.devIndex)
+		fwd, sent := prepareWireguardConnection(t, wg, mesh.PeerName(1), &[32]byte{})
+		fwd.Confirm()
+		require.Equal(t, byte(WireguardPublicKey), (<-sent).tag)
+
+		sender, err := net.DialUDP("udp6", nil, wg.conn.LocalAddr().(*net.UDPAddr))
+		require.NoError(t, err)
+		heartbeat := make([]byte, 1+8)
+		heartbeat[0] = wireguardHeartbeat
+		binary.BigEndian.PutUint64(heartbeat[1:], 42)
+		_, err = sender.Write(heartbeat)
+		require.NoError(t, err)
+
+		select {
+		case msg := <-sent:
+			require.True(t, test.accepted, "heartbeat from outside the device acked")
+			require.Equal(t, byte(WireguardHeartbeatAck), msg.tag)
+		case <-time.After(200 * time.Millisecond):
+			require.False(t, test.accepted, "heartbeat through the device not acked")
+		}
+
+		sender.Close()
+		fwd.Stop()
+		// not wg.Stop, which would destroy the device at devIndex
+		wg.lock.Lock()
+		wg.stopped = true
+		wg.conn.Close()
+		wg.lock.Unlock()
+	}
+}